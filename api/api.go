@@ -4,12 +4,18 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/msawangwan/weather/internal/secret"
 )
 
 type weather struct {
@@ -36,7 +42,8 @@ type clouds struct {
 	All int `json:"all,omitempty"`
 }
 
-type coordinate struct {
+// Coordinate is a point on the globe, in decimal degrees.
+type Coordinate struct {
 	Lon float64 `json:"lon,omitempty"`
 	Lat float64 `json:"lat,omitempty"`
 }
@@ -46,16 +53,16 @@ type Location struct {
 	Name string `json:"name,omitempty"`
 	Base string `json:"base,omitempty"`
 
-	ID         int `json:"id,omitempty"`
-	Visibility int `json:"visibility,omitempty"`
-	Cod        int `json:"cod,omitempty"`
+	ID         int        `json:"id,omitempty"`
+	Visibility int        `json:"visibility,omitempty"`
+	Cod        StatusCode `json:"cod,omitempty"`
 
 	Weather []*weather  `json:"weather,omitempty"`
 	Main    *conditions `json:"main,omitempty"`
 	Wind    *wind       `json:"wind,omitempty"`
 	Clouds  *clouds     `json:"clouds,omitempty"`
 
-	Coord *coordinate `json:"coord,omitempty"`
+	Coord *Coordinate `json:"coord,omitempty"`
 
 	Message *string `json:"message,omitempty"`
 }
@@ -70,44 +77,287 @@ func (l *Location) WeatherLabels() []string {
 	return labels
 }
 
+// WeatherLabels is every weather condition group the openweather api reports, in the order
+// of its condition codes. Each reading is labelled with one or more of them.
+var WeatherLabels = []string{
+	"Thunderstorm",
+	"Drizzle",
+	"Rain",
+	"Snow",
+	"Mist",
+	"Smoke",
+	"Haze",
+	"Dust",
+	"Fog",
+	"Sand",
+	"Ash",
+	"Squall",
+	"Tornado",
+	"Clear",
+	"Clouds",
+}
+
+// Exported provider names. The provider is recorded against cached weather data. A stub
+// provider serves openweather-shaped responses locally and does not need an api key.
+const (
+	ProviderOpenWeather = "openweather"
+	ProviderStub        = "stub"
+)
+
+// StatusCode is the 'cod' field of an openweather api response. Depending on the endpoint it
+// is sent as either a number or a string, so it accepts both.
+type StatusCode int
+
+// UnmarshalJSON reads a status code sent as either a number or a string.
+func (c *StatusCode) UnmarshalJSON(b []byte) error {
+	n, err := strconv.Atoi(strings.Trim(string(b), `"`))
+	if err != nil {
+		return fmt.Errorf("invalid status code: %s", b)
+	}
+
+	*c = StatusCode(n)
+
+	return nil
+}
+
+// ForecastEntry is a single 3 hourly step in a Forecast.
+type ForecastEntry struct {
+	Dt      int64       `json:"dt,omitempty"`
+	DtTxt   string      `json:"dt_txt,omitempty"`
+	Weather []*weather  `json:"weather,omitempty"`
+	Main    *conditions `json:"main,omitempty"`
+	Wind    *wind       `json:"wind,omitempty"`
+	Clouds  *clouds     `json:"clouds,omitempty"`
+}
+
+// WeatherLabels returns all the different weather types forecast for the entry.
+func (e *ForecastEntry) WeatherLabels() []string {
+	labels := []string{}
+	for _, w := range e.Weather {
+		labels = append(labels, w.Label)
+	}
+
+	return labels
+}
+
+// Forecast represents a JSON payload returned by an openweather api forecast call.
+type Forecast struct {
+	Cod     StatusCode       `json:"cod,omitempty"`
+	Message interface{}      `json:"message,omitempty"` // a number on success, a string on error
+	Cnt     int              `json:"cnt,omitempty"`
+	List    []*ForecastEntry `json:"list,omitempty"`
+}
+
 // OpenWeather is used for making calls to the openweather api. Configuration options
-// are loaded from the JSON file under 'config/api.json'.
+// are loaded from the environment, see 'config/api.env'.
 type OpenWeather struct {
+	Provider    string `json:"provider,omitempty"`
 	APIKey      string `json:"api_key,omitempty"`
 	APIEndpoint string `json:"api_endpoint,omitempty"`
+
+	// UserAgent identifies this service to the api, DefaultUserAgent is sent when empty.
+	UserAgent string `json:"user_agent,omitempty"`
+	// Headers are sent with every request, e.g. for providers behind an api gateway.
+	Headers http.Header `json:"headers,omitempty"`
 }
 
-// FetchCurrentWeatherByLocationName returns an initialised Location struct, populated
-// from the results of querying the openweather api.
-func (o *OpenWeather) FetchCurrentWeatherByLocationName(name string) (*Location, error) {
+// Version is the version of this service, reported to the api in the default user agent.
+const Version = "1.0.0"
+
+// DefaultUserAgent is sent to the api unless a client is configured with its own, as some
+// providers rate limit or block generic user agents.
+const DefaultUserAgent = "msawangwan-weather/" + Version
+
+// Validate checks that the client is configured well enough to make requests, so that
+// misconfiguration can be caught on startup rather than on every request.
+func (o *OpenWeather) Validate() error {
+	switch o.Provider {
+	case ProviderOpenWeather, ProviderStub:
+		break
+	default:
+		return fmt.Errorf("unknown provider: %q", o.Provider)
+	}
+
+	if o.APIEndpoint == "" {
+		return fmt.Errorf("no api endpoint configured for provider %s, set %s", o.Provider, envVarAPIEndpoint)
+	}
+
 	resource, err := url.Parse(fmt.Sprintf("http://%s/weather", o.APIEndpoint))
-	if err != nil {
+	if err != nil || resource.Host == "" {
+		return fmt.Errorf("malformed api endpoint for provider %s: %q", o.Provider, o.APIEndpoint)
+	}
+
+	if strings.Contains(o.APIEndpoint, "?") {
+		return fmt.Errorf("api endpoint for provider %s must not include query parameters: %q", o.Provider, o.APIEndpoint)
+	}
+
+	if o.APIKey == "" && o.Provider != ProviderStub {
+		return fmt.Errorf("no api key configured for provider %s, set %s", o.Provider, envVarAPIKey)
+	}
+
+	return nil
+}
+
+// FetchCurrentWeatherByLocationName returns an initialised Location struct, populated
+// from the results of querying the openweather api. Responses are always requested as JSON,
+// and a response in any other format is reported as an error. The request is abandoned if
+// 'ctx' is done before it completes.
+func (o *OpenWeather) FetchCurrentWeatherByLocationName(ctx context.Context, name string) (*Location, error) {
+	query := url.Values{}
+
+	query.Set("q", name)
+
+	var loc *Location
+
+	if err := o.get(ctx, "weather", query, &loc); err != nil {
 		return nil, err
 	}
 
-	query := resource.Query()
+	return loc, nil
+}
+
+// FetchCurrentWeatherByCoordinate is as FetchCurrentWeatherByLocationName, but for the
+// location at 'lat', 'lon'. The openweather api names the location after the nearest place
+// it knows, so the Location's Name can be used as for a location fetched by name.
+func (o *OpenWeather) FetchCurrentWeatherByCoordinate(ctx context.Context, lat, lon float64) (*Location, error) {
+	query := url.Values{}
+
+	query.Set("lat", strconv.FormatFloat(lat, 'f', -1, 64))
+	query.Set("lon", strconv.FormatFloat(lon, 'f', -1, 64))
+
+	var loc *Location
+
+	if err := o.get(ctx, "weather", query, &loc); err != nil {
+		return nil, err
+	}
+
+	return loc, nil
+}
+
+// MaxConcurrentFetches is the most calls made to the openweather api at once when fetching the
+// weather at several coordinates.
+const MaxConcurrentFetches = 4
+
+// FetchCurrentWeatherByCoordinates fetches the weather at each coordinate, a few at a time.
+// The results are in the same order as 'coords', and a coordinate that fails has a nil
+// Location and its error at the same index, without failing the others. Each location is
+// named as by FetchCurrentWeatherByCoordinate. If 'reserve' isn't nil it's called before each
+// call to the api, for example to count the call against a quota, and a coordinate it returns
+// an error for isn't fetched but fails with that error.
+func (o *OpenWeather) FetchCurrentWeatherByCoordinates(ctx context.Context, coords []Coordinate, reserve func(context.Context) error) ([]*Location, []error) {
+	var (
+		locations = make([]*Location, len(coords))
+		errs      = make([]error, len(coords))
+		wg        sync.WaitGroup
+		sem       = make(chan struct{}, MaxConcurrentFetches)
+	)
+
+	for i, coord := range coords {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(i int, coord Coordinate) {
+			defer func() { <-sem; wg.Done() }()
+
+			if reserve != nil {
+				if errs[i] = reserve(ctx); errs[i] != nil {
+					return
+				}
+			}
+
+			locations[i], errs[i] = o.FetchCurrentWeatherByCoordinate(ctx, coord.Lat, coord.Lon)
+		}(i, coord)
+	}
+
+	wg.Wait()
+
+	return locations, errs
+}
+
+// Bounds of the openweather api 'cnt' parameter for forecasts, which are given in 3 hour steps
+// over 5 days.
+const (
+	MinForecastCount = 1
+	MaxForecastCount = 40
+)
+
+// FetchForecastByLocationName returns the next 'count' 3 hourly forecast entries for a location
+// from the openweather api. 'count' must be between MinForecastCount and MaxForecastCount.
+func (o *OpenWeather) FetchForecastByLocationName(ctx context.Context, name string, count int) (*Forecast, error) {
+	if count < MinForecastCount || count > MaxForecastCount {
+		return nil, fmt.Errorf("forecast count must be between %d and %d: %d", MinForecastCount, MaxForecastCount, count)
+	}
+
+	query := url.Values{}
 
 	query.Set("q", name)
+	query.Set("cnt", strconv.Itoa(count))
+
+	var f *Forecast
+
+	if err := o.get(ctx, "forecast", query, &f); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// get requests 'resource' from the api and decodes the JSON response into 'v'. The outcome
+// is recorded in the recent call stats, unless the caller gave up on the call.
+func (o *OpenWeather) get(ctx context.Context, resource string, query url.Values, v interface{}) (err error) {
+	defer func() {
+		if ctx.Err() != context.Canceled {
+			calls.record(err)
+		}
+	}()
+
+	if err = injectedFailure(); err != nil {
+		return err
+	}
+
+	u, err := url.Parse(fmt.Sprintf("http://%s/%s", o.APIEndpoint, resource))
+	if err != nil {
+		return err
+	}
+
 	query.Set("appid", o.APIKey)
+	query.Set("mode", "json") // the default, but set explicitly since xml and html are also supported
 
-	resource.RawQuery = query.Encode()
+	u.RawQuery = query.Encode()
 
-	res, err := http.Get(resource.String())
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	for k, vs := range o.Headers {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+
+	req.Header.Set("User-Agent", DefaultUserAgent)
+	if o.UserAgent != "" {
+		req.Header.Set("User-Agent", o.UserAgent)
+	}
+
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
 	}
 
 	b := &bytes.Buffer{}
 	b.ReadFrom(res.Body)
 	res.Body.Close()
 
-	var loc *Location
-
-	if err := json.Unmarshal(b.Bytes(), &loc); err != nil {
-		return nil, err
+	if body := bytes.TrimSpace(b.Bytes()); len(body) == 0 || body[0] != '{' {
+		return fmt.Errorf(
+			"expected a JSON response from the %s api but got content-type: %q",
+			o.Provider,
+			res.Header.Get("content-type"))
 	}
 
-	return loc, nil
+	return json.Unmarshal(b.Bytes(), v)
 }
 
 // Exported environment variable keys that are expected to exists in the current
@@ -115,6 +365,9 @@ func (o *OpenWeather) FetchCurrentWeatherByLocationName(name string) (*Location,
 const (
 	envVarAPIKey      = "API_KEY"
 	envVarAPIEndpoint = "API_ENDPOINT"
+	envVarAPIProvider = "API_PROVIDER"
+	envVarUserAgent   = "API_USER_AGENT"
+	envVarAPIHeaders  = "API_HEADERS"
 )
 
 // SharedClient is a package level global that can be used for calling the
@@ -133,6 +386,49 @@ func init() {
 		return v
 	}
 
-	SharedClient.APIKey = getEnv(envVarAPIKey)
+	SharedClient.APIKey = secret.MustLookup(envVarAPIKey)
 	SharedClient.APIEndpoint = getEnv(envVarAPIEndpoint)
+
+	SharedClient.Provider = ProviderOpenWeather
+	if v, exists := os.LookupEnv(envVarAPIProvider); exists && v != "" {
+		SharedClient.Provider = v
+	}
+
+	if v, exists := os.LookupEnv(envVarUserAgent); exists && v != "" {
+		SharedClient.UserAgent = v
+	}
+
+	if v, exists := os.LookupEnv(envVarAPIHeaders); exists && v != "" {
+		headers, err := ParseHeaders(v)
+		if err != nil {
+			log.Fatalf("invalid %s: %s", envVarAPIHeaders, err)
+		}
+		SharedClient.Headers = headers
+	}
+}
+
+// ParseHeaders reads a list of headers separated by semicolons, each in the form
+// 'Name: value', e.g. "X-Gateway-Key: abc; X-Tenant: weather".
+func ParseHeaders(s string) (http.Header, error) {
+	headers := http.Header{}
+
+	for _, field := range strings.Split(s, ";") {
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
+
+		kv := strings.SplitN(field, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("malformed header, expected 'Name: value': %q", strings.TrimSpace(field))
+		}
+
+		name := strings.TrimSpace(kv[0])
+		if name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("malformed header name: %q", name)
+		}
+
+		headers.Add(name, strings.TrimSpace(kv[1]))
+	}
+
+	return headers, nil
 }
@@ -1,7 +1,305 @@
 package api
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
 
 func TestOpenweatherAPICall(t *testing.T) {
 	t.Skip("not implemented")
 }
+
+func TestValidateConfiguration(t *testing.T) {
+	var validateTestCases = []struct {
+		label   string
+		client  OpenWeather
+		wantErr bool
+	}{
+		{"valid configuration", OpenWeather{Provider: ProviderOpenWeather, APIKey: "key", APIEndpoint: "api.openweathermap.org/data/2.5"}, false},
+		{"empty endpoint", OpenWeather{Provider: ProviderOpenWeather, APIKey: "key", APIEndpoint: ""}, true},
+		{"malformed endpoint", OpenWeather{Provider: ProviderOpenWeather, APIKey: "key", APIEndpoint: "%zz"}, true},
+		{"missing api key", OpenWeather{Provider: ProviderOpenWeather, APIKey: "", APIEndpoint: "api.openweathermap.org/data/2.5"}, true},
+		{"stub provider without api key", OpenWeather{Provider: ProviderStub, APIKey: "", APIEndpoint: "localhost:8080"}, false},
+		{"stub provider with empty endpoint", OpenWeather{Provider: ProviderStub, APIKey: "", APIEndpoint: ""}, true},
+		{"unknown provider", OpenWeather{Provider: "unknown", APIKey: "key", APIEndpoint: "api.openweathermap.org/data/2.5"}, true},
+		{"endpoint overriding mode", OpenWeather{Provider: ProviderOpenWeather, APIKey: "key", APIEndpoint: "api.openweathermap.org/data/2.5?mode=xml"}, true},
+	}
+
+	for _, tc := range validateTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			err := tc.client.Validate()
+			if (err != nil) != tc.wantErr {
+				t.Errorf("have: %v want error: %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestResponsesAreAlwaysJSON(t *testing.T) {
+	var modeTestCases = []struct {
+		label       string
+		contentType string
+		body        string
+		wantErr     bool
+	}{
+		{"json response", "application/json", `{"cod": 200, "name": "London"}`, false},
+		{"xml response", "application/xml", `<current><city name="London"/></current>`, true},
+		{"html response", "text/html", `<html><body>London</body></html>`, true},
+		{"empty response", "application/json", ``, true},
+	}
+
+	for _, tc := range modeTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if mode := r.URL.Query().Get("mode"); mode != "json" {
+					t.Errorf("have mode: %q want mode: %q", mode, "json")
+				}
+				w.Header().Set("content-type", tc.contentType)
+				fmt.Fprint(w, tc.body)
+			}))
+			defer server.Close()
+
+			client := &OpenWeather{Provider: ProviderOpenWeather, APIKey: "key", APIEndpoint: strings.TrimPrefix(server.URL, "http://")}
+
+			_, err := client.FetchCurrentWeatherByLocationName(context.Background(), "London")
+			if (err != nil) != tc.wantErr {
+				t.Errorf("have: %v want error: %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestForecastCountIsPassedThrough(t *testing.T) {
+	var countTestCases = []struct {
+		label   string
+		count   int
+		wantErr bool
+	}{
+		{"minimum count", MinForecastCount, false},
+		{"maximum count", MaxForecastCount, false},
+		{"zero count", 0, true},
+		{"count above range", MaxForecastCount + 1, true},
+	}
+
+	for _, tc := range countTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if cnt := r.URL.Query().Get("cnt"); cnt != fmt.Sprint(tc.count) {
+					t.Errorf("have cnt: %q want cnt: %d", cnt, tc.count)
+				}
+				fmt.Fprintf(w, `{"cod": "200", "cnt": %d}`, tc.count)
+			}))
+			defer server.Close()
+
+			client := &OpenWeather{Provider: ProviderOpenWeather, APIKey: "key", APIEndpoint: strings.TrimPrefix(server.URL, "http://")}
+
+			f, err := client.FetchForecastByLocationName(context.Background(), "London", tc.count)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("have: %v want error: %v", err, tc.wantErr)
+			}
+
+			if err == nil && (f.Cod != 200 || f.Cnt != tc.count) {
+				t.Errorf("have: %+v want cod: 200 cnt: %d", f, tc.count)
+			}
+		})
+	}
+}
+
+func TestFetchCurrentWeatherByCoordinates(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("lat") + "," + r.URL.Query().Get("lon") {
+		case "51.51,-0.13":
+			fmt.Fprint(w, `{"cod": 200, "name": "London", "coord": {"lat": 51.51, "lon": -0.13}, "main": {"temp": 280}}`)
+		case "39.53,-119.81":
+			fmt.Fprint(w, `{"cod": 200, "name": "Reno", "coord": {"lat": 39.53, "lon": -119.81}, "main": {"temp": 290}}`)
+		case "0,0":
+			fmt.Fprint(w, `{"cod": "404", "message": "city not found"}`)
+		default:
+			fmt.Fprint(w, `<html>bad gateway</html>`)
+		}
+	}))
+	defer server.Close()
+
+	client := &OpenWeather{Provider: ProviderOpenWeather, APIKey: "key", APIEndpoint: strings.TrimPrefix(server.URL, "http://")}
+
+	coords := []Coordinate{
+		{Lat: 51.51, Lon: -0.13},
+		{Lat: 1, Lon: 1},
+		{Lat: 39.53, Lon: -119.81},
+		{Lat: 0, Lon: 0},
+	}
+
+	var coordTestCases = []struct {
+		label    string
+		wantName string
+		wantCod  StatusCode
+		wantErr  bool
+	}{
+		{"london", "London", 200, false},
+		{"non-JSON response", "", 0, true},
+		{"reno", "Reno", 200, false},
+		{"unknown location", "", 404, false},
+	}
+
+	var reserved int64
+
+	reserve := func(ctx context.Context) error {
+		atomic.AddInt64(&reserved, 1)
+		return nil
+	}
+
+	locations, errs := client.FetchCurrentWeatherByCoordinates(context.Background(), coords, reserve)
+
+	if len(locations) != len(coords) || len(errs) != len(coords) {
+		t.Fatalf("have: %d locations and %d errors want: %d of each", len(locations), len(errs), len(coords))
+	}
+
+	if reserved != int64(len(coords)) {
+		t.Errorf("have: %d reserved calls want: %d", reserved, len(coords))
+	}
+
+	for i, tc := range coordTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			if (errs[i] != nil) != tc.wantErr {
+				t.Fatalf("have: %v want error: %v", errs[i], tc.wantErr)
+			}
+
+			if tc.wantErr {
+				if locations[i] != nil {
+					t.Errorf("have: %+v want: no location", locations[i])
+				}
+				return
+			}
+
+			if locations[i].Name != tc.wantName || locations[i].Cod != tc.wantCod {
+				t.Errorf("have: %q cod %d want: %q cod %d", locations[i].Name, locations[i].Cod, tc.wantName, tc.wantCod)
+			}
+		})
+	}
+}
+
+func TestUnreservedCoordinatesAreNotFetched(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("have: a call for %s want: no calls", r.URL.RawQuery)
+	}))
+	defer server.Close()
+
+	client := &OpenWeather{Provider: ProviderOpenWeather, APIKey: "key", APIEndpoint: strings.TrimPrefix(server.URL, "http://")}
+
+	errSpent := errors.New("quota spent")
+
+	locations, errs := client.FetchCurrentWeatherByCoordinates(
+		context.Background(),
+		[]Coordinate{{Lat: 51.51, Lon: -0.13}, {Lat: 39.53, Lon: -119.81}},
+		func(ctx context.Context) error { return errSpent })
+
+	for i := range errs {
+		if locations[i] != nil || errs[i] != errSpent {
+			t.Errorf("have: %v, %v want: no location, %v", locations[i], errs[i], errSpent)
+		}
+	}
+}
+
+func TestRecentCallErrorRate(t *testing.T) {
+	r := &callRecorder{}
+
+	for i := 0; i < recentCallWindow; i++ {
+		r.record(fmt.Errorf("failure %d", i))
+	}
+
+	if have := r.snapshot().ErrorRate(); have != 1 {
+		t.Errorf("have: %v want: %v", have, 1)
+	}
+
+	for i := 0; i < recentCallWindow/4; i++ {
+		r.record(nil)
+	}
+
+	stats := r.snapshot()
+
+	if stats.Recent != recentCallWindow || stats.ErrorRate() != 0.75 {
+		t.Errorf("have: %d calls at %v want: %d calls at %v", stats.Recent, stats.ErrorRate(), recentCallWindow, 0.75)
+	}
+
+	if stats.LastSuccess.Before(stats.LastFailure) || stats.LastError != fmt.Sprintf("failure %d", recentCallWindow-1) {
+		t.Errorf("have: %+v want: a success after the last failure", stats)
+	}
+}
+
+func TestUserAgentAndHeadersAreSent(t *testing.T) {
+	headers, err := ParseHeaders("X-Gateway-Key: abc; X-Tenant: weather")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var userAgentTestCases = []struct {
+		label     string
+		userAgent string
+		want      string
+	}{
+		{"default user agent", "", DefaultUserAgent},
+		{"configured user agent", "weather-test/2.0", "weather-test/2.0"},
+	}
+
+	for _, tc := range userAgentTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			var received http.Header
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received = r.Header
+				fmt.Fprint(w, `{"cod": 200, "name": "London"}`)
+			}))
+			defer server.Close()
+
+			client := &OpenWeather{
+				Provider:    ProviderOpenWeather,
+				APIKey:      "key",
+				APIEndpoint: strings.TrimPrefix(server.URL, "http://"),
+				UserAgent:   tc.userAgent,
+				Headers:     headers,
+			}
+
+			if _, err := client.FetchCurrentWeatherByLocationName(context.Background(), "London"); err != nil {
+				t.Fatal(err)
+			}
+
+			if have := received.Get("User-Agent"); have != tc.want {
+				t.Errorf("have: %v want: %v", have, tc.want)
+			}
+
+			if received.Get("X-Gateway-Key") != "abc" || received.Get("X-Tenant") != "weather" {
+				t.Errorf("have: %v want: the configured headers", received)
+			}
+		})
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	var parseTestCases = []struct {
+		label   string
+		in      string
+		wantErr bool
+	}{
+		{"single header", "X-Gateway-Key: abc", false},
+		{"trailing separator", "X-Gateway-Key: abc;", false},
+		{"value with a colon", "X-Origin: http://localhost", false},
+		{"missing colon", "X-Gateway-Key abc", true},
+		{"empty name", ": abc", true},
+		{"name with a space", "X Gateway: abc", true},
+	}
+
+	for _, tc := range parseTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			_, err := ParseHeaders(tc.in)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("have: %v want error: %v", err, tc.wantErr)
+			}
+		})
+	}
+}
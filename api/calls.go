@@ -0,0 +1,78 @@
+package api
+
+import (
+	"sync"
+	"time"
+)
+
+// recentCallWindow is the number of most recent api calls the error rate is taken over.
+const recentCallWindow = 100
+
+// CallStats summarises the outcome of recent calls to the api. A call fails if the api can't
+// be reached or doesn't respond with JSON, an error reported by the api in its response, such
+// as an unknown location, still counts as a success.
+type CallStats struct {
+	LastSuccess    time.Time
+	LastFailure    time.Time
+	LastError      string
+	Recent         int
+	RecentFailures int
+}
+
+// ErrorRate is the fraction of recent calls that failed, or zero if there are none.
+func (s CallStats) ErrorRate() float64 {
+	if s.Recent == 0 {
+		return 0
+	}
+
+	return float64(s.RecentFailures) / float64(s.Recent)
+}
+
+// callRecorder keeps the outcomes of the last recentCallWindow calls in a ring.
+type callRecorder struct {
+	mu       sync.Mutex
+	stats    CallStats
+	failures [recentCallWindow]bool
+	next     int
+}
+
+func (r *callRecorder) record(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stats.Recent == recentCallWindow && r.failures[r.next] {
+		r.stats.RecentFailures-- // the oldest outcome drops out of the window
+	}
+
+	if r.stats.Recent < recentCallWindow {
+		r.stats.Recent++
+	}
+
+	r.failures[r.next] = err != nil
+	r.next = (r.next + 1) % recentCallWindow
+
+	if err != nil {
+		r.stats.LastFailure = time.Now()
+		r.stats.LastError = err.Error()
+		r.stats.RecentFailures++
+		return
+	}
+
+	r.stats.LastSuccess = time.Now()
+}
+
+func (r *callRecorder) snapshot() CallStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.stats
+}
+
+var (
+	calls = &callRecorder{}
+)
+
+// RecentCalls returns a summary of recent calls to the api, by any client.
+func RecentCalls() CallStats {
+	return calls.snapshot()
+}
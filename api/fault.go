@@ -0,0 +1,28 @@
+//go:build faultinject
+// +build faultinject
+
+package api
+
+import (
+	"github.com/msawangwan/weather/internal/fault"
+)
+
+// failures decides which api call fails, every request to the api counts as a call.
+var failures fault.Injector
+
+// InjectFailure makes the 'n'th api call from now fail with 'err', the next call being the
+// first, so that tests can exercise error paths without a broken upstream. The failed call is
+// recorded in the recent call stats like any other. It is only available in builds with the
+// 'faultinject' tag.
+func InjectFailure(n int, err error) {
+	failures.Set(n, err)
+}
+
+// ResetFailures clears a failure set by InjectFailure that hasn't happened yet.
+func ResetFailures() {
+	failures.Reset()
+}
+
+func injectedFailure() error {
+	return failures.Next()
+}
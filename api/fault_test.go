@@ -0,0 +1,36 @@
+//go:build faultinject
+// +build faultinject
+
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInjectedFailure(t *testing.T) {
+	errInjected := errors.New("injected failure")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"cod": 200, "name": "London"}`)
+	}))
+	defer server.Close()
+
+	client := &OpenWeather{Provider: ProviderOpenWeather, APIKey: "key", APIEndpoint: strings.TrimPrefix(server.URL, "http://")}
+
+	InjectFailure(2, errInjected)
+	defer ResetFailures()
+
+	for call := 1; call <= 3; call++ {
+		_, err := client.FetchCurrentWeatherByLocationName(context.Background(), "London")
+
+		if want := call == 2; (err == errInjected) != want {
+			t.Errorf("have: %v on call %d want failure: %v", err, call, want)
+		}
+	}
+}
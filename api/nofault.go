@@ -0,0 +1,9 @@
+//go:build !faultinject
+// +build !faultinject
+
+package api
+
+// injectedFailure never fails a call outside of builds with the 'faultinject' tag.
+func injectedFailure() error {
+	return nil
+}
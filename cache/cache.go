@@ -0,0 +1,123 @@
+// Package cache defines a key-value cache interface for weather responses, with in-memory
+// and redis backed implementations. A cache sits in front of the database, so that cached
+// weather can be served without a database round trip and shared across instances.
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// Cache stores serialized entries under a key for a limited time.
+type Cache interface {
+	// Get returns the entry stored under 'key', if it exists and has not expired.
+	Get(key string) ([]byte, bool)
+	// Set stores 'entry' under 'key' for 'ttl'.
+	Set(key string, entry []byte, ttl time.Duration)
+	// Delete removes the entry stored under 'key', if any.
+	Delete(key string)
+}
+
+// Exported backend names, used to select a cache implementation from configuration.
+const (
+	BackendNone   = "none"
+	BackendMemory = "memory"
+	BackendRedis  = "redis"
+)
+
+// None is a cache that never stores anything. It is used when caching is disabled so that
+// callers don't need to nil check.
+type None struct{}
+
+// Get always misses.
+func (None) Get(key string) ([]byte, bool) { return nil, false }
+
+// Set does nothing.
+func (None) Set(key string, entry []byte, ttl time.Duration) {}
+
+// Delete does nothing.
+func (None) Delete(key string) {}
+
+type memoryEntry struct {
+	data    []byte
+	expires time.Time
+}
+
+// minSweepLen is the number of entries a Memory cache holds before Set first sweeps it.
+const minSweepLen = 64
+
+// Memory is a cache local to the process. Expired entries are removed when read, and swept
+// by Set each time the number of entries doubles, so that keys never read again don't pile up.
+type Memory struct {
+	mu       sync.Mutex
+	entries  map[string]memoryEntry
+	sweepLen int
+}
+
+// NewMemory returns an empty in-memory cache.
+func NewMemory() *Memory {
+	return &Memory{entries: map[string]memoryEntry{}, sweepLen: minSweepLen}
+}
+
+// Get returns the entry stored under 'key', if it exists and has not expired.
+func (m *Memory) Get(key string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, exists := m.entries[key]
+	if !exists {
+		return nil, false
+	}
+
+	if time.Now().After(e.expires) {
+		delete(m.entries, key)
+		return nil, false
+	}
+
+	return e.data, true
+}
+
+// Set stores 'entry' under 'key' for 'ttl'.
+func (m *Memory) Set(key string, entry []byte, ttl time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.entries[key] = memoryEntry{entry, time.Now().Add(ttl)}
+
+	if len(m.entries) >= m.sweepLen {
+		m.sweep()
+	}
+}
+
+// sweep removes the expired entries and sets the size at which the next sweep happens, twice
+// the entries left over. The caller must hold m.mu.
+func (m *Memory) sweep() {
+	now := time.Now()
+
+	for key, e := range m.entries {
+		if now.After(e.expires) {
+			delete(m.entries, key)
+		}
+	}
+
+	m.sweepLen = 2 * len(m.entries)
+	if m.sweepLen < minSweepLen {
+		m.sweepLen = minSweepLen
+	}
+}
+
+// Delete removes the entry stored under 'key', if any.
+func (m *Memory) Delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.entries, key)
+}
+
+// Len returns the number of entries held, including expired entries not yet removed.
+func (m *Memory) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.entries)
+}
@@ -0,0 +1,92 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMemoryCache(t *testing.T) {
+	var memoryTestCases = []struct {
+		label string
+		run   func(c Cache) ([]byte, bool)
+		want  string
+		found bool
+	}{
+		{"get missing key", func(c Cache) ([]byte, bool) {
+			return c.Get("missing")
+		}, "", false},
+		{"get after set", func(c Cache) ([]byte, bool) {
+			c.Set("london", []byte("clear"), time.Minute)
+			return c.Get("london")
+		}, "clear", true},
+		{"set overwrites", func(c Cache) ([]byte, bool) {
+			c.Set("london", []byte("clear"), time.Minute)
+			c.Set("london", []byte("rain"), time.Minute)
+			return c.Get("london")
+		}, "rain", true},
+		{"get after delete", func(c Cache) ([]byte, bool) {
+			c.Set("london", []byte("clear"), time.Minute)
+			c.Delete("london")
+			return c.Get("london")
+		}, "", false},
+		{"get after expiry", func(c Cache) ([]byte, bool) {
+			c.Set("london", []byte("clear"), time.Millisecond)
+			time.Sleep(5 * time.Millisecond)
+			return c.Get("london")
+		}, "", false},
+		{"non-positive ttl", func(c Cache) ([]byte, bool) {
+			c.Set("london", []byte("clear"), -time.Second)
+			return c.Get("london")
+		}, "", false},
+	}
+
+	for _, tc := range memoryTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			have, found := tc.run(NewMemory())
+			if found != tc.found || string(have) != tc.want {
+				t.Errorf("have: %q (found: %v) want: %q (found: %v)", have, found, tc.want, tc.found)
+			}
+		})
+	}
+}
+
+func TestMemoryCacheSweepsUnreadExpiredKeys(t *testing.T) {
+	const rounds, keysPerRound = 10, 1000
+
+	c := NewMemory()
+
+	for round := 0; round < rounds; round++ {
+		for i := 0; i < keysPerRound; i++ {
+			c.Set(fmt.Sprintf("city-%d-%d", round, i), []byte("clear"), time.Millisecond)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if have, max := c.Len(), 3*keysPerRound; have > max {
+		t.Errorf("have: %d entries want: at most %d", have, max)
+	}
+}
+
+func TestNoneCacheNeverStores(t *testing.T) {
+	c := None{}
+	c.Set("london", []byte("clear"), time.Minute)
+
+	if _, found := c.Get("london"); found {
+		t.Error("have: found want: not found")
+	}
+}
+
+func TestCountedCache(t *testing.T) {
+	c := NewCounted(NewMemory())
+
+	c.Set("london", []byte("clear"), time.Minute)
+
+	c.Get("london")
+	c.Get("london")
+	c.Get("reno")
+
+	if hits, misses := c.Stats(); hits != 2 || misses != 1 {
+		t.Errorf("have: %d hits %d misses want: 2 hits 1 miss", hits, misses)
+	}
+}
@@ -0,0 +1,38 @@
+package cache
+
+import (
+	"sync/atomic"
+)
+
+// Counted wraps a cache, counting the hits and misses of Get so that the effectiveness of the
+// cache can be reported.
+type Counted struct {
+	Cache
+
+	hits   int64
+	misses int64
+}
+
+// NewCounted returns 'c' with its hits and misses counted.
+func NewCounted(c Cache) *Counted {
+	return &Counted{Cache: c}
+}
+
+// Get returns the entry stored under 'key', if it exists and has not expired, counting the
+// lookup as a hit or a miss.
+func (c *Counted) Get(key string) ([]byte, bool) {
+	data, found := c.Cache.Get(key)
+
+	if found {
+		atomic.AddInt64(&c.hits, 1)
+	} else {
+		atomic.AddInt64(&c.misses, 1)
+	}
+
+	return data, found
+}
+
+// Stats returns the number of hits and misses so far.
+func (c *Counted) Stats() (hits, misses int64) {
+	return atomic.LoadInt64(&c.hits), atomic.LoadInt64(&c.misses)
+}
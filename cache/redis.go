@@ -0,0 +1,159 @@
+package cache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	redisDialTimeout = 2 * time.Second
+	redisIOTimeout   = 2 * time.Second
+)
+
+// Redis is a cache backed by a redis server, so that it can be shared across instances. It
+// speaks just enough of the redis protocol for GET, SET and DEL over a single connection.
+// Any redis error is logged and treated as a cache miss.
+type Redis struct {
+	Addr string
+
+	mu   sync.Mutex
+	conn net.Conn
+	rw   *bufio.ReadWriter
+}
+
+// NewRedis returns a cache backed by the redis server at 'addr'. The connection is made
+// lazily, on first use.
+func NewRedis(addr string) *Redis {
+	return &Redis{Addr: addr}
+}
+
+// Get returns the entry stored under 'key', if it exists and has not expired.
+func (r *Redis) Get(key string) ([]byte, bool) {
+	reply, err := r.do("GET", key)
+	if err != nil {
+		log.Printf("redis cache get failed: %s", err)
+		return nil, false
+	}
+
+	if data, ok := reply.([]byte); ok {
+		return data, true
+	}
+
+	return nil, false
+}
+
+// Set stores 'entry' under 'key' for 'ttl'.
+func (r *Redis) Set(key string, entry []byte, ttl time.Duration) {
+	if ttl < time.Millisecond { // already expired, and redis rejects a non-positive expiry
+		return
+	}
+
+	ms := strconv.FormatInt(int64(ttl/time.Millisecond), 10)
+
+	if _, err := r.do("SET", key, string(entry), "PX", ms); err != nil {
+		log.Printf("redis cache set failed: %s", err)
+	}
+}
+
+// Delete removes the entry stored under 'key', if any.
+func (r *Redis) Delete(key string) {
+	if _, err := r.do("DEL", key); err != nil {
+		log.Printf("redis cache delete failed: %s", err)
+	}
+}
+
+// Ping checks the redis server can be reached.
+func (r *Redis) Ping() error {
+	_, err := r.do("PING")
+	return err
+}
+
+// do sends a command and reads its reply. On any error the connection is dropped so the
+// next command starts from a clean connection.
+func (r *Redis) do(args ...string) (interface{}, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.conn == nil {
+		conn, err := net.DialTimeout("tcp", r.Addr, redisDialTimeout)
+		if err != nil {
+			return nil, err
+		}
+
+		r.conn = conn
+		r.rw = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	}
+
+	reply, err := r.roundTrip(args...)
+	if err != nil {
+		r.conn.Close()
+		r.conn = nil
+		r.rw = nil
+	}
+
+	return reply, err
+}
+
+func (r *Redis) roundTrip(args ...string) (interface{}, error) {
+	r.conn.SetDeadline(time.Now().Add(redisIOTimeout))
+
+	fmt.Fprintf(r.rw, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(r.rw, "$%d\r\n%s\r\n", len(a), a)
+	}
+
+	if err := r.rw.Flush(); err != nil {
+		return nil, err
+	}
+
+	return readReply(r.rw.Reader)
+}
+
+// readReply reads a single, non-array, redis protocol reply. A nil bulk string is
+// returned as nil.
+func readReply(rd *bufio.Reader) (interface{}, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) < 3 {
+		return nil, fmt.Errorf("malformed redis reply: %q", line)
+	}
+
+	kind, payload := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return payload, nil
+	case '-':
+		return nil, errors.New(payload)
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+
+		if n < 0 {
+			return nil, nil
+		}
+
+		data := make([]byte, n+2) // includes the trailing \r\n
+		if _, err := io.ReadFull(rd, data); err != nil {
+			return nil, err
+		}
+
+		return data[:n], nil
+	default:
+		return nil, fmt.Errorf("unsupported redis reply type: %q", kind)
+	}
+}
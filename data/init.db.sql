@@ -1,3 +1,6 @@
+drop table if exists api_quota cascade;
+drop table if exists location_query_events cascade;
+drop table if exists weather_stats_monthly cascade;
 drop table if exists bookmarks cascade;
 drop table if exists accounts cascade;
 drop table if exists weather cascade;
@@ -7,7 +10,9 @@ create table locations
 (
     id          serial       primary key,
     city_name   varchar(255) not null unique,
-    query_count integer
+    query_count integer,
+    lat         real,
+    lon         real
 );
 
 create table weather
@@ -16,9 +21,28 @@ create table weather
     labels      text[],
     temp_high   real,
     temp_low    real,
+    source      varchar(255),
+    base        varchar(255),
+    wind_speed  real,
+    wind_deg    real,
+    visibility  integer,
+    clouds      integer,
+    humidity    real,
+    pressure    real,
     at_time     timestamp not null
 );
 
+create index weather_location_id_idx on weather (location_id);
+create index weather_at_time_idx on weather (at_time);
+
+create table location_query_events
+(
+    location_id integer not null,
+    at_time     timestamp not null
+);
+
+create index location_query_events_location_id_at_time_idx on location_query_events (location_id, at_time);
+
 create table accounts
 (
     id           serial primary key,
@@ -30,3 +54,21 @@ create table bookmarks
     id           integer primary key,
     location_ids integer[]
 );
+
+create table weather_stats_monthly
+(
+    location_id integer not null,
+    source      varchar(255) not null,
+    month       timestamp not null,
+    temp_avg    real,
+    temp_min    real,
+    temp_max    real,
+    readings    integer not null,
+    primary key (location_id, source, month)
+);
+
+create table api_quota
+(
+    day   date primary key,
+    calls integer not null default 0
+);
@@ -3,13 +3,19 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"strings"
 	"time"
+
+	"github.com/lib/pq"
+	"github.com/msawangwan/weather/internal/secret"
 )
 
 const (
@@ -37,10 +43,11 @@ func init() {
 	GlobalConn.Username = getEnv(envVarDBUser)
 	GlobalConn.DBName = getEnv(envVarDBName)
 	GlobalConn.Hostname = getEnv(envVarDBHostname)
-	GlobalConn.Password = getEnv(envVarDBPassword)
+	GlobalConn.Password = secret.MustLookup(envVarDBPassword)
 }
 
-// Connection wraps an instance of sql.DB and connection parameters.
+// Connection wraps an instance of sql.DB and connection parameters. Queries made through
+// the connection are transparently retried, once, if the database connection has been lost.
 type Connection struct {
 	DBName   string
 	Hostname string
@@ -51,6 +58,10 @@ type Connection struct {
 	*sql.DB
 }
 
+// driverName is the database/sql driver connections are opened with. Builds with the
+// 'faultinject' tag replace it with a driver that can be made to fail, see InjectFailure.
+var driverName = "postgres"
+
 // Establish tries to establish a database connection. It will retry 'retryCount' number of times
 // waiting 'retryCooldownSeconds' between each attempt.
 func (dbc *Connection) Establish(retryCount int, retryCooldownSeconds int) error {
@@ -66,7 +77,7 @@ func (dbc *Connection) Establish(retryCount int, retryCooldownSeconds int) error
 	}
 
 	for {
-		conn, err := sql.Open("postgres", dbc.ConnectString())
+		conn, err := sql.Open(driverName, dbc.ConnectString())
 		if err != nil {
 			if timeout(attempts) {
 				return err
@@ -103,6 +114,118 @@ func (dbc *Connection) Establish(retryCount int, retryCooldownSeconds int) error
 	return nil
 }
 
+// Query wraps sql.DB.Query, retrying once on a connection error.
+func (dbc *Connection) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return dbc.QueryContext(context.Background(), query, args...)
+}
+
+// QueryContext wraps sql.DB.QueryContext, retrying once on a connection error.
+func (dbc *Connection) QueryContext(ctx context.Context, query string, args ...interface{}) (rows *sql.Rows, err error) {
+	dbc.withReconnect(func() error {
+		rows, err = dbc.DB.QueryContext(ctx, query, args...)
+		return err
+	})
+	return rows, err
+}
+
+// QueryRow wraps sql.DB.QueryRow, retrying once on a connection error.
+func (dbc *Connection) QueryRow(query string, args ...interface{}) *sql.Row {
+	return dbc.QueryRowContext(context.Background(), query, args...)
+}
+
+// QueryRowContext wraps sql.DB.QueryRowContext, retrying once on a connection error.
+func (dbc *Connection) QueryRowContext(ctx context.Context, query string, args ...interface{}) (row *sql.Row) {
+	dbc.withReconnect(func() error {
+		row = dbc.DB.QueryRowContext(ctx, query, args...)
+		return row.Err()
+	})
+	return row
+}
+
+// Exec wraps sql.DB.Exec, retrying once on a connection error.
+func (dbc *Connection) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return dbc.ExecContext(context.Background(), query, args...)
+}
+
+// ExecContext wraps sql.DB.ExecContext, retrying once on a connection error.
+func (dbc *Connection) ExecContext(ctx context.Context, query string, args ...interface{}) (res sql.Result, err error) {
+	dbc.withReconnect(func() error {
+		res, err = dbc.DB.ExecContext(ctx, query, args...)
+		return err
+	})
+	return res, err
+}
+
+// Prepare wraps sql.DB.Prepare, retrying once on a connection error.
+func (dbc *Connection) Prepare(query string) (*sql.Stmt, error) {
+	return dbc.PrepareContext(context.Background(), query)
+}
+
+// PrepareContext wraps sql.DB.PrepareContext, retrying once on a connection error.
+func (dbc *Connection) PrepareContext(ctx context.Context, query string) (stmt *sql.Stmt, err error) {
+	dbc.withReconnect(func() error {
+		stmt, err = dbc.DB.PrepareContext(ctx, query)
+		return err
+	})
+	return stmt, err
+}
+
+// Begin wraps sql.DB.Begin, retrying once on a connection error.
+func (dbc *Connection) Begin() (*sql.Tx, error) {
+	return dbc.BeginTx(context.Background(), nil)
+}
+
+// BeginTx wraps sql.DB.BeginTx, retrying once on a connection error.
+func (dbc *Connection) BeginTx(ctx context.Context, opts *sql.TxOptions) (txn *sql.Tx, err error) {
+	dbc.withReconnect(func() error {
+		txn, err = dbc.DB.BeginTx(ctx, opts)
+		return err
+	})
+	return txn, err
+}
+
+// withReconnect calls 'fn' and, if it fails because the connection was lost, calls 'fn' one
+// more time. The sql.DB itself is never replaced: its pool discards a connection that went bad
+// and opens a new one for the retry, so the handle can be shared without a lock. It never
+// retries more than once, so a database that stays down can't cause a reconnect loop.
+func (dbc *Connection) withReconnect(fn func() error) {
+	err := fn()
+	if !isConnectionError(err) {
+		return
+	}
+
+	log.Printf("db connection lost, retrying on a new connection: %s", err)
+
+	fn()
+}
+
+// Postgres error code classes and codes that mean the server dropped the connection.
+const (
+	connectionExceptionClass = "08"
+	adminShutdown            = "57P01"
+	crashShutdown            = "57P02"
+	cannotConnectNow         = "57P03"
+)
+
+func isConnectionError(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) {
+		return true
+	}
+
+	var pqErr *pq.Error
+
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+
+	switch pqErr.Code {
+	case adminShutdown, crashShutdown, cannotConnectNow:
+		return true
+	}
+
+	return pqErr.Code.Class() == connectionExceptionClass
+}
+
 // ExecFrom executes SQL statements in a file where each statement is delimited by a ';'.
 func (dbc *Connection) ExecFrom(filepath string) error {
 	raw, err := ioutil.ReadFile(filepath)
@@ -126,6 +249,29 @@ func (dbc *Connection) ExecFrom(filepath string) error {
 	return nil
 }
 
+// execFrom is the function ExecFromWithRetry uses to execute the file, replaceable in tests.
+var execFrom = (*Connection).ExecFrom
+
+// ExecFromWithRetry is ExecFrom, retried 'retryCount' number of times waiting
+// 'retryCooldownSeconds' between each attempt, so that a momentary failure while loading a
+// schema doesn't stop the caller.
+func (dbc *Connection) ExecFromWithRetry(filepath string, retryCount int, retryCooldownSeconds int) error {
+	for attempts := 1; ; attempts++ {
+		err := execFrom(dbc, filepath)
+		if err == nil {
+			return nil
+		}
+
+		log.Printf("db exec from %s attempt: %d: %s", filepath, attempts, err)
+
+		if attempts > retryCount {
+			return err
+		}
+
+		time.Sleep(time.Duration(retryCooldownSeconds) * time.Second)
+	}
+}
+
 // ConnectString formats connection parameters into a string used to connect to a postgres database.
 func (dbc *Connection) ConnectString() string {
 	return fmt.Sprintf(
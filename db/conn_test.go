@@ -1,7 +1,13 @@
 package db
 
 import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
 	"testing"
+
+	"github.com/lib/pq"
 )
 
 func TestInitialiseDB(t *testing.T) {
@@ -24,3 +30,105 @@ func TestExececuteStatementsFromAFile(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestExecFromRetriesTransientFailures(t *testing.T) {
+	defer func(f func(*Connection, string) error) { execFrom = f }(execFrom)
+
+	var retryTestCases = []struct {
+		label     string
+		failures  int
+		retries   int
+		wantCalls int
+		wantErr   bool
+	}{
+		{"no failures", 0, 2, 1, false},
+		{"transient failure", 2, 2, 3, false},
+		{"persistent failure", 5, 2, 3, true},
+	}
+
+	for _, tc := range retryTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			calls := 0
+
+			execFrom = func(*Connection, string) error {
+				calls++
+				if calls <= tc.failures {
+					return errors.New("transient")
+				}
+				return nil
+			}
+
+			err := (&Connection{}).ExecFromWithRetry("init.db.sql", tc.retries, 0)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("have: %v want error: %v", err, tc.wantErr)
+			}
+
+			if calls != tc.wantCalls {
+				t.Errorf("have calls: %d want calls: %d", calls, tc.wantCalls)
+			}
+		})
+	}
+}
+
+func TestReconnectAfterDroppedConnection(t *testing.T) {
+	const (
+		maxNumRetries    = 3
+		retryIntervalSec = 1
+	)
+
+	if err := GlobalConn.Establish(maxNumRetries, retryIntervalSec); err != nil {
+		t.Fatal(err)
+	}
+
+	var one int
+
+	if err := GlobalConn.QueryRow(`select 1`).Scan(&one); err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate the connection being dropped out from under us by having the server end every
+	// other session, which includes the idle connections in GlobalConn's pool
+	admin, err := sql.Open(driverName, GlobalConn.ConnectString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+
+	if _, err := admin.Exec(`
+		select pg_terminate_backend(pid)
+		from pg_stat_activity
+		where datname = current_database() and pid <> pg_backend_pid()`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := GlobalConn.QueryRow(`select 1`).Scan(&one); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := GlobalConn.Exec(`select 1`); err != nil {
+		t.Fatal(err)
+	}
+
+	GlobalConn.Close()
+}
+
+func TestIsConnectionError(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("boom"), false},
+		{driver.ErrBadConn, true},
+		{fmt.Errorf("query: %w", sql.ErrConnDone), true},
+		{&pq.Error{Code: "57P01"}, true},
+		{&pq.Error{Code: "08006"}, true},
+		{&pq.Error{Code: "23505"}, false},
+	}
+
+	for _, tc := range cases {
+		if have := isConnectionError(tc.err); have != tc.want {
+			t.Errorf("%v: have: %v want: %v", tc.err, have, tc.want)
+		}
+	}
+}
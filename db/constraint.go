@@ -0,0 +1,49 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// Postgres error codes of the constraint violations mapped by constraintError.
+const (
+	uniqueViolation     = "23505"
+	foreignKeyViolation = "23503"
+)
+
+// ErrConflict is returned, wrapped with the detail of the violation, when a write would
+// duplicate a value that must be unique. Check for it with errors.Is.
+var ErrConflict = errors.New("conflicts with an existing row")
+
+// ErrInvalidReference is returned, wrapped with the detail of the violation, when a write
+// refers to a row that doesn't exist. Check for it with errors.Is.
+var ErrInvalidReference = errors.New("refers to a row that doesn't exist")
+
+// constraintError maps a unique violation in 'err' to ErrConflict and a foreign key violation
+// to ErrInvalidReference, so callers needn't know about postgres error codes. Any other error
+// is returned as it is.
+func constraintError(err error) error {
+	var pqErr *pq.Error
+
+	if !errors.As(err, &pqErr) {
+		return err
+	}
+
+	switch pqErr.Code {
+	case uniqueViolation:
+		return fmt.Errorf("%w: %s", ErrConflict, pqErr.Detail)
+	case foreignKeyViolation:
+		return fmt.Errorf("%w: %s", ErrInvalidReference, pqErr.Detail)
+	}
+
+	return err
+}
+
+// isUniqueViolation reports whether err is a postgres unique constraint violation.
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+
+	return errors.As(err, &pqErr) && pqErr.Code == uniqueViolation
+}
@@ -0,0 +1,65 @@
+package db
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestConstraintError(t *testing.T) {
+	setupDB(t)
+
+	if _, err := NewAccount("taken"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a temporary table only lives in its session, so the violations are made in one transaction
+	txn, err := GlobalConn.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer txn.Rollback()
+
+	if _, err := txn.Exec(`create temporary table account_notes (account_id integer references accounts (id))`); err != nil {
+		t.Fatal(err)
+	}
+
+	var constraintTestCases = []struct {
+		label string
+		query string
+		want  error
+	}{
+		{"unique violation", `insert into accounts (user_name) values ('taken')`, ErrConflict},
+		{"foreign key violation", `insert into account_notes (account_id) values (-1)`, ErrInvalidReference},
+	}
+
+	for i, tc := range constraintTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			savepoint := "violation_" + string(rune('a'+i))
+
+			if _, err := txn.Exec("savepoint " + savepoint); err != nil {
+				t.Fatal(err)
+			}
+
+			defer txn.Exec("rollback to savepoint " + savepoint)
+
+			_, err := txn.Exec(tc.query)
+
+			if have := constraintError(err); !errors.Is(have, tc.want) {
+				t.Errorf("have: %v want: %v", have, tc.want)
+			}
+		})
+	}
+
+	t.Run("other errors are unchanged", func(t *testing.T) {
+		other := errors.New("other")
+
+		if have := constraintError(other); have != other {
+			t.Errorf("have: %v want: %v", have, other)
+		}
+
+		if have := constraintError(nil); have != nil {
+			t.Errorf("have: %v want: %v", have, nil)
+		}
+	})
+}
@@ -0,0 +1,108 @@
+//go:build faultinject
+// +build faultinject
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+
+	"github.com/lib/pq"
+	"github.com/msawangwan/weather/internal/fault"
+)
+
+// failures decides which database call fails, every query, exec, prepare and transaction
+// begin through a connection counts as a call.
+var failures fault.Injector
+
+// InjectFailure makes the 'n'th database call from now fail with 'err', the next call being the
+// first, so that tests can exercise error paths without a broken database. It is only
+// available in builds with the 'faultinject' tag.
+func InjectFailure(n int, err error) {
+	failures.Set(n, err)
+}
+
+// ResetFailures clears a failure set by InjectFailure that hasn't happened yet.
+func ResetFailures() {
+	failures.Reset()
+}
+
+func init() {
+	driverName = "postgres+faultinject"
+	sql.Register(driverName, faultDriver{&pq.Driver{}})
+}
+
+// faultDriver opens connections that fail calls chosen by InjectFailure.
+type faultDriver struct {
+	driver.Driver
+}
+
+func (d faultDriver) Open(name string) (driver.Conn, error) {
+	c, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return faultConn{c}, nil
+}
+
+// faultConn passes every call through to the wrapped connection, unless it's the call chosen
+// to fail.
+type faultConn struct {
+	driver.Conn
+}
+
+func (c faultConn) Prepare(query string) (driver.Stmt, error) {
+	if err := failures.Next(); err != nil {
+		return nil, err
+	}
+
+	return c.Conn.Prepare(query)
+}
+
+func (c faultConn) Begin() (driver.Tx, error) {
+	if err := failures.Next(); err != nil {
+		return nil, err
+	}
+
+	return c.Conn.Begin()
+}
+
+func (c faultConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if err := failures.Next(); err != nil {
+		return nil, err
+	}
+
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+
+	return c.Conn.Begin()
+}
+
+func (c faultConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip // falls back to Prepare, which counts the call
+	}
+
+	if err := failures.Next(); err != nil {
+		return nil, err
+	}
+
+	return q.QueryContext(ctx, query, args)
+}
+
+func (c faultConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip // falls back to Prepare, which counts the call
+	}
+
+	if err := failures.Next(); err != nil {
+		return nil, err
+	}
+
+	return e.ExecContext(ctx, query, args)
+}
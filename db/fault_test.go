@@ -0,0 +1,26 @@
+//go:build faultinject
+// +build faultinject
+
+package db
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestInjectedFailure(t *testing.T) {
+	setupDB(t)
+
+	errInjected := errors.New("injected failure")
+
+	InjectFailure(2, errInjected)
+	defer ResetFailures()
+
+	for call := 1; call <= 3; call++ {
+		_, err := KnownWeatherLabels("")
+
+		if want := call == 2; (err == errInjected) != want {
+			t.Errorf("have: %v on call %d want failure: %v", err, call, want)
+		}
+	}
+}
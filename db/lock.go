@@ -0,0 +1,56 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"hash/fnv"
+)
+
+// LocationLock is a postgres session-level advisory lock held on behalf of a location. It
+// is used to make sure only one server instance refreshes the cached weather for a location
+// at a time.
+type LocationLock struct {
+	key  int64
+	conn *sql.Conn
+}
+
+// TryLockLocation attempts to take the advisory lock for 'cityName' without blocking. If
+// the lock is held elsewhere, a nil lock is returned.
+func TryLockLocation(ctx context.Context, cityName string) (*LocationLock, error) {
+	// advisory locks belong to a session, so the lock and unlock must share a connection
+	conn, err := GlobalConn.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	lock := &LocationLock{key: lockKey(cityName), conn: conn}
+
+	var acquired bool
+
+	if err := conn.QueryRowContext(ctx, `select pg_try_advisory_lock($1)`, lock.key).Scan(&acquired); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if !acquired {
+		conn.Close()
+		return nil, nil
+	}
+
+	return lock, nil
+}
+
+// Release gives up the advisory lock and returns its connection to the pool. The lock is
+// released even if the context it was taken with has since been cancelled.
+func (l *LocationLock) Release() error {
+	defer l.conn.Close()
+
+	_, err := l.conn.ExecContext(context.Background(), `select pg_advisory_unlock($1)`, l.key)
+	return err
+}
+
+func lockKey(cityName string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(cityName))
+	return int64(h.Sum64())
+}
@@ -0,0 +1,164 @@
+package db
+
+import (
+	"database/sql"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/language"
+)
+
+// CanonicalCityName puts a location name in the form it's stored under, with surrounding and
+// repeated whitespace removed and the first letter of each word title cased. Names written
+// entirely in upper case are lower cased first, but otherwise the case of later letters is
+// kept, so that names such as "McKinney" aren't mangled. So "san  francisco", "SAN FRANCISCO"
+// and "San Francisco" are the same location, as are "são paulo" and "São Paulo".
+func CanonicalCityName(name string) string {
+	name = strings.Join(strings.Fields(name), " ")
+
+	if strings.ToUpper(name) == name {
+		name = strings.ToLower(name)
+	}
+
+	// a Caser isn't safe for concurrent use, so one is made for each name
+	return cases.Title(language.Und, cases.NoLower).String(name)
+}
+
+// MergeDuplicateLocations merges the rows of the 'locations' table whose names are the same
+// location, see CanonicalCityName, such as "London" and "london", left by requests made before
+// names were normalized. Of each set of duplicates, the row already named canonically, or
+// else the oldest, survives under the canonical name, and the others' readings, recorded
+// queries, query counts and bookmarks are moved to it before they're deleted. Their monthly
+// stats are dropped, to be recomputed for the survivor at the next stats refresh. It runs in
+// a single transaction and returns the number of rows deleted.
+func MergeDuplicateLocations() (merged int, err error) {
+	txn, err := GlobalConn.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		if err != nil {
+			txn.Rollback()
+			return
+		}
+
+		err = txn.Commit()
+	}()
+
+	rows, err := txn.Query(`select id, city_name from locations order by id for update`)
+	if err != nil {
+		return 0, err
+	}
+
+	type location struct {
+		id   int64
+		name string
+	}
+
+	byName := map[string][]location{}
+
+	for rows.Next() {
+		var l location
+
+		if err = rows.Scan(&l.id, &l.name); err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		canonical := CanonicalCityName(l.name)
+		byName[canonical] = append(byName[canonical], l)
+	}
+
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	names := []string{}
+	for name, locations := range byName {
+		if len(locations) > 1 {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names) // merge in a stable order, so concurrent merges lock rows alike
+
+	for _, name := range names {
+		locations := byName[name]
+
+		survivor := 0
+		for i, l := range locations {
+			if l.name == name {
+				survivor = i
+				break
+			}
+		}
+
+		keep := locations[survivor].id
+
+		for i, l := range locations {
+			if i == survivor {
+				continue
+			}
+
+			if err = mergeLocation(txn, l.id, keep); err != nil {
+				return 0, err
+			}
+
+			merged++
+		}
+
+		if _, err = txn.Exec(`update locations set city_name = $2 where id = $1`, keep, name); err != nil {
+			return 0, err
+		}
+	}
+
+	return merged, nil
+}
+
+// execer is satisfied by both the connection and a transaction.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// mergeLocation moves everything referencing the location 'from' to the location 'to', adds
+// its query count to that of 'to' and deletes it.
+func mergeLocation(q execer, from, to int64) error {
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{`update weather set location_id = $2 where location_id = $1`, []interface{}{from, to}},
+		{`update location_query_events set location_id = $2 where location_id = $1`, []interface{}{from, to}},
+		{`delete from weather_stats_monthly where location_id = $1`, []interface{}{from}},
+		{`
+			update bookmarks
+				set location_ids = (
+					select array_agg(location_id order by position)
+					from (
+						select location_id, min(position) as position
+						from unnest(array_replace(location_ids, $1::integer, $2::integer)) with ordinality as ids(location_id, position)
+						group by location_id
+					) deduplicated
+				)
+			where
+				$1::integer = any(location_ids)`, []interface{}{from, to}},
+		{`
+			update locations
+				set query_count = coalesce(query_count, 0) + coalesce((select query_count from locations where id = $1), 0)
+			where
+				id = $2`, []interface{}{from, to}},
+		{`delete from locations where id = $1`, []interface{}{from}},
+	}
+
+	for _, stmt := range statements {
+		if _, err := q.Exec(stmt.query, stmt.args...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
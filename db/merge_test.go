@@ -0,0 +1,113 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMergeDuplicateLocations(t *testing.T) {
+	setupDB(t)
+
+	at := time.Date(2019, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	// the oldest row isn't the canonically named one, which should survive regardless
+	ids := map[string]int64{}
+
+	for i, cityName := range []string{"london", "London", " LONDON ", "Reno"} {
+		wr, err := SeedWeather(cityName, 270, 280, at.Add(time.Duration(i)*time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids[cityName] = wr.LocationRowID.Int64
+
+		if _, err := GlobalConn.Exec(`update locations set query_count = $2 where id = $1`, wr.LocationRowID.Int64, i+1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	acc, err := NewAccount("merger")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := acc.NewBookmarkCollection(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := acc.UpdateBookmarkCollectionIDs(int(ids["london"]), int(ids["Reno"]), int(ids["London"])); err != nil {
+		t.Fatal(err)
+	}
+
+	merged, err := MergeDuplicateLocations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if merged != 2 {
+		t.Errorf("have: %v want: %v merged", merged, 2)
+	}
+
+	var (
+		locations, readings int
+		queryCount          int64
+		survivor            = ids["London"]
+	)
+
+	if err := GlobalConn.QueryRow(`select count(*) from locations where lower(trim(city_name)) = 'london'`).Scan(&locations); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := GlobalConn.QueryRow(`select query_count from locations where id = $1 and city_name = 'London'`, survivor).Scan(&queryCount); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := GlobalConn.QueryRow(`select count(*) from weather where location_id = $1`, survivor).Scan(&readings); err != nil {
+		t.Fatal(err)
+	}
+
+	if locations != 1 || queryCount != 1+2+3 || readings != 3 {
+		t.Errorf("have: %d locations with %d queries and %d readings want: 1 location with 6 queries and 3 readings", locations, queryCount, readings)
+	}
+
+	bookmarks, err := acc.GetBookmarkCollectionIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []int64{survivor, ids["Reno"]}; !reflect.DeepEqual([]int64(bookmarks.LocationIDs), want) {
+		t.Errorf("have: %v want: %v bookmarked", bookmarks.LocationIDs, want)
+	}
+
+	merged, err = MergeDuplicateLocations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if merged != 0 {
+		t.Errorf("have: %v want: %v merged the second time", merged, 0)
+	}
+}
+
+func TestCanonicalCityName(t *testing.T) {
+	var canonicalTestCases = []struct {
+		name string
+		want string
+	}{
+		{"london", "London"},
+		{" LONDON ", "London"},
+		{"san  francisco", "San Francisco"},
+		{"são paulo", "São Paulo"},
+		{"winston-salem", "Winston-Salem"},
+		{"McKinney", "McKinney"},
+		{"MCKINNEY", "Mckinney"},
+		{"new york", "New York"},
+	}
+
+	for _, tc := range canonicalTestCases {
+		if have := CanonicalCityName(tc.name); have != tc.want {
+			t.Errorf("have: %v want: %v", have, tc.want)
+		}
+	}
+}
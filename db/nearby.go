@@ -0,0 +1,71 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+)
+
+// earthRadiusKm is the mean radius of the earth, used for great-circle distances.
+const earthRadiusKm = 6371.0
+
+// NearbyWeather is the latest cached reading at a location near some coordinate.
+type NearbyWeather struct {
+	CityName   string
+	DistanceKm float64
+	Weather    *WeatherRow
+}
+
+// UpdateLocationCoordinates records the coordinates of a location in the 'locations' table,
+// so that it can be found by NearestCachedWeather.
+func UpdateLocationCoordinates(ctx context.Context, cityName string, lat, lon float64) error {
+	query := `
+		update locations
+			set lat = $2, lon = $3
+		where
+			city_name = $1`
+
+	_, err := GlobalConn.ExecContext(ctx, query, cityName, lat, lon)
+
+	return err
+}
+
+// NearestCachedWeather returns the latest reading at the location nearest to 'lat', 'lon'
+// that has both coordinates and cached weather, or nil if there is no such location within
+// 'radiusKm'. Only the database is consulted.
+func NearestCachedWeather(ctx context.Context, lat, lon, radiusKm float64) (*NearbyWeather, error) {
+	query := `
+		select * from (
+			select distinct on (locations.id)
+				` + locationWeatherColumns + `,
+				2 * $4::float8 * asin(sqrt(
+					power(sin(radians(locations.lat - $1) / 2), 2) +
+					cos(radians($1)) * cos(radians(locations.lat)) *
+					power(sin(radians(locations.lon - $2) / 2), 2))) as distance
+			from locations, weather
+			where
+				locations.lat is not null
+				and locations.lon is not null
+				and locations.id = weather.location_id
+			order by locations.id, weather.at_time desc
+		) as latest
+		where
+			distance <= $3
+		order by distance
+		limit 1`
+
+	nearby := &NearbyWeather{}
+
+	row := GlobalConn.QueryRowContext(ctx, query, lat, lon, radiusKm, earthRadiusKm)
+
+	lr, wr, err := scanLocationWeather(row, &nearby.DistanceKm)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	nearby.CityName, nearby.Weather = lr.CityName.String, wr
+
+	return nearby, nil
+}
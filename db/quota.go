@@ -0,0 +1,86 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// quotaDay returns the day calls made at 't' count towards, as a date.
+func quotaDay(t time.Time) string {
+	return t.Format("2006-01-02")
+}
+
+// IncrAPICalls counts a call to the weather api against today's quota in the 'api_quota'
+// table, returning the number of calls made today. The increment is made by the database, so
+// calls from every instance sharing it are counted.
+func IncrAPICalls(ctx context.Context) (int, error) {
+	query := `
+		insert into api_quota (day, calls)
+			values ($1::date, 1)
+		on conflict (day) do
+			update
+				set calls = api_quota.calls + 1
+		returning
+			calls`
+
+	var calls int
+
+	if err := GlobalConn.QueryRowContext(ctx, query, quotaDay(nowFunc())).Scan(&calls); err != nil {
+		return 0, err
+	}
+
+	return calls, nil
+}
+
+// ReserveAPICall counts a call about to be made to the weather api against today's quota, as
+// IncrAPICalls does, unless 'budget' calls have already been made today, in which case it
+// reports false and nothing is counted. Checking and counting is a single statement, so
+// concurrent reservations can't overshoot the budget. A budget of 0 or less is unlimited.
+func ReserveAPICall(ctx context.Context, budget int) (bool, error) {
+	if budget <= 0 {
+		_, err := IncrAPICalls(ctx)
+		return err == nil, err
+	}
+
+	query := `
+		insert into api_quota (day, calls)
+			values ($1::date, 1)
+		on conflict (day) do
+			update
+				set calls = api_quota.calls + 1
+			where
+				api_quota.calls < $2
+		returning
+			calls`
+
+	var calls int
+
+	switch err := GlobalConn.QueryRowContext(ctx, query, quotaDay(nowFunc()), budget).Scan(&calls); err {
+	case nil:
+		return true, nil
+	case sql.ErrNoRows:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// APICallsToday returns the number of calls made to the weather api today, as counted by
+// IncrAPICalls.
+func APICallsToday(ctx context.Context) (int, error) {
+	query := `
+		select
+			coalesce(sum(calls), 0)
+		from api_quota
+		where
+			day = $1::date`
+
+	var calls int
+
+	if err := GlobalConn.QueryRowContext(ctx, query, quotaDay(nowFunc())).Scan(&calls); err != nil {
+		return 0, err
+	}
+
+	return calls, nil
+}
@@ -0,0 +1,94 @@
+package db
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAPICallQuota(t *testing.T) {
+	setupDB(t)
+
+	defer func(f func() time.Time) { nowFunc = f }(nowFunc)
+
+	today := time.Date(2019, time.March, 1, 23, 0, 0, 0, time.Local)
+	nowFunc = func() time.Time { return today }
+
+	for want := 1; want <= 3; want++ {
+		calls, err := IncrAPICalls(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if calls != want {
+			t.Errorf("have: %v want: %v", calls, want)
+		}
+	}
+
+	calls, err := APICallsToday(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if calls != 3 {
+		t.Errorf("have: %v want: %v", calls, 3)
+	}
+
+	nowFunc = func() time.Time { return today.Add(2 * time.Hour) } // the next day
+
+	calls, err = APICallsToday(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if calls != 0 {
+		t.Errorf("have: %v want: %v on the next day", calls, 0)
+	}
+}
+
+func TestReserveAPICall(t *testing.T) {
+	setupDB(t)
+
+	defer func(f func() time.Time) { nowFunc = f }(nowFunc)
+
+	today := time.Date(2019, time.March, 1, 12, 0, 0, 0, time.Local)
+	nowFunc = func() time.Time { return today }
+
+	const budget = 2
+
+	var (
+		wg       sync.WaitGroup
+		reserved int64
+	)
+
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			ok, err := ReserveAPICall(context.Background(), budget)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if ok {
+				atomic.AddInt64(&reserved, 1)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	calls, err := APICallsToday(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reserved != budget || calls != budget {
+		t.Errorf("have: %d reserved and %d calls want: %d of each", reserved, calls, budget)
+	}
+}
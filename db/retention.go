@@ -0,0 +1,68 @@
+package db
+
+import (
+	"time"
+)
+
+// PurgeWeatherOlderThan deletes every reading in the 'weather' table taken more than 'd'
+// before now, returning the number of readings removed. Stats reflect the remaining history
+// once the stats summary is next refreshed.
+func PurgeWeatherOlderThan(d time.Duration) (int, error) {
+	query := `
+		delete from weather
+		where
+			at_time < $1`
+
+	res, err := GlobalConn.Exec(query, nowFunc().Add(-d))
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+
+	return int(n), err
+}
+
+// CompactWeather collapses runs of consecutive readings at a location that report the same
+// temperatures, labels and source, each taken within 'window' of the one before it, into the
+// first reading of the run. It returns the number of readings removed. Running it again
+// removes nothing more, as every remaining reading differs from, or is more than 'window'
+// after, the one before it.
+func CompactWeather(window time.Duration) (int, error) {
+	query := `
+		delete from weather
+		where ctid in (
+			select ctid from (
+				select
+					ctid,
+					labels,
+					temp_low,
+					temp_high,
+					source,
+					at_time,
+					lag(labels) over readings as prev_labels,
+					lag(temp_low) over readings as prev_temp_low,
+					lag(temp_high) over readings as prev_temp_high,
+					lag(source) over readings as prev_source,
+					lag(at_time) over readings as prev_at_time
+				from weather
+				window readings as (partition by location_id order by at_time)
+			) consecutive
+			where
+				prev_at_time is not null
+				and at_time - prev_at_time <= make_interval(secs => $1)
+				and labels is not distinct from prev_labels
+				and temp_low is not distinct from prev_temp_low
+				and temp_high is not distinct from prev_temp_high
+				and source is not distinct from prev_source
+		)`
+
+	res, err := GlobalConn.Exec(query, window.Seconds())
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+
+	return int(n), err
+}
@@ -1,14 +1,23 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
+	"sort"
 	"time"
 
 	"github.com/lib/pq"
 )
 
+// nowFunc returns the current time, which is recorded against new weather readings. Tests
+// replace it to control the time readings are taken at.
+var (
+	nowFunc = time.Now
+)
+
 // QueryResult is a short-hand alias for the result of a query that will eventually
 // be sent to a client as JSON.
 type QueryResult map[string]interface{}
@@ -24,27 +33,109 @@ type LocationRow struct {
 }
 
 // IncrQueryCount increments a counter for the location in the 'locations' table
-// each time it is queried for weather.
-func (lr *LocationRow) IncrQueryCount() error {
-	lr.QueryCount.Int64 = lr.QueryCount.Int64 + int64(1)
+// each time it is queried for weather, and records the query in the 'location_query_events'
+// table. The increment is made by the database, so that concurrent requests for the same
+// location are all counted, and the row's count is updated to the result.
+func (lr *LocationRow) IncrQueryCount(ctx context.Context) error {
+	query := `
+		with event as (
+			insert into location_query_events (location_id, at_time)
+				select id, $2 from locations where city_name = $1
+		)
+		update locations
+			set query_count = query_count + 1
+		where
+			city_name = $1
+		returning
+			query_count`
 
+	return GlobalConn.QueryRowContext(ctx, query, lr.CityName, nowFunc()).Scan(&lr.QueryCount)
+}
+
+// IncrLocationQueryCount increments the query counter for the location named 'cityName', and
+// records the query, as IncrQueryCount does. It is used when the location's weather is served
+// without reading its row from the database.
+func IncrLocationQueryCount(ctx context.Context, cityName string) error {
 	query := `
+		with event as (
+			insert into location_query_events (location_id, at_time)
+				select id, $2 from locations where city_name = $1
+		)
 		update locations
-			set query_count = $2
+			set query_count = query_count + 1
 		where
 			city_name = $1`
 
-	stmt, err := GlobalConn.Prepare(query)
+	_, err := GlobalConn.ExecContext(ctx, query, cityName, nowFunc())
+	return err
+}
+
+// RollupQueryCounts sets the query count of every location in the 'locations' table to the
+// number of queries recorded for it in the 'location_query_events' table, which is the record
+// of truth, the counter being a cache of it. It returns the number of locations whose count
+// was corrected.
+func RollupQueryCounts() (int, error) {
+	query := `
+		update locations
+			set query_count = counts.queries
+		from (
+			select
+				locations.id,
+				count(location_query_events.location_id) as queries
+			from locations
+				left join location_query_events on location_query_events.location_id = locations.id
+			group by locations.id
+		) counts
+		where
+			locations.id = counts.id
+			and locations.query_count is distinct from counts.queries`
+
+	res, err := GlobalConn.Exec(query)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	_, err = stmt.Exec(lr.CityName, lr.QueryCount)
+	n, err := res.RowsAffected()
+
+	return int(n), err
+}
+
+// QueryCountsSince returns the number of queries recorded for each location since 'since',
+// keyed by location name. Locations that haven't been queried since are left out.
+func QueryCountsSince(since time.Time) (map[string]int, error) {
+	query := `
+		select
+			locations.city_name,
+			count(*)
+		from locations, location_query_events
+		where
+			locations.id = location_query_events.location_id
+			and location_query_events.at_time >= $1
+		group by locations.city_name`
+
+	rows, err := GlobalConn.Query(query, since)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	counts := map[string]int{}
+
+	for rows.Next() {
+		var (
+			cityName string
+			n        int
+		)
+
+		if err := rows.Scan(&cityName, &n); err != nil {
+			return nil, err
+		}
+
+		counts[cityName] = n
 	}
 
-	return stmt.Close()
+	return counts, rows.Err()
 }
 
 // WeatherRow represents a database row in the 'weather' table.
@@ -53,34 +144,64 @@ type WeatherRow struct {
 	TempHigh      sql.NullFloat64
 	TempLow       sql.NullFloat64
 	Labels        pq.StringArray
+	Source        sql.NullString
+	Base          sql.NullString // the provider's internal parameter, e.g. the model behind the reading
+	WindSpeed     sql.NullFloat64
+	WindDeg       sql.NullFloat64
+	Visibility    sql.NullInt64
+	Clouds        sql.NullInt64
+	Humidity      sql.NullFloat64 // relative humidity percentage
+	Pressure      sql.NullFloat64 // atmospheric pressure in hPa
 	AtTime        time.Time
 }
 
-// FetchLocationWeather returns a join of the 'locations' and 'weather' table from the database for
-// a row matching 'cityName'.
-func FetchLocationWeather(cityName string) (QueryResult, error) {
-	query := `
-		select
-			id,
-			city_name,
-			query_count,
-			location_id,
-			labels,
-			temp_high,
-			temp_low,
-			at_time
-		from
-			locations, weather
-		where
-			city_name = $1
-			and at_time = (select max(at_time) from weather)`
+// orderTemps swaps the low and high temperatures of the reading if the low is above the high,
+// as a provider glitch can report them inverted, which would skew averages. It reports whether
+// they were swapped.
+func (wr *WeatherRow) orderTemps() bool {
+	if !wr.TempLow.Valid || !wr.TempHigh.Valid || wr.TempLow.Float64 <= wr.TempHigh.Float64 {
+		return false
+	}
 
-	lr := &LocationRow{}
-	wr := &WeatherRow{}
+	wr.TempLow, wr.TempHigh = wr.TempHigh, wr.TempLow
+
+	return true
+}
 
-	row := GlobalConn.QueryRow(query, cityName)
+// locationWeatherColumns are the columns of a location in the 'locations' table and a reading
+// taken there in the 'weather' table, in the order scanLocationWeather reads them.
+const locationWeatherColumns = `
+	locations.id,
+	locations.city_name,
+	locations.query_count,
+	weather.location_id,
+	weather.labels,
+	weather.temp_high,
+	weather.temp_low,
+	weather.source,
+	weather.base,
+	weather.wind_speed,
+	weather.wind_deg,
+	weather.visibility,
+	weather.clouds,
+	weather.at_time`
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanLocationWeather scans a row selecting locationWeatherColumns, followed by 'extra' columns
+// if any, into a location and its reading. The reading is nil if the row has none, as when the
+// weather is left joined.
+func scanLocationWeather(row rowScanner, extra ...interface{}) (*LocationRow, *WeatherRow, error) {
+	var (
+		lr     = &LocationRow{}
+		wr     = &WeatherRow{}
+		atTime pq.NullTime
+	)
 
-	switch err := row.Scan(
+	dest := []interface{}{
 		&lr.ID,
 		&lr.CityName,
 		&lr.QueryCount,
@@ -88,31 +209,364 @@ func FetchLocationWeather(cityName string) (QueryResult, error) {
 		&wr.Labels,
 		&wr.TempHigh,
 		&wr.TempLow,
-		&wr.AtTime); err {
+		&wr.Source,
+		&wr.Base,
+		&wr.WindSpeed,
+		&wr.WindDeg,
+		&wr.Visibility,
+		&wr.Clouds,
+		&atTime,
+	}
+
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, nil, err
+	}
+
+	if !atTime.Valid {
+		return lr, nil, nil
+	}
+
+	wr.AtTime = atTime.Time
+
+	return lr, wr, nil
+}
+
+// FetchLocationWeather returns a join of the 'locations' and 'weather' table from the database for
+// the most recent reading at the location named 'cityName', or nil if it has none.
+func FetchLocationWeather(ctx context.Context, cityName string) (QueryResult, error) {
+	query := `
+		select
+			` + locationWeatherColumns + `
+		from locations, weather
+		where
+			locations.city_name = $1
+			and locations.id = weather.location_id
+		order by weather.at_time desc
+		limit 1`
+
+	lr, wr, err := scanLocationWeather(GlobalConn.QueryRowContext(ctx, query, cityName))
+
+	switch err {
 	case sql.ErrNoRows:
 		return nil, nil
-	case err:
-		return nil, err
-	default:
+	case nil:
 		return QueryResult{
 			"location": lr,
 			"weather":  wr,
 		}, nil
+	default:
+		return nil, err
+	}
+}
+
+// FetchLocationWeatherByID returns the location with the id 'id' in the 'locations' table and
+// its most recent reading, or nil if there is no such location. The weather is nil if the
+// location has no readings.
+func FetchLocationWeatherByID(ctx context.Context, id int64) (*LocationWeather, error) {
+	query := `
+		select
+			` + locationWeatherColumns + `
+		from locations
+			left join weather on weather.location_id = locations.id
+		where
+			locations.id = $1
+		order by weather.at_time desc nulls last
+		limit 1`
+
+	lr, wr, err := scanLocationWeather(GlobalConn.QueryRowContext(ctx, query, id))
+
+	switch err {
+	case sql.ErrNoRows:
+		return nil, nil
+	case nil:
+		return &LocationWeather{lr, wr}, nil
+	default:
+		return nil, err
+	}
+}
+
+// LatestLocationWeather returns the most recent 'weather' table row for each of the named
+// locations, keyed by location name. Locations without any weather are left out.
+func LatestLocationWeather(cityNames ...string) (map[string]*WeatherRow, error) {
+	query := `
+		select distinct on (locations.city_name)
+			` + locationWeatherColumns + `
+		from locations, weather
+		where
+			locations.city_name = any($1)
+			and locations.id = weather.location_id
+		order by locations.city_name, weather.at_time desc`
+
+	rows, err := GlobalConn.Query(query, pq.Array(cityNames))
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	latest := map[string]*WeatherRow{}
+
+	for rows.Next() {
+		lr, wr, err := scanLocationWeather(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		if lr.CityName.Valid {
+			latest[lr.CityName.String] = wr
+		}
+	}
+
+	return latest, rows.Err()
+}
+
+// WeatherAsOf returns the most recent reading at the location named 'cityName' taken at or
+// before 'at', or nil if there isn't one.
+func WeatherAsOf(ctx context.Context, cityName string, at time.Time) (*WeatherRow, error) {
+	query := `
+		select
+			` + locationWeatherColumns + `
+		from locations, weather
+		where
+			locations.city_name = $1
+			and locations.id = weather.location_id
+			and weather.at_time <= $2
+		order by weather.at_time desc
+		limit 1`
+
+	// readings are stored in local time, without a time zone
+	_, wr, err := scanLocationWeather(GlobalConn.QueryRowContext(ctx, query, cityName, at.Local()))
+
+	switch err {
+	case sql.ErrNoRows:
+		return nil, nil
+	case nil:
+		return wr, nil
+	default:
+		return nil, err
+	}
+}
+
+// LocationWeather is a location and a reading taken there.
+type LocationWeather struct {
+	Location *LocationRow
+	Weather  *WeatherRow
+}
+
+// LatestWeatherForAllLocations returns the most recent reading at every location with
+// weather, in one query, ordered by location name. Locations whose most recent reading was
+// taken before 'since' are left out. At most 'limit' locations are returned, after skipping
+// the first 'offset'.
+func LatestWeatherForAllLocations(ctx context.Context, since time.Time, limit, offset int) ([]LocationWeather, error) {
+	query := `
+		select * from (
+			select distinct on (weather.location_id)
+				` + locationWeatherColumns + `
+			from locations, weather
+			where
+				locations.id = weather.location_id
+			order by weather.location_id, weather.at_time desc
+		) latest
+		where
+			at_time >= $1
+		order by city_name
+		limit $2 offset $3`
+
+	// readings are stored in local time, without a time zone
+	rows, err := GlobalConn.QueryContext(ctx, query, since.Local(), limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	latest := []LocationWeather{}
+
+	for rows.Next() {
+		lr, wr, err := scanLocationWeather(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		latest = append(latest, LocationWeather{lr, wr})
+	}
+
+	return latest, rows.Err()
+}
+
+// ExtremeCachedLocation returns the location whose latest cached reading has the highest
+// median temperature if 'warmest' is set, or the lowest otherwise, along with that reading.
+// Readings missing either temperature, or taken before 'since', are ignored. If nothing is
+// cached, nil rows are returned.
+func ExtremeCachedLocation(ctx context.Context, warmest bool, since time.Time) (*LocationRow, *WeatherRow, error) {
+	query := `
+		select * from (
+			select distinct on (locations.id)
+				` + locationWeatherColumns + `
+			from locations, weather
+			where
+				locations.id = weather.location_id
+			order by locations.id, weather.at_time desc
+		) latest
+		where
+			temp_low is not null
+			and temp_high is not null
+			and at_time >= $1
+		order by (temp_low + temp_high) / 2 %s
+		limit 1`
+
+	order := "asc"
+	if warmest {
+		order = "desc"
+	}
+
+	lr, wr, err := scanLocationWeather(GlobalConn.QueryRowContext(ctx, fmt.Sprintf(query, order), since.Local()))
+
+	switch err {
+	case sql.ErrNoRows:
+		return nil, nil, nil
+	case nil:
+		return lr, wr, nil
+	default:
+		return nil, nil, err
+	}
+}
+
+// EachWeatherReading calls 'fn' with a page of at most 'limit' readings in the 'weather' table,
+// oldest first, skipping the first 'offset', as they are scanned, so that the history never
+// needs to be held in memory. If 'cityName' is not empty, only readings at that location are
+// included. Iteration stops at the first error, from the database or from 'fn', which is
+// returned.
+func EachWeatherReading(ctx context.Context, cityName string, limit, offset int, fn func(cityName string, wr *WeatherRow) error) error {
+	query := `
+		select
+			` + locationWeatherColumns + `
+		from locations, weather
+		where
+			locations.id = weather.location_id
+			and ($1 = '' or locations.city_name = $1)
+		order by weather.at_time, weather.location_id
+		limit $2 offset $3`
+
+	rows, err := GlobalConn.QueryContext(ctx, query, cityName, limit, offset)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		lr, wr, err := scanLocationWeather(rows)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(lr.CityName.String, wr); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// EnsureLocation creates the location named 'cityName' in the 'locations' table with the given
+// coordinates, or updates the coordinates of an existing one, in a single statement. Unlike
+// UpdateCachedLocationWeather, no weather is added and the query count is left alone.
+func EnsureLocation(cityName string, lat, lon float64) (*LocationRow, error) {
+	query := `
+		insert into locations (city_name, query_count, lat, lon)
+			values ($1, 0, $2, $3)
+		on conflict (city_name) do
+			update
+				set lat = excluded.lat, lon = excluded.lon
+		returning
+			id, city_name, query_count`
+
+	lr := &LocationRow{}
+
+	if err := GlobalConn.QueryRow(query, cityName, lat, lon).Scan(&lr.ID, &lr.CityName, &lr.QueryCount); err != nil {
+		return nil, err
+	}
+
+	return lr, nil
+}
+
+// StaleLocation is a location whose latest reading is out of date, and when it was taken.
+type StaleLocation struct {
+	Location      LocationRow
+	LatestReading time.Time
+}
+
+// StaleLocations returns a page of at most 'limit' of the locations whose latest reading in the
+// 'weather' table was taken more than 'olderThan' before now, the longest unrefreshed first,
+// skipping the first 'offset', with the time of that reading. Locations without any readings
+// aren't included.
+func StaleLocations(ctx context.Context, olderThan time.Duration, limit, offset int) ([]StaleLocation, error) {
+	query := `
+		select
+			locations.id,
+			locations.city_name,
+			locations.query_count,
+			max(weather.at_time) as latest
+		from locations, weather
+		where
+			locations.id = weather.location_id
+		group by locations.id
+		having
+			max(weather.at_time) < $1
+		order by latest, locations.city_name
+		limit $2 offset $3`
+
+	rows, err := GlobalConn.QueryContext(ctx, query, nowFunc().Add(-olderThan), limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	stale := []StaleLocation{}
+
+	for rows.Next() {
+		var sl StaleLocation
+
+		if err := rows.Scan(&sl.Location.ID, &sl.Location.CityName, &sl.Location.QueryCount, &sl.LatestReading); err != nil {
+			return nil, err
+		}
+
+		stale = append(stale, sl)
 	}
+
+	return stale, rows.Err()
+}
+
+// UpdateCachedLocationWeather will update the cached weather for a location in the 'weather' table
+// from 'reading'. The reading's location id and time are ignored, they are set when it is stored.
+// Inverted low and high temperatures are swapped before the reading is stored, see orderTemps.
+// The location's query count is incremented and the query recorded.
+func UpdateCachedLocationWeather(ctx context.Context, cityName string, reading *WeatherRow) (QueryResult, error) {
+	return updateCachedLocationWeather(ctx, cityName, reading, true)
+}
+
+// RefreshCachedLocationWeather is as UpdateCachedLocationWeather, but without counting or
+// recording a query of the location, for refreshes no client asked for.
+func RefreshCachedLocationWeather(ctx context.Context, cityName string, reading *WeatherRow) (QueryResult, error) {
+	return updateCachedLocationWeather(ctx, cityName, reading, false)
 }
 
-// UpdateCachedLocationWeather will update the cached weather for a location in the 'weather' table.
-func UpdateCachedLocationWeather(cityName string, tempMin, tempMax float64, labels ...string) (QueryResult, error) {
+func updateCachedLocationWeather(ctx context.Context, cityName string, reading *WeatherRow, queried bool) (result QueryResult, err error) {
 	var (
 		query string
 		stmt  *sql.Stmt
 		row   *sql.Row
-		err   error
 	)
 
-	txn, txnError := GlobalConn.Begin()
+	if reading.orderTemps() {
+		log.Printf("swapped inverted temperatures for %s: low %g, high %g", cityName, reading.TempHigh.Float64, reading.TempLow.Float64)
+	}
+
+	txn, txnError := GlobalConn.BeginTx(ctx, nil)
 	if txnError != nil {
-		return nil, err
+		return nil, txnError
 	}
 
 	defer func() {
@@ -129,43 +583,80 @@ func UpdateCachedLocationWeather(cityName string, tempMin, tempMax float64, labe
 			values ($1, $2)
 		on conflict (city_name) do
 			update
-				set query_count = locations.query_count + 1
+				set query_count = locations.query_count + $2
 		returning
 			id, city_name, query_count`
 
-	stmt, err = txn.Prepare(query)
+	stmt, err = txn.PrepareContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
 
+	queries := 0
+	if queried {
+		queries = 1
+	}
+
 	lr := &LocationRow{}
 
-	row = stmt.QueryRow(cityName, 1)
+	row = stmt.QueryRowContext(ctx, cityName, queries)
 	if err = row.Scan(&lr.ID, &lr.CityName, &lr.QueryCount); err != nil {
 		return nil, err
 	}
 
 	stmt.Close()
 
+	if queried {
+		query = `
+			insert into location_query_events (location_id, at_time)
+				values ($1, $2)`
+
+		if _, err = txn.ExecContext(ctx, query, lr.ID, nowFunc()); err != nil {
+			return nil, err
+		}
+	}
+
 	query = `
-		insert into weather (location_id, labels, temp_low, temp_high, at_time)
-			values ($1, $2, $3, $4, $5)
+		insert into weather (location_id, labels, temp_low, temp_high, source, base, wind_speed, wind_deg, visibility, clouds, humidity, pressure, at_time)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
 		returning
-			location_id, labels, temp_high, temp_low, at_time`
+			location_id, labels, temp_low, temp_high, source, base, wind_speed, wind_deg, visibility, clouds, humidity, pressure, at_time`
 
-	stmt, err = txn.Prepare(query)
+	stmt, err = txn.PrepareContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
 
 	wr := &WeatherRow{}
 
-	row = stmt.QueryRow(lr.ID, pq.StringArray(labels), tempMin, tempMax, time.Now())
-	if err := row.Scan(
+	row = stmt.QueryRowContext(
+		ctx,
+		lr.ID,
+		reading.Labels,
+		reading.TempLow,
+		reading.TempHigh,
+		reading.Source,
+		reading.Base,
+		reading.WindSpeed,
+		reading.WindDeg,
+		reading.Visibility,
+		reading.Clouds,
+		reading.Humidity,
+		reading.Pressure,
+		nowFunc())
+	if err = row.Scan(
 		&wr.LocationRowID,
 		&wr.Labels,
-		&wr.TempHigh,
 		&wr.TempLow,
+		&wr.TempHigh,
+		&wr.Source,
+		&wr.Base,
+		&wr.WindSpeed,
+		&wr.WindDeg,
+		&wr.Visibility,
+		&wr.Clouds,
+		&wr.Humidity,
+		&wr.Pressure,
 		&wr.AtTime); err != nil {
 		return nil, err
 	}
@@ -198,63 +689,435 @@ func TotalQueryCount() (int, error) {
 	return 0, nil
 }
 
-// KnownWeatherLabels returns a list of unique weather label types cached in the database.
-func KnownWeatherLabels() ([]string, error) {
+// AverageTemperatureByLabel returns the average median temperature of the readings with each
+// weather label, keyed by label. A reading with several labels counts towards each of them.
+// Readings missing either temperature are ignored. If 'source' is not empty, only readings
+// reported by that provider are included.
+func AverageTemperatureByLabel(source string) (map[string]float64, error) {
 	query := `
-		select labels
-			from weather
-		where location_id is not null`
+		select
+			label,
+			avg((temp_low + temp_high) / 2)
+		from weather, unnest(labels) as label
+		where
+			temp_low is not null
+			and temp_high is not null
+			and ($1 = '' or source = $1)
+		group by label`
 
-	rows, err := GlobalConn.Query(query)
+	rows, err := GlobalConn.Query(query, source)
 	if err != nil {
 		return nil, err
 	}
 
-	labels := []string{}
-	uniqueLabels := map[string]bool{}
+	defer rows.Close()
+
+	averages := map[string]float64{}
 
 	for rows.Next() {
-		ls := []string{}
+		var (
+			label string
+			avg   float64
+		)
 
-		if err := rows.Scan(pq.Array(&ls)); err != nil {
+		if err := rows.Scan(&label, &avg); err != nil {
 			return nil, err
 		}
 
-		for _, l := range ls {
-			if _, seen := uniqueLabels[l]; seen {
-				continue
-			}
-
-			uniqueLabels[l] = true
-
-			labels = append(labels, l)
-		}
+		averages[label] = avg
 	}
 
-	return labels, nil
+	return averages, rows.Err()
 }
 
-// DailyWeatherSummary returns each unique weather label type as keys mapped to a list
-// of locations where that weather type was seen.
-func DailyWeatherSummary() (QueryResultList, error) {
+// DominantLabelPerCity returns the weather label seen in the most readings at each location
+// with labelled readings, keyed by location name. A reading with several labels counts towards
+// each of them. Ties go to the label first in alphabetical order. If 'source' is not empty,
+// only readings reported by that provider are counted.
+func DominantLabelPerCity(source string) (map[string]string, error) {
 	query := `
 		select
-			locations.city_name,
-			locations.id,
-			weather.at_time,
-			weather.labels,
-			weather.location_id
-		from locations, weather
-		where
-			locations.city_name is not null
-			and locations.id = weather.location_id
+			city_name,
+			label
+		from (
+			select
+				locations.city_name,
+				label,
+				row_number() over (
+					partition by locations.city_name
+					order by count(*) desc, label
+				) as rank
+			from locations, weather, unnest(weather.labels) as label
+			where
+				locations.city_name is not null
+				and locations.id = weather.location_id
+				and ($1 = '' or weather.source = $1)
+			group by locations.city_name, label
+		) as ranked
+		where rank = 1`
+
+	rows, err := GlobalConn.Query(query, source)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	dominant := map[string]string{}
+
+	for rows.Next() {
+		var cityName, label string
+
+		if err := rows.Scan(&cityName, &label); err != nil {
+			return nil, err
+		}
+
+		dominant[cityName] = label
+	}
+
+	return dominant, rows.Err()
+}
+
+// labelCountGranularities are the periods LabelCountsByPeriod can group readings by.
+var labelCountGranularities = map[string]bool{
+	"day":   true,
+	"week":  true,
+	"month": true,
+}
+
+// LabelCountsByPeriod returns how many readings had each weather label, keyed by the start of
+// each period (as YYYY-MM-DD) and then by label. 'granularity' is the length of the period,
+// one of day, week or month, weeks starting on monday. Only readings taken from 'from' up to,
+// but not including, 'to' are counted, a zero time leaving that end of the range open. A
+// reading with several labels counts towards each of them. If 'source' is not empty, only
+// readings reported by that provider are counted.
+func LabelCountsByPeriod(granularity, source string, from, to time.Time) (map[string]map[string]int, error) {
+	if !labelCountGranularities[granularity] {
+		return nil, fmt.Errorf("unsupported granularity: %s", granularity)
+	}
+
+	query := `
+		select
+			date_trunc($1, at_time) as period,
+			label,
+			count(*)
+		from weather, unnest(labels) as label
+		where
+			($2::timestamp is null or at_time >= $2)
+			and ($3::timestamp is null or at_time < $3)
+			and ($4 = '' or source = $4)
+		group by period, label`
+
+	lower, upper := (&DateRange{from, to}).bounds()
+
+	rows, err := GlobalConn.Query(query, granularity, lower, upper, source)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	counts := map[string]map[string]int{}
+
+	for rows.Next() {
+		var (
+			period time.Time
+			label  string
+			n      int
+		)
+
+		if err := rows.Scan(&period, &label, &n); err != nil {
+			return nil, err
+		}
+
+		key := period.Format("2006-01-02")
+
+		if counts[key] == nil {
+			counts[key] = map[string]int{}
+		}
+
+		counts[key][label] = n
+	}
+
+	return counts, rows.Err()
+}
+
+// DownsampledReading is the average of the readings at a location over one bucket of time.
+type DownsampledReading struct {
+	Bucket time.Time // the start of the bucket
+	AvgMid float64   // the average median temperature, midway between low and high
+}
+
+// WeatherDownsampled averages the median temperatures of the readings at the location named
+// 'cityName' over consecutive buckets of time, each 'bucket' long, for charting long ranges
+// without fetching every reading. Buckets start at 'from', or the unix epoch if it's zero, and
+// only readings taken from 'from' up to, but not including, 'to' are averaged, a zero time
+// leaving that end of the range open. Buckets without readings are left out, the rest are
+// returned in order.
+func WeatherDownsampled(ctx context.Context, cityName string, from, to time.Time, bucket time.Duration) ([]DownsampledReading, error) {
+	if bucket < time.Second {
+		return nil, fmt.Errorf("bucket must be at least a second: %s", bucket)
+	}
+
+	query := `
+		select
+			$2::timestamp
+				+ floor(extract(epoch from weather.at_time - $2::timestamp) / $5)
+				* $5 * interval '1 second' as bucket,
+			avg((weather.temp_low + weather.temp_high) / 2)
+		from locations, weather
+		where
+			locations.city_name = $1
+			and locations.id = weather.location_id
+			and weather.temp_low is not null
+			and weather.temp_high is not null
+			and ($3::timestamp is null or weather.at_time >= $3)
+			and ($4::timestamp is null or weather.at_time < $4)
+		group by bucket
+		order by bucket`
+
+	origin := from
+	if origin.IsZero() {
+		origin = time.Unix(0, 0).UTC()
+	}
+
+	lower, upper := (&DateRange{from, to}).bounds()
+
+	rows, err := GlobalConn.QueryContext(ctx, query, cityName, origin, lower, upper, bucket.Seconds())
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	readings := []DownsampledReading{}
+
+	for rows.Next() {
+		var r DownsampledReading
+
+		if err := rows.Scan(&r.Bucket, &r.AvgMid); err != nil {
+			return nil, err
+		}
+
+		readings = append(readings, r)
+	}
+
+	return readings, rows.Err()
+}
+
+// ReadingCountsByDay counts the readings at the location named 'cityName' on each day, keyed
+// by date as YYYY-MM-DD, for showing how densely a location has been read over time. Only
+// readings taken from 'from' up to, but not including, 'to' are counted, a zero time leaving
+// that end of the range open. Days without readings are left out.
+func ReadingCountsByDay(ctx context.Context, cityName string, from, to time.Time) (map[string]int, error) {
+	query := `
+		select weather.at_time::date as day, count(*)
+		from locations, weather
+		where
+			locations.city_name = $1
+			and locations.id = weather.location_id
+			and ($2::timestamp is null or weather.at_time >= $2)
+			and ($3::timestamp is null or weather.at_time < $3)
+		group by day`
+
+	lower, upper := (&DateRange{from, to}).bounds()
+
+	rows, err := GlobalConn.QueryContext(ctx, query, cityName, lower, upper)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	counts := map[string]int{}
+
+	for rows.Next() {
+		var (
+			day   time.Time
+			count int
+		)
+
+		if err := rows.Scan(&day, &count); err != nil {
+			return nil, err
+		}
+
+		counts[day.Format("2006-01-02")] = count
+	}
+
+	return counts, rows.Err()
+}
+
+// StatsCoverage describes the readings stats are computed from.
+type StatsCoverage struct {
+	Locations int         // distinct locations with readings
+	Readings  int         // total readings
+	From      pq.NullTime // the earliest reading, if there are any
+	To        pq.NullTime // the latest reading, if there are any
+}
+
+// WeatherStatsCoverage returns how many readings, at how many locations, over what period the
+// 'weather' table holds, from a single aggregate query. If 'source' is not empty, only readings
+// reported by that provider are included.
+func WeatherStatsCoverage(source string) (*StatsCoverage, error) {
+	query := `
+		select
+			count(distinct location_id),
+			count(*),
+			min(at_time),
+			max(at_time)
+		from weather
+		where
+			$1 = '' or source = $1`
+
+	c := &StatsCoverage{}
+
+	if err := GlobalConn.QueryRow(query, source).Scan(&c.Locations, &c.Readings, &c.From, &c.To); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// KnownWeatherLabels returns a list of unique weather label types cached in the database. If
+// 'source' is not empty, only labels reported by that provider are returned.
+func KnownWeatherLabels(source string) ([]string, error) {
+	query := `
+		select labels
+			from weather
+		where
+			location_id is not null
+			and ($1 = '' or source = $1)`
+
+	rows, err := GlobalConn.Query(query, source)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var entries entryCounter
+
+	labels := []string{}
+	uniqueLabels := map[string]bool{}
+
+	for rows.Next() {
+		ls := []string{}
+
+		if err := rows.Scan(pq.Array(&ls)); err != nil {
+			return nil, err
+		}
+
+		for _, l := range ls {
+			if _, seen := uniqueLabels[l]; seen {
+				continue
+			}
+
+			uniqueLabels[l] = true
+
+			if err := entries.add(1); err != nil {
+				return nil, err
+			}
+
+			labels = append(labels, l)
+		}
+	}
+
+	return labels, nil
+}
+
+// MaxStatsEntries caps the number of entries, such as temperatures or sightings of a label,
+// assembled into the result of a single stats query. A query that would exceed it fails with
+// a *ResultTooLargeError instead. Zero means no limit.
+var (
+	MaxStatsEntries = 10000
+)
+
+// ResultTooLargeError is returned by a stats query when its result would hold more than
+// MaxStatsEntries entries.
+type ResultTooLargeError struct {
+	Limit int
+}
+
+func (e *ResultTooLargeError) Error() string {
+	return fmt.Sprintf("stats result has more than %d entries", e.Limit)
+}
+
+// entryCounter counts the entries assembled into a stats result, so that assembly can stop
+// as soon as the result grows past MaxStatsEntries.
+type entryCounter int
+
+func (c *entryCounter) add(n int) error {
+	*c += entryCounter(n)
+
+	if MaxStatsEntries > 0 && int(*c) > MaxStatsEntries {
+		return &ResultTooLargeError{MaxStatsEntries}
+	}
+
+	return nil
+}
+
+// DateRange limits a query to readings taken from From up to, but not including, To. A
+// zero From or To leaves that end of the range open.
+type DateRange struct {
+	From time.Time
+	To   time.Time
+}
+
+// bounds returns the range as query arguments, with an open end as null.
+func (r *DateRange) bounds() (from, to interface{}) {
+	if !r.From.IsZero() {
+		from = r.From
+	}
+
+	if !r.To.IsZero() {
+		to = r.To
+	}
+
+	return from, to
+}
+
+// DailyWeatherSummary returns each unique weather label type as keys mapped to a list
+// of locations where that weather type was seen. If 'source' is not empty, only readings
+// reported by that provider are included. Only readings within 'dates' are included, or if
+// it is nil, readings taken on the day of the most recent reading.
+func DailyWeatherSummary(source string, dates *DateRange) (QueryResultList, error) {
+	query := `
+		select
+			locations.city_name,
+			locations.id,
+			weather.at_time,
+			weather.labels,
+			weather.location_id
+		from locations, weather
+		where
+			locations.city_name is not null
+			and locations.id = weather.location_id
+			and ($1 = '' or weather.source = $1)
+			and ($2::timestamp is null or weather.at_time >= $2)
+			and ($3::timestamp is null or weather.at_time < $3)
 		order by weather.at_time desc`
 
-	rows, err := GlobalConn.Query(query)
+	if dates == nil {
+		latest, err := latestReadingTime(source)
+		if err != nil {
+			return nil, err
+		}
+
+		day := time.Date(latest.Year(), latest.Month(), latest.Day(), 0, 0, 0, 0, latest.Location())
+		dates = &DateRange{day, day.AddDate(0, 0, 1)}
+	}
+
+	from, to := dates.bounds()
+
+	rows, err := GlobalConn.Query(query, source, from, to)
 	if err != nil {
 		return nil, err
 	}
 
+	defer rows.Close()
+
+	var entries entryCounter
+
 	summary := QueryResultList{}
 
 	for rows.Next() {
@@ -275,6 +1138,10 @@ func DailyWeatherSummary() (QueryResultList, error) {
 			continue
 		}
 
+		if err := entries.add(len(ls)); err != nil {
+			return nil, err
+		}
+
 		for _, l := range ls {
 			if _, initialised := summary[l]; !initialised {
 				summary[l] = []interface{}{}
@@ -292,159 +1159,590 @@ func DailyWeatherSummary() (QueryResultList, error) {
 		}
 	}
 
-	return summary, nil
+	return summary, nil
+}
+
+// latestReadingTime returns the time of the most recent reading, from 'source' if it is not
+// empty, or the zero time if there are no readings.
+func latestReadingTime(source string) (time.Time, error) {
+	query := `
+		select max(at_time)
+			from weather
+		where
+			$1 = '' or source = $1`
+
+	var latest pq.NullTime
+
+	if err := GlobalConn.QueryRow(query, source).Scan(&latest); err != nil {
+		return time.Time{}, err
+	}
+
+	return latest.Time, nil
+}
+
+// maxReadingDistance is how far a reading may be from a requested time and still be
+// considered 'near' it.
+const maxReadingDistance = time.Hour
+
+// InsufficientDataError is returned when no reading exists near a requested time. Nearest
+// is the time of the closest reading found, or the zero time if there are no readings at all.
+type InsufficientDataError struct {
+	CityName  string
+	Requested time.Time
+	Nearest   time.Time
+}
+
+func (e *InsufficientDataError) Error() string {
+	if e.Nearest.IsZero() {
+		return fmt.Sprintf("insufficient data near %s: no readings found for %s", e.Requested.Format(time.RFC3339), e.CityName)
+	}
+
+	return fmt.Sprintf(
+		"insufficient data near %s: nearest reading for %s is at %s",
+		e.Requested.Format(time.RFC3339),
+		e.CityName,
+		e.Nearest.Format(time.RFC3339))
+}
+
+// TemperatureDelta returns the difference in median temperature between the readings nearest
+// to 't1' and 't2' for a location, as the temperature at 't2' minus the temperature at 't1'. If
+// either time has no reading within an hour of it, an *InsufficientDataError is returned.
+func TemperatureDelta(ctx context.Context, cityName string, t1, t2 time.Time) (float64, error) {
+	from, err := nearestMedianTemperature(ctx, cityName, t1)
+	if err != nil {
+		return 0, err
+	}
+
+	to, err := nearestMedianTemperature(ctx, cityName, t2)
+	if err != nil {
+		return 0, err
+	}
+
+	return to - from, nil
+}
+
+func nearestMedianTemperature(ctx context.Context, cityName string, t time.Time) (float64, error) {
+	query := `
+		select
+			weather.temp_low,
+			weather.temp_high,
+			weather.at_time
+		from locations, weather
+		where
+			locations.city_name = $1
+			and locations.id = weather.location_id
+		order by abs(extract(epoch from (weather.at_time - $2)))
+		limit 1`
+
+	var (
+		templo sql.NullFloat64
+		temphi sql.NullFloat64
+	)
+
+	at := time.Time{}
+
+	// readings are stored in local time, without a time zone
+	switch err := GlobalConn.QueryRowContext(ctx, query, cityName, t.Local()).Scan(&templo, &temphi, &at); err {
+	case sql.ErrNoRows:
+		return 0, &InsufficientDataError{CityName: cityName, Requested: t}
+	case nil:
+		break
+	default:
+		return 0, err
+	}
+
+	distance := t.Sub(at)
+	if distance < 0 {
+		distance = -distance
+	}
+
+	if distance > maxReadingDistance || !templo.Valid || !temphi.Valid {
+		return 0, &InsufficientDataError{CityName: cityName, Requested: t, Nearest: at}
+	}
+
+	return (templo.Float64 + temphi.Float64) / 2, nil
+}
+
+// TemperatureQueries is a type alias for convenience, represents a list of temperatures.
+type TemperatureQueries []float64
+
+// DailyTemperatureQuery is another convenience type alias.
+type DailyTemperatureQuery map[int]TemperatureQueries
+
+// MonthlyTemperatureQuery is another convenience type alias.
+type MonthlyTemperatureQuery map[int]DailyTemperatureQuery
+
+// YearlyTemperatureQuery is another convenience type alias.
+type YearlyTemperatureQuery map[int]MonthlyTemperatureQuery
+
+// LocationTemperatureQueryResult is another convenience type alias. It represents
+// a location - day/month/year JSON structure.
+type LocationTemperatureQueryResult map[string]YearlyTemperatureQuery
+
+// InitialiseForDate is a helper function for ensuring that a key for the specified date is referencing an initialised map.
+func (q LocationTemperatureQueryResult) InitialiseForDate(city string, y int, mo int, d int) {
+	if _, initialised := q[city]; !initialised {
+		q[city] = YearlyTemperatureQuery{}
+	}
+	if _, initialised := q[city][y]; !initialised {
+		q[city][y] = MonthlyTemperatureQuery{}
+	}
+
+	if _, initialised := q[city][y][mo]; !initialised {
+		q[city][y][mo] = DailyTemperatureQuery{}
+	}
+
+	if _, initialised := q[city][y][mo][d]; !initialised {
+		q[city][y][mo][d] = TemperatureQueries{}
+	}
+}
+
+// Add appends a temperature to the list of temperatures at day/month/year for a location.
+func (q LocationTemperatureQueryResult) Add(temp float64, city string, y int, mo int, d int) {
+	q[city][y][mo][d] = append(q[city][y][mo][d], temp)
+}
+
+// TemperaturePoint is a single temperature in a series, taken on 'Date' (YYYY-MM-DD), or for
+// a monthly temperature, in the month 'Date' (YYYY-MM).
+type TemperaturePoint struct {
+	Date  string  `json:"date"`
+	Value float64 `json:"value"`
+}
+
+// Series flattens the result into a list of points per location, sorted by date, which is
+// easier to chart than the nested year/month/day structure. A day with several temperatures
+// has a point for each, in the order they were added.
+func (q LocationTemperatureQueryResult) Series() map[string][]TemperaturePoint {
+	series := map[string][]TemperaturePoint{}
+
+	for city, years := range q {
+		points := []TemperaturePoint{}
+
+		for y, months := range years {
+			for mo, days := range months {
+				for d, temps := range days {
+					date := fmt.Sprintf("%04d-%02d-%02d", y, mo, d)
+					if d == 0 { // monthly temperatures aren't broken down by day
+						date = fmt.Sprintf("%04d-%02d", y, mo)
+					}
+
+					for _, t := range temps {
+						points = append(points, TemperaturePoint{date, t})
+					}
+				}
+			}
+		}
+
+		sort.SliceStable(points, func(i, j int) bool { return points[i].Date < points[j].Date })
+
+		series[city] = points
+	}
+
+	return series
+}
+
+// TemperatureQueryFilter is a string constant that defines the available filters
+// for querying temperature statistics.
+type TemperatureQueryFilter string
+
+// Exported temperature statistics query filter enums
+const (
+	FilterLows     TemperatureQueryFilter = "lows"
+	FilterHighs    TemperatureQueryFilter = "highs"
+	FilterAverages TemperatureQueryFilter = "avgs"
+)
+
+// readingColumn selects a numeric column of the 'weather' table. It's passed to queries as an
+// argument and matched by selectReadingColumn, rather than interpolated into the query text.
+type readingColumn string
+
+const (
+	columnTempLow  readingColumn = "temp_low"
+	columnTempHigh readingColumn = "temp_high"
+	columnHumidity readingColumn = "humidity"
+	columnPressure readingColumn = "pressure"
+)
+
+// selectReadingColumn is the value of the 'weather' column selected by the readingColumn given
+// as the query's argument $2.
+const selectReadingColumn = `
+	case $2
+		when 'temp_low' then weather.temp_low
+		when 'temp_high' then weather.temp_high
+		when 'humidity' then weather.humidity
+		when 'pressure' then weather.pressure
+	end`
+
+// Metric is a numeric measurement of the weather that stats can be reported for.
+type Metric string
+
+// Exported stats metric enums
+const (
+	MetricTemp     Metric = "temp"
+	MetricHumidity Metric = "humidity"
+	MetricPressure Metric = "pressure"
+)
+
+// metricColumns are the columns holding each metric with a single value per reading.
+var metricColumns = map[Metric]readingColumn{
+	MetricHumidity: columnHumidity,
+	MetricPressure: columnPressure,
+}
+
+// MonthlyTemperature returns location temperature metrics based on the given filter. Currently
+// only supports 'FilterLows' and 'FilterHighs'. If 'source' is not empty, only readings reported
+// by that provider are included.
+func MonthlyTemperature(f TemperatureQueryFilter, source string) (LocationTemperatureQueryResult, error) {
+	column := columnTempLow
+
+	switch f {
+	case FilterLows:
+		break
+	case FilterHighs:
+		column = columnTempHigh
+	default:
+		return nil, fmt.Errorf("invalid reporting filter: %s", f)
+	}
+
+	query := `
+		select
+			locations.city_name,
+			locations.id,
+			weather.at_time,
+			` + selectReadingColumn + `,
+			weather.location_id
+		from locations, weather
+		where
+			locations.city_name is not null
+			and locations.id = weather.location_id
+			and ($1 = '' or weather.source = $1)
+		order by weather.at_time desc`
+
+	rows, err := GlobalConn.Query(query, source, string(column))
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var entries entryCounter
+
+	temps := LocationTemperatureQueryResult{}
+
+	for rows.Next() {
+		var (
+			cname sql.NullString
+			id    sql.NullInt64
+			lid   sql.NullInt64
+			temp  sql.NullFloat64
+		)
+
+		t := time.Time{}
+
+		if err := rows.Scan(&cname, &id, &t, &temp, &lid); err != nil {
+			return nil, err
+		}
+
+		if !cname.Valid {
+			continue
+		}
+
+		y, m, d := t.Date()
+		mo := int(m)
+		city := cname.String
+
+		temps.InitialiseForDate(city, y, mo, d)
+
+		if !temp.Valid {
+			continue
+		}
+
+		if err := entries.add(1); err != nil {
+			return nil, err
+		}
+
+		temps.Add(temp.Float64, city, y, mo, d)
+	}
+
+	return temps, nil
+}
+
+// MonthlyAverageTemperature returns the average median temperature of every reading for
+// each month, keyed under day 0 of the month. If 'source' is not empty, only readings
+// reported by that provider are included. Currently filtering by individual 'months' is
+// not implemented.
+func MonthlyAverageTemperature(source string, months ...string) (LocationTemperatureQueryResult, error) {
+	query := `
+		select
+			locations.city_name,
+			date_trunc('month', weather.at_time),
+			avg((weather.temp_low + weather.temp_high) / 2)
+		from locations, weather
+		where
+			locations.city_name is not null
+			and locations.id = weather.location_id
+			and weather.temp_low is not null
+			and weather.temp_high is not null
+			and ($1 = '' or weather.source = $1)
+		group by 1, 2`
+
+	rows, err := GlobalConn.Query(query, source)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var entries entryCounter
+
+	monthlyAvgTemps := LocationTemperatureQueryResult{}
+
+	for rows.Next() {
+		var (
+			cname sql.NullString
+			avg   sql.NullFloat64
+		)
+
+		t := time.Time{}
+
+		if err := rows.Scan(&cname, &t, &avg); err != nil {
+			return nil, err
+		}
+
+		if !cname.Valid || !avg.Valid {
+			continue
+		}
+
+		if err := entries.add(1); err != nil {
+			return nil, err
+		}
+
+		y, m, _ := t.Date()
+		mo := int(m)
+		city := cname.String
+
+		monthlyAvgTemps.InitialiseForDate(city, y, mo, 0)
+		monthlyAvgTemps.Add(avg.Float64, city, y, mo, 0)
+	}
+
+	return monthlyAvgTemps, rows.Err()
+}
+
+// MonthlyMetric returns the stats for each of 'filters' of the 'metric', keyed by filter. For
+// temperatures they're those of MonthlyTemperatureSummary. Humidity and pressure have one value
+// per reading, so their lows and highs are the lowest and highest value in each month, and their
+// averages the average value, each keyed under day 0 of the month. If 'source' is not empty,
+// only readings reported by that provider are included.
+func MonthlyMetric(metric Metric, source string, filters ...TemperatureQueryFilter) (map[TemperatureQueryFilter]LocationTemperatureQueryResult, error) {
+	if metric == MetricTemp {
+		return MonthlyTemperatureSummary(source, filters...)
+	}
+
+	column, supported := metricColumns[metric]
+	if !supported {
+		return nil, fmt.Errorf("unsupported metric: %s", metric)
+	}
+
+	reports, err := newMonthlyReports(filters)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		select
+			city_name,
+			date_trunc('month', at_time),
+			min(value),
+			max(value),
+			avg(value)
+		from (
+			select
+				locations.city_name,
+				weather.at_time,
+				` + selectReadingColumn + ` as value
+			from locations, weather
+			where
+				locations.city_name is not null
+				and locations.id = weather.location_id
+				and ($1 = '' or weather.source = $1)
+		) as readings
+		where value is not null
+		group by 1, 2`
+
+	rows, err := GlobalConn.Query(query, source, string(column))
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	return reports, addMonthlyReports(reports, rows)
+}
+
+// newMonthlyReports returns an empty report for each of 'filters', keyed by filter, or an error
+// if any filter is invalid.
+func newMonthlyReports(filters []TemperatureQueryFilter) (map[TemperatureQueryFilter]LocationTemperatureQueryResult, error) {
+	reports := map[TemperatureQueryFilter]LocationTemperatureQueryResult{}
+
+	for _, f := range filters {
+		switch f {
+		case FilterLows, FilterHighs, FilterAverages:
+			reports[f] = LocationTemperatureQueryResult{}
+		default:
+			return nil, fmt.Errorf("invalid reporting filter: %s", f)
+		}
+	}
+
+	return reports, nil
 }
 
-// TemperatureQueries is a type alias for convenience, represents a list of temperatures.
-type TemperatureQueries []float64
+// addMonthlyReports adds the lowest, highest and average value scanned from each of 'rows', in
+// that order after the location name and month, to the reports of those filters, each keyed
+// under day 0 of the month. Missing values are left out.
+func addMonthlyReports(reports map[TemperatureQueryFilter]LocationTemperatureQueryResult, rows *sql.Rows) error {
+	var entries entryCounter
 
-// DailyTemperatureQuery is another convenience type alias.
-type DailyTemperatureQuery map[int]TemperatureQueries
+	for rows.Next() {
+		var (
+			city                     string
+			t                        time.Time
+			lowest, highest, average sql.NullFloat64
+		)
 
-// MonthlyTemperatureQuery is another convenience type alias.
-type MonthlyTemperatureQuery map[int]DailyTemperatureQuery
+		if err := rows.Scan(&city, &t, &lowest, &highest, &average); err != nil {
+			return err
+		}
 
-// YearlyTemperatureQuery is another convenience type alias.
-type YearlyTemperatureQuery map[int]MonthlyTemperatureQuery
+		y, m, _ := t.Date()
+		mo := int(m)
 
-// LocationTemperatureQueryResult is another convenience type alias. It represents
-// a location - day/month/year JSON structure.
-type LocationTemperatureQueryResult map[string]YearlyTemperatureQuery
+		for f, v := range map[TemperatureQueryFilter]sql.NullFloat64{FilterLows: lowest, FilterHighs: highest, FilterAverages: average} {
+			report, wanted := reports[f]
+			if !wanted || !v.Valid {
+				continue
+			}
 
-// InitialiseForDate is a helper function for ensuring that a key for the specified date is referencing an initialised map.
-func (q LocationTemperatureQueryResult) InitialiseForDate(city string, y int, mo int, d int) {
-	if _, initialised := q[city]; !initialised {
-		q[city] = YearlyTemperatureQuery{}
-	}
-	if _, initialised := q[city][y]; !initialised {
-		q[city][y] = MonthlyTemperatureQuery{}
-	}
+			if err := entries.add(1); err != nil {
+				return err
+			}
 
-	if _, initialised := q[city][y][mo]; !initialised {
-		q[city][y][mo] = DailyTemperatureQuery{}
+			report.InitialiseForDate(city, y, mo, 0)
+			report.Add(v.Float64, city, y, mo, 0)
+		}
 	}
 
-	if _, initialised := q[city][y][mo][d]; !initialised {
-		q[city][y][mo][d] = TemperatureQueries{}
-	}
+	return rows.Err()
 }
 
-// Add appends a temperature to the list of temperatures at day/month/year for a location.
-func (q LocationTemperatureQueryResult) Add(temp float64, city string, y int, mo int, d int) {
-	q[city][y][mo][d] = append(q[city][y][mo][d], temp)
+// TemperatureExtremes is the range of temperatures recorded at a location.
+type TemperatureExtremes struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
 }
 
-// TemperatureQueryFilter is a string constant that defines the available filters
-// for querying temperature statistics.
-type TemperatureQueryFilter string
-
-// Exported temperature statistics query filter enums
-const (
-	FilterLows     TemperatureQueryFilter = "lows"
-	FilterHighs    TemperatureQueryFilter = "highs"
-	FilterAverages TemperatureQueryFilter = "avgs"
-)
-
-// MonthlyTemperature returns location temperature metrics based on the given filter. Currently
-// only supports 'FilterLows' and 'FilterHighs'.
-func MonthlyTemperature(f TemperatureQueryFilter) (LocationTemperatureQueryResult, error) {
-	param := "temp_low"
-
-	switch f {
-	case FilterLows:
-		break
-	case FilterHighs:
-		param = "temp_high"
-	default:
-		return nil, fmt.Errorf("invalid reporting filter: " + string(f))
-	}
-
+// TemperatureExtremesPerCity returns the lowest and highest median temperature ever recorded
+// at each location with readings, keyed by location name. Readings missing either temperature
+// are ignored. If 'source' is not empty, only readings reported by that provider are included.
+func TemperatureExtremesPerCity(source string) (map[string]TemperatureExtremes, error) {
 	query := `
 		select
 			locations.city_name,
-			locations.id,
-			weather.at_time,
-			weather.%s,
-			weather.location_id
+			min((weather.temp_low + weather.temp_high) / 2),
+			max((weather.temp_low + weather.temp_high) / 2)
 		from locations, weather
-		where locations.city_name is not null and locations.id = weather.location_id
-		order by weather.at_time desc`
-
-	rows, err := GlobalConn.Query(fmt.Sprintf(query, param))
+		where
+			locations.id = weather.location_id
+			and locations.city_name is not null
+			and weather.temp_low is not null
+			and weather.temp_high is not null
+			and ($1 = '' or weather.source = $1)
+		group by locations.city_name`
+
+	rows, err := GlobalConn.Query(query, source)
 	if err != nil {
 		return nil, err
 	}
 
-	temps := LocationTemperatureQueryResult{}
+	defer rows.Close()
+
+	extremes := map[string]TemperatureExtremes{}
 
 	for rows.Next() {
 		var (
-			cname sql.NullString
-			id    sql.NullInt64
-			lid   sql.NullInt64
-			temp  sql.NullFloat64
+			cityName string
+			e        TemperatureExtremes
 		)
 
-		t := time.Time{}
-
-		if err := rows.Scan(&cname, &id, &t, &temp, &lid); err != nil {
+		if err := rows.Scan(&cityName, &e.Min, &e.Max); err != nil {
 			return nil, err
 		}
 
-		if !cname.Valid {
-			continue
-		}
-
-		y, m, d := t.Date()
-		mo := int(m)
-		city := cname.String
-
-		temps.InitialiseForDate(city, y, mo, d)
-
-		if !temp.Valid {
-			continue
-		}
-
-		temps.Add(temp.Float64, city, y, mo, d)
+		extremes[cityName] = e
 	}
 
-	return temps, nil
+	return extremes, rows.Err()
 }
 
-// MonthlyAverageTemperature returns the average temperature for all the months. Currently
-// filtering by individual 'months' is not implemented.
-func MonthlyAverageTemperature(months ...string) (LocationTemperatureQueryResult, error) {
+// MonthlyTemperatures returns the results of MonthlyTemperature and MonthlyAverageTemperature
+// for each of 'filters', keyed by filter, from a single scan of the readings rather than one
+// per filter. If 'source' is not empty, only readings reported by that provider are included.
+func MonthlyTemperatures(source string, filters ...TemperatureQueryFilter) (map[TemperatureQueryFilter]LocationTemperatureQueryResult, error) {
+	reports, err := newMonthlyReports(filters)
+	if err != nil {
+		return nil, err
+	}
+
 	query := `
 		select
 			locations.city_name,
-			locations.id,
 			weather.at_time,
 			weather.temp_low,
-			weather.temp_high,
-			weather.location_id
+			weather.temp_high
 		from locations, weather
-		where locations.city_name is not null and locations.id = weather.location_id
+		where
+			locations.city_name is not null
+			and locations.id = weather.location_id
+			and ($1 = '' or weather.source = $1)
 		order by weather.at_time desc`
 
-	rows, err := GlobalConn.Query(query)
+	rows, err := GlobalConn.Query(query, source)
 	if err != nil {
 		return nil, err
 	}
 
-	dailyAvgTemps := LocationTemperatureQueryResult{}
+	defer rows.Close()
+
+	type monthKey struct {
+		city string
+		y    int
+		mo   int
+	}
+
+	type monthTotal struct {
+		sum   float64
+		count int
+	}
+
+	var (
+		entries entryCounter
+		totals  = map[monthKey]*monthTotal{}
+		months  = []monthKey{} // in the order first seen, so averages are added like the other filters
+	)
+
+	lows, wantLows := reports[FilterLows]
+	highs, wantHighs := reports[FilterHighs]
+	_, wantAvgs := reports[FilterAverages]
 
 	for rows.Next() {
 		var (
 			cname  sql.NullString
-			id     sql.NullInt64
-			lid    sql.NullInt64
 			templo sql.NullFloat64
 			temphi sql.NullFloat64
 		)
 
 		t := time.Time{}
 
-		if err := rows.Scan(&cname, &id, &t, &templo, &temphi, &lid); err != nil {
+		if err := rows.Scan(&cname, &t, &templo, &temphi); err != nil {
 			return nil, err
 		}
 
@@ -456,47 +1754,66 @@ func MonthlyAverageTemperature(months ...string) (LocationTemperatureQueryResult
 		mo := int(m)
 		city := cname.String
 
-		dailyAvgTemps.InitialiseForDate(city, y, mo, d)
+		for _, temp := range []struct {
+			want   bool
+			report LocationTemperatureQueryResult
+			value  sql.NullFloat64
+		}{
+			{wantLows, lows, templo},
+			{wantHighs, highs, temphi},
+		} {
+			if !temp.want {
+				continue
+			}
+
+			temp.report.InitialiseForDate(city, y, mo, d)
+
+			if !temp.value.Valid {
+				continue
+			}
+
+			if err := entries.add(1); err != nil {
+				return nil, err
+			}
 
-		if !templo.Valid || !temphi.Valid {
+			temp.report.Add(temp.value.Float64, city, y, mo, d)
+		}
+
+		if !wantAvgs || !templo.Valid || !temphi.Valid {
 			continue
 		}
 
-		mid := (templo.Float64 + temphi.Float64) / 2
+		key := monthKey{city, y, mo}
 
-		dailyAvgTemps.Add(mid, city, y, mo, d)
-	}
+		total, seen := totals[key]
+		if !seen {
+			if err := entries.add(1); err != nil {
+				return nil, err
+			}
 
-	monthlyAvgTemps := LocationTemperatureQueryResult{}
+			total = &monthTotal{}
+			totals[key] = total
+			months = append(months, key)
+		}
 
-	for c, cities := range dailyAvgTemps {
-		for y, year := range cities {
-			for m, month := range year {
-				var (
-					avg             float64
-					samplesPerMonth int
-					samplesPerDay   int
-				)
-
-				for _, day := range month {
-					samplesPerMonth++
-					for _, temp := range day {
-						log.Println(temp)
-						samplesPerDay++
-						avg += temp
-					}
-				}
+		total.sum += (templo.Float64 + temphi.Float64) / 2
+		total.count++
+	}
 
-				avg /= float64(samplesPerDay)
-				avg /= float64(samplesPerMonth)
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
-				monthlyAvgTemps.InitialiseForDate(c, y, m, 0)
-				monthlyAvgTemps.Add(avg, c, y, m, 0)
-			}
+	if avgs, wantAvgs := reports[FilterAverages]; wantAvgs {
+		for _, key := range months {
+			total := totals[key]
+
+			avgs.InitialiseForDate(key.city, key.y, key.mo, 0)
+			avgs.Add(total.sum/float64(total.count), key.city, key.y, key.mo, 0)
 		}
 	}
 
-	return monthlyAvgTemps, nil
+	return reports, nil
 }
 
 // AccountRow represents a database row in the 'accounts' table.
@@ -505,23 +1822,140 @@ type AccountRow struct {
 	ID   sql.NullInt64
 }
 
-// NewAccount creates a new row in the database 'accounts' table.
+// NewAccount creates a new row in the database 'accounts' table. If an account with
+// the same username already exists, the existing row is returned instead so that
+// repeat registrations are idempotent.
 func NewAccount(username string) (*AccountRow, error) {
+	return newAccount(GlobalConn, username)
+}
+
+// rowQuerier is satisfied by both the connection and a transaction, so that rows can be
+// created on their own or as part of a batch.
+type rowQuerier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func newAccount(q rowQuerier, username string) (*AccountRow, error) {
 	query := `
 		insert into accounts (user_name)
 			values ($1)
 			on conflict (user_name)
-				do nothing
+				do update set user_name = excluded.user_name
 		returning
 			id, user_name`
 
 	rowData := &AccountRow{}
-	row := GlobalConn.QueryRow(query, username)
+	row := q.QueryRow(query, username)
 
 	if err := row.Scan(&rowData.ID, &rowData.Name); err != nil {
+		return nil, constraintError(err)
+	}
+
+	return rowData, nil
+}
+
+// BulkAccountResult is the outcome of creating a single account with NewAccounts. If the
+// username was already taken, Conflict is set and Account and Collection are nil.
+type BulkAccountResult struct {
+	Username   string
+	Account    *AccountRow
+	Collection *BookmarkRow
+	Conflict   bool
+}
+
+// NewAccounts creates an account, and its bookmark collection, for each of 'usernames' in a
+// single transaction. Usernames that already exist, or repeat earlier in the list, are
+// skipped and reported as conflicts rather than failing the batch.
+func NewAccounts(usernames ...string) (results []*BulkAccountResult, err error) {
+	txn, err := GlobalConn.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err != nil {
+			txn.Rollback()
+			return
+		}
+
+		err = constraintError(txn.Commit())
+	}()
+
+	rows, err := txn.Query(`select user_name from accounts where user_name = any($1)`, pq.Array(usernames))
+	if err != nil {
+		return nil, err
+	}
+
+	taken := map[string]bool{}
+
+	for rows.Next() {
+		var name sql.NullString
+
+		if err = rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		taken[name.String] = true
+	}
+
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
 		return nil, err
 	}
 
+	for _, username := range usernames {
+		result := &BulkAccountResult{Username: username}
+		results = append(results, result)
+
+		if taken[username] {
+			result.Conflict = true
+			continue
+		}
+
+		taken[username] = true
+
+		if result.Account, err = newAccount(txn, username); err != nil {
+			return nil, err
+		}
+
+		if result.Collection, err = result.Account.newBookmarkCollection(txn); err != nil {
+			return nil, err
+		}
+	}
+
+	return results, nil
+}
+
+// ErrAccountNameTaken is returned when an account username is already in use.
+var ErrAccountNameTaken = errors.New("an account with that username already exists")
+
+// UpdateAccountName renames the account with username 'oldName' to 'newName'. The
+// linked bookmark collection is keyed by account id and so is left untouched. Returns
+// ErrAccountNameTaken if 'newName' belongs to another account.
+func UpdateAccountName(oldName, newName string) (*AccountRow, error) {
+	query := `
+		update accounts
+			set user_name = $2
+		where
+			user_name = $1
+		returning
+			id, user_name`
+
+	rowData := &AccountRow{}
+	row := GlobalConn.QueryRow(query, oldName, newName)
+
+	if err := row.Scan(&rowData.ID, &rowData.Name); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		if isUniqueViolation(err) {
+			return nil, ErrAccountNameTaken
+		}
+		return nil, constraintError(err)
+	}
+
 	return rowData, nil
 }
 
@@ -544,19 +1978,26 @@ func ExistingAccount(username string) (*AccountRow, error) {
 }
 
 // NewBookmarkCollection creates a new row in the database 'bookmarks' table and
-// maps it to the account.
+// maps it to the account. If the account already has a collection, it is returned
+// unchanged.
 func (u *AccountRow) NewBookmarkCollection() (*BookmarkRow, error) {
+	return u.newBookmarkCollection(GlobalConn)
+}
+
+func (u *AccountRow) newBookmarkCollection(q rowQuerier) (*BookmarkRow, error) {
 	query := `
 		insert into bookmarks (id, location_ids)
 			values ($1, $2)
+			on conflict (id)
+				do update set id = excluded.id
 		returning
 			id, location_ids`
 
 	rowData := &BookmarkRow{ID: u.ID}
-	row := GlobalConn.QueryRow(query, rowData.ID, rowData.LocationIDs)
+	row := q.QueryRow(query, rowData.ID, rowData.LocationIDs)
 
 	if err := row.Scan(&rowData.ID, &rowData.LocationIDs); err != nil {
-		return nil, err
+		return nil, constraintError(err)
 	}
 
 	return rowData, nil
@@ -581,6 +2022,7 @@ func (u *AccountRow) GetBookmarkCollectionIDs() (*BookmarkRow, error) {
 }
 
 // UpdateBookmarkCollectionIDs updates a row in the database 'bookmarks' table for the account.
+// If the account has no bookmark collection, nil is returned.
 func (u *AccountRow) UpdateBookmarkCollectionIDs(bookmarks ...int) (*BookmarkRow, error) {
 	query := `
 		update bookmarks
@@ -598,7 +2040,38 @@ func (u *AccountRow) UpdateBookmarkCollectionIDs(bookmarks ...int) (*BookmarkRow
 	row := GlobalConn.QueryRow(query, rowData.ID, rowData.LocationIDs)
 
 	if err := row.Scan(&rowData.LocationIDs); err != nil {
-		return nil, err
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, constraintError(err)
+	}
+
+	return rowData, nil
+}
+
+// ReplaceBookmarkCollectionIDs replaces the location ids of the account's row in the database
+// 'bookmarks' table with exactly 'bookmarks'.
+func (u *AccountRow) ReplaceBookmarkCollectionIDs(bookmarks ...int) (*BookmarkRow, error) {
+	query := `
+		update bookmarks
+			set location_ids = $2
+		where
+			id = $1
+		returning location_ids`
+
+	ids := []int64{}
+	for _, b := range bookmarks {
+		ids = append(ids, int64(b))
+	}
+
+	rowData := &BookmarkRow{ID: u.ID, LocationIDs: pq.Int64Array(ids)}
+	row := GlobalConn.QueryRow(query, rowData.ID, rowData.LocationIDs)
+
+	if err := row.Scan(&rowData.LocationIDs); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, constraintError(err)
 	}
 
 	return rowData, nil
@@ -610,6 +2083,23 @@ type BookmarkRow struct {
 	LocationIDs pq.Int64Array
 }
 
+// AllBookmarks returns every location bookmarked by any account, without duplicates, as a
+// single 'bookmarks' table row with no id.
+func AllBookmarks() (*BookmarkRow, error) {
+	query := `
+		select
+			coalesce(array_agg(distinct location_id), '{}')
+		from bookmarks, unnest(location_ids) as location_id`
+
+	b := &BookmarkRow{}
+
+	if err := GlobalConn.QueryRow(query).Scan(&b.LocationIDs); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
 // NamesFromIDs generate a list of location names given the location ids of the 'bookmarks' table row
 func (b *BookmarkRow) NamesFromIDs() ([]string, error) {
 	query := `select city_name from locations where id = any($1)`
@@ -636,6 +2126,43 @@ func (b *BookmarkRow) NamesFromIDs() ([]string, error) {
 	return names, nil
 }
 
+// BookmarkedLocation is a location in a bookmark collection, by id and name.
+type BookmarkedLocation struct {
+	ID       int64
+	CityName string
+}
+
+// LocationsFromIDs is as NamesFromIDs, but pairs each name with its location id, in the order
+// the locations were bookmarked.
+func (b *BookmarkRow) LocationsFromIDs() ([]BookmarkedLocation, error) {
+	query := `
+		select
+			locations.id, locations.city_name
+		from unnest($1::integer[]) with ordinality as bookmarked(id, position)
+			join locations on locations.id = bookmarked.id
+		order by bookmarked.position`
+
+	rows, err := GlobalConn.Query(query, b.LocationIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	locs := []BookmarkedLocation{}
+
+	for rows.Next() {
+		var loc BookmarkedLocation
+
+		if err := rows.Scan(&loc.ID, &loc.CityName); err != nil {
+			return nil, err
+		}
+
+		locs = append(locs, loc)
+	}
+
+	return locs, rows.Err()
+}
+
 // IDsFromNames maps location ids from the given location names
 func IDsFromNames(names ...string) ([]int, error) {
 	query := `select id from locations where city_name = any($1)`
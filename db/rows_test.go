@@ -0,0 +1,1631 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func setupDB(t testing.TB) {
+	const (
+		maxNumRetries    = 3
+		retryIntervalSec = 1
+	)
+
+	if err := GlobalConn.Establish(maxNumRetries, retryIntervalSec); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := GlobalConn.ExecFrom("../data/init.db.sql"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// seedWeather inserts 'numCities' locations and spreads 'numReadings' weather rows across
+// them, one reading a minute going back from now.
+func seedWeather(t testing.TB, numCities, numReadings int) {
+	query := `
+		insert into locations (city_name, query_count)
+			select 'City ' || i, 1
+			from generate_series(1, $1) as i`
+
+	if _, err := GlobalConn.Exec(query, numCities); err != nil {
+		t.Fatal(err)
+	}
+
+	query = `
+		insert into weather (location_id, labels, temp_high, temp_low, source, at_time)
+			select
+				(i % $1) + 1,
+				array['Clear'],
+				290 + (i % 10),
+				280 + (i % 10),
+				'openweather',
+				now() - (i || ' minutes')::interval
+			from generate_series(1, $2) as i`
+
+	if _, err := GlobalConn.Exec(query, numCities, numReadings); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHotQueriesWithinBudget(t *testing.T) {
+	const (
+		numCities   = 50
+		numReadings = 20000
+		budget      = 2 * time.Second
+	)
+
+	setupDB(t)
+	seedWeather(t, numCities, numReadings)
+
+	var hotQueries = []struct {
+		label string
+		query func() error
+	}{
+		{"location weather", func() error { _, err := FetchLocationWeather(context.Background(), "City 1"); return err }},
+		{"daily summary", func() error { _, err := DailyWeatherSummary("", nil); return err }},
+		{"monthly lows", func() error { _, err := MonthlyTemperature(FilterLows, ""); return err }},
+		{"monthly averages", func() error { _, err := MonthlyAverageTemperature(""); return err }},
+	}
+
+	for _, tc := range hotQueries {
+		t.Run(tc.label, func(t *testing.T) {
+			start := time.Now()
+
+			if err := tc.query(); err != nil {
+				t.Fatal(err)
+			}
+
+			if elapsed := time.Since(start); elapsed > budget {
+				t.Errorf("have: %s want: under %s", elapsed, budget)
+			}
+		})
+	}
+}
+
+func TestWeatherQueriesUseIndexes(t *testing.T) {
+	setupDB(t)
+
+	ctx := context.Background()
+
+	// planner settings are per session, so keep them on one connection
+	conn, err := GlobalConn.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the test tables are tiny, so stop the planner from preferring a sequential scan
+	if _, err := conn.ExecContext(ctx, `set enable_seqscan = off`); err != nil {
+		t.Fatal(err)
+	}
+
+	var explainTestCases = []struct {
+		label string
+		query string
+		index string
+	}{
+		{"weather by location", `explain select * from weather where location_id = 1`, "weather_location_id_idx"},
+		{"weather by time", `explain select max(at_time) from weather`, "weather_at_time_idx"},
+		{"locations by name", `explain select * from locations where city_name = 'London'`, "locations_city_name_key"},
+	}
+
+	for _, tc := range explainTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			rows, err := conn.QueryContext(ctx, tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+
+			plan := []string{}
+
+			for rows.Next() {
+				var line string
+				if err := rows.Scan(&line); err != nil {
+					t.Fatal(err)
+				}
+				plan = append(plan, line)
+			}
+
+			if !strings.Contains(strings.Join(plan, "\n"), tc.index) {
+				t.Errorf("have plan: %v want index: %s", plan, tc.index)
+			}
+		})
+	}
+}
+
+var benchmarkSizes = []struct {
+	label       string
+	numCities   int
+	numReadings int
+}{
+	{"1k readings", 10, 1000},
+	{"10k readings", 50, 10000},
+	{"100k readings", 100, 100000},
+}
+
+func BenchmarkMonthlyTemperature(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(size.label, func(b *testing.B) {
+			setupDB(b)
+			seedWeather(b, size.numCities, size.numReadings)
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, err := MonthlyTemperature(FilterLows, ""); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMonthlyAverageTemperature(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(size.label, func(b *testing.B) {
+			setupDB(b)
+			seedWeather(b, size.numCities, size.numReadings)
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, err := MonthlyAverageTemperature(""); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkAllMonthlyTemperatures compares fetching lows, highs and averages with a query
+// each against computing them together from a single query.
+func BenchmarkAllMonthlyTemperatures(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(size.label, func(b *testing.B) {
+			setupDB(b)
+			seedWeather(b, size.numCities, size.numReadings)
+
+			b.Run("separate queries", func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if _, err := MonthlyTemperature(FilterLows, ""); err != nil {
+						b.Fatal(err)
+					}
+					if _, err := MonthlyTemperature(FilterHighs, ""); err != nil {
+						b.Fatal(err)
+					}
+					if _, err := MonthlyAverageTemperature(""); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+
+			b.Run("single query", func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if _, err := MonthlyTemperatures("", FilterLows, FilterHighs, FilterAverages); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func seedReading(t testing.TB, cityName string, low, high float64, at time.Time) {
+	if _, err := SeedWeather(cityName, low, high, at, "Clear"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMonthlyAverageTemperature(t *testing.T) {
+	setupDB(t)
+
+	date := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 12, 0, 0, 0, time.UTC) }
+
+	seedReading(t, "Testville", 270, 280, date(2019, time.March, 1))
+	seedReading(t, "Testville", 280, 290, date(2019, time.March, 1))
+	seedReading(t, "Testville", 290, 300, date(2019, time.March, 15))
+	seedReading(t, "Testville", 300, 310, date(2019, time.April, 2))
+
+	avgs, err := MonthlyAverageTemperature("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var monthlyAvgTestCases = []struct {
+		label string
+		month int
+		want  float64
+	}{
+		{"average over several days", 3, (275.0 + 285.0 + 295.0) / 3},
+		{"average of a single reading", 4, 305.0},
+	}
+
+	for _, tc := range monthlyAvgTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			have := avgs["Testville"][2019][tc.month][0]
+			if len(have) != 1 || have[0] != tc.want {
+				t.Errorf("have: %v want: %v", have, tc.want)
+			}
+		})
+	}
+}
+
+func TestMonthlyMetric(t *testing.T) {
+	setupDB(t)
+
+	date := func(m time.Month, d int) time.Time { return time.Date(2019, m, d, 12, 0, 0, 0, time.UTC) }
+
+	var readings = []struct {
+		at                 time.Time
+		humidity, pressure interface{}
+	}{
+		{date(time.March, 1), 40, 1010},
+		{date(time.March, 9), 60, 1020},
+		{date(time.March, 20), 80, nil}, // pressure wasn't reported
+		{date(time.April, 2), 55, 1000},
+	}
+
+	for _, r := range readings {
+		wr, err := SeedWeather("Humidville", 270, 280, r.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		query := `update weather set humidity = $3, pressure = $4 where location_id = $1 and at_time = $2`
+
+		if _, err := GlobalConn.Exec(query, wr.LocationRowID, wr.AtTime, r.humidity, r.pressure); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var metricTestCases = []struct {
+		metric Metric
+		filter TemperatureQueryFilter
+		month  int
+		want   float64
+	}{
+		{MetricHumidity, FilterAverages, 3, 60},
+		{MetricHumidity, FilterLows, 3, 40},
+		{MetricHumidity, FilterHighs, 3, 80},
+		{MetricHumidity, FilterAverages, 4, 55},
+		{MetricPressure, FilterAverages, 3, 1015},
+		{MetricPressure, FilterHighs, 4, 1000},
+	}
+
+	for _, tc := range metricTestCases {
+		t.Run(fmt.Sprintf("%s %s in month %d", tc.metric, tc.filter, tc.month), func(t *testing.T) {
+			reports, err := MonthlyMetric(tc.metric, "", tc.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			have := reports[tc.filter]["Humidville"][2019][tc.month][0]
+			if len(have) != 1 || math.Abs(have[0]-tc.want) > 0.01 {
+				t.Errorf("have: %v want: %v", have, tc.want)
+			}
+		})
+	}
+
+	if _, err := MonthlyMetric(Metric("wind"), "", FilterAverages); err == nil {
+		t.Errorf("have: %v want: an unsupported metric error", err)
+	}
+}
+
+func TestMonthlyTemperatureSummary(t *testing.T) {
+	setupDB(t)
+
+	date := func(m time.Month, d int) time.Time { return time.Date(2019, m, d, 12, 0, 0, 0, time.UTC) }
+
+	seedReading(t, "Testville", 270, 280, date(time.March, 1))
+	seedReading(t, "Testville", 280, 300, date(time.March, 15))
+	seedReading(t, "Testville", 300, 310, date(time.April, 2))
+
+	reports, err := MonthlyMetric(MetricTemp, "", FilterLows, FilterHighs, FilterAverages)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reports[FilterAverages]) != 0 {
+		t.Errorf("have: %v want: nothing before the summary is refreshed", reports[FilterAverages])
+	}
+
+	if _, err := RefreshStatsSummary(); err != nil {
+		t.Fatal(err)
+	}
+
+	reports, err = MonthlyMetric(MetricTemp, "", FilterLows, FilterHighs, FilterAverages)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var summaryTestCases = []struct {
+		filter TemperatureQueryFilter
+		month  int
+		want   float64
+	}{
+		{FilterLows, 3, 270},
+		{FilterHighs, 3, 300},
+		{FilterAverages, 3, 282.5},
+		{FilterAverages, 4, 305},
+	}
+
+	for _, tc := range summaryTestCases {
+		t.Run(fmt.Sprintf("%s in month %d", tc.filter, tc.month), func(t *testing.T) {
+			have := reports[tc.filter]["Testville"][2019][tc.month][0]
+			if len(have) != 1 || math.Abs(have[0]-tc.want) > 0.01 {
+				t.Errorf("have: %v want: %v", have, tc.want)
+			}
+		})
+	}
+}
+
+func TestDailyWeatherSummaryDates(t *testing.T) {
+	setupDB(t)
+
+	date := func(d int) time.Time { return time.Date(2019, time.March, d, 0, 0, 0, 0, time.UTC) }
+
+	seedReading(t, "Firstville", 270, 280, date(1).Add(12*time.Hour))
+	seedReading(t, "Secondville", 270, 280, date(2).Add(12*time.Hour))
+	seedReading(t, "Thirdville", 270, 280, date(3).Add(12*time.Hour))
+
+	var datesTestCases = []struct {
+		label string
+		dates *DateRange
+		want  []string
+	}{
+		{"single day", &DateRange{date(2), date(3)}, []string{"Secondville"}},
+		{"range of days", &DateRange{date(1), date(3)}, []string{"Secondville", "Firstville"}},
+		{"open ended range", &DateRange{From: date(2)}, []string{"Thirdville", "Secondville"}},
+		{"most recent day by default", nil, []string{"Thirdville"}},
+	}
+
+	for _, tc := range datesTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			summary, err := DailyWeatherSummary("", tc.dates)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			have := []string{}
+			for _, seen := range summary["Clear"] {
+				have = append(have, seen.(struct {
+					CityName string
+					Date     time.Time
+				}).CityName)
+			}
+
+			if strings.Join(have, ",") != strings.Join(tc.want, ",") {
+				t.Errorf("have: %v want: %v", have, tc.want)
+			}
+		})
+	}
+}
+
+func TestMonthlyTemperaturesMatchSeparateQueries(t *testing.T) {
+	setupDB(t)
+
+	date := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 12, 0, 0, 0, time.UTC) }
+
+	seedReading(t, "Testville", 270, 280, date(2019, time.March, 1))
+	seedReading(t, "Testville", 280, 290, date(2019, time.March, 15))
+	seedReading(t, "Otherville", 300, 310, date(2019, time.April, 2))
+
+	reports, err := MonthlyTemperatures("", FilterLows, FilterHighs, FilterAverages)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lows, _ := MonthlyTemperature(FilterLows, "")
+	highs, _ := MonthlyTemperature(FilterHighs, "")
+	avgs, _ := MonthlyAverageTemperature("")
+
+	var filterTestCases = []struct {
+		filter TemperatureQueryFilter
+		want   LocationTemperatureQueryResult
+	}{
+		{FilterLows, lows},
+		{FilterHighs, highs},
+		{FilterAverages, avgs},
+	}
+
+	for _, tc := range filterTestCases {
+		t.Run(string(tc.filter), func(t *testing.T) {
+			if have := reports[tc.filter]; fmt.Sprint(have) != fmt.Sprint(tc.want) {
+				t.Errorf("have: %v want: %v", have, tc.want)
+			}
+		})
+	}
+
+	if _, err := MonthlyTemperatures("", "medians"); err == nil {
+		t.Error("have: nil want: an invalid filter error")
+	}
+}
+
+func TestAverageTemperatureByLabel(t *testing.T) {
+	setupDB(t)
+
+	at := time.Date(2019, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	var readings = []struct {
+		low, high float64
+		labels    []string
+	}{
+		{270, 280, []string{"Rain"}},         // median 275
+		{280, 290, []string{"Rain", "Mist"}}, // median 285
+		{290, 300, []string{"Clear"}},        // median 295
+		{300, 310, []string{"Clear"}},        // median 305
+	}
+
+	for i, r := range readings {
+		if _, err := SeedWeather("Labelville", r.low, r.high, at.Add(time.Duration(i)*time.Hour), r.labels...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	averages, err := AverageTemperatureByLabel("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]float64{
+		"Rain":  280, // (275 + 285) / 2
+		"Mist":  285,
+		"Clear": 300, // (295 + 305) / 2
+	}
+
+	if len(averages) != len(want) {
+		t.Errorf("have: %v want: %v", averages, want)
+	}
+
+	for label, avg := range want {
+		if math.Abs(averages[label]-avg) > 0.01 {
+			t.Errorf("have: %v want: %v for %s", averages[label], avg, label)
+		}
+	}
+
+	averages, err = AverageTemperatureByLabel("unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(averages) != 0 {
+		t.Errorf("have: %v want: no labels", averages)
+	}
+}
+
+func TestWeatherDownsampled(t *testing.T) {
+	setupDB(t)
+
+	at := func(h, m int) time.Time { return time.Date(2019, time.March, 4, h, m, 0, 0, time.UTC) }
+
+	// two readings in the first hour, none in the second, three in the third
+	var readings = []struct {
+		at        time.Time
+		low, high float64
+	}{
+		{at(10, 0), 270, 280},
+		{at(10, 30), 272, 282},
+		{at(12, 0), 280, 290},
+		{at(12, 20), 281, 291},
+		{at(12, 40), 282, 292},
+	}
+
+	for _, r := range readings {
+		if _, err := SeedWeather("Downsampleville", r.low, r.high, r.at); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var downsampleTestCases = []struct {
+		label    string
+		from, to time.Time
+		bucket   time.Duration
+		want     []DownsampledReading
+	}{
+		{"hourly", time.Time{}, time.Time{}, time.Hour, []DownsampledReading{
+			{at(10, 0), 276},
+			{at(12, 0), 286},
+		}},
+		{"from the range's start", at(10, 30), time.Time{}, 2 * time.Hour, []DownsampledReading{
+			{at(10, 30), 282.67},
+			{at(12, 30), 287},
+		}},
+		{"within the range", time.Time{}, at(12, 30), 24 * time.Hour, []DownsampledReading{
+			{time.Date(2019, time.March, 4, 0, 0, 0, 0, time.UTC), 280.75},
+		}},
+	}
+
+	for _, tc := range downsampleTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			have, err := WeatherDownsampled(context.Background(), "Downsampleville", tc.from, tc.to, tc.bucket)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(have) != len(tc.want) {
+				t.Fatalf("have: %v want: %v", have, tc.want)
+			}
+
+			for i := range have {
+				if !have[i].Bucket.Equal(tc.want[i].Bucket) || math.Abs(have[i].AvgMid-tc.want[i].AvgMid) > 0.01 {
+					t.Errorf("have: %v want: %v", have[i], tc.want[i])
+				}
+			}
+		})
+	}
+
+	if _, err := WeatherDownsampled(context.Background(), "Downsampleville", time.Time{}, time.Time{}, time.Millisecond); err == nil {
+		t.Errorf("have: %v want: a bucket too small error", err)
+	}
+}
+
+func TestReadingCountsByDay(t *testing.T) {
+	setupDB(t)
+
+	day := func(d, h int) time.Time { return time.Date(2019, time.March, d, h, 0, 0, 0, time.UTC) }
+
+	// three readings on the 4th, none on the 5th, one on the 6th and two on the 7th
+	for _, at := range []time.Time{day(4, 1), day(4, 12), day(4, 23), day(6, 8), day(7, 0), day(7, 18)} {
+		if _, err := SeedWeather("Sparkville", 270, 280, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := SeedWeather("Elsewhere", 270, 280, day(5, 12)); err != nil {
+		t.Fatal(err)
+	}
+
+	var countTestCases = []struct {
+		label    string
+		from, to time.Time
+		want     map[string]int
+	}{
+		{"every day", time.Time{}, time.Time{}, map[string]int{"2019-03-04": 3, "2019-03-06": 1, "2019-03-07": 2}},
+		{"within the range", day(4, 12), day(7, 0), map[string]int{"2019-03-04": 2, "2019-03-06": 1}},
+		{"no readings", day(8, 0), time.Time{}, map[string]int{}},
+	}
+
+	for _, tc := range countTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			have, err := ReadingCountsByDay(context.Background(), "Sparkville", tc.from, tc.to)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(have, tc.want) {
+				t.Errorf("have: %v want: %v", have, tc.want)
+			}
+		})
+	}
+}
+
+func TestDominantLabelPerCity(t *testing.T) {
+	setupDB(t)
+
+	at := time.Date(2019, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	var readings = []struct {
+		cityName string
+		labels   []string
+	}{
+		{"Cloudville", []string{"Clouds"}},
+		{"Cloudville", []string{"Clouds", "Rain"}},
+		{"Cloudville", []string{"Rain"}},
+		{"Cloudville", []string{"Clouds"}},
+		{"Tieville", []string{"Snow"}},
+		{"Tieville", []string{"Mist"}}, // tied with snow, but first alphabetically
+		{"Tieville", []string{"Snow", "Mist"}},
+		{"Blankville", []string{}},
+	}
+
+	for i, r := range readings {
+		if _, err := SeedWeather(r.cityName, 270, 280, at.Add(time.Duration(i)*time.Hour), r.labels...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	have, err := DominantLabelPerCity("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"Cloudville": "Clouds",
+		"Tieville":   "Mist",
+	}
+
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("have: %v want: %v", have, want)
+	}
+
+	have, err = DominantLabelPerCity("unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(have) != 0 {
+		t.Errorf("have: %v want: no locations", have)
+	}
+}
+
+func TestLabelCountsByPeriod(t *testing.T) {
+	setupDB(t)
+
+	date := func(m time.Month, d int) time.Time { return time.Date(2019, m, d, 12, 0, 0, 0, time.UTC) }
+
+	var readings = []struct {
+		at     time.Time
+		labels []string
+	}{
+		{date(time.March, 4), []string{"Rain"}}, // a monday
+		{date(time.March, 4), []string{"Rain", "Mist"}},
+		{date(time.March, 5), []string{"Clear"}},
+		{date(time.March, 11), []string{"Rain"}},
+		{date(time.April, 2), []string{"Clear"}},
+	}
+
+	for _, r := range readings {
+		if _, err := SeedWeather("Countingville", 280, 290, r.at, r.labels...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var labelCountTestCases = []struct {
+		granularity string
+		source      string
+		from, to    time.Time
+		want        map[string]map[string]int
+	}{
+		{"day", "", time.Time{}, time.Time{}, map[string]map[string]int{
+			"2019-03-04": {"Rain": 2, "Mist": 1},
+			"2019-03-05": {"Clear": 1},
+			"2019-03-11": {"Rain": 1},
+			"2019-04-02": {"Clear": 1},
+		}},
+		{"week", "", time.Time{}, time.Time{}, map[string]map[string]int{
+			"2019-03-04": {"Rain": 2, "Mist": 1, "Clear": 1},
+			"2019-03-11": {"Rain": 1},
+			"2019-04-01": {"Clear": 1},
+		}},
+		{"month", "", time.Time{}, time.Time{}, map[string]map[string]int{
+			"2019-03-01": {"Rain": 3, "Mist": 1, "Clear": 1},
+			"2019-04-01": {"Clear": 1},
+		}},
+		{"month", "", date(time.March, 5), date(time.April, 1), map[string]map[string]int{
+			"2019-03-01": {"Rain": 1, "Clear": 1},
+		}},
+		{"month", "seed", date(time.April, 1), time.Time{}, map[string]map[string]int{
+			"2019-04-01": {"Clear": 1},
+		}},
+		{"month", "unknown", time.Time{}, time.Time{}, map[string]map[string]int{}},
+	}
+
+	for _, tc := range labelCountTestCases {
+		counts, err := LabelCountsByPeriod(tc.granularity, tc.source, tc.from, tc.to)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(counts, tc.want) {
+			t.Errorf("have: %v want: %v for %s from %q", counts, tc.want, tc.granularity, tc.source)
+		}
+	}
+
+	if _, err := LabelCountsByPeriod("hour", "", time.Time{}, time.Time{}); err == nil {
+		t.Errorf("have: %v want: an unsupported granularity error", err)
+	}
+}
+
+func TestTemperatureExtremesPerCity(t *testing.T) {
+	setupDB(t)
+
+	at := time.Date(2019, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	seedReading(t, "Hotville", 290, 300, at)                   // median 295
+	seedReading(t, "Hotville", 300, 320, at.AddDate(0, 1, 0))  // median 310
+	seedReading(t, "Hotville", 280, 300, at.AddDate(0, 2, 0))  // median 290
+	seedReading(t, "Coldville", 250, 260, at)                  // median 255
+	seedReading(t, "Coldville", 260, 270, at.AddDate(1, 0, 0)) // median 265
+
+	extremes, err := TemperatureExtremesPerCity("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]TemperatureExtremes{
+		"Hotville":  {Min: 290, Max: 310},
+		"Coldville": {Min: 255, Max: 265},
+	}
+
+	if len(extremes) != len(want) {
+		t.Errorf("have: %v want: %v", extremes, want)
+	}
+
+	for cityName, e := range want {
+		have := extremes[cityName]
+
+		if math.Abs(have.Min-e.Min) > 0.01 || math.Abs(have.Max-e.Max) > 0.01 {
+			t.Errorf("have: %v want: %v for %s", have, e, cityName)
+		}
+	}
+
+	extremes, err = TemperatureExtremesPerCity("unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(extremes) != 0 {
+		t.Errorf("have: %v want: no locations", extremes)
+	}
+}
+
+func TestWeatherStatsCoverage(t *testing.T) {
+	setupDB(t)
+
+	first := time.Date(2019, time.March, 1, 12, 0, 0, 0, time.UTC)
+	last := time.Date(2019, time.March, 20, 12, 0, 0, 0, time.UTC)
+
+	seedReading(t, "Aville", 270, 280, first)
+	seedReading(t, "Aville", 275, 285, first.Add(24*time.Hour))
+	seedReading(t, "Bville", 280, 290, last)
+
+	c, err := WeatherStatsCoverage("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Locations != 2 || c.Readings != 3 || !c.From.Time.Equal(first) || !c.To.Time.Equal(last) {
+		t.Errorf("have: %+v want: 2 locations, 3 readings from %s to %s", c, first, last)
+	}
+
+	c, err = WeatherStatsCoverage("unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Locations != 0 || c.Readings != 0 || c.From.Valid || c.To.Valid {
+		t.Errorf("have: %+v want: no readings", c)
+	}
+}
+
+func TestWeatherAsOf(t *testing.T) {
+	setupDB(t)
+
+	noon := time.Date(2019, time.March, 1, 12, 0, 0, 0, time.Local)
+
+	seedReading(t, "Asofville", 260, 270, noon.Add(-2*time.Hour))
+	seedReading(t, "Asofville", 270, 280, noon)
+	seedReading(t, "Asofville", 280, 290, noon.Add(2*time.Hour))
+	seedReading(t, "Otherville", 290, 300, noon.Add(-time.Hour))
+
+	var asOfTestCases = []struct {
+		label string
+		at    time.Time
+		want  float64 // the low temp, 0 if there's no reading
+	}{
+		{"exactly at a reading", noon, 270},
+		{"between readings", noon.Add(time.Hour), 270},
+		{"after every reading", noon.Add(24 * time.Hour), 280},
+		{"just after the first reading", noon.Add(-time.Hour), 260},
+		{"before every reading", noon.Add(-3 * time.Hour), 0},
+		{"in another time zone", noon.Add(time.Hour).In(time.FixedZone("UTC+10", 10*60*60)), 270},
+	}
+
+	for _, tc := range asOfTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			wr, err := WeatherAsOf(context.Background(), "Asofville", tc.at)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.want == 0 {
+				if wr != nil {
+					t.Errorf("have: %+v want: %v", wr, nil)
+				}
+				return
+			}
+
+			if wr == nil || wr.TempLow.Float64 != tc.want {
+				t.Errorf("have: %+v want: the reading with a low of %v", wr, tc.want)
+			}
+		})
+	}
+}
+
+func TestLatestWeatherForAllLocations(t *testing.T) {
+	setupDB(t)
+
+	now := time.Now()
+
+	for _, city := range []string{"Aville", "Bville", "Cville"} {
+		seedReading(t, city, 260, 270, now.Add(-2*time.Hour))
+		seedReading(t, city, 280, 290, now) // the latest
+		seedReading(t, city, 270, 280, now.Add(-time.Hour))
+	}
+
+	seedReading(t, "Dville", 280, 290, now.Add(-3*time.Hour))
+
+	var pageTestCases = []struct {
+		label  string
+		since  time.Time
+		limit  int
+		offset int
+		want   []string
+	}{
+		{"every location", time.Time{}, 10, 0, []string{"Aville", "Bville", "Cville", "Dville"}},
+		{"first page", time.Time{}, 2, 0, []string{"Aville", "Bville"}},
+		{"second page", time.Time{}, 2, 2, []string{"Cville", "Dville"}},
+		{"fresh locations", now.Add(-time.Hour), 10, 0, []string{"Aville", "Bville", "Cville"}},
+	}
+
+	for _, tc := range pageTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			latest, err := LatestWeatherForAllLocations(context.Background(), tc.since, tc.limit, tc.offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			have := []string{}
+			for _, lw := range latest {
+				if lw.Weather.TempLow.Float64 != 280 {
+					t.Errorf("have: %+v want: the latest reading at %s", lw.Weather, lw.Location.CityName.String)
+				}
+				have = append(have, lw.Location.CityName.String)
+			}
+
+			if strings.Join(have, ",") != strings.Join(tc.want, ",") {
+				t.Errorf("have: %v want: %v", have, tc.want)
+			}
+		})
+	}
+}
+
+func TestExtremeCachedLocation(t *testing.T) {
+	setupDB(t)
+
+	if lr, wr, err := ExtremeCachedLocation(context.Background(), true, time.Time{}); err != nil || lr != nil || wr != nil {
+		t.Fatalf("have: %v, %v, %v want: nothing cached", lr, wr, err)
+	}
+
+	now := time.Now()
+
+	seedReading(t, "Hotville", 300, 310, now)
+	seedReading(t, "Mildville", 280, 290, now)
+	seedReading(t, "Coldville", 400, 410, now.Add(-time.Hour)) // no longer the latest reading
+	seedReading(t, "Coldville", 250, 260, now)
+	seedReading(t, "Frostville", 200, 210, now.Add(-3*time.Hour))
+
+	var extremeTestCases = []struct {
+		label   string
+		warmest bool
+		since   time.Time
+		want    string
+	}{
+		{"warmest", true, time.Time{}, "Hotville"},
+		{"coldest", false, time.Time{}, "Frostville"},
+		{"coldest fresh", false, now.Add(-time.Hour), "Coldville"},
+	}
+
+	for _, tc := range extremeTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			lr, _, err := ExtremeCachedLocation(context.Background(), tc.warmest, tc.since)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if lr == nil || lr.CityName.String != tc.want {
+				t.Errorf("have: %+v want: %s", lr, tc.want)
+			}
+		})
+	}
+}
+
+func TestSeededWeatherIsLatest(t *testing.T) {
+	setupDB(t)
+
+	if _, err := SeedLocation("Seedville", 51.5, -0.13); err != nil {
+		t.Fatal(err)
+	}
+
+	at := time.Date(2019, time.March, 29, 21, 0, 0, 0, time.UTC)
+
+	seedReading(t, "Seedville", 270, 280, at.Add(-time.Hour))
+	seedReading(t, "Seedville", 275, 285, at)
+
+	latest, err := LatestLocationWeather("Seedville")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wr, found := latest["Seedville"]
+	if !found || !wr.AtTime.Equal(at) || wr.TempLow.Float64 != 275 {
+		t.Errorf("have: %+v want: reading at %s", wr, at)
+	}
+}
+
+func TestReadingsAreTakenAtTheClockTime(t *testing.T) {
+	defer func(f func() time.Time) { nowFunc = f }(nowFunc)
+
+	setupDB(t)
+
+	at := time.Date(2019, time.March, 29, 21, 0, 0, 0, time.UTC)
+	nowFunc = func() time.Time { return at }
+
+	reading := &WeatherRow{
+		TempLow:  sql.NullFloat64{Float64: 270, Valid: true},
+		TempHigh: sql.NullFloat64{Float64: 280, Valid: true},
+	}
+
+	q, err := UpdateCachedLocationWeather(context.Background(), "Clockville", reading)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if wr := q["weather"].(*WeatherRow); !wr.AtTime.Equal(at) {
+		t.Errorf("have: %s want: %s", wr.AtTime, at)
+	}
+}
+
+func TestEnsureLocation(t *testing.T) {
+	setupDB(t)
+
+	lr, err := EnsureLocation("Ensureville", 51.5, -0.12)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := lr.IncrQueryCount(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// again, with new coordinates, which are updated without touching the query count
+	again, err := EnsureLocation("Ensureville", 40.7, -74)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if again.ID != lr.ID || again.QueryCount.Int64 != 1 {
+		t.Errorf("have: %+v want: the same location queried once", again)
+	}
+
+	var (
+		locations, readings int
+		lat, lon            float64
+	)
+
+	if err := GlobalConn.QueryRow(`select count(*), min(lat), min(lon) from locations`).Scan(&locations, &lat, &lon); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := GlobalConn.QueryRow(`select count(*) from weather`).Scan(&readings); err != nil {
+		t.Fatal(err)
+	}
+
+	if locations != 1 || readings != 0 || math.Abs(lat-40.7) > 0.001 || math.Abs(lon+74) > 0.001 {
+		t.Errorf("have: %d locations at %v,%v with %d readings want: 1 location at 40.7,-74 with no readings", locations, lat, lon, readings)
+	}
+}
+
+func TestUpdateCachedLocationWeatherReturnsTemps(t *testing.T) {
+	setupDB(t)
+
+	reading := &WeatherRow{
+		TempLow:  sql.NullFloat64{Float64: 5, Valid: true},
+		TempHigh: sql.NullFloat64{Float64: 25, Valid: true},
+	}
+
+	q, err := UpdateCachedLocationWeather(context.Background(), "Returnville", reading)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if wr := q["weather"].(*WeatherRow); wr.TempLow.Float64 != 5 || wr.TempHigh.Float64 != 25 {
+		t.Errorf("have: low %v high %v want: low %v high %v", wr.TempLow.Float64, wr.TempHigh.Float64, 5, 25)
+	}
+
+	var low, high float64
+
+	if err := GlobalConn.QueryRow(`select temp_low, temp_high from weather`).Scan(&low, &high); err != nil {
+		t.Fatal(err)
+	}
+
+	if low != 5 || high != 25 {
+		t.Errorf("have: stored low %v high %v want: low %v high %v", low, high, 5, 25)
+	}
+}
+
+func TestUpdateCachedLocationWeatherAfterDeadline(t *testing.T) {
+	setupDB(t)
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	q, err := UpdateCachedLocationWeather(ctx, "Lateville", &WeatherRow{})
+	if err == nil || q != nil {
+		t.Fatalf("have: %v, %v want: the deadline error and no result", q, err)
+	}
+
+	var n int
+
+	if err := GlobalConn.QueryRow(`select count(*) from weather`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 0 {
+		t.Errorf("have: %d readings want: none stored", n)
+	}
+}
+
+func TestInvertedTemperaturesAreSwapped(t *testing.T) {
+	setupDB(t)
+
+	var tempTestCases = []struct {
+		label     string
+		city      string
+		low, high float64
+	}{
+		{"ordered temperatures", "Orderville", 270, 280},
+		{"inverted temperatures", "Invertville", 280, 270},
+		{"equal temperatures", "Evenville", 275, 275},
+	}
+
+	for _, tc := range tempTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			reading := &WeatherRow{
+				TempLow:  sql.NullFloat64{Float64: tc.low, Valid: true},
+				TempHigh: sql.NullFloat64{Float64: tc.high, Valid: true},
+			}
+
+			q, err := UpdateCachedLocationWeather(context.Background(), tc.city, reading)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := [2]float64{math.Min(tc.low, tc.high), math.Max(tc.low, tc.high)}
+
+			// both the returned row and the stored row, so that the returning clause is checked too
+			returned := q["weather"].(*WeatherRow)
+
+			latest, err := LatestLocationWeather(tc.city)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, wr := range []*WeatherRow{returned, latest[tc.city]} {
+				if have := [2]float64{wr.TempLow.Float64, wr.TempHigh.Float64}; have != want {
+					t.Errorf("have: %v want: %v", have, want)
+				}
+			}
+		})
+	}
+}
+
+func TestOrderTemps(t *testing.T) {
+	wr := &WeatherRow{
+		TempLow:  sql.NullFloat64{Float64: 280, Valid: true},
+		TempHigh: sql.NullFloat64{Valid: false},
+	}
+
+	if wr.orderTemps() {
+		t.Errorf("have: swapped want: a missing temperature left alone")
+	}
+
+	wr.TempHigh = sql.NullFloat64{Float64: 270, Valid: true}
+
+	if !wr.orderTemps() || wr.TempLow.Float64 != 270 || wr.TempHigh.Float64 != 280 {
+		t.Errorf("have: %+v want: low 270 high 280", wr)
+	}
+
+	if wr.orderTemps() {
+		t.Errorf("have: swapped want: ordered temperatures left alone")
+	}
+}
+
+func TestStatsResultLimit(t *testing.T) {
+	defer func(n int) { MaxStatsEntries = n }(MaxStatsEntries)
+
+	setupDB(t)
+	seedWeather(t, 5, 50)
+
+	MaxStatsEntries = 10
+
+	if _, err := MonthlyTemperature(FilterLows, ""); err == nil {
+		t.Errorf("have: nil want: %v", &ResultTooLargeError{MaxStatsEntries})
+	} else if _, tooLarge := err.(*ResultTooLargeError); !tooLarge {
+		t.Errorf("have: %v want: %v", err, &ResultTooLargeError{MaxStatsEntries})
+	}
+}
+
+func TestConcurrentQueryCountIncrements(t *testing.T) {
+	const numRequests = 50
+
+	setupDB(t)
+
+	lr, err := SeedLocation("Countville", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < numRequests; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			row := &LocationRow{CityName: lr.CityName}
+
+			if err := row.IncrQueryCount(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	var count int
+
+	if err := GlobalConn.QueryRow(`select query_count from locations where city_name = $1`, "Countville").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+
+	if count != numRequests {
+		t.Errorf("have: %d want: %d", count, numRequests)
+	}
+}
+
+func TestFetchLocationWeatherByID(t *testing.T) {
+	setupDB(t)
+
+	now := time.Now()
+
+	seedReading(t, "Idville", 270, 280, now.Add(-time.Hour))
+	seedReading(t, "Idville", 275, 285, now)
+
+	byName, err := FetchLocationWeather(context.Background(), "Idville")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if byName == nil {
+		t.Fatalf("have: %v want: the location and its weather by name", byName)
+	}
+
+	lr, wr := byName["location"].(*LocationRow), byName["weather"].(*WeatherRow)
+
+	byID, err := FetchLocationWeatherByID(context.Background(), lr.ID.Int64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if byID == nil || byID.Weather == nil {
+		t.Fatalf("have: %v want: the location and its weather", byID)
+	}
+
+	var fieldTestCases = []struct {
+		field      string
+		have, want interface{}
+	}{
+		{"location id", byID.Location.ID, lr.ID},
+		{"city name", byID.Location.CityName, lr.CityName},
+		{"query count", byID.Location.QueryCount, lr.QueryCount},
+		{"weather location id", byID.Weather.LocationRowID, wr.LocationRowID},
+		{"temp high", byID.Weather.TempHigh, wr.TempHigh},
+		{"temp low", byID.Weather.TempLow, wr.TempLow},
+		{"labels", byID.Weather.Labels, wr.Labels},
+		{"source", byID.Weather.Source, wr.Source},
+		{"base", byID.Weather.Base, wr.Base},
+		{"wind speed", byID.Weather.WindSpeed, wr.WindSpeed},
+		{"wind deg", byID.Weather.WindDeg, wr.WindDeg},
+		{"visibility", byID.Weather.Visibility, wr.Visibility},
+		{"clouds", byID.Weather.Clouds, wr.Clouds},
+		{"humidity", byID.Weather.Humidity, wr.Humidity},
+		{"pressure", byID.Weather.Pressure, wr.Pressure},
+		{"at time", byID.Weather.AtTime, wr.AtTime},
+	}
+
+	for _, tc := range fieldTestCases {
+		if !reflect.DeepEqual(tc.have, tc.want) {
+			t.Errorf("%s: have: %v want: %v", tc.field, tc.have, tc.want)
+		}
+	}
+
+	if wr.TempHigh.Float64 != 285 { // the latest reading
+		t.Errorf("have: %v want: %v", wr.TempHigh.Float64, 285)
+	}
+
+	empty, err := SeedLocation("Emptyville", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byID, err = FetchLocationWeatherByID(context.Background(), empty.ID.Int64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if byID == nil || byID.Location.CityName.String != "Emptyville" || byID.Weather != nil {
+		t.Errorf("have: %+v want: the location without weather", byID)
+	}
+
+	byID, err = FetchLocationWeatherByID(context.Background(), empty.ID.Int64+100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if byID != nil {
+		t.Errorf("have: %+v want: %v", byID, nil)
+	}
+}
+
+func TestQueriesAreRecordedAsEvents(t *testing.T) {
+	setupDB(t)
+
+	lr, err := SeedLocation("Eventville", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := lr.IncrQueryCount(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := IncrLocationQueryCount(context.Background(), "Eventville"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := UpdateCachedLocationWeather(context.Background(), "Eventville", &WeatherRow{}); err != nil {
+		t.Fatal(err)
+	}
+
+	counts, err := QueryCountsSince(time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if counts["Eventville"] != 3 {
+		t.Errorf("have: %v want: %v", counts["Eventville"], 3)
+	}
+}
+
+func TestRollupQueryCounts(t *testing.T) {
+	setupDB(t)
+
+	defer func(f func() time.Time) { nowFunc = f }(nowFunc)
+
+	then := time.Date(2018, 10, 1, 12, 0, 0, 0, time.Local)
+	nowFunc = func() time.Time { return then }
+
+	lr, err := SeedLocation("Rollupville", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := lr.IncrQueryCount(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	nowFunc = func() time.Time { return then.Add(time.Hour) }
+
+	if err := lr.IncrQueryCount(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := GlobalConn.Exec(`update locations set query_count = 42 where city_name = $1`, "Rollupville"); err != nil {
+		t.Fatal(err)
+	}
+
+	corrected, err := RollupQueryCounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if corrected != 1 {
+		t.Errorf("have: %v want: %v", corrected, 1)
+	}
+
+	var count int
+
+	if err := GlobalConn.QueryRow(`select query_count from locations where city_name = $1`, "Rollupville").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 4 {
+		t.Errorf("have: %v want: %v", count, 4)
+	}
+
+	corrected, err = RollupQueryCounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if corrected != 0 {
+		t.Errorf("have: %v want: %v", corrected, 0)
+	}
+
+	counts, err := QueryCountsSince(then.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if counts["Rollupville"] != 1 {
+		t.Errorf("have: %v want: %v", counts["Rollupville"], 1)
+	}
+}
+
+func TestPurgeWeatherOlderThan(t *testing.T) {
+	setupDB(t)
+
+	now := time.Now()
+
+	seedReading(t, "Purgeville", 270, 280, now.Add(-48*time.Hour))
+	seedReading(t, "Purgeville", 270, 280, now.Add(-36*time.Hour))
+	seedReading(t, "Purgeville", 270, 280, now.Add(-time.Hour))
+
+	purged, err := PurgeWeatherOlderThan(24 * time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if purged != 2 {
+		t.Errorf("have: %d want: %d", purged, 2)
+	}
+
+	latest, err := LatestLocationWeather("Purgeville")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if wr, found := latest["Purgeville"]; !found || now.Sub(wr.AtTime) > 24*time.Hour {
+		t.Errorf("have: %+v want: the recent reading", wr)
+	}
+
+	if _, err := MonthlyAverageTemperature(""); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStaleLocations(t *testing.T) {
+	setupDB(t)
+
+	now := time.Now()
+
+	seedReading(t, "Freshville", 270, 280, now.Add(-48*time.Hour))
+	seedReading(t, "Freshville", 270, 280, now.Add(-time.Minute)) // refreshed recently
+	seedReading(t, "Staleville", 270, 280, now.Add(-2*time.Hour))
+	seedReading(t, "Stalerville", 270, 280, now.Add(-3*time.Hour))
+
+	if _, err := SeedLocation("Emptyville", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	stale, err := StaleLocations(context.Background(), time.Hour, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var have []string
+
+	for _, sl := range stale {
+		have = append(have, sl.Location.CityName.String)
+
+		if now.Sub(sl.LatestReading) < time.Hour {
+			t.Errorf("have: %v want: a reading older than an hour for %s", sl.LatestReading, sl.Location.CityName.String)
+		}
+	}
+
+	want := []string{"Stalerville", "Staleville"} // the longest unrefreshed first
+
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("have: %v want: %v", have, want)
+	}
+}
+
+func TestCompactWeather(t *testing.T) {
+	setupDB(t)
+
+	start := time.Date(2019, time.March, 1, 12, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time { return start.Add(time.Duration(minutes) * time.Minute) }
+
+	seedReading(t, "Compactville", 270, 280, at(0))
+	seedReading(t, "Compactville", 270, 280, at(5))  // duplicate
+	seedReading(t, "Compactville", 270, 280, at(10)) // duplicate
+	seedReading(t, "Compactville", 275, 285, at(15)) // distinct temps
+	seedReading(t, "Compactville", 270, 280, at(20)) // distinct from the reading before it
+	seedReading(t, "Compactville", 270, 280, at(60)) // outside the window
+	seedReading(t, "Otherville", 270, 280, at(5))    // another location
+
+	if _, err := SeedWeather("Compactville", 270, 280, at(65), "Rain"); err != nil { // distinct labels
+		t.Fatal(err)
+	}
+
+	removed, err := CompactWeather(10 * time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if removed != 2 {
+		t.Errorf("have: %d want: %d", removed, 2)
+	}
+
+	removed, err = CompactWeather(10 * time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if removed != 0 {
+		t.Errorf("have: %d want: %d on the second run", removed, 0)
+	}
+
+	var remaining int
+
+	if err := GlobalConn.QueryRow(`select count(*) from weather`).Scan(&remaining); err != nil {
+		t.Fatal(err)
+	}
+
+	if remaining != 6 {
+		t.Errorf("have: %d want: %d", remaining, 6)
+	}
+}
+
+func TestConcurrentStatsRefreshIsRejected(t *testing.T) {
+	statsRefreshing <- struct{}{} // as if another refresh is running
+	defer func() { <-statsRefreshing }()
+
+	if _, err := RefreshStatsSummary(); err != ErrStatsRefreshInProgress {
+		t.Errorf("have: %v want: %v", err, ErrStatsRefreshInProgress)
+	}
+}
+
+func TestTemperatureSeries(t *testing.T) {
+	nested := LocationTemperatureQueryResult{}
+
+	var readings = []struct {
+		temp float64
+		y    int
+		mo   int
+		d    int
+	}{
+		{290, 2019, 4, 2},
+		{270, 2018, 12, 31},
+		{280, 2019, 3, 15},
+		{281, 2019, 3, 15},
+		{275, 2019, 3, 1},
+		{285, 2019, 2, 0}, // a monthly temperature
+	}
+
+	for _, r := range readings {
+		nested.InitialiseForDate("Testville", r.y, r.mo, r.d)
+		nested.Add(r.temp, "Testville", r.y, r.mo, r.d)
+	}
+
+	points := nested.Series()["Testville"]
+
+	if len(points) != len(readings) {
+		t.Fatalf("have: %d points want: %d", len(points), len(readings))
+	}
+
+	for i, p := range points {
+		if i > 0 && points[i-1].Date > p.Date {
+			t.Errorf("have: %s before %s want: sorted by date", points[i-1].Date, p.Date)
+		}
+
+		var y, mo, d int // d is left 0 for a month
+		fmt.Sscanf(strings.Replace(p.Date, "-", " ", -1), "%d %d %d", &y, &mo, &d)
+
+		found := false
+		for _, temp := range nested["Testville"][y][mo][d] {
+			found = found || temp == p.Value
+		}
+
+		if !found {
+			t.Errorf("have: %+v want: a value from %v", p, nested["Testville"][y][mo][d])
+		}
+	}
+
+	if points[0].Date != "2018-12-31" || points[1].Date != "2019-02" || points[3].Value != 280 || points[4].Value != 281 {
+		t.Errorf("have: %+v want: points in date order, same day values in the order added", points)
+	}
+}
+
+func TestAllBookmarks(t *testing.T) {
+	setupDB(t)
+
+	var ids []int
+
+	for _, cityName := range []string{"Markville", "Pinville", "Flagville"} {
+		lr, err := SeedLocation(cityName, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids = append(ids, int(lr.ID.Int64))
+	}
+
+	for i, bookmarks := range [][]int{{ids[0], ids[1]}, {ids[1], ids[2]}, {}} {
+		acc, err := NewAccount(fmt.Sprintf("bookmarker%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := acc.NewBookmarkCollection(); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := acc.UpdateBookmarkCollectionIDs(bookmarks...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	all, err := AllBookmarks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := all.NamesFromIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(names)
+
+	want := []string{"Flagville", "Markville", "Pinville"}
+
+	if !reflect.DeepEqual(names, want) || len(all.LocationIDs) != len(want) {
+		t.Errorf("have: %v (%v) want: %v", names, all.LocationIDs, want)
+	}
+}
+
+func TestBookmarkedLocationsFromIDs(t *testing.T) {
+	setupDB(t)
+
+	var want []BookmarkedLocation
+
+	for _, cityName := range []string{"Markville", "Pinville"} {
+		lr, err := SeedLocation(cityName, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want = append(want, BookmarkedLocation{lr.ID.Int64, cityName})
+	}
+
+	acc, err := NewAccount("exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := acc.NewBookmarkCollection(); err != nil {
+		t.Fatal(err)
+	}
+
+	col, err := acc.UpdateBookmarkCollectionIDs(int(want[1].ID), int(want[0].ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	have, err := col.LocationsFromIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// in the order bookmarked, not by id
+	want[0], want[1] = want[1], want[0]
+
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("have: %v want: %v", have, want)
+	}
+}
@@ -0,0 +1,55 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// SeedLocation inserts a location directly into the 'locations' table, or updates the
+// coordinates of an existing one. It is meant for setting up precise test data without
+// going through the openweather api.
+func SeedLocation(cityName string, lat, lon float64) (*LocationRow, error) {
+	return EnsureLocation(cityName, lat, lon)
+}
+
+// SeedWeather inserts a weather reading taken at 'at' directly into the 'weather' table,
+// creating the location, without coordinates, if it doesn't exist. It is meant for setting
+// up precise test data without going through the openweather api.
+func SeedWeather(cityName string, low, high float64, at time.Time, labels ...string) (*WeatherRow, error) {
+	query := `
+		insert into locations (city_name, query_count)
+			values ($1, 0)
+		on conflict (city_name) do
+			update
+				set city_name = excluded.city_name
+		returning
+			id`
+
+	var id sql.NullInt64
+
+	if err := GlobalConn.QueryRow(query, cityName).Scan(&id); err != nil {
+		return nil, err
+	}
+
+	query = `
+		insert into weather (location_id, labels, temp_low, temp_high, source, at_time)
+			values ($1, $2, $3, $4, 'seed', $5)
+		returning
+			location_id, labels, temp_high, temp_low, source, at_time`
+
+	wr := &WeatherRow{}
+
+	if err := GlobalConn.QueryRow(query, id, pq.StringArray(labels), low, high, at).Scan(
+		&wr.LocationRowID,
+		&wr.Labels,
+		&wr.TempHigh,
+		&wr.TempLow,
+		&wr.Source,
+		&wr.AtTime); err != nil {
+		return nil, err
+	}
+
+	return wr, nil
+}
@@ -0,0 +1,191 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrStatsRefreshInProgress is returned by RefreshStatsSummary when another refresh is
+// already running.
+var ErrStatsRefreshInProgress = errors.New("a stats summary refresh is already in progress")
+
+// statsRefreshing is held for the duration of a refresh so that two refreshes don't stomp
+// each other.
+var statsRefreshing = make(chan struct{}, 1)
+
+// TemperatureSummary holds aggregate temperatures over a period of time.
+type TemperatureSummary struct {
+	Avg      float64
+	Min      float64
+	Max      float64
+	Readings int
+}
+
+// MonthlySummaryQuery is a convenience type alias, mapping months to a summary.
+type MonthlySummaryQuery map[int]*TemperatureSummary
+
+// YearlySummaryQuery is another convenience type alias.
+type YearlySummaryQuery map[int]MonthlySummaryQuery
+
+// LocationSummaryQueryResult is another convenience type alias. It represents
+// a location - month/year JSON structure.
+type LocationSummaryQueryResult map[string]YearlySummaryQuery
+
+// RefreshStatsSummary recomputes the per-location, per-month aggregates in the
+// 'weather_stats_monthly' table from the full 'weather' table, so that summary stats
+// don't need to scan every reading on each request. It returns the number of location-month
+// buckets recomputed, or ErrStatsRefreshInProgress if another refresh is running.
+func RefreshStatsSummary() (buckets int64, err error) {
+	select {
+	case statsRefreshing <- struct{}{}:
+		defer func() { <-statsRefreshing }()
+	default:
+		return 0, ErrStatsRefreshInProgress
+	}
+
+	txn, err := GlobalConn.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		if err != nil {
+			txn.Rollback()
+			return
+		}
+
+		err = txn.Commit()
+	}()
+
+	if _, err = txn.Exec(`delete from weather_stats_monthly`); err != nil {
+		return 0, err
+	}
+
+	query := `
+		insert into weather_stats_monthly (location_id, source, month, temp_avg, temp_min, temp_max, readings)
+			select
+				location_id,
+				coalesce(source, ''),
+				date_trunc('month', at_time),
+				avg((temp_low + temp_high) / 2),
+				min(temp_low),
+				max(temp_high),
+				count(*)
+			from weather
+			group by 1, 2, 3`
+
+	res, err := txn.Exec(query)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// MonthlyWeatherSummary returns the average, minimum and maximum temperature per location
+// per month, as of the last call to RefreshStatsSummary. If 'source' is not empty, only
+// readings reported by that provider are included.
+func MonthlyWeatherSummary(source string) (LocationSummaryQueryResult, error) {
+	query := `
+		select
+			locations.city_name,
+			weather_stats_monthly.month,
+			sum(weather_stats_monthly.temp_avg * weather_stats_monthly.readings) / sum(weather_stats_monthly.readings),
+			min(weather_stats_monthly.temp_min),
+			max(weather_stats_monthly.temp_max),
+			sum(weather_stats_monthly.readings)
+		from locations, weather_stats_monthly
+		where
+			locations.id = weather_stats_monthly.location_id
+			and ($1 = '' or weather_stats_monthly.source = $1)
+		group by locations.city_name, weather_stats_monthly.month`
+
+	rows, err := GlobalConn.Query(query, source)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var entries entryCounter
+
+	summary := LocationSummaryQueryResult{}
+
+	for rows.Next() {
+		var (
+			cname    sql.NullString
+			avg      sql.NullFloat64
+			min      sql.NullFloat64
+			max      sql.NullFloat64
+			readings sql.NullInt64
+		)
+
+		t := time.Time{}
+
+		if err := rows.Scan(&cname, &t, &avg, &min, &max, &readings); err != nil {
+			return nil, err
+		}
+
+		if !cname.Valid {
+			continue
+		}
+
+		if err := entries.add(1); err != nil {
+			return nil, err
+		}
+
+		city := cname.String
+		y, m, _ := t.Date()
+
+		if _, initialised := summary[city]; !initialised {
+			summary[city] = YearlySummaryQuery{}
+		}
+
+		if _, initialised := summary[city][y]; !initialised {
+			summary[city][y] = MonthlySummaryQuery{}
+		}
+
+		summary[city][y][int(m)] = &TemperatureSummary{
+			Avg:      avg.Float64,
+			Min:      min.Float64,
+			Max:      max.Float64,
+			Readings: int(readings.Int64),
+		}
+	}
+
+	return summary, rows.Err()
+}
+
+// MonthlyTemperatureSummary returns the lowest low, highest high and average median temperature
+// per location per month for each of 'filters', keyed by filter, each keyed under day 0 of the
+// month, as of the last call to RefreshStatsSummary. If 'source' is not empty, only readings
+// reported by that provider are included.
+func MonthlyTemperatureSummary(source string, filters ...TemperatureQueryFilter) (map[TemperatureQueryFilter]LocationTemperatureQueryResult, error) {
+	reports, err := newMonthlyReports(filters)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		select
+			locations.city_name,
+			weather_stats_monthly.month,
+			min(weather_stats_monthly.temp_min),
+			max(weather_stats_monthly.temp_max),
+			sum(weather_stats_monthly.temp_avg * weather_stats_monthly.readings) / nullif(sum(weather_stats_monthly.readings) filter (where weather_stats_monthly.temp_avg is not null), 0)
+		from locations, weather_stats_monthly
+		where
+			locations.id = weather_stats_monthly.location_id
+			and ($1 = '' or weather_stats_monthly.source = $1)
+		group by locations.city_name, weather_stats_monthly.month`
+
+	rows, err := GlobalConn.Query(query, source)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	return reports, addMonthlyReports(reports, rows)
+}
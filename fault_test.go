@@ -0,0 +1,63 @@
+//go:build faultinject
+// +build faultinject
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/msawangwan/weather/api"
+	"github.com/msawangwan/weather/cache"
+	"github.com/msawangwan/weather/db"
+)
+
+func TestInjectedFailures(t *testing.T) {
+	state := &testContext{}
+	if err := state.setup(); err != nil {
+		t.Fatal(err)
+	}
+	defer state.teardown()
+
+	defer func(c cache.Cache) { weatherCache = c }(weatherCache)
+
+	errInjected := errors.New("injected failure")
+
+	var failureTestCases = []struct {
+		label      string
+		resource   string
+		inject     func()
+		wantStatus int
+	}{
+		{"db failure", "/api/v1/location/weather/all", func() { db.InjectFailure(1, errInjected) }, http.StatusInternalServerError},
+		{"upstream failure", "/api/v1/location/weather?city=New+York", func() { api.InjectFailure(1, errInjected) }, http.StatusInternalServerError},
+		{"upstream forecast failure", "/api/v1/location/forecast?city=New+York", func() { api.InjectFailure(1, errInjected) }, http.StatusInternalServerError},
+	}
+
+	for _, tc := range failureTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			defer db.ResetFailures()
+			defer api.ResetFailures()
+
+			weatherCache = cache.NewMemory()
+
+			tc.inject()
+
+			res, err := state.c.Get(state.mockServer.URL + tc.resource)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			state.c.ReadFrom(res.Body)
+			res.Body.Close()
+			body := state.c.String()
+			state.c.Buffer.Reset()
+
+			score(t, body, errInjected, func() bool {
+				return res.StatusCode == tc.wantStatus && strings.Contains(body, errInjected.Error())
+			})
+		})
+	}
+}
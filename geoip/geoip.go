@@ -0,0 +1,123 @@
+// Package geoip defines an interface for locating IP addresses, with an implementation that
+// looks them up in a table of networks loaded from a file, in the manner of the MaxMind city
+// databases, so that weather can be reported near a client without it giving its coordinates.
+package geoip
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrNotFound is returned when an address can't be located.
+var ErrNotFound = errors.New("no location known for the address")
+
+// Locator finds the coordinates of IP addresses.
+type Locator interface {
+	// Locate returns the latitude and longitude of 'ip', or ErrNotFound.
+	Locate(ip net.IP) (lat, lon float64, err error)
+}
+
+// None is a locator that knows no addresses. It is used when geolocation isn't configured so
+// that callers don't need to nil check.
+type None struct{}
+
+// Locate always returns ErrNotFound.
+func (None) Locate(ip net.IP) (float64, float64, error) { return 0, 0, ErrNotFound }
+
+type network struct {
+	*net.IPNet
+	lat, lon float64
+}
+
+// Networks locates addresses by the network they belong to, the most specific network
+// containing an address giving its coordinates.
+type Networks struct {
+	networks []network
+}
+
+// ReadNetworks reads a table of networks, one per line, as a CIDR block and its latitude and
+// longitude separated by commas, e.g. "81.2.69.0/24,51.5142,-0.0931". Blank lines and lines
+// starting with '#' are skipped.
+func ReadNetworks(r io.Reader) (*Networks, error) {
+	n := &Networks{}
+
+	scanner := bufio.NewScanner(r)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Split(text, ",")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected 'network,lat,lon': %q", line, text)
+		}
+
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(fields[0]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+
+		lat, err := strconv.ParseFloat(strings.TrimSpace(fields[1]), 64)
+		if err != nil || lat < -90 || lat > 90 {
+			return nil, fmt.Errorf("line %d: invalid latitude: %q", line, fields[1])
+		}
+
+		lon, err := strconv.ParseFloat(strings.TrimSpace(fields[2]), 64)
+		if err != nil || lon < -180 || lon > 180 {
+			return nil, fmt.Errorf("line %d: invalid longitude: %q", line, fields[2])
+		}
+
+		n.networks = append(n.networks, network{ipNet, lat, lon})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+// OpenNetworks reads a table of networks from the file at 'path', see ReadNetworks.
+func OpenNetworks(path string) (*Networks, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return ReadNetworks(f)
+}
+
+// Locate returns the coordinates of the most specific network containing 'ip', or ErrNotFound
+// if none does.
+func (n *Networks) Locate(ip net.IP) (float64, float64, error) {
+	var (
+		best     *network
+		bestSize = -1
+	)
+
+	for i := range n.networks {
+		if !n.networks[i].Contains(ip) {
+			continue
+		}
+
+		if size, _ := n.networks[i].Mask.Size(); size > bestSize {
+			best, bestSize = &n.networks[i], size
+		}
+	}
+
+	if best == nil {
+		return 0, 0, ErrNotFound
+	}
+
+	return best.lat, best.lon, nil
+}
@@ -0,0 +1,58 @@
+package geoip
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+const testNetworks = `
+# network,lat,lon
+81.2.0.0/16,51.5,-0.1
+81.2.69.0/24,51.5142,-0.0931
+2001:db8::/32,39.5,-119.8
+`
+
+func TestNetworksLocate(t *testing.T) {
+	n, err := ReadNetworks(strings.NewReader(testNetworks))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var locateTestCases = []struct {
+		ip       string
+		lat, lon float64
+		err      error
+	}{
+		{"81.2.69.160", 51.5142, -0.0931, nil}, // the most specific network wins
+		{"81.2.1.1", 51.5, -0.1, nil},
+		{"2001:db8::1", 39.5, -119.8, nil},
+		{"10.0.0.1", 0, 0, ErrNotFound},
+	}
+
+	for _, tc := range locateTestCases {
+		lat, lon, err := n.Locate(net.ParseIP(tc.ip))
+		if lat != tc.lat || lon != tc.lon || err != tc.err {
+			t.Errorf("have: %v,%v %v want: %v,%v %v for %s", lat, lon, err, tc.lat, tc.lon, tc.err, tc.ip)
+		}
+	}
+}
+
+func TestReadNetworksRejectsMalformedLines(t *testing.T) {
+	for _, line := range []string{
+		"81.2.69.0/24,51.5",
+		"81.2.69.0,51.5,-0.1",
+		"81.2.69.0/24,95,-0.1",
+		"81.2.69.0/24,51.5,west",
+	} {
+		if _, err := ReadNetworks(strings.NewReader(line)); err == nil {
+			t.Errorf("have: %v want: an error for %q", err, line)
+		}
+	}
+}
+
+func TestNoneLocatesNothing(t *testing.T) {
+	if _, _, err := (None{}).Locate(net.ParseIP("81.2.69.160")); err != ErrNotFound {
+		t.Errorf("have: %v want: %v", err, ErrNotFound)
+	}
+}
@@ -5,5 +5,6 @@ require (
 	github.com/ianlancetaylor/demangle v0.0.0-20181102032728-5e5cf60278f6 // indirect
 	github.com/lib/pq v1.0.0
 	golang.org/x/arch v0.0.0-20190312162104-788fe5ffcd8c // indirect
+	golang.org/x/text v0.3.0
 	golang.org/x/tools v0.0.0-20190330180304-aef51cc3777c
 )
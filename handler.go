@@ -1,444 +1,3868 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"log"
+	"math"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/msawangwan/weather/api"
+	"github.com/msawangwan/weather/cache"
 	"github.com/msawangwan/weather/db"
+	"github.com/msawangwan/weather/geoip"
+	"github.com/msawangwan/weather/units"
 )
 
 const (
-	cacheTTLMinutes = 1
+	refreshWaitAttempts = 10
+	refreshWaitInterval = 100 * time.Millisecond
 )
 
+// nowFunc returns the current time. Tests replace it to control the cache TTL decision.
 var (
-	errMethodMustBeGET       = errors.New("HTTP method must be GET")
-	errMethodMustBePOST      = errors.New("HTTP method must be POST")
-	errMethodMustBeGETorPOST = errors.New("HTTP method must be GET or POST")
+	nowFunc = time.Now
 )
 
+// cacheTTL is how long a reading is fresh for, after which the weather at its location is
+// fetched again from the openweather api. It can be overridden from the environment on startup.
+var (
+	cacheTTL = time.Minute
+)
+
+// cacheControl sets a Cache-Control header on location weather responses, so that clients and
+// intermediaries don't ask again before the reading is due a refresh. It can be disabled from
+// the environment on startup.
+var (
+	cacheControl = true
+)
+
+// readThroughOnly stops fresh readings from the openweather api being written to the database,
+// so that a replica serving analytics doesn't skew a primary's stats. They are still reported.
+// Readings are written unless it's configured from the environment on startup.
+var (
+	readThroughOnly = false
+)
+
+// requestTimeout is the time budget for handling a single request, including any database
+// queries and upstream api calls. It can be overridden from the environment on startup.
+var (
+	requestTimeout = 10 * time.Second
+)
+
+// weatherCache sits in front of the database for location weather. Caching is disabled
+// unless a backend is configured from the environment on startup.
+var (
+	weatherCache cache.Cache = cache.None{}
+)
+
+// defaultCity is the location reported when a location weather request doesn't name one.
+// Requests must name a location unless it's configured from the environment on startup.
+var (
+	defaultCity = ""
+)
+
+// nearbyRadiusKm is how far from the requested coordinate a cached location may be and still
+// be reported by the nearby cached weather endpoint. It can be overridden from the environment
+// on startup.
+var (
+	nearbyRadiusKm = 50.0
+)
+
+// trustedProxies are the addresses of proxies in front of the service, whose forwarding headers
+// are believed when finding a client's address, see clientIP. No proxies are trusted unless
+// they're configured from the environment on startup.
+var (
+	trustedProxies []*net.IPNet
+)
+
+// adminToken authenticates requests to admin endpoints, which clients send as a bearer
+// token. Admin endpoints are disabled unless it's configured from the environment on startup.
+var (
+	adminToken = ""
+)
+
+// maxBatchCities caps the number of locations in a single batch weather request. It can be
+// overridden from the environment on startup.
+var (
+	maxBatchCities = 20
+)
+
+// tempPrecision is the number of decimal places temperatures are rounded to in responses. It
+// can be overridden from the environment on startup.
+var (
+	tempPrecision = 2
+)
+
+var (
+	errRequestTimedOut = errors.New("request timed out waiting on a dependency")
+	errCityRequired    = errors.New("city parameter required")
+)
+
+var (
+	errAdminDisabled     = errors.New("admin endpoints are disabled")
+	errAdminUnauthorized = errors.New("missing or invalid admin token")
+)
+
+var (
+	errBodyEmpty     = errors.New("request body is empty")
+	errBodyMalformed = errors.New("malformed JSON")
+)
+
+var (
+	errUsernameEmpty   = errors.New("username must not be empty")
+	errUsernameTooLong = fmt.Errorf("username must be at most %d characters", maxUsernameLength)
+)
+
+const (
+	maxUsernameLength = 255 // matches the accounts.user_name column width
+)
+
+// weatherReport is the JSON payload sent to clients for the weather at a location. Optional
+// fields are pointers, so that fields missing from older readings are omitted, not zeroed.
+type weatherReport struct {
+	CityName   string   `json:"city_name,omitempty"`
+	Conditions []string `json:"conditions,omitempty"`
+	LowTemp    *float64 `json:"low_temp,omitempty"`
+	HighTemp   *float64 `json:"high_temp,omitempty"`
+	MedianTemp *float64 `json:"median_temp,omitempty"`
+	Wind       *wind    `json:"wind,omitempty"`
+	Visibility *int64   `json:"visibility,omitempty"` // meters
+	Clouds     *int64   `json:"clouds,omitempty"`     // cloud cover percentage
+	Provider   *string  `json:"provider,omitempty"`   // where the reading came from
+	Base       *string  `json:"base,omitempty"`       // the provider's model or station data behind the reading
+	AtTime     jsonTime `json:"at_time,omitempty"`
+}
+
+// weatherShapeCompact is the value of the shape query parameter that has lists of weather
+// written as compactWeather, rather than as objects.
+const weatherShapeCompact = "compact"
+
+// compactWeather writes a report to JSON as a positional array rather than an object, about
+// halving the size of lists of weather for clients short of bandwidth. The fields are, in
+// order: city name, low, high and median temperatures, conditions and the time of the reading,
+// e.g. ["Reno", 270.1, 282.3, 276.2, ["Clear"], "2019-03-29T17:04:05Z"]. Missing temperatures
+// are null.
+type compactWeather struct {
+	*weatherReport
+}
+
+func (c compactWeather) MarshalJSON() ([]byte, error) {
+	conditions := c.Conditions
+	if conditions == nil {
+		conditions = []string{}
+	}
+
+	return json.Marshal([]interface{}{
+		c.CityName,
+		c.LowTemp,
+		c.HighTemp,
+		c.MedianTemp,
+		conditions,
+		c.AtTime,
+	})
+}
+
+// parseWeatherShape reads the optional shape query parameter of a list of weather, reporting
+// whether the list should be compact.
+func parseWeatherShape(params url.Values) (compact bool, err error) {
+	switch shape := params.Get("shape"); shape {
+	case "":
+		return false, nil
+	case weatherShapeCompact:
+		return true, nil
+	default:
+		return false, errors.New("unsupported shape: " + shape)
+	}
+}
+
+// newWeatherReport builds a report for a location from a 'weather' table row.
+func newWeatherReport(cityName string, wr *db.WeatherRow) *weatherReport {
+	return &weatherReport{
+		cityName,
+		wr.Labels,
+		nullableTemp(wr.TempLow),
+		nullableTemp(wr.TempHigh),
+		nullableTemp(sql.NullFloat64{
+			Float64: (wr.TempLow.Float64 + wr.TempHigh.Float64) / 2, // uh-oh, overflow (jk, unlikely but this would be somthing to test huh)
+			Valid:   wr.TempLow.Valid && wr.TempHigh.Valid,
+		}),
+		newWind(wr.WindSpeed, wr.WindDeg),
+		nullableInt(wr.Visibility),
+		nullableInt(wr.Clouds),
+		nullableString(wr.Source),
+		nullableString(wr.Base),
+		jsonTime{wr.AtTime},
+	}
+}
+
+// wind is the wind speed, in meters per second, and direction at a location.
+type wind struct {
+	Speed     float64 `json:"speed"`
+	Deg       float64 `json:"deg"`
+	Direction string  `json:"direction"`
+}
+
+func newWind(speed, deg sql.NullFloat64) *wind {
+	if !speed.Valid || !deg.Valid {
+		return nil
+	}
+
+	return &wind{speed.Float64, deg.Float64, units.DegreesToCompass(deg.Float64)}
+}
+
+// temperature is a single temperature given in every supported unit.
+type temperature struct {
+	Kelvin     float64 `json:"kelvin"`
+	Celsius    float64 `json:"celsius"`
+	Fahrenheit float64 `json:"fahrenheit"`
+}
+
+func newTemperature(kelvin float64) temperature {
+	return temperature{
+		roundTemp(kelvin),
+		roundTemp(units.KelvinToCelsius(kelvin)),
+		roundTemp(units.KelvinToFahrenheit(kelvin)),
+	}
+}
+
+// newNullableTemperature is newTemperature for a temperature that may be missing, in which
+// case nil is returned.
+func newNullableTemperature(kelvin *float64) *temperature {
+	if kelvin == nil {
+		return nil
+	}
+	t := newTemperature(*kelvin)
+	return &t
+}
+
+// multiUnitWeatherReport is a weatherReport with every temperature given in every supported unit.
+type multiUnitWeatherReport struct {
+	CityName   string       `json:"city_name,omitempty"`
+	Conditions []string     `json:"conditions,omitempty"`
+	LowTemp    *temperature `json:"low_temp,omitempty"`
+	HighTemp   *temperature `json:"high_temp,omitempty"`
+	MedianTemp *temperature `json:"median_temp,omitempty"`
+	Wind       *wind        `json:"wind,omitempty"`
+	Visibility *int64       `json:"visibility,omitempty"`
+	Clouds     *int64       `json:"clouds,omitempty"`
+	Provider   *string      `json:"provider,omitempty"`
+	Base       *string      `json:"base,omitempty"`
+	AtTime     jsonTime     `json:"at_time,omitempty"`
+}
+
+func (r *weatherReport) inAllUnits() *multiUnitWeatherReport {
+	return &multiUnitWeatherReport{
+		r.CityName,
+		r.Conditions,
+		newNullableTemperature(r.LowTemp),
+		newNullableTemperature(r.HighTemp),
+		newNullableTemperature(r.MedianTemp),
+		r.Wind,
+		r.Visibility,
+		r.Clouds,
+		r.Provider,
+		r.Base,
+		r.AtTime,
+	}
+}
+
+// roundedToInt returns a copy of the report with every temperature rounded to the nearest
+// whole degree, halves rounded away from zero.
+func (r *weatherReport) roundedToInt() *weatherReport {
+	rounded := *r
+	rounded.LowTemp = roundedFloat(r.LowTemp)
+	rounded.HighTemp = roundedFloat(r.HighTemp)
+	rounded.MedianTemp = roundedFloat(r.MedianTemp)
+	return &rounded
+}
+
+// roundedToInt returns a copy of the report with every temperature rounded to the nearest
+// whole degree in each unit, after conversion.
+func (r *multiUnitWeatherReport) roundedToInt() *multiUnitWeatherReport {
+	rounded := *r
+	rounded.LowTemp = r.LowTemp.roundedToInt()
+	rounded.HighTemp = r.HighTemp.roundedToInt()
+	rounded.MedianTemp = r.MedianTemp.roundedToInt()
+	return &rounded
+}
+
+func (t *temperature) roundedToInt() *temperature {
+	if t == nil {
+		return nil
+	}
+	return &temperature{math.Round(t.Kelvin), math.Round(t.Celsius), math.Round(t.Fahrenheit)}
+}
+
+func roundedFloat(f *float64) *float64 {
+	if f == nil {
+		return nil
+	}
+	rounded := math.Round(*f)
+	return &rounded
+}
+
+// Supported values for the round query parameter. Temperatures are rounded to tempPrecision
+// decimal places unless whole degrees are requested.
+const (
+	roundInt = "int"
+)
+
+// Supported values for the units query parameter. Temperatures are in kelvin unless all units are requested.
+const (
+	unitsStandard = "standard"
+	unitsAll      = "all"
+)
+
+// upstreamError is returned when the openweather api responds, but not with weather. Its status
+// is the status the client is answered with.
+type upstreamError struct {
+	status  int
+	message string
+}
+
+func (e *upstreamError) Error() string {
+	return e.message
+}
+
+// newUpstreamError returns the error an openweather api response reports, or nil if it has
+// weather. A response with weather is accepted even if its 'cod' is missing, and a response
+// without weather is an error even if its 'cod' is 200. An unknown location is reported as not
+// found, and anything else as a bad gateway.
+func newUpstreamError(location *api.Location) *upstreamError {
+	if location.Main != nil && (location.Cod == 0 || location.Cod == http.StatusOK) {
+		return nil
+	}
+
+	e := &upstreamError{http.StatusBadGateway, "failed to communicate with the openweather api: unknown reason"}
+
+	if location.Cod == http.StatusNotFound {
+		e.status = http.StatusNotFound
+	}
+
+	if location.Message != nil && *location.Message != "" {
+		e.message = *location.Message
+	} else if location.Cod == http.StatusOK || location.Cod == 0 {
+		e.message = "the openweather api responded without weather"
+	}
+
+	return e
+}
+
 // ReportLocationWeather handles GET requests for location weather. The location should be
-// specified by the query parameter 'cityname'.
+// specified by the query parameter 'cityname'. Temperatures are in kelvin, unless the optional
+// query parameter 'units' is 'all', in which case each is given in kelvin, celsius and fahrenheit.
+// If 'city' is omitted the configured default city is reported, if there is one. If the optional
+// query parameter 'at' (RFC 3339) is given, the latest cached reading at or before then is
+// reported instead, without calling the openweather api, unless it was taken more than the
+// optional 'max_age' before then. If the optional query parameter 'round'
+// is 'int', temperatures are rounded to whole degrees in each unit. The location may instead be
+// specified by its id with the query parameter 'location_id', in which case a fresh reading is
+// served without looking the location up by name. Or it may be specified by its coordinates
+// with the query parameters 'lat' and 'lon', see coordinateWeather. HEAD requests are answered
+// with the same headers, including the age of the reading, but no body.
 func ReportLocationWeather(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		methodError(w, http.MethodGet, http.MethodHead)
+		return
+	}
+
+	params, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	var (
+		cityName = normalizeCityName(params.Get("city"))
+		byID     *db.LocationWeather
+	)
+
+	var coord *api.Coordinate
+
+	if latParam, lonParam := params.Get("lat"), params.Get("lon"); latParam != "" && lonParam != "" {
+		if cityName != "" || params.Get("location_id") != "" || params.Get("at") != "" {
+			badRequestError(w, errors.New("lat and lon can't be combined with city, location_id or at"))
+			return
+		}
+
+		lat, err := strconv.ParseFloat(latParam, 64)
+		if err != nil || lat < -90 || lat > 90 {
+			badRequestError(w, errors.New("lat must be a number between -90 and 90: "+latParam))
+			return
+		}
+
+		lon, err := strconv.ParseFloat(lonParam, 64)
+		if err != nil || lon < -180 || lon > 180 {
+			badRequestError(w, errors.New("lon must be a number between -180 and 180: "+lonParam))
+			return
+		}
+
+		coord = &api.Coordinate{Lat: lat, Lon: lon}
+	}
+
+	if idParam := params.Get("location_id"); idParam != "" {
+		if cityName != "" {
+			badRequestError(w, errors.New("city can't be combined with location_id"))
+			return
+		}
+
+		id, err := strconv.ParseInt(idParam, 10, 64)
+		if err != nil || id < 1 {
+			badRequestError(w, errors.New("location_id must be a positive integer: "+idParam))
+			return
+		}
+
+		byID, err = db.FetchLocationWeatherByID(r.Context(), id)
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+
+		if byID == nil {
+			notFoundError(w, "no location with id: "+idParam)
+			return
+		}
+
+		cityName = byID.Location.CityName.String
+	}
+
+	if cityName == "" && coord == nil {
+		cityName = defaultCity
+	}
+
+	if cityName == "" && coord == nil {
+		badRequestError(w, errCityRequired)
+		return
+	}
+
+	unitsParam := params.Get("units")
+
+	if unitsParam != "" && unitsParam != unitsStandard && unitsParam != unitsAll {
+		badRequestError(w, errors.New("unsupported units: "+unitsParam))
+		return
+	}
+
+	roundParam := params.Get("round")
+
+	if roundParam != "" && roundParam != roundInt {
+		badRequestError(w, errors.New("unsupported round: "+roundParam))
+		return
+	}
+
+	var report *weatherReport
+
+	if atParam := params.Get("at"); atParam != "" {
+		at, err := time.Parse(time.RFC3339, atParam)
+		if err != nil {
+			badRequestError(w, errors.New("at must be an RFC 3339 timestamp: "+atParam))
+			return
+		}
+
+		maxAge, err := parseMaxAge(params)
+		if err != nil {
+			badRequestError(w, err)
+			return
+		}
+
+		wr, err := db.WeatherAsOf(r.Context(), cityName, at)
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+
+		if wr == nil {
+			notFoundError(w, fmt.Sprintf("no cached weather for location: %s at or before %s", cityName, atParam))
+			return
+		}
+
+		// the age of a past reading is relative to the time asked for, not now
+		if maxAge > 0 && at.Sub(wr.AtTime) > maxAge {
+			notFoundError(w, fmt.Sprintf("no fresh data: the reading at %s before %s is older than %s", cityName, atParam, maxAge))
+			return
+		}
+
+		report = newWeatherReport(cityName, wr)
+	} else if byID != nil && isCached(byID.Location, byID.Weather) {
+		if err := byID.Location.IncrQueryCount(r.Context()); err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+
+		report = newWeatherReport(cityName, byID.Weather)
+	} else {
+		if coord != nil {
+			report, err = coordinateWeather(r.Context(), *coord)
+		} else {
+			report, err = locationWeather(r.Context(), cityName)
+		}
+		if err != nil {
+			sendWeatherError(w, r, err)
+			return
+		}
+	}
+
+	setFreshnessHeaders(w, report, unitsParam)
+
+	if unitsParam == unitsAll {
+		all := report.inAllUnits()
+		if roundParam == roundInt {
+			all = all.roundedToInt()
+		}
+
+		sendJSON(w, all)
+		return
+	}
+
+	if roundParam == roundInt {
+		report = report.roundedToInt()
+	}
+
+	sendJSON(w, report)
+}
+
+// sendWeatherError responds to a failure to get the weather for the request 'r': with the
+// status and message of the openweather api if it refused the location, a 503 if the request
+// ran out of time, or a 500 otherwise.
+func sendWeatherError(w http.ResponseWriter, r *http.Request, err error) {
+	if e, upstream := err.(*upstreamError); upstream {
+		sendError(w, e.status, e)
+		return
+	}
+
+	if r.Context().Err() == context.DeadlineExceeded {
+		serviceUnavailableError(w, errRequestTimedOut)
+		return
+	}
+
+	internalServerError(w, r, err)
+}
+
+// staleWarning is the Warning header sent with a reading that is past its freshness, which HTTP
+// clients understand as a stale response.
+const staleWarning = `110 - "Response is Stale"`
+
+// isStale reports whether a reading taken at 'at' is past its freshness, that is, older than
+// cacheTTL. Stale readings are served when they can't be refreshed, or when they're asked for.
+func isStale(at time.Time) bool {
+	return nowFunc().Sub(at) >= cacheTTL
+}
+
+// setFreshnessHeaders describes how fresh a report is, so clients can check the age of the
+// reading from the headers alone, with a Warning if it's stale. Unless cacheControl is disabled,
+// it also tells them how long they may cache the report for, which is until the reading is due
+// a refresh.
+func setFreshnessHeaders(w http.ResponseWriter, report *weatherReport, unitsParam string) {
+	at := report.AtTime.Time
+
+	h := fnv.New64a()
+	h.Write([]byte(fmt.Sprintf("%s|%s|%d", report.CityName, unitsParam, at.UnixNano())))
+
+	age := int64(nowFunc().Sub(at).Seconds())
+	if age < 0 {
+		age = 0
+	}
+
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, h.Sum64()))
+	w.Header().Set("Last-Modified", at.UTC().Format(http.TimeFormat))
+	w.Header().Set("Age", strconv.FormatInt(age, 10))
+
+	if isStale(at) {
+		w.Header().Set("Warning", staleWarning)
+	}
+
+	if !cacheControl {
+		return
+	}
+
+	// clients and intermediaries may reuse the response until the reading is due a refresh
+	if remaining := cacheTTL - nowFunc().Sub(at); remaining >= time.Second {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int64(remaining.Seconds())))
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+}
+
+// ReportBatchLocationWeather handles POST requests for the weather at several locations at
+// once. Clients must send the locations in a JSON payload, for example: {"cities": str[]}.
+// Each location is reported individually, so one failing location doesn't fail the batch.
+// An optional "units" field may be sent, either "standard" (kelvin) or "all".
+func ReportBatchLocationWeather(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodError(w, http.MethodPost)
+		return
+	}
+
+	payload := struct {
+		Cities []string `json:"cities"`
+		Units  string   `json:"units"`
+	}{
+		[]string{},
+		"",
+	}
+
+	if !decodeBody(w, r, &payload) {
+		return
+	}
+
+	if len(payload.Cities) > maxBatchCities {
+		sendError(
+			w,
+			http.StatusRequestEntityTooLarge,
+			fmt.Errorf("too many cities in batch: %d, the maximum is %d", len(payload.Cities), maxBatchCities))
+		return
+	}
+
+	if payload.Units != "" && payload.Units != unitsStandard && payload.Units != unitsAll {
+		sendError(w, http.StatusUnprocessableEntity, errors.New("unsupported units: "+payload.Units))
+		return
+	}
+
+	type result struct {
+		City    string      `json:"city"`
+		Weather interface{} `json:"weather,omitempty"`
+		Error   string      `json:"error,omitempty"`
+	}
+
+	var (
+		results = make([]result, len(payload.Cities))
+		wg      sync.WaitGroup
+	)
+
+	for i, city := range payload.Cities {
+		wg.Add(1)
+
+		go func(i int, city string) {
+			defer wg.Done()
+
+			cityName := normalizeCityName(city)
+
+			report, err := locationWeather(r.Context(), cityName)
+			if err != nil {
+				log.Printf("request %s: %s", requestID(r.Context()), err)
+				results[i] = result{City: cityName, Error: err.Error()}
+				return
+			}
+
+			if payload.Units == unitsAll {
+				results[i] = result{City: cityName, Weather: report.inAllUnits()}
+				return
+			}
+
+			results[i] = result{City: cityName, Weather: report}
+		}(i, city)
+	}
+
+	wg.Wait()
+
+	sendJSON(w, results)
+}
+
+// ReportBatchCoordinateWeather handles POST requests for the weather at several coordinates at
+// once. Clients must send the coordinates in a JSON payload, for example:
+// {"coordinates": [{"lat": float, "lon": float}]}. Each coordinate is fetched from the
+// openweather api and cached as the location the api names for it, or by its coordinates
+// rounded to 2 decimal places when it has no name. As with ReportBatchLocationWeather, each
+// coordinate is reported individually, and an optional "units" field may be sent.
+func ReportBatchCoordinateWeather(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodError(w, http.MethodPost)
+		return
+	}
+
+	payload := struct {
+		Coordinates []api.Coordinate `json:"coordinates"`
+		Units       string           `json:"units"`
+	}{
+		[]api.Coordinate{},
+		"",
+	}
+
+	if !decodeBody(w, r, &payload) {
+		return
+	}
+
+	if len(payload.Coordinates) > maxBatchCities {
+		sendError(
+			w,
+			http.StatusRequestEntityTooLarge,
+			fmt.Errorf("too many coordinates in batch: %d, the maximum is %d", len(payload.Coordinates), maxBatchCities))
+		return
+	}
+
+	for _, c := range payload.Coordinates {
+		if c.Lat < -90 || c.Lat > 90 || c.Lon < -180 || c.Lon > 180 {
+			badRequestError(w, fmt.Errorf("coordinates must have a lat between -90 and 90 and a lon between -180 and 180: %v,%v", c.Lat, c.Lon))
+			return
+		}
+	}
+
+	if payload.Units != "" && payload.Units != unitsStandard && payload.Units != unitsAll {
+		sendError(w, http.StatusUnprocessableEntity, errors.New("unsupported units: "+payload.Units))
+		return
+	}
+
+	spent, err := apiQuotaSpent(r.Context())
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	if spent {
+		sendError(w, errAPIQuotaSpent.status, errAPIQuotaSpent)
+		return
+	}
+
+	type result struct {
+		Lat     float64     `json:"lat"`
+		Lon     float64     `json:"lon"`
+		City    string      `json:"city,omitempty"`
+		Weather interface{} `json:"weather,omitempty"`
+		Error   string      `json:"error,omitempty"`
+	}
+
+	// each call is counted against the dailyAPIBudget before it's made, so a batch can't spend
+	// more than is left of it
+	locations, errs := api.SharedClient.FetchCurrentWeatherByCoordinates(r.Context(), payload.Coordinates, reserveAPICall)
+
+	results := make([]result, len(payload.Coordinates))
+
+	for i, c := range payload.Coordinates {
+		results[i] = result{Lat: c.Lat, Lon: c.Lon}
+
+		err := errs[i]
+		if err == nil {
+			if e := newUpstreamError(locations[i]); e != nil {
+				err = e
+			}
+		}
+
+		if err != nil {
+			log.Printf("request %s: %s", requestID(r.Context()), err)
+			results[i].Error = err.Error()
+			continue
+		}
+
+		report, err := cacheCoordinateWeather(r.Context(), c, locations[i])
+		if err != nil {
+			log.Printf("request %s: %s", requestID(r.Context()), err)
+			results[i].Error = err.Error()
+			continue
+		}
+
+		results[i].City = report.CityName
+
+		if payload.Units == unitsAll {
+			results[i].Weather = report.inAllUnits()
+		} else {
+			results[i].Weather = report
+		}
+	}
+
+	sendJSON(w, results)
+}
+
+// coordinateRadiusKm is how far from a coordinate a cached location may be and still be taken
+// as the location at it, rather than asking the openweather api.
+const coordinateRadiusKm = 10.0
+
+// coordinateWeather returns the weather at a coordinate. If a location is cached within
+// coordinateRadiusKm of it, that location's weather is reported as by locationWeather.
+// Otherwise it's fetched from the openweather api, unless the dailyAPIBudget is spent, and
+// cached as the location the api names, see cacheCoordinateWeather, so it's then served from
+// the cache. As with a refresh, only one request fetches a coordinate at a time.
+func coordinateWeather(ctx context.Context, c api.Coordinate) (*weatherReport, error) {
+	nearby, err := db.NearestCachedWeather(ctx, c.Lat, c.Lon, coordinateRadiusKm)
+	if err != nil {
+		return nil, err
+	}
+
+	if nearby != nil {
+		return locationWeather(ctx, nearby.CityName)
+	}
+
+	lock, err := db.TryLockLocation(ctx, coordinateCityName(c))
+	if err != nil {
+		return nil, err
+	}
+
+	if lock != nil {
+		defer lock.Release()
+	}
+
+	// once locked, the location may have been cached by the request that held the lock, and
+	// without the lock, wait for that request to cache it
+	for i := 0; ; i++ {
+		nearby, err = db.NearestCachedWeather(ctx, c.Lat, c.Lon, coordinateRadiusKm)
+		if err != nil {
+			return nil, err
+		}
+
+		if nearby != nil {
+			return locationWeather(ctx, nearby.CityName)
+		}
+
+		if lock != nil || i == refreshWaitAttempts {
+			break
+		}
+
+		select {
+		case <-time.After(refreshWaitInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	if err := reserveAPICall(ctx); err != nil {
+		return nil, err
+	}
+
+	location, err := api.SharedClient.FetchCurrentWeatherByCoordinate(ctx, c.Lat, c.Lon)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := newUpstreamError(location); err != nil {
+		return nil, err
+	}
+
+	return cacheCoordinateWeather(ctx, c, location)
+}
+
+// coordinateCityName is the name a location at a coordinate is cached under when the
+// openweather api doesn't name it.
+func coordinateCityName(c api.Coordinate) string {
+	return fmt.Sprintf("%.2f,%.2f", c.Lat, c.Lon)
+}
+
+// cacheCoordinateWeather caches the weather the openweather api reported at a coordinate, see
+// storeLocationWeather, under the name the api gave it or else the coordinate's.
+func cacheCoordinateWeather(ctx context.Context, c api.Coordinate, location *api.Location) (*weatherReport, error) {
+	cityName := normalizeCityName(location.Name)
+	if cityName == "" {
+		cityName = coordinateCityName(c)
+	}
+
+	if location.Coord == nil {
+		location.Coord = &c
+	}
+
+	return storeLocationWeather(ctx, cityName, location, true)
+}
+
+// langDefault is the language of weather condition labels from the openweather api.
+const langDefault = "en"
+
+// weatherCacheKey identifies a cached weather report by location, units and language. Reports
+// are cached as they're read from the database, in standard units and the default language,
+// and converted per request, so that one cached report serves every unit system.
+type weatherCacheKey struct {
+	city  string
+	units string
+	lang  string
+}
+
+func (k weatherCacheKey) String() string {
+	return "weather:" + k.city + "|" + k.units + "|" + k.lang
+}
+
+// warmUpCache has the weather at every bookmarked location fetched on startup, so that the
+// first request for one is served from the cache. It uses api quota, so it's disabled unless
+// it's enabled from the environment on startup.
+var (
+	warmUpCache = false
+)
+
+// warmUpConcurrency is the most locations fetched at once while warming up the cache.
+const warmUpConcurrency = 4
+
+// warmCacheFromBookmarks fetches the weather at every location bookmarked by any account, as
+// a request for it would, a few at a time, logging each location that fails. Locations that
+// are already fresh aren't fetched again, and once the dailyAPIBudget is spent the rest fail.
+// Unlike a request, no location's query count is incremented, as no client asked for it. It
+// returns the number of locations warmed.
+func warmCacheFromBookmarks(ctx context.Context) (int, error) {
+	bookmarks, err := db.AllBookmarks()
+	if err != nil {
+		return 0, err
+	}
+
+	names, err := bookmarks.NamesFromIDs()
+	if err != nil {
+		return 0, err
+	}
+
+	log.Printf("warming up the cache for %d bookmarked locations", len(names))
+
+	var (
+		wg     sync.WaitGroup
+		sem    = make(chan struct{}, warmUpConcurrency)
+		warmed int64
+	)
+
+	for _, cityName := range names {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(cityName string) {
+			defer func() { <-sem; wg.Done() }()
+
+			if _, err := refreshedLocationWeather(ctx, cityName, false); err != nil {
+				log.Printf("failed to warm up the cache for %s: %s", cityName, err)
+				return
+			}
+
+			atomic.AddInt64(&warmed, 1)
+		}(cityName)
+	}
+
+	wg.Wait()
+
+	return int(warmed), nil
+}
+
+// dailyAPIBudget is the most calls made to the openweather api a day, counted across every
+// instance sharing the database. Once it's spent, locations are served from their latest
+// reading however old it is, or answered 503 without one, until the next day. Calls aren't
+// limited unless it's configured from the environment on startup.
+var (
+	dailyAPIBudget = 0
+)
+
+var errAPIQuotaSpent = &upstreamError{http.StatusServiceUnavailable, "the daily openweather api quota is spent, try again tomorrow"}
+
+// locationWeather returns the weather at a location, from the cache if it is fresh and from
+// the openweather api otherwise, unless the dailyAPIBudget is spent. The location's query
+// count is incremented.
+func locationWeather(ctx context.Context, cityName string) (*weatherReport, error) {
+	return refreshedLocationWeather(ctx, cityName, true)
+}
+
+// refreshedLocationWeather is locationWeather, only incrementing the location's query count if
+// it was 'queried' by a client.
+func refreshedLocationWeather(ctx context.Context, cityName string, queried bool) (*weatherReport, error) {
+	key := weatherCacheKey{cityName, unitsStandard, langDefault}.String()
+
+	if data, cached := weatherCache.Get(key); cached {
+		report := &weatherReport{}
+
+		if err := json.Unmarshal(data, report); err == nil {
+			if !queried {
+				return report, nil
+			}
+
+			if err := db.IncrLocationQueryCount(ctx, cityName); err != nil {
+				return nil, err
+			}
+
+			return report, nil
+		}
+
+		weatherCache.Delete(key) // unreadable, so fall through to the db
+	}
+
+	query, err := db.FetchLocationWeather(ctx, cityName)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		lr *db.LocationRow
+		wr *db.WeatherRow
+	)
+
+	lr, wr = parseRows(query)
+	refresh := !isCached(lr, wr)
+
+	if refresh {
+		lock, err := db.TryLockLocation(ctx, cityName)
+		if err != nil {
+			return nil, err
+		}
+
+		if lock != nil {
+			defer lock.Release()
+
+			// the lock may have been released by another request's refresh just before it was
+			// taken, in which case its result is already in the database
+			query, err = db.FetchLocationWeather(ctx, cityName)
+			if err != nil {
+				return nil, err
+			}
+
+			lr, wr = parseRows(query)
+			refresh = !isCached(lr, wr)
+		} else {
+			// another instance is refreshing this location, so wait for its result to land in
+			// the cache instead of also calling the openweather api
+			for i := 0; i < refreshWaitAttempts && refresh; i++ {
+				select {
+				case <-time.After(refreshWaitInterval):
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+
+				query, err = db.FetchLocationWeather(ctx, cityName)
+				if err != nil {
+					return nil, err
+				}
+
+				lr, wr = parseRows(query)
+				refresh = !isCached(lr, wr)
+			}
+		}
+	}
+
+	if refresh {
+		if err := reserveAPICall(ctx); err != nil {
+			if err != errAPIQuotaSpent || lr == nil || wr == nil {
+				return nil, err
+			}
+
+			log.Printf("daily api quota of %d calls spent, serving the latest reading for %s", dailyAPIBudget, cityName)
+			refresh = false
+		}
+	}
+
+	if !refresh {
+		if queried {
+			if err := lr.IncrQueryCount(ctx); err != nil {
+				return nil, err
+			}
+		}
+
+		return cacheWeatherReport(cityName, wr), nil
+	}
+
+	location, err := api.SharedClient.FetchCurrentWeatherByLocationName(ctx, cityName)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := newUpstreamError(location); err != nil {
+		return nil, err
+	}
+
+	return storeLocationWeather(ctx, cityName, location, queried)
+}
+
+// storeLocationWeather caches the weather the openweather api reported at a location, and the
+// location's coordinates, in the database, unless readThroughOnly, and in the weatherCache.
+// The location's query count is only incremented if it was 'queried' by a client.
+func storeLocationWeather(ctx context.Context, cityName string, location *api.Location, queried bool) (*weatherReport, error) {
+	wr := newWeatherRow(location)
+
+	if readThroughOnly {
+		wr.AtTime = nowFunc()
+		return cacheWeatherReport(cityName, wr), nil
+	}
+
+	var (
+		query db.QueryResult
+		err   error
+	)
+
+	if queried {
+		query, err = db.UpdateCachedLocationWeather(ctx, cityName, wr)
+	} else {
+		query, err = db.RefreshCachedLocationWeather(ctx, cityName, wr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if location.Coord != nil {
+		if err := db.UpdateLocationCoordinates(ctx, cityName, location.Coord.Lat, location.Coord.Lon); err != nil {
+			return nil, err
+		}
+	}
+
+	_, wr = parseRows(query)
+
+	return cacheWeatherReport(cityName, wr), nil
+}
+
+// cacheWeatherReport reports a reading at a location, keeping the report in the weatherCache
+// until the reading is due a refresh.
+func cacheWeatherReport(cityName string, wr *db.WeatherRow) *weatherReport {
+	report := newWeatherReport(cityName, wr)
+
+	if data, err := json.Marshal(report); err == nil {
+		weatherCache.Set(weatherCacheKey{cityName, unitsStandard, langDefault}.String(), data, cacheTTL-nowFunc().Sub(wr.AtTime))
+	}
+
+	return report
+}
+
+// reserveAPICall counts a call about to be made to the openweather api against the
+// dailyAPIBudget, or returns errAPIQuotaSpent without counting it if the budget is spent.
+// Reserving before calling means failed calls are counted too.
+func reserveAPICall(ctx context.Context) error {
+	reserved, err := db.ReserveAPICall(ctx, dailyAPIBudget)
+	if err != nil {
+		return err
+	}
+
+	if !reserved {
+		return errAPIQuotaSpent
+	}
+
+	return nil
+}
+
+// apiQuotaSpent reports whether the openweather api has been called dailyAPIBudget times
+// today, in which case no more calls should be made until tomorrow. It's never spent without
+// a budget.
+func apiQuotaSpent(ctx context.Context) (bool, error) {
+	if dailyAPIBudget <= 0 {
+		return false, nil
+	}
+
+	calls, err := db.APICallsToday(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return calls >= dailyAPIBudget, nil
+}
+
+// newWeatherRow is the reading in a response from the openweather api, ready to be cached.
+// Its time is left for the database to set.
+func newWeatherRow(location *api.Location) *db.WeatherRow {
+	reading := &db.WeatherRow{
+		TempLow:    sql.NullFloat64{Float64: location.Main.TempMin, Valid: true},
+		TempHigh:   sql.NullFloat64{Float64: location.Main.TempMax, Valid: true},
+		Labels:     location.WeatherLabels(),
+		Source:     sql.NullString{String: api.SharedClient.Provider, Valid: true},
+		Base:       sql.NullString{String: location.Base, Valid: location.Base != ""},
+		Visibility: sql.NullInt64{Int64: int64(location.Visibility), Valid: location.Visibility > 0},
+		Humidity:   sql.NullFloat64{Float64: location.Main.Humidity, Valid: location.Main.Humidity > 0},
+		Pressure:   sql.NullFloat64{Float64: location.Main.Pressure, Valid: location.Main.Pressure > 0},
+	}
+
+	if location.Wind != nil {
+		reading.WindSpeed = sql.NullFloat64{Float64: location.Wind.Speed, Valid: true}
+		reading.WindDeg = sql.NullFloat64{Float64: location.Wind.Deg, Valid: true}
+	}
+
+	if location.Clouds != nil {
+		reading.Clouds = sql.NullInt64{Int64: int64(location.Clouds.All), Valid: true}
+	}
+
+	return reading
+}
+
+// statsQueryParameters documents the query parameters of the stats endpoint.
+var statsQueryParameters = []string{
+	"count=query|labels (only query is implemented)",
+	"summary=day|month|year (only day and month are implemented, month is refreshed periodically)",
+	"temp=lows|highs|avgs (the monthly lowest, highest and average temperature, refreshed periodically, also reports the number of locations and readings and the period they cover as meta)",
+	"temp=extremes (the lowest and highest median temperature ever recorded at each location)",
+	"metric=temp|humidity|pressure (optional, what temp=lows|highs|avgs reports on, humidity and pressure as the monthly lowest, highest and average, defaults to temp)",
+	"by=label (the average median temperature of readings with each weather label)",
+	"by=dominant-label (the weather label seen in the most readings at each location, ties going to the first alphabetically)",
+	"granularity=day|week|month (optional, with by=label reports how many readings had each label per period instead, within from and to)",
+	"shape=nested|series (optional, series reports temp as a date sorted list of points per location, defaults to nested)",
+	"source=<provider> (optional, filters by the provider that reported the weather)",
+	"date=YYYY-MM-DD or from=YYYY-MM-DD&to=YYYY-MM-DD (optional, the days covered by summary=day, defaults to the most recent day)",
+}
+
+// Supported values for the stats shape query parameter, which only applies to temperatures.
+const (
+	statsShapeNested = "nested"
+	statsShapeSeries = "series"
+)
+
+// statsGranularities are the supported periods for counting labels by with the stats
+// granularity query parameter.
+var statsGranularities = []string{"day", "week", "month"}
+
+// statsMetrics are the metrics the stats metric query parameter can report on.
+var statsMetrics = []string{string(db.MetricTemp), string(db.MetricHumidity), string(db.MetricPressure)}
+
+// statsOverviewParams are the stats reported for a request without query parameters when
+// statsOverview is enabled: the total query count, the known labels and the most recent day's
+// summary.
+var statsOverviewParams = url.Values{
+	"count":   []string{"query", "labels"},
+	"summary": []string{"day"},
+}
+
+// statsOverview makes the stats endpoint report an at-a-glance overview, rather than list its
+// query parameters, when none are given. It can be enabled from the environment on startup.
+var (
+	statsOverview = false
+)
+
+// ReportWeatherStatistics handles GET requests for various weather stats depending
+// on what query parameter are set. If no query string is found in the uri, the full list of
+// available parameters is returned as a JSON payload, or if statsOverview is enabled, the
+// overview stats in statsOverviewParams.
+func ReportWeatherStatistics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodError(w, http.MethodGet)
+		return
+	}
+
+	params, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	if len(params) == 0 && statsOverview {
+		params = statsOverviewParams
+	}
+
+	// if no query parameters are attached to the request, we send a payload that lists available query parameters
+	if sendDoc(w,
+		struct {
+			ValidQueryParameters []string
+		}{
+			statsQueryParameters,
+		},
+		func() bool { return len(params) == 0 },
+	) {
+		return
+	}
+
+	dates, err := parseDateRange(params)
+	if err != nil {
+		badRequestError(w, err)
+		return
+	}
+
+	shape := params.Get("shape")
+	if shape != "" && shape != statsShapeNested && shape != statsShapeSeries {
+		badRequestError(w, errors.New("unsupported shape: "+shape))
+		return
+	}
+
+	granularity := params.Get("granularity")
+	if granularity != "" && !hasParam(statsGranularities, granularity) {
+		badRequestError(w, errors.New("unsupported granularity: "+granularity))
+		return
+	}
+
+	metric := db.MetricTemp
+	if v := params.Get("metric"); v != "" {
+		if !hasParam(statsMetrics, v) {
+			badRequestError(w, errors.New("unsupported metric: "+v))
+			return
+		}
+		metric = db.Metric(v)
+	}
+
+	var (
+		stats  = &StatsResponse{}
+		source = params.Get("source") // optional, filters readings by provider
+	)
+
+	for q, p := range params {
+		switch q {
+		case "count":
+			if hasParam(p, "query") {
+				count, err := db.TotalQueryCount()
+				if err != nil {
+					statsQueryError(w, r, err)
+					return
+				}
+
+				stats.Count = &statsCount{count}
+			}
+
+			if hasParam(p, "labels") {
+				labels, err := db.KnownWeatherLabels(source)
+				if err != nil {
+					statsQueryError(w, r, err)
+					return
+				}
+
+				if labels == nil {
+					labels = []string{}
+				}
+
+				stats.Labels = &labels
+			}
+
+			break
+		case "summary":
+			summaries := &statsSummary{}
+
+			if hasParam(p, "day") {
+				summary, err := db.DailyWeatherSummary(source, dates)
+				if err != nil {
+					statsQueryError(w, r, err)
+					return
+				}
+
+				summaries.Daily = &summary
+			}
+
+			if hasParam(p, "month") {
+				summary, err := db.MonthlyWeatherSummary(source)
+				if err != nil {
+					statsQueryError(w, r, err)
+					return
+				}
+
+				roundSummaryTemps(summary)
+
+				summaries.Monthly = &summary
+			}
+
+			if summaries.Daily != nil || summaries.Monthly != nil {
+				stats.Summary = summaries
+			}
+
+			break
+		case "by":
+			if hasParam(p, "label") && granularity != "" {
+				var from, to time.Time
+
+				if dates != nil {
+					from, to = dates.From, dates.To
+				}
+
+				counts, err := db.LabelCountsByPeriod(granularity, source, from, to)
+				if err != nil {
+					statsQueryError(w, r, err)
+					return
+				}
+
+				stats.LabelCounts = &counts
+			} else if hasParam(p, "label") {
+				averages, err := db.AverageTemperatureByLabel(source)
+				if err != nil {
+					statsQueryError(w, r, err)
+					return
+				}
+
+				for label, avg := range averages {
+					averages[label] = roundTemp(avg)
+				}
+
+				stats.LabelTemperatures = &averages
+			}
+
+			if hasParam(p, "dominant-label") {
+				dominant, err := db.DominantLabelPerCity(source)
+				if err != nil {
+					statsQueryError(w, r, err)
+					return
+				}
+
+				stats.DominantLabels = &dominant
+			}
+
+			break
+		case "temp":
+			if hasParam(p, "extremes") && metric != db.MetricTemp {
+				badRequestError(w, errors.New("temp=extremes only reports temperatures, not "+string(metric)))
+				return
+			}
+
+			if hasParam(p, "extremes") {
+				extremes, err := db.TemperatureExtremesPerCity(source)
+				if err != nil {
+					statsQueryError(w, r, err)
+					return
+				}
+
+				for cityName, e := range extremes {
+					extremes[cityName] = db.TemperatureExtremes{Min: roundTemp(e.Min), Max: roundTemp(e.Max)}
+				}
+
+				stats.TemperatureExtremes = &extremes
+			}
+
+			if hasParam(p, "lows", "highs", "avgs") { // lows, highs and avgs are all computed from one query
+				filters := []db.TemperatureQueryFilter{}
+
+				for _, subv := range p {
+					if subv != "extremes" {
+						filters = append(filters, db.TemperatureQueryFilter(subv))
+					}
+				}
+
+				reports, err := db.MonthlyMetric(metric, source, filters...)
+				if err != nil {
+					statsQueryError(w, r, err)
+					return
+				}
+
+				temps := &statsTemperatures{}
+
+				for f, report := range reports {
+					roundTemps(report)
+
+					r := &statsTemperatureReport{Nested: report}
+					if shape == statsShapeSeries {
+						r = &statsTemperatureReport{Series: report.Series()}
+					}
+
+					temps.set(f, r)
+				}
+
+				switch metric {
+				case db.MetricHumidity:
+					stats.Humidity = temps
+				case db.MetricPressure:
+					stats.Pressure = temps
+				default:
+					stats.Temperatures = temps
+				}
+
+				coverage, err := db.WeatherStatsCoverage(source)
+				if err != nil {
+					statsQueryError(w, r, err)
+					return
+				}
+
+				stats.Meta = newStatsMeta(coverage)
+			}
+
+			break
+		}
+	}
+
+	sendJSON(w, stats)
+}
+
+// StatsResponse is the body of a stats response. Each field holds one family of stats and is
+// only sent if it was requested, so which keys are present depends on the query parameters, but
+// the shape of each doesn't.
+type StatsResponse struct {
+	Count               *statsCount                        `json:"count,omitempty"`                // count=query
+	Labels              *[]string                          `json:"labels,omitempty"`               // count=labels
+	Summary             *statsSummary                      `json:"summary,omitempty"`              // summary=day|month
+	LabelCounts         *map[string]map[string]int         `json:"label_counts,omitempty"`         // by=label&granularity=..., keyed by period then label
+	LabelTemperatures   *map[string]float64                `json:"label_temperatures,omitempty"`   // by=label, keyed by label
+	DominantLabels      *map[string]string                 `json:"dominant_labels,omitempty"`      // by=dominant-label, keyed by location
+	TemperatureExtremes *map[string]db.TemperatureExtremes `json:"temperature_extremes,omitempty"` // temp=extremes, keyed by location
+	Temperatures        *statsTemperatures                 `json:"temperatures,omitempty"`         // temp=lows|highs|avgs
+	Humidity            *statsTemperatures                 `json:"humidity,omitempty"`             // temp=lows|highs|avgs&metric=humidity
+	Pressure            *statsTemperatures                 `json:"pressure,omitempty"`             // temp=lows|highs|avgs&metric=pressure
+	Meta                *statsMeta                         `json:"meta,omitempty"`                 // with temperatures, humidity or pressure
+}
+
+// statsCount holds the requested counts.
+type statsCount struct {
+	LocationQueries int `json:"location_queries"`
+}
+
+// statsSummary holds the requested weather summaries, each keyed by label.
+type statsSummary struct {
+	Daily   *db.QueryResultList            `json:"daily,omitempty"`
+	Monthly *db.LocationSummaryQueryResult `json:"monthly,omitempty"`
+}
+
+// statsTemperatures holds the requested temperature stats, or those of another metric.
+type statsTemperatures struct {
+	Lows  *statsTemperatureReport `json:"lows,omitempty"`
+	Highs *statsTemperatureReport `json:"highs,omitempty"`
+	Avgs  *statsTemperatureReport `json:"avgs,omitempty"`
+}
+
+// set stores the report 'r' for the filter 'f'.
+func (t *statsTemperatures) set(f db.TemperatureQueryFilter, r *statsTemperatureReport) {
+	switch f {
+	case db.FilterLows:
+		t.Lows = r
+	case db.FilterHighs:
+		t.Highs = r
+	case db.FilterAverages:
+		t.Avgs = r
+	}
+}
+
+// statsTemperatureReport is one filter's temperatures keyed by location, sent nested by year,
+// month and day, or with shape=series, as a date sorted list of points per location.
+type statsTemperatureReport struct {
+	Nested db.LocationTemperatureQueryResult
+	Series map[string][]db.TemperaturePoint
+}
+
+func (r statsTemperatureReport) MarshalJSON() ([]byte, error) {
+	if r.Series != nil {
+		return json.Marshal(r.Series)
+	}
+
+	return json.Marshal(r.Nested)
+}
+
+// statsMeta describes the readings temperature stats are computed from, so that clients can
+// put the numbers in context.
+type statsMeta struct {
+	Locations int       `json:"locations"`
+	Readings  int       `json:"readings"`
+	From      *jsonTime `json:"from,omitempty"`
+	To        *jsonTime `json:"to,omitempty"`
+}
+
+func newStatsMeta(c *db.StatsCoverage) *statsMeta {
+	meta := &statsMeta{Locations: c.Locations, Readings: c.Readings}
+
+	if c.From.Valid && c.To.Valid {
+		meta.From, meta.To = &jsonTime{c.From.Time}, &jsonTime{c.To.Time}
+	}
+
+	return meta
+}
+
+// ReportWeatherStatisticsHelp handles GET requests for the list of query parameters accepted
+// by the stats endpoint, whether or not statsOverview is enabled.
+func ReportWeatherStatisticsHelp(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodError(w, http.MethodGet)
+		return
+	}
+
+	sendJSON(w, struct {
+		ValidQueryParameters []string
+	}{
+		statsQueryParameters,
+	})
+}
+
+// ReportSupportedWeatherLabels handles GET requests for every weather label the provider may
+// report, whether or not it has been seen yet. Labels seen in cached readings are reported by
+// the stats endpoint instead.
+func ReportSupportedWeatherLabels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodError(w, http.MethodGet)
+		return
+	}
+
+	sendJSON(w, struct {
+		Labels []string `json:"labels"`
+	}{
+		api.WeatherLabels,
+	})
+}
+
+// dateFormat is the format of dates in query parameters.
+const dateFormat = "2006-01-02"
+
+// parseDateRange reads the optional 'date', or 'from' and 'to', query parameters as a range of
+// whole days, with 'to' included. If none are given, nil is returned.
+func parseDateRange(params url.Values) (*db.DateRange, error) {
+	date, from, to := params.Get("date"), params.Get("from"), params.Get("to")
+
+	if date == "" && from == "" && to == "" {
+		return nil, nil
+	}
+
+	if date != "" {
+		if from != "" || to != "" {
+			return nil, errors.New("date can't be combined with from or to")
+		}
+
+		from, to = date, date
+	}
+
+	dates := &db.DateRange{}
+
+	if from != "" {
+		t, err := time.Parse(dateFormat, from)
+		if err != nil {
+			return nil, fmt.Errorf("invalid date, expected YYYY-MM-DD: %s", from)
+		}
+		dates.From = t
+	}
+
+	if to != "" {
+		t, err := time.Parse(dateFormat, to)
+		if err != nil {
+			return nil, fmt.Errorf("invalid date, expected YYYY-MM-DD: %s", to)
+		}
+		dates.To = t.AddDate(0, 0, 1)
+	}
+
+	if !dates.From.IsZero() && !dates.To.IsZero() && !dates.From.Before(dates.To) {
+		return nil, fmt.Errorf("from must not be after to: %s, %s", from, to)
+	}
+
+	return dates, nil
+}
+
+// ReportTemperatureDelta handles GET requests for the change in temperature at a location
+// between two points in time. The location is specified by the query parameter 'city' and
+// the times by 'from' and 'to' as RFC3339 timestamps. If 'to' is omitted, it defaults to now.
+// If either time has no reading near it, a 404 is sent.
+func ReportTemperatureDelta(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodError(w, http.MethodGet)
+		return
+	}
+
+	params, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	cityName := normalizeCityName(params.Get("city"))
+	if cityName == "" {
+		badRequestError(w, errCityRequired)
+		return
+	}
+
+	from, err := time.Parse(time.RFC3339, params.Get("from"))
+	if err != nil {
+		badRequestError(w, err)
+		return
+	}
+
+	to := nowFunc()
+
+	if v := params.Get("to"); v != "" {
+		to, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			badRequestError(w, err)
+			return
+		}
+	}
+
+	delta, err := db.TemperatureDelta(r.Context(), cityName, from, to)
+	if err != nil {
+		if _, insufficient := err.(*db.InsufficientDataError); insufficient {
+			sendError(w, http.StatusNotFound, err)
+			return
+		}
+		internalServerError(w, r, err)
+		return
+	}
+
+	sendJSON(w, struct {
+		CityName string    `json:"city_name,omitempty"`
+		From     time.Time `json:"from,omitempty"`
+		To       time.Time `json:"to,omitempty"`
+		Delta    float64   `json:"delta"`
+	}{
+		cityName,
+		from,
+		to,
+		roundTemp(delta),
+	})
+}
+
+// defaultForecastCount is the number of forecast entries reported when 'cnt' isn't given.
+const defaultForecastCount = api.MaxForecastCount
+
+type forecastEntry struct {
+	Conditions []string `json:"conditions,omitempty"`
+	LowTemp    float64  `json:"low_temp,omitempty"`
+	HighTemp   float64  `json:"high_temp,omitempty"`
+	AtTime     jsonTime `json:"at_time,omitempty"`
+}
+
+type forecastReport struct {
+	CityName string           `json:"city_name,omitempty"`
+	Forecast []*forecastEntry `json:"forecast"`
+}
+
+// Sections of a forecast that can be excluded from forecast reports. The time of each entry
+// is always kept.
+const (
+	forecastSectionConditions = "conditions"
+	forecastSectionTemps      = "temps"
+)
+
+var forecastSections = []string{forecastSectionConditions, forecastSectionTemps}
+
+// forecastExclude are the sections dropped from every forecast before it's cached and
+// reported, for deployments that don't use them, keeping the cache lean. Nothing is excluded
+// unless it's configured from the environment on startup.
+var (
+	forecastExclude = map[string]bool{}
+)
+
+// excluding drops the 'exclude' sections from the report's entries, in place.
+func (r *forecastReport) excluding(exclude map[string]bool) *forecastReport {
+	for _, e := range r.Forecast {
+		if exclude[forecastSectionConditions] {
+			e.Conditions = nil
+		}
+
+		if exclude[forecastSectionTemps] {
+			e.LowTemp, e.HighTemp = 0, 0
+		}
+	}
+
+	return r
+}
+
+// newForecastUpstreamError returns the error an openweather api forecast response reports, or
+// nil if it has a forecast, as newUpstreamError does for the current weather. The message of a
+// forecast is a number on success, so only a string message is passed on.
+func newForecastUpstreamError(f *api.Forecast) *upstreamError {
+	if f.Cod == http.StatusOK {
+		return nil
+	}
+
+	e := &upstreamError{http.StatusBadGateway, "failed to communicate with the openweather api: unknown reason"}
+
+	if f.Cod == http.StatusNotFound {
+		e.status = http.StatusNotFound
+	}
+
+	if message, ok := f.Message.(string); ok && message != "" {
+		e.message = message
+	}
+
+	return e
+}
+
+// ReportLocationForecast handles GET requests for the forecast at a location, in 3 hour steps.
+// The location must be specified by the query parameter 'city'. The optional query parameter
+// 'cnt' limits the number of steps reported and is passed through to the upstream api. Any
+// sections in forecastExclude are dropped before the forecast is cached. A forecast that isn't
+// cached is fetched only if the dailyAPIBudget isn't spent, see reserveAPICall.
+func ReportLocationForecast(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodError(w, http.MethodGet)
+		return
+	}
+
+	params, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	cityName := normalizeCityName(params.Get("city"))
+	if cityName == "" {
+		badRequestError(w, errCityRequired)
+		return
+	}
+
+	count := defaultForecastCount
+
+	if v := params.Get("cnt"); v != "" {
+		count, err = strconv.Atoi(v)
+		if err != nil || count < api.MinForecastCount || count > api.MaxForecastCount {
+			badRequestError(w, fmt.Errorf("cnt must be an integer between %d and %d: %s", api.MinForecastCount, api.MaxForecastCount, v))
+			return
+		}
+	}
+
+	key := fmt.Sprintf("forecast:%s:%d", cityName, count)
+
+	if data, cached := weatherCache.Get(key); cached {
+		report := &forecastReport{}
+		if err := json.Unmarshal(data, report); err == nil {
+			sendJSON(w, report)
+			return
+		}
+		weatherCache.Delete(key)
+	}
+
+	if err := reserveAPICall(r.Context()); err != nil {
+		sendWeatherError(w, r, err)
+		return
+	}
+
+	f, err := api.SharedClient.FetchForecastByLocationName(r.Context(), cityName, count)
+	if err != nil {
+		if r.Context().Err() == context.DeadlineExceeded {
+			serviceUnavailableError(w, errRequestTimedOut)
+			return
+		}
+		internalServerError(w, r, err)
+		return
+	}
+
+	if e := newForecastUpstreamError(f); e != nil {
+		sendWeatherError(w, r, e)
+		return
+	}
+
+	report := &forecastReport{CityName: cityName, Forecast: []*forecastEntry{}}
+
+	for _, e := range f.List {
+		if len(report.Forecast) == count {
+			break
+		}
+
+		entry := &forecastEntry{
+			Conditions: e.WeatherLabels(),
+			AtTime:     jsonTime{time.Unix(e.Dt, 0).UTC()},
+		}
+
+		if e.Main != nil {
+			entry.LowTemp = roundTemp(e.Main.TempMin)
+			entry.HighTemp = roundTemp(e.Main.TempMax)
+		}
+
+		report.Forecast = append(report.Forecast, entry)
+	}
+
+	report.excluding(forecastExclude)
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	weatherCache.Set(key, data, cacheTTL)
+
+	sendJSON(w, report)
+}
+
+// ReportNearbyCachedWeather handles GET requests for the weather near a coordinate, given by
+// the query parameters 'lat' and 'lon'. It is answered from cached data only, never the
+// openweather api, with the latest reading at the nearest location within nearbyRadiusKm,
+// its distance and the age of the reading. It's meant for when the api quota is exhausted.
+// The optional query parameter 'max_age', a duration such as "30m", rejects older readings.
+func ReportNearbyCachedWeather(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodError(w, http.MethodGet)
+		return
+	}
+
+	params, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	lat, err := strconv.ParseFloat(params.Get("lat"), 64)
+	if err != nil || lat < -90 || lat > 90 {
+		badRequestError(w, errors.New("lat must be a number between -90 and 90: "+params.Get("lat")))
+		return
+	}
+
+	lon, err := strconv.ParseFloat(params.Get("lon"), 64)
+	if err != nil || lon < -180 || lon > 180 {
+		badRequestError(w, errors.New("lon must be a number between -180 and 180: "+params.Get("lon")))
+		return
+	}
+
+	maxAge, err := parseMaxAge(params)
+	if err != nil {
+		badRequestError(w, err)
+		return
+	}
+
+	sendNearbyCachedWeather(w, r, lat, lon, maxAge)
+}
+
+// parseMaxAge reads the optional query parameter 'max_age', the oldest reading a client of
+// the cache-only endpoints will accept, given as for parseDuration with bare integers in
+// seconds. It's 0, accepting readings of any age, when omitted.
+func parseMaxAge(params url.Values) (time.Duration, error) {
+	v := params.Get("max_age")
+	if v == "" {
+		return 0, nil
+	}
+
+	maxAge, err := parseDuration(v, time.Second)
+	if err != nil || maxAge <= 0 {
+		return 0, errors.New("max_age must be a positive duration: " + v)
+	}
+
+	return maxAge, nil
+}
+
+// freshSince is the time of the oldest reading within 'maxAge', as read by parseMaxAge, or the
+// zero time, accepting readings of any age, if it's 0.
+func freshSince(maxAge time.Duration) time.Time {
+	if maxAge == 0 {
+		return time.Time{}
+	}
+
+	return nowFunc().Add(-maxAge)
+}
+
+// geoLocator locates clients by their IP address for the IP location weather endpoint. It
+// knows no addresses unless a table of networks is configured from the environment on startup.
+var (
+	geoLocator geoip.Locator = geoip.None{}
+)
+
+var errClientNotLocated = errors.New("couldn't locate the client, give coordinates to /api/v1/location/weather/nearby-cached instead")
+
+// ReportIPLocationWeather handles GET requests for the weather near the client, located by
+// its IP address, taken from trusted proxies' headers as for logging, see clientIP. It's
+// answered as ReportNearbyCachedWeather is for the client's coordinates, including 'max_age',
+// or with a 400 asking for coordinates if the client can't be located.
+func ReportIPLocationWeather(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodError(w, http.MethodGet)
+		return
+	}
+
+	params, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	maxAge, err := parseMaxAge(params)
+	if err != nil {
+		badRequestError(w, err)
+		return
+	}
+
+	ip := net.ParseIP(clientIP(r))
+	if ip == nil {
+		badRequestError(w, errClientNotLocated)
+		return
+	}
+
+	lat, lon, err := geoLocator.Locate(ip)
+	if err != nil {
+		log.Printf("failed to locate %s: %s", ip, err)
+		badRequestError(w, errClientNotLocated)
+		return
+	}
+
+	sendNearbyCachedWeather(w, r, lat, lon, maxAge)
+}
+
+// sendNearbyCachedWeather responds with the latest cached reading at the nearest location to
+// 'lat', 'lon' within nearbyRadiusKm, its distance and the age of the reading, or a 404 if
+// there's no location that near, or its reading is older than a non-zero 'maxAge'.
+func sendNearbyCachedWeather(w http.ResponseWriter, r *http.Request, lat, lon float64, maxAge time.Duration) {
+	nearby, err := db.NearestCachedWeather(r.Context(), lat, lon, nearbyRadiusKm)
+	if err != nil {
+		if r.Context().Err() == context.DeadlineExceeded {
+			serviceUnavailableError(w, errRequestTimedOut)
+			return
+		}
+		internalServerError(w, r, err)
+		return
+	}
+
+	if nearby == nil {
+		notFoundError(w, fmt.Sprintf("no cached location within %gkm of %g,%g", nearbyRadiusKm, lat, lon))
+		return
+	}
+
+	age := nowFunc().Sub(nearby.Weather.AtTime)
+
+	if maxAge > 0 && age > maxAge {
+		notFoundError(w, fmt.Sprintf("no fresh data: the reading at %s is older than %s", nearby.CityName, maxAge))
+		return
+	}
+
+	stale := isStale(nearby.Weather.AtTime)
+	if stale {
+		w.Header().Set("Warning", staleWarning)
+	}
+
+	sendJSON(w, struct {
+		*weatherReport
+		DistanceKm float64 `json:"distance_km"`
+		AgeSeconds int64   `json:"age_seconds"`
+		Stale      bool    `json:"stale"`
+	}{
+		newWeatherReport(nearby.CityName, nearby.Weather),
+		math.Round(nearby.DistanceKm*100) / 100,
+		int64(age.Seconds()),
+		stale,
+	})
+}
+
+// cachedLocationWeather is a flattened view of a joined 'locations' and 'weather' row, with
+// null columns omitted, for inspecting exactly what's cached.
+type cachedLocationWeather struct {
+	LocationID *int64   `json:"location_id,omitempty"`
+	CityName   *string  `json:"city_name,omitempty"`
+	QueryCount *int64   `json:"query_count,omitempty"`
+	Labels     []string `json:"labels"`
+	TempLow    *float64 `json:"temp_low,omitempty"`
+	TempHigh   *float64 `json:"temp_high,omitempty"`
+	Source     *string  `json:"source,omitempty"`
+	Base       *string  `json:"base,omitempty"`
+	WindSpeed  *float64 `json:"wind_speed,omitempty"`
+	WindDeg    *float64 `json:"wind_deg,omitempty"`
+	Visibility *int64   `json:"visibility,omitempty"`
+	Clouds     *int64   `json:"clouds,omitempty"`
+	AtTime     jsonTime `json:"at_time"`
+}
+
+func newCachedLocationWeather(lr *db.LocationRow, wr *db.WeatherRow) *cachedLocationWeather {
+	return &cachedLocationWeather{
+		nullableInt(lr.ID),
+		nullableString(lr.CityName),
+		nullableInt(lr.QueryCount),
+		wr.Labels,
+		nullableFloat(wr.TempLow),
+		nullableFloat(wr.TempHigh),
+		nullableString(wr.Source),
+		nullableString(wr.Base),
+		nullableFloat(wr.WindSpeed),
+		nullableFloat(wr.WindDeg),
+		nullableInt(wr.Visibility),
+		nullableInt(wr.Clouds),
+		jsonTime{wr.AtTime},
+	}
+}
+
+// AdminDebugLocationWeather handles authenticated GET requests for the cached row of a
+// location, specified by the query parameter 'city', as stored in the database. Unlike the
+// weather endpoint it never calls the openweather api and reports the raw, unrounded columns.
+func AdminDebugLocationWeather(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodError(w, http.MethodGet)
+		return
+	}
+
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	params, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	cityName := normalizeCityName(params.Get("city"))
+	if cityName == "" {
+		badRequestError(w, errCityRequired)
+		return
+	}
+
+	query, err := db.FetchLocationWeather(r.Context(), cityName)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	lr, wr := parseRows(query)
+	if lr == nil || wr == nil {
+		notFoundError(w, "no cached weather for location: "+cityName)
+		return
+	}
+
+	sendJSON(w, newCachedLocationWeather(lr, wr))
+}
+
+// weatherDiff is how a fresh reading differs from the cached one: the change in each
+// temperature, from cached to fresh, the conditions only one of them has, and how much older
+// the cached reading is.
+type weatherDiff struct {
+	LowTemp           *float64 `json:"low_temp,omitempty"`
+	HighTemp          *float64 `json:"high_temp,omitempty"`
+	MedianTemp        *float64 `json:"median_temp,omitempty"`
+	ConditionsAdded   []string `json:"conditions_added"`
+	ConditionsRemoved []string `json:"conditions_removed"`
+	AgeSeconds        int64    `json:"age_seconds"`
+}
+
+func newWeatherDiff(cached, fresh *weatherReport) *weatherDiff {
+	delta := func(from, to *float64) *float64 {
+		if from == nil || to == nil {
+			return nil
+		}
+		d := roundTemp(*to - *from)
+		return &d
+	}
+
+	diff := &weatherDiff{
+		LowTemp:           delta(cached.LowTemp, fresh.LowTemp),
+		HighTemp:          delta(cached.HighTemp, fresh.HighTemp),
+		MedianTemp:        delta(cached.MedianTemp, fresh.MedianTemp),
+		ConditionsAdded:   []string{},
+		ConditionsRemoved: []string{},
+		AgeSeconds:        int64(fresh.AtTime.Sub(cached.AtTime.Time).Seconds()),
+	}
+
+	inCached, inFresh := map[string]bool{}, map[string]bool{}
+
+	for _, label := range cached.Conditions {
+		inCached[label] = true
+	}
+
+	for _, label := range fresh.Conditions {
+		inFresh[label] = true
+
+		if !inCached[label] {
+			diff.ConditionsAdded = append(diff.ConditionsAdded, label)
+		}
+	}
+
+	for _, label := range cached.Conditions {
+		if !inFresh[label] {
+			diff.ConditionsRemoved = append(diff.ConditionsRemoved, label)
+		}
+	}
+
+	return diff
+}
+
+// AdminDiffLocationWeather handles authenticated GET requests comparing the cached reading at
+// a location, specified by the query parameter 'city', with a fresh one from the openweather
+// api, for diagnosing stale or wrong weather. The fresh reading isn't cached, but it does
+// count against dailyAPIBudget, and a 503 is sent once that's spent.
+func AdminDiffLocationWeather(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodError(w, http.MethodGet)
+		return
+	}
+
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	params, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	cityName := normalizeCityName(params.Get("city"))
+	if cityName == "" {
+		badRequestError(w, errCityRequired)
+		return
+	}
+
+	query, err := db.FetchLocationWeather(r.Context(), cityName)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	lr, wr := parseRows(query)
+	if lr == nil || wr == nil {
+		notFoundError(w, "no cached weather for location: "+cityName)
+		return
+	}
+
+	if err := reserveAPICall(r.Context()); err != nil {
+		sendWeatherError(w, r, err)
+		return
+	}
+
+	location, err := api.SharedClient.FetchCurrentWeatherByLocationName(r.Context(), cityName)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	if e := newUpstreamError(location); e != nil {
+		sendError(w, e.status, e)
+		return
+	}
+
+	reading := newWeatherRow(location)
+	reading.AtTime = nowFunc()
+
+	cached, fresh := newWeatherReport(cityName, wr), newWeatherReport(cityName, reading)
+
+	sendJSON(w, struct {
+		Cached *weatherReport `json:"cached"`
+		Fresh  *weatherReport `json:"fresh"`
+		Diff   *weatherDiff   `json:"diff"`
+	}{
+		cached,
+		fresh,
+		newWeatherDiff(cached, fresh),
+	})
+}
+
+// ReportExtremeCachedWeather handles GET requests for the warmest and coldest locations right
+// now, by the median temperature of the latest cached reading at each location. Only cached
+// data is consulted, so a 404 is sent if no weather is cached yet. The optional query
+// parameter 'max_age' leaves out locations whose latest reading is older, see parseMaxAge.
+func ReportExtremeCachedWeather(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodError(w, http.MethodGet)
+		return
+	}
+
+	params, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	maxAge, err := parseMaxAge(params)
+	if err != nil {
+		badRequestError(w, err)
+		return
+	}
+
+	since := freshSince(maxAge)
+
+	warmLocation, warmWeather, err := db.ExtremeCachedLocation(r.Context(), true, since)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	coldLocation, coldWeather, err := db.ExtremeCachedLocation(r.Context(), false, since)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	if warmLocation == nil || coldLocation == nil {
+		if maxAge > 0 {
+			notFoundError(w, fmt.Sprintf("no fresh data: no cached weather with temperatures newer than %s", maxAge))
+			return
+		}
+		notFoundError(w, "no cached weather with temperatures yet")
+		return
+	}
+
+	sendJSON(w, struct {
+		Warmest *weatherReport `json:"warmest"`
+		Coldest *weatherReport `json:"coldest"`
+	}{
+		newWeatherReport(warmLocation.CityName.String, warmWeather),
+		newWeatherReport(coldLocation.CityName.String, coldWeather),
+	})
+}
+
+// Page sizes of list endpoints: the size of a page when 'limit' is omitted, and the largest
+// page a client can ask for. They can be overridden from the environment on startup.
+var (
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+)
+
+// parsePagination reads the optional query parameters 'limit' and 'offset' of a list endpoint.
+// The limit defaults to defaultPageLimit and is capped at maxPageLimit, the offset defaults to
+// 0. Either that isn't a number, or is too small, is an error.
+func parsePagination(r *http.Request) (limit, offset int, err error) {
+	params, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	limit = defaultPageLimit
+
+	if v := params.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return 0, 0, errors.New("limit must be a positive integer: " + v)
+		}
+	}
+
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+
+	if v := params.Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return 0, 0, errors.New("offset must be a non-negative integer: " + v)
+		}
+	}
+
+	return limit, offset, nil
+}
+
+// ReportAllLocationWeather handles GET requests for the latest cached weather at every
+// location, ordered by location name, a page at a time. The page is chosen by the optional
+// query parameters 'limit' and 'offset', see parsePagination. Only cached data is consulted.
+// If there may be more locations, 'next_offset' gives the offset of the next page. With
+// 'shape=compact' the weather is written as compactWeather. The optional query parameter
+// 'max_age' leaves out locations whose latest reading is older, see parseMaxAge.
+func ReportAllLocationWeather(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodError(w, http.MethodGet)
+		return
+	}
+
+	params, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		badRequestError(w, err)
+		return
+	}
+
+	compact, err := parseWeatherShape(params)
+	if err != nil {
+		badRequestError(w, err)
+		return
+	}
+
+	maxAge, err := parseMaxAge(params)
+	if err != nil {
+		badRequestError(w, err)
+		return
+	}
+
+	latest, err := db.LatestWeatherForAllLocations(r.Context(), freshSince(maxAge), limit, offset)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	reports := []interface{}{}
+
+	for _, lw := range latest {
+		report := newWeatherReport(lw.Location.CityName.String, lw.Weather)
+
+		if compact {
+			reports = append(reports, compactWeather{report})
+		} else {
+			reports = append(reports, report)
+		}
+	}
+
+	var next *int
+
+	if len(latest) == limit {
+		n := offset + limit
+		next = &n
+	}
+
+	sendJSON(w, struct {
+		Weather    []interface{} `json:"weather"`
+		Limit      int           `json:"limit"`
+		Offset     int           `json:"offset"`
+		NextOffset *int          `json:"next_offset,omitempty"`
+	}{
+		reports,
+		limit,
+		offset,
+		next,
+	})
+}
+
+// ReportWeatherHistory handles GET requests for an export of the cached readings, oldest first,
+// a page at a time, optionally only at the location given by the query parameter 'city'. The
+// page is chosen by the optional query parameters 'limit' and 'offset', see parsePagination.
+// The readings are streamed as a JSON array while they're read from the database, so large
+// pages use little memory. The status is sent before the first reading, so an error part way
+// through is reported as a final {"error": str} element of the array. With 'shape=compact'
+// the readings are written as compactWeather. With 'bucket', a duration such as "1h", the
+// readings at the location are downsampled instead, see sendDownsampledWeather.
+func ReportWeatherHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodError(w, http.MethodGet)
+		return
+	}
+
+	params, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	cityName := normalizeCityName(params.Get("city"))
+
+	if params.Get("bucket") != "" {
+		sendDownsampledWeather(w, r, cityName, params)
+		return
+	}
+
+	compact, err := parseWeatherShape(params)
+	if err != nil {
+		badRequestError(w, err)
+		return
+	}
+
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		badRequestError(w, err)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+
+	var (
+		enc   = json.NewEncoder(w)
+		count = 0
+	)
+
+	io.WriteString(w, "[")
+
+	err = db.EachWeatherReading(r.Context(), cityName, limit, offset, func(city string, wr *db.WeatherRow) error {
+		if count > 0 {
+			io.WriteString(w, ",")
+		}
+
+		count++
+
+		if compact {
+			return enc.Encode(compactWeather{newWeatherReport(city, wr)})
+		}
+
+		return enc.Encode(newWeatherReport(city, wr))
+	})
+
+	if err != nil {
+		log.Printf("request %s: %s", requestID(r.Context()), err)
+
+		if count > 0 {
+			io.WriteString(w, ",")
+		}
+
+		enc.Encode(struct {
+			Error string `json:"error"`
+		}{
+			err.Error(),
+		})
+	}
+
+	io.WriteString(w, "]\n")
+}
+
+// downsampledReading is the average median temperature at a location over a bucket of time.
+type downsampledReading struct {
+	Bucket     jsonTime `json:"bucket"`
+	MedianTemp float64  `json:"median_temp"`
+}
+
+// sendDownsampledWeather responds with the median temperature at the location named 'cityName'
+// averaged over buckets of time, each as long as the query parameter 'bucket', oldest first,
+// so charts of long ranges get an evenly spaced series however dense the readings are. The
+// optional 'date', or 'from' and 'to', parameters limit the range, buckets starting at 'from'.
+func sendDownsampledWeather(w http.ResponseWriter, r *http.Request, cityName string, params url.Values) {
+	if cityName == "" {
+		badRequestError(w, errCityRequired)
+		return
+	}
+
+	bucket, err := parseDuration(params.Get("bucket"), time.Second)
+	if err != nil || bucket < time.Second {
+		badRequestError(w, errors.New("bucket must be a duration of at least a second: "+params.Get("bucket")))
+		return
+	}
+
+	dates, err := parseDateRange(params)
+	if err != nil {
+		badRequestError(w, err)
+		return
+	}
+
+	if dates == nil {
+		dates = &db.DateRange{}
+	}
+
+	readings, err := db.WeatherDownsampled(r.Context(), cityName, dates.From, dates.To, bucket)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	series := []downsampledReading{}
+
+	for _, r := range readings {
+		series = append(series, downsampledReading{jsonTime{r.Bucket}, roundTemp(r.AvgMid)})
+	}
+
+	sendJSON(w, series)
+}
+
+// maxActivityFillDays caps the days reported by the weather activity endpoint when it fills in
+// days without readings.
+const maxActivityFillDays = 1000
+
+// ReportWeatherActivity handles GET requests for the number of readings at a location on each
+// day, keyed by date, for an activity sparkline showing how densely and how recently it has
+// been read. The location is specified by the query parameter 'city', and the optional 'date',
+// or 'from' and 'to', parameters limit the range. Days without readings are left out, unless
+// the optional query parameter 'fill' is true, in which case they're reported as 0 from the
+// start of the range, or the first reading, to its end, or the last reading.
+func ReportWeatherActivity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodError(w, http.MethodGet)
+		return
+	}
+
+	params, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	cityName := normalizeCityName(params.Get("city"))
+	if cityName == "" {
+		badRequestError(w, errCityRequired)
+		return
+	}
+
+	fill := false
+	if v := params.Get("fill"); v != "" {
+		if fill, err = strconv.ParseBool(v); err != nil {
+			badRequestError(w, errors.New("fill must be true or false: "+v))
+			return
+		}
+	}
+
+	dates, err := parseDateRange(params)
+	if err != nil {
+		badRequestError(w, err)
+		return
+	}
+
+	if dates == nil {
+		dates = &db.DateRange{}
+	}
+
+	counts, err := db.ReadingCountsByDay(r.Context(), cityName, dates.From, dates.To)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	if fill {
+		first, last := dates.From, time.Time{}
+		if !dates.To.IsZero() {
+			last = dates.To.AddDate(0, 0, -1) // the range ends before 'to'
+		}
+
+		for day := range counts {
+			t, _ := time.Parse(dateFormat, day)
+			if dates.From.IsZero() && (first.IsZero() || t.Before(first)) {
+				first = t
+			}
+			if dates.To.IsZero() && (last.IsZero() || t.After(last)) {
+				last = t
+			}
+		}
+
+		if !first.IsZero() && !last.IsZero() {
+			if last.Sub(first) >= maxActivityFillDays*24*time.Hour {
+				badRequestError(w, fmt.Errorf("can't fill more than %d days, narrow the range with from and to", maxActivityFillDays))
+				return
+			}
+
+			for day := first; !day.After(last); day = day.AddDate(0, 0, 1) {
+				if _, exists := counts[day.Format(dateFormat)]; !exists {
+					counts[day.Format(dateFormat)] = 0
+				}
+			}
+		}
+	}
+
+	// dates sort as strings, so the days are sent in order
+	sendJSON(w, counts)
+}
+
+// AdminRefreshStatsSummary handles authenticated POST requests to recompute the stats summary
+// immediately, for example after a bulk import, rather than waiting for the periodic refresh.
+// It reports how long the refresh took and how many location-month buckets were recomputed.
+// Only one refresh runs at a time, a request made during another refresh is rejected.
+func AdminRefreshStatsSummary(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodError(w, http.MethodPost)
+		return
+	}
+
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	start := time.Now()
+
+	buckets, err := db.RefreshStatsSummary()
+	if err != nil {
+		if err == db.ErrStatsRefreshInProgress {
+			conflictError(w, err)
+			return
+		}
+		internalServerError(w, r, err)
+		return
+	}
+
+	sendJSON(w, struct {
+		DurationMs int64 `json:"duration_ms"`
+		Buckets    int64 `json:"buckets"`
+	}{
+		time.Since(start).Milliseconds(),
+		buckets,
+	})
+}
+
+// retention is how long weather readings are kept, older readings are purged periodically.
+// Readings are kept forever unless it's configured from the environment on startup.
+var (
+	retention time.Duration
+)
+
+// AdminPurgeWeather handles authenticated POST requests to delete weather readings older than
+// the number of days given by the query parameter 'days', or if it's omitted, the configured
+// retention. It reports how many readings were removed.
+func AdminPurgeWeather(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodError(w, http.MethodPost)
+		return
+	}
+
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	params, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	olderThan := retention
+
+	if v := params.Get("days"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 1 {
+			badRequestError(w, errors.New("days must be a positive integer: "+v))
+			return
+		}
+		olderThan = time.Duration(days) * 24 * time.Hour
+	}
+
+	if olderThan <= 0 {
+		badRequestError(w, errors.New("days parameter required when no retention is configured"))
+		return
+	}
+
+	purged, err := db.PurgeWeatherOlderThan(olderThan)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	sendJSON(w, struct {
+		OlderThan string `json:"older_than"`
+		Purged    int    `json:"purged"`
+	}{
+		olderThan.String(),
+		purged,
+	})
+}
+
+// defaultStaleAfter is how long since its latest reading a location is reported as stale by
+// AdminReportStaleLocations when no threshold is given.
+const defaultStaleAfter = time.Hour
+
+// staleLocation is a location whose weather hasn't been refreshed recently, with the time of
+// its latest reading and how long ago that was.
+type staleLocation struct {
+	City          string   `json:"city"`
+	LatestReading jsonTime `json:"latest_reading"`
+	AgeSeconds    int64    `json:"age_seconds"`
+}
+
+// AdminReportStaleLocations handles authenticated GET requests for the locations whose latest
+// reading is older than the query parameter 'older_than', a duration that defaults to an hour,
+// the longest unrefreshed first, a page at a time, see parsePagination. It helps spot locations that stopped refreshing, for example
+// because the api can no longer resolve them.
+func AdminReportStaleLocations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodError(w, http.MethodGet)
+		return
+	}
+
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	params, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	olderThan := defaultStaleAfter
+
+	if v := params.Get("older_than"); v != "" {
+		d, err := parseDuration(v, time.Second)
+		if err != nil || d <= 0 {
+			badRequestError(w, errors.New("older_than must be a positive duration: "+v))
+			return
+		}
+		olderThan = d
+	}
+
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		badRequestError(w, err)
+		return
+	}
+
+	rows, err := db.StaleLocations(r.Context(), olderThan, limit, offset)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	stale := []staleLocation{}
+
+	for _, sl := range rows {
+		stale = append(stale, staleLocation{
+			City:          sl.Location.CityName.String,
+			LatestReading: jsonTime{sl.LatestReading},
+			AgeSeconds:    int64(nowFunc().Sub(sl.LatestReading).Seconds()),
+		})
+	}
+
+	var next *int
+
+	if len(rows) == limit {
+		n := offset + limit
+		next = &n
+	}
+
+	sendJSON(w, struct {
+		OlderThan  string          `json:"older_than"`
+		Locations  []staleLocation `json:"locations"`
+		Limit      int             `json:"limit"`
+		Offset     int             `json:"offset"`
+		NextOffset *int            `json:"next_offset,omitempty"`
+	}{
+		olderThan.String(),
+		stale,
+		limit,
+		offset,
+		next,
+	})
+}
+
+// AdminReportAPIQuota handles authenticated GET requests for today's usage of the openweather
+// api: the calls made, and if a dailyAPIBudget is configured, the budget and what's left of it.
+func AdminReportAPIQuota(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodError(w, http.MethodGet)
+		return
+	}
+
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	calls, err := db.APICallsToday(r.Context())
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	var budget, remaining *int
+
+	if dailyAPIBudget > 0 {
+		n := dailyAPIBudget - calls
+		if n < 0 {
+			n = 0
+		}
+
+		b := dailyAPIBudget
+		budget, remaining = &b, &n
+	}
+
+	sendJSON(w, struct {
+		Calls     int  `json:"calls"`
+		Budget    *int `json:"budget,omitempty"`
+		Remaining *int `json:"remaining,omitempty"`
+	}{
+		calls,
+		budget,
+		remaining,
+	})
+}
+
+// AdminMergeDuplicateLocations handles authenticated POST requests to merge locations stored
+// under differently written names of the same location, see db.MergeDuplicateLocations. It
+// responds with the number of duplicates 'merged', or a 409 without normalizeCityNames, as
+// merging would title case names given as they're meant to be written.
+func AdminMergeDuplicateLocations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodError(w, http.MethodPost)
+		return
+	}
+
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	if !normalizeCityNames {
+		conflictError(w, errors.New("city name normalization is disabled, so locations aren't merged"))
+		return
+	}
+
+	merged, err := db.MergeDuplicateLocations()
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	sendJSON(w, struct {
+		Merged int `json:"merged"`
+	}{
+		merged,
+	})
+}
+
+// maxBulkAccounts caps the number of usernames in a single bulk account registration.
+const maxBulkAccounts = 100
+
+// AdminBulkCreateAccounts handles authenticated POST requests for registering many accounts
+// at once, for example when seeding an environment. Clients must send the usernames in a JSON
+// payload, for example: {"usernames": str[]}. The accounts and their bookmark collections are
+// created in a single transaction. Usernames that are already taken are skipped and reported
+// as conflicts, and invalid usernames are reported as invalid, without failing the batch.
+func AdminBulkCreateAccounts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodError(w, http.MethodPost)
+		return
+	}
+
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	payload := struct {
+		Usernames []string `json:"usernames"`
+	}{
+		[]string{},
+	}
+
+	if !decodeBody(w, r, &payload) {
+		return
+	}
+
+	if len(payload.Usernames) > maxBulkAccounts {
+		sendError(
+			w,
+			http.StatusRequestEntityTooLarge,
+			fmt.Errorf("too many usernames in batch: %d, the maximum is %d", len(payload.Usernames), maxBulkAccounts))
+		return
+	}
+
+	type result struct {
+		Username             string `json:"username"`
+		Status               string `json:"status"`
+		ID                   int64  `json:"id,omitempty"`
+		BookmarkCollectionID int64  `json:"bookmark_collection_id,omitempty"`
+		Error                string `json:"error,omitempty"`
+	}
+
+	var (
+		results = make([]result, len(payload.Usernames))
+		valid   = []string{}
+	)
+
+	for i, username := range payload.Usernames {
+		results[i].Username = username
+
+		if err := validateUsername(username); err != nil {
+			results[i].Status = "invalid"
+			results[i].Error = err.Error()
+			continue
+		}
+
+		valid = append(valid, username)
+	}
+
+	created, err := db.NewAccounts(valid...)
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+
+	for i := range results {
+		if results[i].Status != "" {
+			continue
+		}
+
+		c := created[0]
+		created = created[1:]
+
+		if c.Conflict {
+			results[i].Status = "conflict"
+			continue
+		}
+
+		results[i].Status = "created"
+		results[i].ID = c.Account.ID.Int64
+		results[i].BookmarkCollectionID = c.Collection.ID.Int64
+	}
+
+	sendJSON(w, results)
+}
+
+// AccountUserAction handles both GET and PUT requests for an account user. GET requests
+// are handled by GetAccountUserInfo and PUT requests by RenameAccount.
+func AccountUserAction(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		GetAccountUserInfo(w, r)
+	case http.MethodPut:
+		RenameAccount(w, r)
+	default:
+		methodError(w, http.MethodGet, http.MethodPut)
+	}
+}
+
+// GetAccountUserInfo handles GET requests for account user info. The account user
+// should be specifed by as a value to the query parameter 'username'.
+func GetAccountUserInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodError(w, http.MethodGet)
+		return
+	}
+
+	params, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	username := params.Get("username")
+
+	acc, err := db.ExistingAccount(username)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	if acc == nil {
+		notFoundError(w, "no account found with that username: "+username)
+		return
+	}
+
+	sendJSON(w, struct {
+		Name string `json:"name,omitempty"`
+		ID   int64  `json:"id,omitempty"`
+	}{
+		acc.Name.String,
+		acc.ID.Int64,
+	})
+}
+
+// CreateNewAccount handles POST requests for registering a new account. Clients
+// must send the account username in a JSON payload, for example: {"username": str}.
+// Registering a username that already exists returns the existing account.
+func CreateNewAccount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodError(w, http.MethodPost)
+		return
+	}
+
+	payload := map[string]string{}
+
+	if !decodeBody(w, r, &payload) {
+		return
+	}
+
+	username := payload["username"]
+
+	if err := validateUsername(username); err != nil {
+		badRequestError(w, err)
+		return
+	}
+
+	acc, err := db.NewAccount(username)
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+
+	col, err := acc.NewBookmarkCollection()
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+
+	sendJSON(
+		w,
+		struct {
+			Name                  string  `json:"name,omitempty"`
+			ID                    int64   `json:"id,omitempty"`
+			BookmarkCollectionID  int64   `json:"bookmark_collection_id,omitempty"`
+			BookmarkedLocationIDs []int64 `json:"bookmarked_location_i_ds,omitempty"`
+		}{
+			acc.Name.String,
+			acc.ID.Int64,
+			col.ID.Int64,
+			col.LocationIDs,
+		})
+}
+
+// RenameAccount handles PUT requests for renaming an account. Clients must send the current
+// and new usernames in a JSON payload, for example: {"username": str, "new_username": str}.
+// Responds with a 409 if the new username is already taken.
+func RenameAccount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		methodError(w, http.MethodPut)
+		return
+	}
+
+	payload := map[string]string{}
+
+	if !decodeBody(w, r, &payload) {
+		return
+	}
+
+	username := payload["username"]
+	newUsername := payload["new_username"]
+
+	if err := validateUsername(newUsername); err != nil {
+		badRequestError(w, err)
+		return
+	}
+
+	acc, err := db.UpdateAccountName(username, newUsername)
+	if err != nil {
+		if err == db.ErrAccountNameTaken {
+			conflictError(w, err)
+			return
+		}
+		storeError(w, r, err)
+		return
+	}
+
+	if acc == nil {
+		notFoundError(w, "no account found with that username: "+username)
+		return
+	}
+
+	sendJSON(w, struct {
+		Name string `json:"name,omitempty"`
+		ID   int64  `json:"id,omitempty"`
+	}{
+		acc.Name.String,
+		acc.ID.Int64,
+	})
+}
+
+// AccountBookmarksCollectionAction handles GET, POST and PUT requests. As a GET, returns
+// the bookmarks for an account user, where the account user is specified as the query parameter, 'username'.
+// As a POST, will update the bookmarks of an account user where the username and bookmarks to be added
+// is specified by the JSON payload: {"username": str, "locations": str[]}. As a PUT, takes the same
+// payload but replaces the bookmarks of the account user with exactly the given locations.
+func AccountBookmarksCollectionAction(w http.ResponseWriter, r *http.Request) {
+	var (
+		result interface{}
+	)
+
+	switch r.Method {
+	case http.MethodGet:
+		params, err := url.ParseQuery(r.URL.RawQuery)
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+
+		username := params.Get("username")
+
+		acc, err := db.ExistingAccount(username)
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+
+		if acc == nil {
+			notFoundError(w, "no account found with that username: "+username)
+			return
+		}
+
+		col, err := acc.GetBookmarkCollectionIDs()
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+
+		if col == nil {
+			notFoundError(w, fmt.Sprintf("no bookmark collection associated with that id: %d", acc.ID.Int64))
+			return
+		}
+
+		locs, err := col.NamesFromIDs()
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+
+		result = struct {
+			Bookmarks []string
+		}{
+			locs,
+		}
+
+		break
+	case http.MethodPost, http.MethodPut:
+		payload := struct {
+			Username  string
+			Locations []string
+		}{
+			"",
+			[]string{},
+		}
+
+		if !decodeBody(w, r, &payload) {
+			return
+		}
+
+		acc, err := db.ExistingAccount(payload.Username)
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+
+		if acc == nil {
+			notFoundError(w, "no account found with that username: "+payload.Username)
+			return
+		}
+
+		newIDs, err := db.IDsFromNames(payload.Locations...)
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+
+		var col *db.BookmarkRow
+
+		if r.Method == http.MethodPut {
+			col, err = acc.ReplaceBookmarkCollectionIDs(newIDs...)
+		} else {
+			col, err = acc.UpdateBookmarkCollectionIDs(newIDs...)
+		}
+
+		if err != nil {
+			storeError(w, r, err)
+			return
+		}
+
+		if col == nil {
+			notFoundError(w, fmt.Sprintf("no bookmark collection associated with that id: %d", acc.ID.Int64))
+			return
+		}
+
+		locs, err := col.NamesFromIDs()
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+
+		result = struct {
+			Bookmarks []string
+		}{
+			locs,
+		}
+	default:
+		methodError(w, http.MethodGet, http.MethodPost, http.MethodPut)
+		return
+	}
+
+	sendJSON(w, result)
+}
+
+// Default criteria for extreme weather, temperatures are in kelvin.
+const (
+	defaultExtremeHotTemp  = 308.15 // 35C
+	defaultExtremeColdTemp = 263.15 // -10C
+)
+
+var (
+	defaultExtremeLabels = []string{"Thunderstorm", "Snow", "Tornado", "Squall"}
+)
+
+// ReportExtremeBookmarkWeather handles GET requests for the bookmarked locations of an account
+// user whose latest cached weather is extreme. The account user is specified by the query
+// parameter 'username'. What counts as extreme can be set with the optional query parameters
+// 'hot' and 'cold', temperatures in kelvin, and 'labels', a comma separated list of weather labels.
+func ReportExtremeBookmarkWeather(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		methodError(w, errMethodMustBeGET)
+		methodError(w, http.MethodGet)
 		return
 	}
 
-	// this *should* be an external function ..otherwise we create a new anonymous instance every request
-	parseRows := func(q db.QueryResult) (lr *db.LocationRow, wr *db.WeatherRow) {
-		for _, v := range q {
-			switch row := v.(type) {
-			case *db.LocationRow:
-				lr = row
-			case *db.WeatherRow:
-				wr = row
-			}
+	params, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	var (
+		hot    = defaultExtremeHotTemp
+		cold   = defaultExtremeColdTemp
+		labels = defaultExtremeLabels
+	)
+
+	if v := params.Get("hot"); v != "" {
+		if hot, err = strconv.ParseFloat(v, 64); err != nil {
+			badRequestError(w, err)
+			return
 		}
-		return lr, wr
 	}
 
-	params, err := url.ParseQuery(r.URL.RawQuery)
+	if v := params.Get("cold"); v != "" {
+		if cold, err = strconv.ParseFloat(v, 64); err != nil {
+			badRequestError(w, err)
+			return
+		}
+	}
+
+	if v := params.Get("labels"); v != "" {
+		labels = strings.Split(v, ",")
+	}
+
+	username := params.Get("username")
+
+	acc, err := db.ExistingAccount(username)
 	if err != nil {
-		internalServerError(w, err)
+		internalServerError(w, r, err)
 		return
 	}
 
-	cityName := strings.Title(params.Get("city"))
-	refresh := true
+	if acc == nil {
+		notFoundError(w, "no account found with that username: "+username)
+		return
+	}
 
-	query, err := db.FetchLocationWeather(cityName)
+	col, err := acc.GetBookmarkCollectionIDs()
 	if err != nil {
-		internalServerError(w, err)
+		internalServerError(w, r, err)
 		return
 	}
 
-	var (
-		lr *db.LocationRow
-		wr *db.WeatherRow
-	)
+	if col == nil {
+		notFoundError(w, fmt.Sprintf("no bookmark collection associated with that id: %d", acc.ID.Int64))
+		return
+	}
 
-	lr, wr = parseRows(query)
+	locs, err := col.NamesFromIDs()
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	latest, err := db.LatestLocationWeather(locs...)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
 
-	if lr != nil && wr != nil {
-		delta := time.Now().Sub(wr.AtTime)
+	type extremeWeather struct {
+		CityName   string   `json:"city_name"`
+		Reasons    []string `json:"reasons"`
+		Conditions []string `json:"conditions,omitempty"`
+		LowTemp    float64  `json:"low_temp"`
+		HighTemp   float64  `json:"high_temp"`
+		AtTime     jsonTime `json:"at_time"`
+	}
 
-		if delta.Minutes() < cacheTTLMinutes {
-			refresh = false
+	extreme := []extremeWeather{}
 
-			if err := lr.IncrQueryCount(); err != nil {
-				internalServerError(w, err)
-				return
-			}
+	for _, city := range locs {
+		wr, exists := latest[city]
+		if !exists {
+			continue
 		}
-	}
 
-	if refresh {
-		location, err := api.SharedClient.FetchCurrentWeatherByLocationName(cityName)
-		if err != nil {
-			internalServerError(w, err)
-			return
+		reasons := []string{}
+
+		if wr.TempHigh.Valid && wr.TempHigh.Float64 >= hot {
+			reasons = append(reasons, "hot")
 		}
 
-		if location.Cod != 200 {
-			if location.Message != nil {
-				sendMessage(w, *location.Message)
-			} else {
-				sendMessage(w, "failed to communicate with the openweather api: unknown reason")
+		if wr.TempLow.Valid && wr.TempLow.Float64 <= cold {
+			reasons = append(reasons, "cold")
+		}
+
+		for _, l := range wr.Labels {
+			if hasParam(labels, strings.ToLower(l)) {
+				reasons = append(reasons, l)
 			}
-			return
 		}
 
-		tempMin := location.Main.TempMin
-		tempMax := location.Main.TempMax
-		labels := location.WeatherLabels()
+		if len(reasons) == 0 {
+			continue
+		}
+
+		extreme = append(extreme, extremeWeather{
+			city,
+			reasons,
+			wr.Labels,
+			roundTemp(wr.TempLow.Float64),
+			roundTemp(wr.TempHigh.Float64),
+			jsonTime{wr.AtTime},
+		})
+	}
 
-		query, err = db.UpdateCachedLocationWeather(cityName, tempMin, tempMax, labels...)
-		if err != nil {
-			internalServerError(w, err)
+	sendJSON(w, struct {
+		Extreme []extremeWeather `json:"extreme"`
+	}{
+		extreme,
+	})
+}
+
+// ReportBookmarkWeather handles GET requests for the weather at one bookmarked location of an
+// account user, the user specified by the query parameter 'username' and the location by 'city'.
+// The location must be in the user's bookmarks. Its weather is reported as by the location
+// weather endpoint, including the optional query parameter 'units'.
+func ReportBookmarkWeather(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodError(w, http.MethodGet)
+		return
+	}
+
+	params, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	username := params.Get("username")
+	if username == "" {
+		badRequestError(w, errUsernameEmpty)
+		return
+	}
+
+	cityName := normalizeCityName(params.Get("city"))
+	if cityName == "" {
+		badRequestError(w, errCityRequired)
+		return
+	}
+
+	unitsParam := params.Get("units")
+
+	if unitsParam != "" && unitsParam != unitsStandard && unitsParam != unitsAll {
+		badRequestError(w, errors.New("unsupported units: "+unitsParam))
+		return
+	}
+
+	acc, err := db.ExistingAccount(username)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	if acc == nil {
+		notFoundError(w, "no account found with that username: "+username)
+		return
+	}
+
+	col, err := acc.GetBookmarkCollectionIDs()
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	var locs []string
+
+	if col != nil {
+		if locs, err = col.NamesFromIDs(); err != nil {
+			internalServerError(w, r, err)
 			return
 		}
+	}
 
-		lr, wr = parseRows(query)
+	bookmarked := false
+	for _, loc := range locs {
+		bookmarked = bookmarked || loc == cityName
 	}
 
-	sendJSON(
-		w,
-		struct {
-			CityName   string    `json:"city_name,omitempty"`
-			Conditions []string  `json:"conditions,omitempty"`
-			LowTemp    float64   `json:"low_temp,omitempty"`
-			HighTemp   float64   `json:"high_temp,omitempty"`
-			MedianTemp float64   `json:"median_temp,omitempty"`
-			AtTime     time.Time `json:"at_time,omitempty"`
-		}{
-			cityName,
-			wr.Labels,
-			wr.TempLow.Float64,
-			wr.TempHigh.Float64,
-			(wr.TempLow.Float64 + wr.TempHigh.Float64) / 2, // uh-oh, overflow (jk, unlikely but this would be somthing to test huh)
-			wr.AtTime,
-		})
+	if !bookmarked {
+		notFoundError(w, fmt.Sprintf("%s is not bookmarked by %s", cityName, username))
+		return
+	}
+
+	report, err := locationWeather(r.Context(), cityName)
+	if err != nil {
+		sendWeatherError(w, r, err)
+		return
+	}
+
+	setFreshnessHeaders(w, report, unitsParam)
+
+	if unitsParam == unitsAll {
+		sendJSON(w, report.inAllUnits())
+		return
+	}
+
+	sendJSON(w, report)
 }
 
-// ReportWeatherStatistics handles GET requests for various weather stats depending
-// on what query parameter are set. If no query string is found in the uri, the full list of
-// available parameters is returned as a JSON payload.
-func ReportWeatherStatistics(w http.ResponseWriter, r *http.Request) {
+// ExportAccount handles GET requests for all of an account user's data in one document, for
+// data portability: the account, its bookmark collection and each bookmarked location by id
+// and name. The account user is specified by the query parameter 'username'. If the optional
+// query parameter 'weather' is true, each bookmark also has its latest cached weather, read
+// from the database without calling the openweather api. Accounts have no credentials of their
+// own, so only the admin may export them.
+func ExportAccount(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		methodError(w, errMethodMustBeGET)
+		methodError(w, http.MethodGet)
+		return
+	}
+
+	if !authorizeAdmin(w, r) {
 		return
 	}
 
 	params, err := url.ParseQuery(r.URL.RawQuery)
 	if err != nil {
-		internalServerError(w, err)
+		internalServerError(w, r, err)
 		return
 	}
 
-	// if no query parameters are attached to the request, we send a payload that lists available query parameters
-	if sendDoc(w,
-		struct {
-			ValidQueryParameters []string
-		}{
-			[]string{
-				"count=query|labels (only query is implemented)",
-				"summary=day|month|year (only day is implemented)",
-				"temp=lows|highs|avgs",
-			},
-		},
-		func() bool { return len(params) == 0 },
-	) {
+	username := params.Get("username")
+	if username == "" {
+		badRequestError(w, errUsernameEmpty)
 		return
 	}
 
-	var (
-		stats = make(map[string]interface{})
-	)
+	withWeather := false
+	if v := params.Get("weather"); v != "" {
+		if withWeather, err = strconv.ParseBool(v); err != nil {
+			badRequestError(w, errors.New("weather must be true or false: "+v))
+			return
+		}
+	}
 
-	for q, p := range params {
-		switch q {
-		case "count":
-			if hasParam(p, "query") {
-				count, err := db.TotalQueryCount()
-				if err != nil {
-					internalServerError(w, err)
-					return
-				}
+	acc, err := db.ExistingAccount(username)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
 
-				stats["count"] = map[string]interface{}{
-					"location_queries": &count,
-				}
+	if acc == nil {
+		notFoundError(w, "no account found with that username: "+username)
+		return
+	}
+
+	type bookmark struct {
+		ID       int64          `json:"id"`
+		CityName string         `json:"city_name"`
+		Weather  *weatherReport `json:"weather,omitempty"`
+	}
+
+	export := struct {
+		Name                 string     `json:"name"`
+		ID                   int64      `json:"id"`
+		BookmarkCollectionID int64      `json:"bookmark_collection_id,omitempty"`
+		Bookmarks            []bookmark `json:"bookmarks"`
+	}{
+		Name:      acc.Name.String,
+		ID:        acc.ID.Int64,
+		Bookmarks: []bookmark{},
+	}
+
+	col, err := acc.GetBookmarkCollectionIDs()
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	if col != nil {
+		export.BookmarkCollectionID = col.ID.Int64
+
+		locs, err := col.LocationsFromIDs()
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+
+		var latest map[string]*db.WeatherRow
+
+		if withWeather {
+			names := make([]string, len(locs))
+			for i, loc := range locs {
+				names[i] = loc.CityName
 			}
 
-			if hasParam(p, "labels") {
-				labels, err := db.KnownWeatherLabels()
-				if err != nil {
-					internalServerError(w, err)
-					return
-				}
+			latest, err = db.LatestLocationWeather(names...)
+			if err != nil {
+				internalServerError(w, r, err)
+				return
+			}
+		}
+
+		for _, loc := range locs {
+			b := bookmark{ID: loc.ID, CityName: loc.CityName}
 
-				stats["labels"] = labels
+			if wr, exists := latest[loc.CityName]; exists {
+				b.Weather = newWeatherReport(loc.CityName, wr)
 			}
 
-			break
-		case "summary":
-			if hasParam(p, "day") {
-				summary, err := db.DailyWeatherSummary()
-				if err != nil {
-					internalServerError(w, err)
-					return
-				}
+			export.Bookmarks = append(export.Bookmarks, b)
+		}
+	}
+
+	sendJSON(w, export)
+}
+
+/*
+	utility functions
+*/
+
+func nullableTemp(f sql.NullFloat64) *float64 {
+	if !f.Valid {
+		return nil
+	}
+	t := roundTemp(f.Float64)
+	return &t
+}
+
+// nullableFloat is nullableTemp without the rounding.
+func nullableFloat(f sql.NullFloat64) *float64 {
+	if !f.Valid {
+		return nil
+	}
+	return &f.Float64
+}
+
+func nullableString(s sql.NullString) *string {
+	if !s.Valid {
+		return nil
+	}
+	return &s.String
+}
+
+func nullableInt(i sql.NullInt64) *int64 {
+	if !i.Valid {
+		return nil
+	}
+	return &i.Int64
+}
+
+func parseRows(q db.QueryResult) (lr *db.LocationRow, wr *db.WeatherRow) {
+	for _, v := range q {
+		switch row := v.(type) {
+		case *db.LocationRow:
+			lr = row
+		case *db.WeatherRow:
+			wr = row
+		}
+	}
+	return lr, wr
+}
 
-				stats["summary"] = map[string]interface{}{
-					"daily": summary,
-				}
-			}
+func isCached(lr *db.LocationRow, wr *db.WeatherRow) bool {
+	if lr == nil || wr == nil {
+		return false
+	}
 
-			break
-		case "temp":
-			if hasParam(p, "lows", "highs", "avgs") { // can get lows, highs and avgs in one query
-				temps := map[string]db.LocationTemperatureQueryResult{}
+	return nowFunc().Sub(wr.AtTime) < cacheTTL
+}
 
-				for _, subv := range p {
-					f := db.TemperatureQueryFilter(subv)
+// withDeadline wraps a handler so that each request's context expires after requestTimeout.
+// Handlers pass the context on to the database and the openweather api, so a slow dependency
+// can't hold a request past its budget, and a client disconnecting cancels its work.
+func withDeadline(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+		defer cancel()
 
-					var report db.LocationTemperatureQueryResult
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
 
-					if f == db.FilterAverages {
-						report, err = db.MonthlyAverageTemperature()
-					} else {
-						report, err = db.MonthlyTemperature(f)
-					}
+// maxInFlight is the most requests that are handled at once, beyond which requests are turned
+// away rather than left to exhaust database connections. Requests aren't limited unless it's
+// configured from the environment on startup.
+var (
+	maxInFlight = 0
+)
 
-					if err != nil {
-						internalServerError(w, err)
-						return
-					}
+// inFlightRetryAfter is how long, in seconds, clients turned away by the concurrency limit are
+// told to wait before trying again.
+const inFlightRetryAfter = 1
 
-					temps[subv] = report
-				}
+var errTooManyInFlight = errors.New("too many requests in flight, try again later")
 
-				stats["temperatures"] = temps
-			}
+// withConcurrencyLimit wraps a handler so that at most 'limit' requests are handled at once.
+// Requests beyond the limit are answered with 503 and a Retry-After header straight away.
+// Health and status checks are never limited, so that a busy instance isn't reported as down.
+func withConcurrencyLimit(h http.Handler, limit int) http.Handler {
+	inFlight := make(chan struct{}, limit)
 
-			break
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/status" || strings.HasPrefix(r.URL.Path, "/api/v1/health") {
+			h.ServeHTTP(w, r)
+			return
 		}
-	}
 
-	sendJSON(w, stats)
+		select {
+		case inFlight <- struct{}{}:
+			defer func() { <-inFlight }()
+		default:
+			w.Header().Set("Retry-After", strconv.Itoa(inFlightRetryAfter))
+			serviceUnavailableError(w, errTooManyInFlight)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
 }
 
-// GetAccountUserInfo handles GET requests for account user info. The account user
-// should be specifed by as a value to the query parameter 'username'.
-func GetAccountUserInfo(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		methodError(w, errMethodMustBeGET)
-		return
-	}
+// endpointSwitches turns endpoints, by path, off and back on while the service runs, so that
+// expensive endpoints can be shed under load without a redeploy. Every endpoint is enabled
+// until it's switched off.
+type endpointSwitches struct {
+	mu       sync.RWMutex
+	disabled map[string]bool
+}
 
-	params, err := url.ParseQuery(r.URL.RawQuery)
-	if err != nil {
-		internalServerError(w, err)
-		return
-	}
+func (s *endpointSwitches) enabled(path string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return !s.disabled[path]
+}
 
-	username := params.Get("username")
+func (s *endpointSwitches) set(path string, enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	acc, err := db.ExistingAccount(username)
-	if err != nil {
-		internalServerError(w, err)
-		return
+	if enabled {
+		delete(s.disabled, path)
+	} else {
+		s.disabled[path] = true
 	}
+}
 
-	if acc == nil {
-		sendMessage(
-			w, "no account found with that username: "+username)
-		return
+// list returns the paths of the disabled endpoints, in order.
+func (s *endpointSwitches) list() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	paths := []string{}
+	for path := range s.disabled {
+		paths = append(paths, path)
 	}
+	sort.Strings(paths)
 
-	sendJSON(w, struct {
-		Name string `json:"name,omitempty"`
-		ID   int64  `json:"id,omitempty"`
-	}{
-		acc.Name.String,
-		acc.ID.Int64,
-	})
+	return paths
 }
 
-// CreateNewAccount handles POST requests for registering a new account. Clients
-// must send the account username in a JSON payload, for example: {"username": str}.
-func CreateNewAccount(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		methodError(w, errMethodMustBePOST)
-		return
-	}
+// endpoints are the endpoint switches consulted by withEndpointSwitches. Endpoints can be
+// disabled from the environment on startup, and switched by admins at any time.
+var (
+	endpoints = &endpointSwitches{disabled: map[string]bool{}}
+)
 
-	payload := map[string]string{}
+// endpointSwitchesPath is the admin endpoint that switches the others, which can't itself be
+// switched off.
+const endpointSwitchesPath = "/api/v1/admin/endpoints"
 
-	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-		internalServerError(w, err)
-		return
-	}
+var errEndpointDisabled = errors.New("endpoint disabled")
 
-	username := payload["username"]
+// withEndpointSwitches wraps a handler so that requests to disabled endpoints are answered
+// with a 503 and a JSON body, {"error": "endpoint disabled"}, without being handled.
+func withEndpointSwitches(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !endpoints.enabled(r.URL.Path) {
+			sendError(w, http.StatusServiceUnavailable, errEndpointDisabled)
+			return
+		}
 
-	acc, err := db.NewAccount(username)
-	if err != nil {
-		internalServerError(w, err)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// AdminEndpointSwitches handles authenticated requests for the endpoint switches. GET lists
+// the 'disabled' endpoints. PUT switches one, given in a JSON payload, for example:
+// {"path": "/api/v1/location/weather/history", "enabled": false}, and responds with the list.
+func AdminEndpointSwitches(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPut {
+		methodError(w, http.MethodGet, http.MethodPut)
 		return
 	}
 
-	col, err := acc.NewBookmarkCollection()
-	if err != nil {
-		internalServerError(w, err)
+	if !authorizeAdmin(w, r) {
 		return
 	}
 
-	sendJSON(
-		w,
-		struct {
-			Name                  string  `json:"name,omitempty"`
-			ID                    int64   `json:"id,omitempty"`
-			BookmarkCollectionID  int64   `json:"bookmark_collection_id,omitempty"`
-			BookmarkedLocationIDs []int64 `json:"bookmarked_location_i_ds,omitempty"`
-		}{
-			acc.Name.String,
-			acc.ID.Int64,
-			col.ID.Int64,
-			col.LocationIDs,
-		})
-}
-
-// AccountBookmarksCollectionAction handles bot GET and POST requests. As a GET, returns
-// the bookmarks for an account user, where the account user is specified as the query parameter, 'username'.
-// As a POST, will update the bookmarks of an account user where the username and bookmarks to be added
-// is specified by the JSON payload: {"username": str, "locations": str[]}
-func AccountBookmarksCollectionAction(w http.ResponseWriter, r *http.Request) {
-	var (
-		result interface{}
-	)
+	if r.Method == http.MethodPut {
+		payload := struct {
+			Path    string `json:"path"`
+			Enabled *bool  `json:"enabled"`
+		}{}
 
-	switch r.Method {
-	case http.MethodGet:
-		params, err := url.ParseQuery(r.URL.RawQuery)
-		if err != nil {
-			internalServerError(w, err)
+		if !decodeBody(w, r, &payload) {
 			return
 		}
 
-		username := params.Get("username")
-
-		acc, err := db.ExistingAccount(username)
-		if err != nil {
-			internalServerError(w, err)
+		if !strings.HasPrefix(payload.Path, "/api/") || payload.Enabled == nil {
+			badRequestError(w, errors.New("an api endpoint path and whether it's enabled are required"))
 			return
 		}
 
-		if acc == nil {
-			sendMessage(
-				w, "no account found with that username: "+username)
+		if payload.Path == endpointSwitchesPath {
+			badRequestError(w, errors.New("the endpoint switches can't be switched off"))
 			return
 		}
 
-		col, err := acc.GetBookmarkCollectionIDs()
-		if err != nil {
-			internalServerError(w, err)
-			return
-		}
+		endpoints.set(payload.Path, *payload.Enabled)
+		log.Printf("endpoint %s enabled: %t", payload.Path, *payload.Enabled)
+	}
 
-		if col == nil {
-			sendMessage(
-				w, fmt.Sprintf("no bookmark collection associated with that id: %d", col.ID.Int64))
-			return
-		}
+	sendJSON(w, struct {
+		Disabled []string `json:"disabled"`
+	}{
+		endpoints.list(),
+	})
+}
 
-		locs, err := col.NamesFromIDs()
-		if err != nil {
-			internalServerError(w, err)
-			return
-		}
+// corsAllowedOrigins are the origins browsers may call the api from, "*" allowing any. Cross
+// origin requests aren't allowed unless they're configured from the environment on startup.
+// corsMaxAge is how long browsers may cache the result of a preflight request, so they needn't
+// repeat it before every request. It can be overridden from the environment on startup.
+var (
+	corsAllowedOrigins []string
+	corsMaxAge         = 10 * time.Minute
+)
 
-		result = struct {
-			Bookmarks []string
-		}{
-			locs,
-		}
+// corsAllowedHeaders are the request headers browsers may send cross origin, beyond those
+// they always may.
+var corsAllowedHeaders = []string{"Authorization", "Content-Type", requestIDHeader}
 
-		break
-	case http.MethodPost:
-		payload := struct {
-			Username  string
-			Locations []string
-		}{
-			"",
-			[]string{},
+// corsOrigin returns the value of Access-Control-Allow-Origin for a request from 'origin', or
+// "" if the origin isn't allowed.
+func corsOrigin(origin string) string {
+	for _, allowed := range corsAllowedOrigins {
+		if allowed == "*" {
+			return "*"
 		}
-
-		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-			internalServerError(w, err)
-			return
+		if strings.EqualFold(allowed, origin) {
+			return origin
 		}
+	}
 
-		acc, err := db.ExistingAccount(payload.Username)
-		if err != nil {
-			internalServerError(w, err)
-			return
-		}
+	return ""
+}
 
-		if acc == nil {
-			sendMessage(
-				w, "no account found with that username: "+payload.Username)
+// withCORS wraps a handler so that browsers may call it from corsAllowedOrigins. Preflight
+// requests, OPTIONS requests asking whether a method may be used, are answered directly with
+// a 204, allowing any method and corsAllowedHeaders, and an Access-Control-Max-Age of
+// corsMaxAge so the browser caches the answer. Other requests are handled as usual, with
+// Access-Control-Allow-Origin set for allowed origins.
+func withCORS(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			h.ServeHTTP(w, r)
 			return
 		}
 
-		newIDs, err := db.IDsFromNames(payload.Locations...)
-		if err != nil {
-			internalServerError(w, err)
-			return
-		}
+		w.Header().Add("Vary", "Origin")
 
-		col, err := acc.UpdateBookmarkCollectionIDs(newIDs...)
-		if err != nil {
-			internalServerError(w, err)
-			return
+		allowed := corsOrigin(origin)
+		if allowed != "" {
+			w.Header().Set("Access-Control-Allow-Origin", allowed)
 		}
 
-		if col == nil {
-			sendMessage(
-				w, fmt.Sprintf("no bookmark collection associated with that id: %d", col.ID.Int64))
+		if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+			h.ServeHTTP(w, r)
 			return
 		}
 
-		locs, err := col.NamesFromIDs()
-		if err != nil {
-			internalServerError(w, err)
-			return
+		if allowed != "" {
+			w.Header().Set("Access-Control-Allow-Methods", r.Header.Get("Access-Control-Request-Method"))
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(corsAllowedHeaders, ", "))
+			w.Header().Set("Access-Control-Max-Age", strconv.FormatInt(int64(corsMaxAge.Seconds()), 10))
 		}
 
-		result = struct {
-			Bookmarks []string
-		}{
-			locs,
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// shutdownDrain is how long the server waits, after a shutdown signal, for requests in flight
+// to finish before closing their connections. It can be overridden from the environment on
+// startup.
+var (
+	shutdownDrain = 10 * time.Second
+)
+
+// inFlightCounter counts the requests being handled, so that shutdown can report how many it
+// is waiting on.
+type inFlightCounter struct {
+	n int64
+}
+
+// track wraps a handler so that its requests are counted while they're handled.
+func (c *inFlightCounter) track(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&c.n, 1)
+		defer atomic.AddInt64(&c.n, -1)
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// count returns the number of requests being handled.
+func (c *inFlightCounter) count() int64 {
+	return atomic.LoadInt64(&c.n)
+}
+
+// requestIDHeader carries the id of a request, from a gateway in front of the service or
+// generated by it, so that log lines can be correlated across both.
+const requestIDHeader = "X-Request-ID"
+
+// validRequestID matches the inbound request ids that are honored. Anything else, which could
+// forge or garble log lines, is replaced with a generated id.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+type requestIDKey struct{}
+
+// withRequestID wraps a handler so that each request has an id, taken from the inbound
+// X-Request-ID header if it's present and valid, or generated otherwise. The id is echoed in
+// the response header and stored in the request context, see requestID, so that the logs of a
+// failed request can be found from it.
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
 		}
-	default:
-		methodError(w, errMethodMustBeGETorPOST)
-		return
-	}
 
-	sendJSON(w, result)
+		w.Header().Set(requestIDHeader, id)
+
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
 }
 
-/*
-	utility functions
-*/
+// requestID returns the id of the request 'ctx' belongs to, if it has one.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// normalizeCityNames has location names title cased, see db.CanonicalCityName, so that names
+// written differently are the same location. Deployments that only send canonical names, some
+// of which title casing would mangle, such as "'s-Hertogenbosch", can disable it from the
+// environment on startup.
+var (
+	normalizeCityNames = true
+)
+
+// normalizeCityName puts a location name in the form it's cached under and looked up from the
+// openweather api as, see db.CanonicalCityName. Without normalizeCityNames, only its surrounding
+// and repeated whitespace is removed.
+func normalizeCityName(name string) string {
+	if !normalizeCityNames {
+		return strings.Join(strings.Fields(name), " ")
+	}
+
+	return db.CanonicalCityName(name)
+}
 
 func hasParam(p []string, targets ...string) bool {
 	if len(p) > 0 {
@@ -454,6 +3878,94 @@ func hasParam(p []string, targets ...string) bool {
 	return false
 }
 
+// authorizeAdmin checks the request carries the admin token, responding with an error if it
+// doesn't.
+func authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if adminToken == "" {
+		sendError(w, http.StatusForbidden, errAdminDisabled)
+		return false
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		sendError(w, http.StatusUnauthorized, errAdminUnauthorized)
+		return false
+	}
+
+	return true
+}
+
+// requireJSONContentType makes clients declare request bodies as JSON, so that a body sent as
+// a form or text is turned away up front rather than failing to decode. It can be disabled
+// from the environment on startup.
+var (
+	requireJSONContentType = true
+)
+
+var errContentTypeMustBeJSON = errors.New("Content-Type must be application/json")
+
+// hasJSONContentType reports whether the request body is declared as JSON, with or without
+// parameters such as a charset. If it isn't, and requireJSONContentType is set, it responds
+// with a 415 and returns false.
+func hasJSONContentType(w http.ResponseWriter, r *http.Request) bool {
+	if !requireJSONContentType {
+		return true
+	}
+
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil && mediaType == "application/json" {
+		return true
+	}
+
+	sendError(w, http.StatusUnsupportedMediaType, errContentTypeMustBeJSON)
+
+	return false
+}
+
+// decodeBody decodes the JSON request body into 'v'. If the body isn't declared as JSON, see
+// hasJSONContentType, it responds with a 415. If the body is empty, isn't valid JSON or doesn't
+// fit 'v', it responds with a 400 describing which. Either way it returns false.
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if !hasJSONContentType(w, r) {
+		return false
+	}
+
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err == nil {
+		return true
+	}
+
+	var (
+		syntaxErr *json.SyntaxError
+		typeErr   *json.UnmarshalTypeError
+	)
+
+	switch {
+	case errors.Is(err, io.EOF):
+		badRequestError(w, errBodyEmpty)
+	case errors.As(err, &syntaxErr), errors.Is(err, io.ErrUnexpectedEOF):
+		badRequestError(w, errBodyMalformed)
+	case errors.As(err, &typeErr):
+		badRequestError(w, fmt.Errorf("invalid value for field %s: expected %s", typeErr.Field, typeErr.Type))
+	default:
+		badRequestError(w, err)
+	}
+
+	return false
+}
+
+func validateUsername(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return errUsernameEmpty
+	}
+
+	if len(name) > maxUsernameLength {
+		return errUsernameTooLong
+	}
+
+	return nil
+}
+
 func sendJSON(w http.ResponseWriter, payload interface{}) {
 	w.Header().Set("content-type", "application/json")
 	log.Println("\n", stringify(payload))
@@ -468,6 +3980,11 @@ func sendMessage(w http.ResponseWriter, m string) {
 	})
 }
 
+// notFoundError is sendError with a 404 status, for resources that should exist but don't.
+func notFoundError(w http.ResponseWriter, m string) {
+	sendError(w, http.StatusNotFound, errors.New(m))
+}
+
 func sendDoc(w http.ResponseWriter, doc interface{}, pred func() bool) bool {
 	if pred() {
 		w.WriteHeader(202)
@@ -479,11 +3996,80 @@ func sendDoc(w http.ResponseWriter, doc interface{}, pred func() bool) bool {
 	return false
 }
 
-func methodError(w http.ResponseWriter, er error) {
-	http.Error(w, er.Error(), http.StatusMethodNotAllowed)
+// methodError answers a request made with a method the handler doesn't support, listing the
+// 'allowed' methods in the Allow header and in a JSON body, for example:
+// {"error": "HTTP method must be GET or HEAD", "allowed": ["GET", "HEAD"]}.
+func methodError(w http.ResponseWriter, allowed ...string) {
+	m := allowed[len(allowed)-1]
+	if len(allowed) > 1 {
+		m = strings.Join(allowed[:len(allowed)-1], ", ") + " or " + m
+	}
+
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusMethodNotAllowed)
+	json.NewEncoder(w).Encode(struct {
+		Error   string   `json:"error"`
+		Allowed []string `json:"allowed"`
+	}{
+		"HTTP method must be " + m,
+		allowed,
+	})
+}
+
+// sendError responds with 'status' and the error in a JSON body, for example:
+// {"error": "city parameter required"}. Every error is answered with it, except for unknown
+// paths, which the mux answers itself.
+func sendError(w http.ResponseWriter, status int, er error) {
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{
+		er.Error(),
+	})
+}
+
+func badRequestError(w http.ResponseWriter, er error) {
+	sendError(w, http.StatusBadRequest, er)
+}
+
+func conflictError(w http.ResponseWriter, er error) {
+	sendError(w, http.StatusConflict, er)
+}
+
+// storeError responds to a failed write to the database, with a 409 if it conflicts with an
+// existing row, a 422 if it refers to a row that doesn't exist, or a 500 otherwise.
+func storeError(w http.ResponseWriter, r *http.Request, er error) {
+	switch {
+	case errors.Is(er, db.ErrConflict):
+		conflictError(w, er)
+	case errors.Is(er, db.ErrInvalidReference):
+		sendError(w, http.StatusUnprocessableEntity, er)
+	default:
+		internalServerError(w, r, er)
+	}
+}
+
+// statsQueryError responds to a failed stats query, with a 422 asking the client to narrow
+// the query if its result was too large.
+func statsQueryError(w http.ResponseWriter, r *http.Request, er error) {
+	if _, tooLarge := er.(*db.ResultTooLargeError); tooLarge {
+		sendError(w, http.StatusUnprocessableEntity, fmt.Errorf("%s, narrow the query with a source filter or fewer stats", er))
+		return
+	}
+
+	internalServerError(w, r, er)
 }
 
-func internalServerError(w http.ResponseWriter, er error) {
+func serviceUnavailableError(w http.ResponseWriter, er error) {
 	log.Println(er)
-	http.Error(w, er.Error(), http.StatusInternalServerError)
+	sendError(w, http.StatusServiceUnavailable, er)
+}
+
+// internalServerError responds with a 500, logging the error with the id of the request 'r' so
+// that it can be traced back from the client or gateway.
+func internalServerError(w http.ResponseWriter, r *http.Request, er error) {
+	log.Printf("request %s: %s %s: %s", requestID(r.Context()), r.Method, r.URL.Path, er)
+	sendError(w, http.StatusInternalServerError, er)
 }
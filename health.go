@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/msawangwan/weather/api"
+	"github.com/msawangwan/weather/cache"
+	"github.com/msawangwan/weather/db"
+)
+
+// Health of a subsystem, from best to worst.
+const (
+	healthOK       = "ok"
+	healthDegraded = "degraded"
+	healthDown     = "down"
+)
+
+// Thresholds at which a subsystem is considered degraded or down.
+const (
+	dbSlowPing = 500 * time.Millisecond
+
+	upstreamDegradedErrorRate = 0.1
+	upstreamDownErrorRate     = 0.5
+)
+
+var (
+	healthRank = map[string]int{healthOK: 0, healthDegraded: 1, healthDown: 2}
+)
+
+// worstHealth returns the worst of 'statuses', or healthOK if there are none.
+func worstHealth(statuses ...string) string {
+	worst := healthOK
+
+	for _, s := range statuses {
+		if healthRank[s] > healthRank[worst] {
+			worst = s
+		}
+	}
+
+	return worst
+}
+
+type dbHealth struct {
+	Status          string  `json:"status"`
+	Error           string  `json:"error,omitempty"`
+	PingMs          float64 `json:"ping_ms"`
+	OpenConnections int     `json:"open_connections"`
+	InUse           int     `json:"in_use"`
+	Idle            int     `json:"idle"`
+	WaitCount       int64   `json:"wait_count"`
+}
+
+type upstreamHealth struct {
+	Status      string    `json:"status"`
+	Provider    string    `json:"provider"`
+	LastSuccess *jsonTime `json:"last_success,omitempty"`
+	LastFailure *jsonTime `json:"last_failure,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+	RecentCalls int       `json:"recent_calls"`
+	ErrorRate   float64   `json:"error_rate"`
+}
+
+type cacheHealth struct {
+	Status   string   `json:"status"`
+	Error    string   `json:"error,omitempty"`
+	Backend  string   `json:"backend"`
+	Hits     int64    `json:"hits"`
+	Misses   int64    `json:"misses"`
+	HitRatio *float64 `json:"hit_ratio,omitempty"`
+	Size     *int     `json:"size,omitempty"`
+}
+
+// ReportDetailedHealth handles GET requests for a diagnostic report of the database, the
+// upstream api and the cache. Each reports ok, degraded or down, and the overall status is
+// the worst of them. The report is always sent with a 200, so it can be read mid-incident.
+func ReportDetailedHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodError(w, http.MethodGet)
+		return
+	}
+
+	var (
+		dbh       = checkDBHealth(r)
+		upstreamh = checkUpstreamHealth()
+		cacheh    = checkCacheHealth()
+	)
+
+	sendJSON(w, struct {
+		Status   string          `json:"status"`
+		DB       *dbHealth       `json:"db"`
+		Upstream *upstreamHealth `json:"upstream"`
+		Cache    *cacheHealth    `json:"cache"`
+	}{
+		worstHealth(dbh.Status, upstreamh.Status, cacheh.Status),
+		dbh,
+		upstreamh,
+		cacheh,
+	})
+}
+
+func checkDBHealth(r *http.Request) *dbHealth {
+	if db.GlobalConn.DB == nil {
+		return &dbHealth{Status: healthDown, Error: "not connected"}
+	}
+
+	start := time.Now()
+	err := db.GlobalConn.PingContext(r.Context())
+	ping := time.Since(start)
+
+	stats := db.GlobalConn.Stats()
+
+	h := &dbHealth{
+		Status:          healthOK,
+		PingMs:          math.Round(ping.Seconds()*1000*100) / 100,
+		OpenConnections: stats.OpenConnections,
+		InUse:           stats.InUse,
+		Idle:            stats.Idle,
+		WaitCount:       stats.WaitCount,
+	}
+
+	switch {
+	case err != nil:
+		h.Status = healthDown
+		h.Error = err.Error()
+	case ping > dbSlowPing:
+		h.Status = healthDegraded
+	}
+
+	return h
+}
+
+func checkUpstreamHealth() *upstreamHealth {
+	stats := api.RecentCalls()
+
+	h := &upstreamHealth{
+		Status:      healthOK,
+		Provider:    api.SharedClient.Provider,
+		LastError:   stats.LastError,
+		RecentCalls: stats.Recent,
+		ErrorRate:   stats.ErrorRate(),
+	}
+
+	if !stats.LastSuccess.IsZero() {
+		h.LastSuccess = &jsonTime{stats.LastSuccess}
+	}
+
+	if !stats.LastFailure.IsZero() {
+		h.LastFailure = &jsonTime{stats.LastFailure}
+	}
+
+	switch {
+	case h.ErrorRate >= upstreamDownErrorRate:
+		h.Status = healthDown
+	case h.ErrorRate >= upstreamDegradedErrorRate:
+		h.Status = healthDegraded
+	}
+
+	return h
+}
+
+func checkCacheHealth() *cacheHealth {
+	h := &cacheHealth{Status: healthOK}
+
+	c := weatherCache
+
+	if counted, ok := c.(*cache.Counted); ok {
+		h.Hits, h.Misses = counted.Stats()
+
+		if lookups := h.Hits + h.Misses; lookups > 0 {
+			ratio := math.Round(float64(h.Hits)/float64(lookups)*100) / 100
+			h.HitRatio = &ratio
+		}
+
+		c = counted.Cache
+	}
+
+	switch backend := c.(type) {
+	case cache.None:
+		h.Backend = cache.BackendNone
+	case *cache.Memory:
+		h.Backend = cache.BackendMemory
+		size := backend.Len()
+		h.Size = &size
+	case *cache.Redis:
+		h.Backend = cache.BackendRedis
+		if err := backend.Ping(); err != nil {
+			h.Status = healthDown
+			h.Error = err.Error()
+		}
+	default:
+		h.Backend = fmt.Sprintf("%T", c)
+	}
+
+	return h
+}
@@ -2,9 +2,231 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/msawangwan/weather/db"
 )
 
 func stringify(i interface{}) string {
 	s, _ := json.MarshalIndent(i, "", "\t")
 	return string(s)
 }
+
+// Supported formats for timestamps in responses.
+const (
+	timeFormatRFC3339    = "rfc3339"
+	timeFormatUnix       = "unix"
+	timeFormatUnixMillis = "unixms"
+)
+
+// timeFormat is the format timestamps are written in, one of the supported formats above. It
+// can be overridden from the environment on startup.
+var (
+	timeFormat = timeFormatRFC3339
+)
+
+// jsonTime is a time.Time that is written to JSON in the configured timeFormat, as either an
+// RFC3339 string or a number of seconds or milliseconds since the unix epoch.
+type jsonTime struct {
+	time.Time
+}
+
+func (t jsonTime) MarshalJSON() ([]byte, error) {
+	switch timeFormat {
+	case timeFormatUnix:
+		return []byte(strconv.FormatInt(t.Unix(), 10)), nil
+	case timeFormatUnixMillis:
+		return []byte(strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)), nil
+	default:
+		return t.Time.MarshalJSON()
+	}
+}
+
+// UnmarshalJSON reads back a time written by MarshalJSON, so that responses can be cached as JSON.
+func (t *jsonTime) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		return t.Time.UnmarshalJSON(b)
+	}
+
+	n, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp: %s", b)
+	}
+
+	switch timeFormat {
+	case timeFormatUnixMillis:
+		t.Time = time.Unix(0, n*int64(time.Millisecond))
+	default:
+		t.Time = time.Unix(n, 0)
+	}
+
+	return nil
+}
+
+// parseDuration reads a duration given as a go duration string, such as "10m" or "24h", or an
+// ISO 8601 duration, such as "PT10M" or "P1D". A bare integer is read as a number of 'unit',
+// so that durations configured as plain numbers before keep their meaning.
+func parseDuration(v string, unit time.Duration) (time.Duration, error) {
+	if n, err := strconv.Atoi(v); err == nil {
+		return time.Duration(n) * unit, nil
+	}
+
+	if d, err := time.ParseDuration(v); err == nil {
+		return d, nil
+	}
+
+	return parseISO8601Duration(v)
+}
+
+// iso8601Duration matches the subset of ISO 8601 durations with a fixed length: weeks, days,
+// hours, minutes and seconds. Years and months vary in length, so they aren't supported.
+var iso8601Duration = regexp.MustCompile(`^P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+func parseISO8601Duration(v string) (time.Duration, error) {
+	m := iso8601Duration.FindStringSubmatch(v)
+	if m == nil || v == "P" || v[len(v)-1] == 'T' {
+		return 0, fmt.Errorf("invalid duration: %q", v)
+	}
+
+	var d time.Duration
+
+	for i, unit := range []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second} {
+		if m[i+1] == "" {
+			continue
+		}
+
+		n, err := strconv.ParseFloat(m[i+1], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration: %q", v)
+		}
+
+		d += time.Duration(n * float64(unit))
+	}
+
+	return d, nil
+}
+
+// roundTemp rounds a temperature to 'tempPrecision' decimal places for display.
+func roundTemp(t float64) float64 {
+	p := math.Pow(10, float64(tempPrecision))
+	return math.Round(t*p) / p
+}
+
+// roundTemps rounds, in place, every temperature in a stats report.
+func roundTemps(report db.LocationTemperatureQueryResult) {
+	for _, years := range report {
+		for _, months := range years {
+			for _, days := range months {
+				for _, temps := range days {
+					for i, t := range temps {
+						temps[i] = roundTemp(t)
+					}
+				}
+			}
+		}
+	}
+}
+
+// roundSummaryTemps rounds, in place, every temperature in a summary report.
+func roundSummaryTemps(report db.LocationSummaryQueryResult) {
+	for _, years := range report {
+		for _, months := range years {
+			for _, summary := range months {
+				summary.Avg = roundTemp(summary.Avg)
+				summary.Min = roundTemp(summary.Min)
+				summary.Max = roundTemp(summary.Max)
+			}
+		}
+	}
+}
+
+// parseTrustedProxies reads a comma separated list of proxy addresses, each either an IP or a
+// CIDR block, e.g. "10.0.0.0/8, 192.168.1.1".
+func parseTrustedProxies(v string) ([]*net.IPNet, error) {
+	proxies := []*net.IPNet{}
+
+	for _, field := range strings.Split(v, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		if !strings.Contains(field, "/") {
+			ip := net.ParseIP(field)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid proxy address: %q", field)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, block, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy address: %q", field)
+		}
+
+		proxies = append(proxies, block)
+	}
+
+	return proxies, nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, block := range trustedProxies {
+		if block.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client that made the request. The X-Forwarded-For and
+// X-Real-IP headers are only believed when the request came from a trusted proxy, as anyone
+// can send them. X-Forwarded-For is read from the right, skipping trusted proxies, since a
+// client may have put anything on the left of it.
+func clientIP(r *http.Request) string {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+
+	if ip := net.ParseIP(peer); ip == nil || !isTrustedProxy(ip) {
+		return peer
+	}
+
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(hops[i]))
+			if ip == nil {
+				break // garbled, so nothing further left can be believed
+			}
+
+			if !isTrustedProxy(ip) || i == 0 {
+				return ip.String()
+			}
+		}
+
+		return peer
+	}
+
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+
+	return peer
+}
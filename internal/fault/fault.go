@@ -0,0 +1,51 @@
+// Package fault counts calls to a dependency so that tests can make a chosen call fail. It is
+// only imported by files built with the 'faultinject' build tag, which keeps it out of
+// production builds.
+package fault
+
+import (
+	"sync"
+)
+
+// Injector fails the nth call made after it is set. The zero value never fails a call.
+type Injector struct {
+	mu    sync.Mutex
+	calls int
+	n     int
+	err   error
+}
+
+// Set makes the 'n'th call from now fail with 'err', the next call being the first. Only that
+// call fails, and only once. A previously set failure that hasn't happened yet is replaced.
+func (i *Injector) Set(n int, err error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.calls, i.n, i.err = 0, n, err
+}
+
+// Reset clears any failure that hasn't happened yet.
+func (i *Injector) Reset() {
+	i.Set(0, nil)
+}
+
+// Next counts a call, returning the error it should fail with, or nil if it shouldn't fail.
+func (i *Injector) Next() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.err == nil {
+		return nil
+	}
+
+	i.calls++
+
+	if i.calls != i.n {
+		return nil
+	}
+
+	err := i.err
+	i.err = nil
+
+	return err
+}
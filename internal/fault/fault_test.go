@@ -0,0 +1,34 @@
+package fault
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestInjectorFailsTheNthCall(t *testing.T) {
+	var (
+		i       Injector
+		errTest = errors.New("injected")
+	)
+
+	if err := i.Next(); err != nil {
+		t.Errorf("have: %v want: %v before a failure is set", err, nil)
+	}
+
+	i.Set(3, errTest)
+
+	for call := 1; call <= 5; call++ {
+		err := i.Next()
+
+		if want := call == 3; (err == errTest) != want {
+			t.Errorf("have: %v on call %d want failure: %v", err, call, want)
+		}
+	}
+
+	i.Set(1, errTest)
+	i.Reset()
+
+	if err := i.Next(); err != nil {
+		t.Errorf("have: %v want: %v after a reset", err, nil)
+	}
+}
@@ -0,0 +1,54 @@
+// Package secret reads secrets from the environment, either from a variable or from a file
+// named by one, which is how docker and kubernetes usually mount them.
+package secret
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+// FileSuffix is appended to the name of a variable to name the variable holding the path of
+// a file with its value, e.g. API_KEY_FILE for API_KEY.
+const FileSuffix = "_FILE"
+
+// Lookup returns the value of the secret 'key'. If the variable 'key' + FileSuffix is set, the
+// value is read from the file it names, with surrounding whitespace trimmed, taking precedence
+// over 'key'. Otherwise the value is that of 'key'. 'exists' reports whether either is set.
+func Lookup(key string) (v string, exists bool, err error) {
+	if path, ok := os.LookupEnv(key + FileSuffix); ok && path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", true, err
+		}
+
+		v = strings.TrimSpace(string(b))
+		if v == "" {
+			return "", true, fmt.Errorf("secret file is empty: %s", path)
+		}
+
+		return v, true, nil
+	}
+
+	v, exists = os.LookupEnv(key)
+
+	return v, exists, nil
+}
+
+// MustLookup returns the value of the secret 'key' as Lookup does, for reading configuration on
+// startup. It exits if the secret's file can't be read, and logs that the secret isn't defined
+// if neither variable is set, returning "".
+func MustLookup(key string) string {
+	v, exists, err := Lookup(key)
+	if err != nil {
+		log.Fatalf("invalid %s: %s", key+FileSuffix, err)
+	}
+
+	if !exists {
+		log.Printf("variable not defined in the current environment: %s or %s", key, key+FileSuffix)
+	}
+
+	return v
+}
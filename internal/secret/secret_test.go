@@ -0,0 +1,105 @@
+package secret
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testKey = "WEATHER_TEST_SECRET"
+
+func writeSecret(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "secret")
+
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func setEnv(t *testing.T, key, value string) {
+	old, existed := os.LookupEnv(key)
+
+	os.Setenv(key, value)
+
+	t.Cleanup(func() {
+		if existed {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestLookupReadsTheFile(t *testing.T) {
+	setEnv(t, testKey, "from-env")
+	setEnv(t, testKey+FileSuffix, writeSecret(t, "  from-file\n"))
+
+	v, exists, err := Lookup(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !exists || v != "from-file" {
+		t.Errorf("have: %q, %v want: %q, %v", v, exists, "from-file", true)
+	}
+}
+
+func TestLookupFallsBackToTheVariable(t *testing.T) {
+	setEnv(t, testKey, "from-env")
+
+	v, exists, err := Lookup(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !exists || v != "from-env" {
+		t.Errorf("have: %q, %v want: %q, %v", v, exists, "from-env", true)
+	}
+}
+
+func TestLookupWithNeitherSet(t *testing.T) {
+	v, exists, err := Lookup(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exists || v != "" {
+		t.Errorf("have: %q, %v want: %q, %v", v, exists, "", false)
+	}
+}
+
+func TestLookupFailures(t *testing.T) {
+	var lookupFailureTestCases = []struct {
+		label string
+		path  string
+	}{
+		{"missing file", filepath.Join(os.TempDir(), "weather-no-such-secret")},
+		{"empty file", writeSecret(t, " \n")},
+	}
+
+	for _, tc := range lookupFailureTestCases {
+		setEnv(t, testKey+FileSuffix, tc.path)
+
+		if _, _, err := Lookup(testKey); err == nil {
+			t.Errorf("have: %v want: an error for a %s", err, tc.label)
+		}
+	}
+}
+
+func TestMustLookup(t *testing.T) {
+	setEnv(t, testKey+FileSuffix, writeSecret(t, "from-file"))
+
+	if v := MustLookup(testKey); v != "from-file" {
+		t.Errorf("have: %q want: %q", v, "from-file")
+	}
+}
@@ -1,17 +1,69 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/msawangwan/weather/api"
+	"github.com/msawangwan/weather/cache"
 	"github.com/msawangwan/weather/db"
+	"github.com/msawangwan/weather/geoip"
 )
 
 const (
 	envVarListenAddr = "LISTEN_ADDR"
 	envVarListenPort = "LISTEN_PORT"
+
+	envVarTempPrecision  = "TEMP_PRECISION"
+	envVarMaxBatchCities = "BATCH_MAX_CITIES"
+
+	envVarStatsRefreshMinutes = "STATS_REFRESH_MINUTES"
+	envVarStatsMaxEntries     = "STATS_MAX_ENTRIES"
+	envVarStatsOverview       = "STATS_OVERVIEW"
+
+	envVarRetentionDays    = "RETENTION_DAYS"
+	envVarCompactionWindow = "COMPACTION_WINDOW_MINUTES"
+	envVarCacheTTL         = "CACHE_TTL"
+	envVarReadThroughOnly  = "READ_THROUGH_ONLY"
+	envVarCacheControl     = "CACHE_CONTROL"
+	envVarWarmUpCache      = "WARM_UP_CACHE"
+	envVarAPIDailyBudget   = "API_DAILY_BUDGET"
+	envVarForecastExclude  = "FORECAST_EXCLUDE"
+
+	envVarRequestTimeoutSeconds = "REQUEST_TIMEOUT_SECONDS"
+	envVarMaxInFlight           = "MAX_IN_FLIGHT_REQUESTS"
+	envVarRequireJSON           = "REQUIRE_JSON_CONTENT_TYPE"
+	envVarShutdownDrainSeconds  = "SHUTDOWN_DRAIN_SECONDS"
+	envVarPageLimit             = "PAGE_LIMIT"
+	envVarMaxPageLimit          = "MAX_PAGE_LIMIT"
+	envVarDisabledEndpoints     = "DISABLED_ENDPOINTS"
+
+	envVarTimeFormat = "TIME_FORMAT"
+
+	envVarDefaultCity        = "DEFAULT_CITY"
+	envVarNormalizeCityNames = "NORMALIZE_CITY_NAMES"
+
+	envVarNearbyRadiusKm = "NEARBY_RADIUS_KM"
+	envVarGeoIPNetworks  = "GEOIP_NETWORKS_FILE"
+
+	envVarAdminToken = "ADMIN_TOKEN"
+
+	envVarTrustedProxies = "TRUSTED_PROXIES"
+
+	envVarCORSAllowedOrigins = "CORS_ALLOWED_ORIGINS"
+	envVarCORSMaxAge         = "CORS_MAX_AGE"
+
+	envVarCacheBackend = "CACHE_BACKEND"
+	envVarRedisAddr    = "REDIS_ADDR"
 )
 
 func main() {
@@ -24,12 +76,180 @@ func main() {
 		retryIntervalSec = 2
 	)
 
+	statsRefreshInterval := 15 * time.Minute
+
+	var compactionWindow time.Duration // disabled unless configured
+
+	if err := api.SharedClient.Validate(); err != nil {
+		log.Fatalf("invalid api configuration: %s", err)
+	}
+
+	log.Printf("using %s api endpoint: %s", api.SharedClient.Provider, api.SharedClient.APIEndpoint)
+
+	if v, exists := os.LookupEnv(envVarRequestTimeoutSeconds); exists && v != "" {
+		d, err := parseDuration(v, time.Second)
+		if err != nil || d <= 0 {
+			log.Fatalf("invalid %s: %s", envVarRequestTimeoutSeconds, v)
+		}
+		requestTimeout = d
+	}
+
+	if v, exists := os.LookupEnv(envVarMaxInFlight); exists && v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("invalid %s: %s", envVarMaxInFlight, v)
+		}
+		maxInFlight = n
+	}
+
+	if v, exists := os.LookupEnv(envVarDisabledEndpoints); exists && v != "" {
+		for _, path := range strings.Split(v, ",") {
+			path = strings.TrimSpace(path)
+			if !strings.HasPrefix(path, "/api/") || path == endpointSwitchesPath {
+				log.Fatalf("invalid %s: %s", envVarDisabledEndpoints, v)
+			}
+			endpoints.set(path, false)
+		}
+	}
+
+	if v, exists := os.LookupEnv(envVarPageLimit); exists && v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("invalid %s: %s", envVarPageLimit, v)
+		}
+		defaultPageLimit = n
+	}
+
+	if v, exists := os.LookupEnv(envVarMaxPageLimit); exists && v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < defaultPageLimit {
+			log.Fatalf("invalid %s: %s, it can't be less than %s", envVarMaxPageLimit, v, envVarPageLimit)
+		}
+		maxPageLimit = n
+	}
+
+	if v, exists := os.LookupEnv(envVarRequireJSON); exists && v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("invalid %s: %s", envVarRequireJSON, v)
+		}
+		requireJSONContentType = b
+	}
+
+	if v, exists := os.LookupEnv(envVarWarmUpCache); exists && v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("invalid %s: %s", envVarWarmUpCache, v)
+		}
+		warmUpCache = b
+	}
+
+	if v, exists := os.LookupEnv(envVarAPIDailyBudget); exists && v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("invalid %s: %s", envVarAPIDailyBudget, v)
+		}
+		dailyAPIBudget = n
+	}
+
+	if v, exists := os.LookupEnv(envVarForecastExclude); exists && v != "" {
+		for _, section := range strings.Split(v, ",") {
+			section = strings.TrimSpace(section)
+			if section != forecastSectionConditions && section != forecastSectionTemps {
+				log.Fatalf("invalid %s: %s, the sections are %s", envVarForecastExclude, v, strings.Join(forecastSections, ", "))
+			}
+			forecastExclude[section] = true
+		}
+	}
+
+	if v, exists := os.LookupEnv(envVarShutdownDrainSeconds); exists && v != "" {
+		d, err := parseDuration(v, time.Second)
+		if err != nil || d < 0 {
+			log.Fatalf("invalid %s: %s", envVarShutdownDrainSeconds, v)
+		}
+		shutdownDrain = d
+	}
+
+	if v, exists := os.LookupEnv(envVarCacheTTL); exists && v != "" {
+		d, err := parseDuration(v, time.Minute)
+		if err != nil || d <= 0 {
+			log.Fatalf("invalid %s: %s", envVarCacheTTL, v)
+		}
+		cacheTTL = d
+	}
+
+	switch format, _ := os.LookupEnv(envVarTimeFormat); format {
+	case "":
+		break
+	case timeFormatRFC3339, timeFormatUnix, timeFormatUnixMillis:
+		timeFormat = format
+	default:
+		log.Fatalf("invalid %s: %s", envVarTimeFormat, format)
+	}
+
+	if v, exists := os.LookupEnv(envVarAdminToken); exists {
+		adminToken = v
+	}
+
+	if v, exists := os.LookupEnv(envVarTrustedProxies); exists && v != "" {
+		proxies, err := parseTrustedProxies(v)
+		if err != nil {
+			log.Fatalf("invalid %s: %s", envVarTrustedProxies, err)
+		}
+		trustedProxies = proxies
+	}
+
+	if v, exists := os.LookupEnv(envVarCORSAllowedOrigins); exists && v != "" {
+		for _, origin := range strings.Split(v, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				corsAllowedOrigins = append(corsAllowedOrigins, origin)
+			}
+		}
+	}
+
+	if v, exists := os.LookupEnv(envVarCORSMaxAge); exists && v != "" {
+		d, err := parseDuration(v, time.Second)
+		if err != nil || d < 0 {
+			log.Fatalf("invalid %s: %s", envVarCORSMaxAge, v)
+		}
+		corsMaxAge = d
+	}
+
+	if v, exists := os.LookupEnv(envVarNormalizeCityNames); exists && v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("invalid %s: %s", envVarNormalizeCityNames, v)
+		}
+		normalizeCityNames = enabled
+	}
+
+	if v, exists := os.LookupEnv(envVarDefaultCity); exists {
+		defaultCity = normalizeCityName(v)
+	}
+
+	switch backend, _ := os.LookupEnv(envVarCacheBackend); backend {
+	case "", cache.BackendNone:
+		break
+	case cache.BackendMemory:
+		weatherCache = cache.NewMemory()
+	case cache.BackendRedis:
+		addr, exists := os.LookupEnv(envVarRedisAddr)
+		if !exists || addr == "" {
+			log.Fatalf("%s must be set to use the redis cache backend", envVarRedisAddr)
+		}
+		weatherCache = cache.NewRedis(addr)
+	default:
+		log.Fatalf("invalid %s: %s", envVarCacheBackend, backend)
+	}
+
+	weatherCache = cache.NewCounted(weatherCache)
+
 	go func() { // spin up the db concurrently so we can complete other setup
 		if err := db.GlobalConn.Establish(maxNumRetries, retryIntervalSec); err != nil {
 			log.Fatal(err)
 		}
 
-		if err := db.GlobalConn.ExecFrom("./data/init.db.sql"); err != nil {
+		if err := db.GlobalConn.ExecFromWithRetry("./data/init.db.sql", maxNumRetries, retryIntervalSec); err != nil {
 			log.Fatal(err)
 		}
 
@@ -40,25 +260,249 @@ func main() {
 
 	defer db.GlobalConn.Close()
 
+	if v, exists := os.LookupEnv(envVarTempPrecision); exists && v != "" {
+		p, err := strconv.Atoi(v)
+		if err != nil || p < 0 {
+			log.Fatalf("invalid %s: %s", envVarTempPrecision, v)
+		}
+		tempPrecision = p
+	}
+
+	if v, exists := os.LookupEnv(envVarMaxBatchCities); exists && v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("invalid %s: %s", envVarMaxBatchCities, v)
+		}
+		maxBatchCities = n
+	}
+
+	if v, exists := os.LookupEnv(envVarNearbyRadiusKm); exists && v != "" {
+		km, err := strconv.ParseFloat(v, 64)
+		if err != nil || km <= 0 {
+			log.Fatalf("invalid %s: %s", envVarNearbyRadiusKm, v)
+		}
+		nearbyRadiusKm = km
+	}
+
+	if v, exists := os.LookupEnv(envVarGeoIPNetworks); exists && v != "" {
+		networks, err := geoip.OpenNetworks(v)
+		if err != nil {
+			log.Fatalf("invalid %s: %s", envVarGeoIPNetworks, err)
+		}
+		geoLocator = networks
+	}
+
+	if v, exists := os.LookupEnv(envVarStatsRefreshMinutes); exists && v != "" {
+		d, err := parseDuration(v, time.Minute)
+		if err != nil || d <= 0 {
+			log.Fatalf("invalid %s: %s", envVarStatsRefreshMinutes, v)
+		}
+		statsRefreshInterval = d
+	}
+
+	if v, exists := os.LookupEnv(envVarStatsMaxEntries); exists && v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("invalid %s: %s", envVarStatsMaxEntries, v)
+		}
+		db.MaxStatsEntries = n
+	}
+
+	if v, exists := os.LookupEnv(envVarStatsOverview); exists && v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("invalid %s: %s", envVarStatsOverview, v)
+		}
+		statsOverview = enabled
+	}
+
+	if v, exists := os.LookupEnv(envVarCacheControl); exists && v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("invalid %s: %s", envVarCacheControl, v)
+		}
+		cacheControl = enabled
+	}
+
+	if v, exists := os.LookupEnv(envVarReadThroughOnly); exists && v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("invalid %s: %s", envVarReadThroughOnly, v)
+		}
+		readThroughOnly = enabled
+	}
+
+	if v, exists := os.LookupEnv(envVarRetentionDays); exists && v != "" {
+		d, err := parseDuration(v, 24*time.Hour)
+		if err != nil || d <= 0 {
+			log.Fatalf("invalid %s: %s", envVarRetentionDays, v)
+		}
+		retention = d
+	}
+
+	if v, exists := os.LookupEnv(envVarCompactionWindow); exists && v != "" {
+		d, err := parseDuration(v, time.Minute)
+		if err != nil || d <= 0 {
+			log.Fatalf("invalid %s: %s", envVarCompactionWindow, v)
+		}
+		compactionWindow = d
+	}
+
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/api/v1/account/user", GetAccountUserInfo)
+	mux.HandleFunc("/api/v1/account/user", AccountUserAction)
 	mux.HandleFunc("/api/v1/account/user/register", CreateNewAccount)
 	mux.HandleFunc("/api/v1/account/user/bookmark", AccountBookmarksCollectionAction)
+	mux.HandleFunc("/api/v1/account/user/bookmark/extreme", ReportExtremeBookmarkWeather)
+	mux.HandleFunc("/api/v1/account/user/bookmark/weather", ReportBookmarkWeather)
+	mux.HandleFunc("/api/v1/account/user/export", ExportAccount)
 	mux.HandleFunc("/api/v1/location/weather", ReportLocationWeather)
+	mux.HandleFunc("/api/v1/location/weather/batch", ReportBatchLocationWeather)
+	mux.HandleFunc("/api/v1/location/weather/batch/coordinates", ReportBatchCoordinateWeather)
 	mux.HandleFunc("/api/v1/location/weather/stats", ReportWeatherStatistics)
+	mux.HandleFunc("/api/v1/location/weather/stats/help", ReportWeatherStatisticsHelp)
+	mux.HandleFunc("/api/v1/location/weather/delta", ReportTemperatureDelta)
+	mux.HandleFunc("/api/v1/location/weather/nearby-cached", ReportNearbyCachedWeather)
+	mux.HandleFunc("/api/v1/location/weather/ip", ReportIPLocationWeather)
+	mux.HandleFunc("/api/v1/location/weather/all", ReportAllLocationWeather)
+	mux.HandleFunc("/api/v1/location/weather/extremes", ReportExtremeCachedWeather)
+	mux.HandleFunc("/api/v1/location/weather/history", ReportWeatherHistory)
+	mux.HandleFunc("/api/v1/location/weather/activity", ReportWeatherActivity)
+	mux.HandleFunc("/api/v1/location/weather/debug", AdminDebugLocationWeather)
+	mux.HandleFunc("/api/v1/location/forecast", ReportLocationForecast)
+	mux.HandleFunc("/api/v1/weather/labels", ReportSupportedWeatherLabels)
+	mux.HandleFunc("/api/v1/admin/stats/refresh", AdminRefreshStatsSummary)
+	mux.HandleFunc("/api/v1/admin/accounts/bulk", AdminBulkCreateAccounts)
+	mux.HandleFunc("/api/v1/admin/weather/purge", AdminPurgeWeather)
+	mux.HandleFunc("/api/v1/admin/weather/diff", AdminDiffLocationWeather)
+	mux.HandleFunc("/api/v1/admin/locations/merge", AdminMergeDuplicateLocations)
+	mux.HandleFunc("/api/v1/admin/stale", AdminReportStaleLocations)
+	mux.HandleFunc("/api/v1/admin/quota", AdminReportAPIQuota)
+	mux.HandleFunc(endpointSwitchesPath, AdminEndpointSwitches)
+	mux.HandleFunc("/api/v1/health/detailed", ReportDetailedHealth)
 	mux.HandleFunc("/api/v1/status", func(w http.ResponseWriter, r *http.Request) { sendMessage(w, "ok") })
 
 	addr, _ := os.LookupEnv(envVarListenAddr)
 	port, _ := os.LookupEnv(envVarListenPort)
 
+	handler := withDeadline(mux)
+	if maxInFlight > 0 {
+		handler = withConcurrencyLimit(handler, maxInFlight)
+	}
+	handler = withEndpointSwitches(handler)
+	if len(corsAllowedOrigins) > 0 {
+		handler = withCORS(handler)
+	}
+
+	requests := &inFlightCounter{}
+
 	server := http.Server{
 		Addr:    fmt.Sprintf("%s:%s", addr, port),
-		Handler: mux,
+		Handler: requests.track(withRequestID(handler)),
 	}
 
 	<-ready // wait for db
 
+	if warmUpCache {
+		go func() { // fetch bookmarked locations ahead of their first request
+			start := time.Now()
+
+			warmed, err := warmCacheFromBookmarks(context.Background())
+			if err != nil {
+				log.Printf("failed to warm up the cache: %s", err)
+				return
+			}
+
+			log.Printf("warmed up the cache for %d bookmarked locations in %s", warmed, time.Since(start))
+		}()
+	}
+
+	go func() { // periodically recompute the stats summary so stats requests don't scan every reading
+		for {
+			if _, err := db.RefreshStatsSummary(); err != nil {
+				log.Printf("failed to refresh stats summary: %s", err)
+			}
+
+			// and the query counts from the recorded queries, in case any counter has drifted
+			if corrected, err := db.RollupQueryCounts(); err != nil {
+				log.Printf("failed to roll up query counts: %s", err)
+			} else if corrected > 0 {
+				log.Printf("corrected the query count of %d locations", corrected)
+			}
+
+			time.Sleep(statsRefreshInterval)
+		}
+	}()
+
+	if retention > 0 {
+		go func() { // periodically purge readings older than the retention window to bound table growth
+			for {
+				purged, err := db.PurgeWeatherOlderThan(retention)
+				if err != nil {
+					log.Printf("failed to purge old weather: %s", err)
+				} else if purged > 0 {
+					log.Printf("purged %d weather readings older than %s", purged, retention)
+				}
+
+				time.Sleep(time.Hour)
+			}
+		}()
+	}
+
+	if compactionWindow > 0 {
+		go func() { // periodically collapse repeated readings so they don't bias stats
+			for {
+				removed, err := db.CompactWeather(compactionWindow)
+				if err != nil {
+					log.Printf("failed to compact weather: %s", err)
+				} else if removed > 0 {
+					log.Printf("compacted %d repeated weather readings", removed)
+				}
+
+				time.Sleep(time.Hour)
+			}
+		}()
+	}
+
+	l, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
 	log.Printf("server listening for incoming requests @ %s:%s", addr, port)
-	log.Fatal(server.ListenAndServe())
+
+	if err := serve(&server, l, stop, shutdownDrain, requests); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// serve handles requests on 'l' until a signal is received on 'stop', then stops accepting new
+// requests and waits up to 'drain' for the requests in flight to finish, before closing the
+// connections of any that haven't.
+func serve(server *http.Server, l net.Listener, stop <-chan os.Signal, drain time.Duration, requests *inFlightCounter) error {
+	errs := make(chan error, 1)
+
+	go func() { errs <- server.Serve(l) }()
+
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-stop:
+		log.Printf("received %s, draining %d requests in flight for up to %s", sig, requests.count(), drain)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("drain period elapsed, closing %d requests in flight", requests.count())
+		return server.Close()
+	}
+
+	log.Printf("server shut down")
+
+	return nil
 }
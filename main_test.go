@@ -2,27 +2,51 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"log"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/msawangwan/weather/api"
+	"github.com/msawangwan/weather/cache"
 	"github.com/msawangwan/weather/db"
+	"github.com/msawangwan/weather/geoip"
 )
 
 const (
 	dataDirPath = "test/data/"
+
+	slowLocation      = "slow" // the mock api takes slowResponseDelay to respond for this location
+	slowResponseDelay = 2 * time.Second
 )
 
 type mockAPIServer struct {
 	*httptest.Server
+
+	mu   sync.Mutex
+	hits map[string]int
+}
+
+func (s *mockAPIServer) hitCount(resource string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hits[resource]
 }
 
 func (s *mockAPIServer) setup() error {
@@ -58,6 +82,8 @@ func (s *mockAPIServer) setup() error {
 		return err
 	}
 
+	s.hits = map[string]int{}
+
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/weather", func(w http.ResponseWriter, r *http.Request) {
@@ -72,9 +98,44 @@ func (s *mockAPIServer) setup() error {
 			return
 		}
 
-		resource := strings.ToLower(params["q"][0]) + ".json"
+		// by coordinates, the location whose coordinates match to 2 decimal places is reported
+		if params.Get("lat") != "" && params.Get("lon") != "" {
+			lat, _ := strconv.ParseFloat(params.Get("lat"), 64)
+			lon, _ := strconv.ParseFloat(params.Get("lon"), 64)
+
+			for resource, data := range responseJSON {
+				p := &api.Location{}
+				if json.Unmarshal(data, p) != nil || p.Coord == nil {
+					continue
+				}
+
+				if fmt.Sprintf("%.2f,%.2f", p.Coord.Lat, p.Coord.Lon) == fmt.Sprintf("%.2f,%.2f", lat, lon) {
+					s.mu.Lock()
+					s.hits[resource]++
+					s.mu.Unlock()
+
+					json.NewEncoder(w).Encode(&p)
+					return
+				}
+			}
+
+			m := map[string]interface{}{}
+			json.Unmarshal(responseJSON["404.json"], &m)
+			json.NewEncoder(w).Encode(&m)
+			return
+		}
+
+		if strings.ToLower(params["q"][0]) == slowLocation {
+			time.Sleep(slowResponseDelay)
+		}
+
+		// location files are named with spaces as '+', ie: "san+francisco.json"
+		resource := strings.Replace(strings.ToLower(params["q"][0]), " ", "+", -1) + ".json"
+
+		s.mu.Lock()
+		s.hits[resource]++
+		s.mu.Unlock()
 
-		// todo: handle locations with spaces, ie: "san francisco"
 		if data, exists := responseJSON[resource]; exists {
 			p := &api.Location{}
 			json.Unmarshal(data, p)
@@ -84,10 +145,48 @@ func (s *mockAPIServer) setup() error {
 
 		m := map[string]interface{}{}
 		data := responseJSON["404.json"]
-		json.Unmarshal(data, m)
+		json.Unmarshal(data, &m)
 		json.NewEncoder(w).Encode(&m)
 	})
 
+	mux.HandleFunc("/forecast", func(w http.ResponseWriter, r *http.Request) {
+		params, err := url.ParseQuery(r.URL.RawQuery)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		resource := strings.Replace(strings.ToLower(params.Get("q")), " ", "+", -1) + ".json"
+
+		data, exists := responseJSON[resource]
+		if !exists {
+			m := map[string]interface{}{}
+			json.Unmarshal(responseJSON["404.json"], &m)
+			json.NewEncoder(w).Encode(&m)
+			return
+		}
+
+		count, err := strconv.Atoi(params.Get("cnt"))
+		if err != nil || count > api.MaxForecastCount {
+			count = api.MaxForecastCount
+		}
+
+		// the forecast repeats the current weather in 3 hour steps
+		p := &api.Location{}
+		json.Unmarshal(data, p)
+
+		f := &api.Forecast{Cod: http.StatusOK, Message: 0, Cnt: count}
+		for i := 0; i < count; i++ {
+			f.List = append(f.List, &api.ForecastEntry{
+				Dt:      time.Now().Add(time.Duration(i*3) * time.Hour).Unix(),
+				Weather: p.Weather,
+				Main:    p.Main,
+			})
+		}
+
+		json.NewEncoder(w).Encode(f)
+	})
+
 	s.Server = httptest.NewServer(mux)
 
 	return nil
@@ -117,14 +216,39 @@ func (s *mockServer) setup() error {
 
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/api/v1/account/user", GetAccountUserInfo)
+	mux.HandleFunc("/api/v1/account/user", AccountUserAction)
 	mux.HandleFunc("/api/v1/account/user/register", CreateNewAccount)
 	mux.HandleFunc("/api/v1/account/user/bookmark", AccountBookmarksCollectionAction)
+	mux.HandleFunc("/api/v1/account/user/bookmark/extreme", ReportExtremeBookmarkWeather)
+	mux.HandleFunc("/api/v1/account/user/bookmark/weather", ReportBookmarkWeather)
+	mux.HandleFunc("/api/v1/account/user/export", ExportAccount)
 	mux.HandleFunc("/api/v1/location/weather", ReportLocationWeather)
+	mux.HandleFunc("/api/v1/location/weather/batch", ReportBatchLocationWeather)
+	mux.HandleFunc("/api/v1/location/weather/batch/coordinates", ReportBatchCoordinateWeather)
 	mux.HandleFunc("/api/v1/location/weather/stats", ReportWeatherStatistics)
+	mux.HandleFunc("/api/v1/location/weather/stats/help", ReportWeatherStatisticsHelp)
+	mux.HandleFunc("/api/v1/location/weather/delta", ReportTemperatureDelta)
+	mux.HandleFunc("/api/v1/location/weather/nearby-cached", ReportNearbyCachedWeather)
+	mux.HandleFunc("/api/v1/location/weather/ip", ReportIPLocationWeather)
+	mux.HandleFunc("/api/v1/location/weather/all", ReportAllLocationWeather)
+	mux.HandleFunc("/api/v1/location/weather/extremes", ReportExtremeCachedWeather)
+	mux.HandleFunc("/api/v1/location/weather/history", ReportWeatherHistory)
+	mux.HandleFunc("/api/v1/location/weather/activity", ReportWeatherActivity)
+	mux.HandleFunc("/api/v1/location/weather/debug", AdminDebugLocationWeather)
+	mux.HandleFunc("/api/v1/location/forecast", ReportLocationForecast)
+	mux.HandleFunc("/api/v1/weather/labels", ReportSupportedWeatherLabels)
+	mux.HandleFunc("/api/v1/admin/stats/refresh", AdminRefreshStatsSummary)
+	mux.HandleFunc("/api/v1/admin/accounts/bulk", AdminBulkCreateAccounts)
+	mux.HandleFunc("/api/v1/admin/weather/purge", AdminPurgeWeather)
+	mux.HandleFunc("/api/v1/admin/weather/diff", AdminDiffLocationWeather)
+	mux.HandleFunc("/api/v1/admin/locations/merge", AdminMergeDuplicateLocations)
+	mux.HandleFunc("/api/v1/admin/stale", AdminReportStaleLocations)
+	mux.HandleFunc("/api/v1/admin/quota", AdminReportAPIQuota)
+	mux.HandleFunc(endpointSwitchesPath, AdminEndpointSwitches)
+	mux.HandleFunc("/api/v1/health/detailed", ReportDetailedHealth)
 	mux.HandleFunc("/api/v1/status", func(w http.ResponseWriter, r *http.Request) { sendMessage(w, "ok") })
 
-	s.Server = httptest.NewServer(mux)
+	s.Server = httptest.NewServer(withRequestID(withEndpointSwitches(withDeadline(mux))))
 
 	return nil
 }
@@ -134,6 +258,16 @@ func (s *mockServer) teardown() {
 	db.GlobalConn.Close()
 }
 
+// stubLocator locates every address at the same coordinates, or fails with err.
+type stubLocator struct {
+	lat, lon float64
+	err      error
+}
+
+func (l stubLocator) Locate(ip net.IP) (float64, float64, error) {
+	return l.lat, l.lon, l.err
+}
+
 type mockClient struct {
 	*http.Client
 	*bytes.Buffer
@@ -197,6 +331,17 @@ func score(t *testing.T, have, want interface{}, test func() bool) {
 	t.Fail()
 }
 
+// UnmarshalJSON lets the tests read back a report written by MarshalJSON in either shape.
+func (r *statsTemperatureReport) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &r.Nested); err == nil {
+		return nil
+	}
+
+	r.Nested = nil
+
+	return json.Unmarshal(b, &r.Series)
+}
+
 func TestHandlers(t *testing.T) {
 	initState := func() (*testContext, func()) {
 		ctx := &testContext{}
@@ -215,7 +360,7 @@ func TestHandlers(t *testing.T) {
 		return ctx, func() { ctx.teardown() }
 	}
 
-	context, cleanup := initState()
+	state, cleanup := initState()
 	defer cleanup()
 
 	locationQuery := struct {
@@ -239,17 +384,17 @@ func TestHandlers(t *testing.T) {
 
 	for _, tc := range getLocationTestCases {
 		t.Run(tc.label, func(t *testing.T) {
-			res, err := context.c.Get(context.mockServer.URL + tc.resource)
+			res, err := state.c.Get(state.mockServer.URL + tc.resource)
 			if err != nil {
 				t.Fatal(err)
 			}
 
 			locationQuery.CityName = ""
 
-			context.c.ReadFrom(res.Body)
+			state.c.ReadFrom(res.Body)
 			res.Body.Close()
-			json.Unmarshal(context.c.Bytes(), &locationQuery)
-			context.c.Buffer.Reset()
+			json.Unmarshal(state.c.Bytes(), &locationQuery)
+			state.c.Buffer.Reset()
 
 			score(t, locationQuery.CityName, tc.want, func() bool {
 				return locationQuery.CityName == tc.want
@@ -262,24 +407,24 @@ func TestHandlers(t *testing.T) {
 		resource string
 		want     float64
 	}{
-		{"expected location median temp 1", "/api/v1/location/weather?city=Reno", 276.2050018310547},
-		{"expected location median temp 2", "/api/v1/location/weather?city=London", 280.1499938964844},
+		{"expected location median temp 1", "/api/v1/location/weather?city=Reno", 276.21},
+		{"expected location median temp 2", "/api/v1/location/weather?city=London", 280.15},
 		// add edge cases here ..
 	}
 
 	for _, tc := range getLocationTempTestCases {
 		t.Run(tc.label, func(t *testing.T) {
-			res, err := context.c.Get(context.mockServer.URL + tc.resource)
+			res, err := state.c.Get(state.mockServer.URL + tc.resource)
 			if err != nil {
 				t.Fatal(err)
 			}
 
 			locationQuery.MedianTemp = 0.0
 
-			context.c.ReadFrom(res.Body)
+			state.c.ReadFrom(res.Body)
 			res.Body.Close()
-			json.Unmarshal(context.c.Bytes(), &locationQuery)
-			context.c.Buffer.Reset()
+			json.Unmarshal(state.c.Bytes(), &locationQuery)
+			state.c.Buffer.Reset()
 
 			score(t, locationQuery.MedianTemp, tc.want, func() bool {
 				return locationQuery.MedianTemp == tc.want
@@ -287,28 +432,101 @@ func TestHandlers(t *testing.T) {
 		})
 	}
 
+	var windDirectionTestCases = []struct {
+		label    string
+		resource string
+		want     string
+	}{
+		{"expected wind direction 1", "/api/v1/location/weather?city=Reno", "NE"},
+		{"expected wind direction 2", "/api/v1/location/weather?city=London", "E"},
+		// add edge cases here ..
+	}
+
+	for _, tc := range windDirectionTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			res, err := state.c.Get(state.mockServer.URL + tc.resource)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			windQuery := struct {
+				Wind struct {
+					Direction string `json:"direction"`
+				} `json:"wind"`
+			}{}
+
+			state.c.ReadFrom(res.Body)
+			res.Body.Close()
+			json.Unmarshal(state.c.Bytes(), &windQuery)
+			state.c.Buffer.Reset()
+
+			score(t, windQuery.Wind.Direction, tc.want, func() bool {
+				return windQuery.Wind.Direction == tc.want
+			})
+		})
+	}
+
+	var visibilityAndCloudsTestCases = []struct {
+		label          string
+		resource       string
+		wantVisibility int64
+		wantClouds     int64
+	}{
+		{"expected visibility and clouds 1", "/api/v1/location/weather?city=Reno", 16093, 20},
+		{"expected visibility and clouds 2", "/api/v1/location/weather?city=London", 10000, 90},
+		// add edge cases here ..
+	}
+
+	for _, tc := range visibilityAndCloudsTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			for i := 0; i < 2; i++ { // the second request is always a cache hit
+				res, err := state.c.Get(state.mockServer.URL + tc.resource)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				conditionsQuery := struct {
+					Visibility int64 `json:"visibility"`
+					Clouds     int64 `json:"clouds"`
+				}{}
+
+				state.c.ReadFrom(res.Body)
+				res.Body.Close()
+				json.Unmarshal(state.c.Bytes(), &conditionsQuery)
+				state.c.Buffer.Reset()
+
+				have := []int64{conditionsQuery.Visibility, conditionsQuery.Clouds}
+				want := []int64{tc.wantVisibility, tc.wantClouds}
+
+				score(t, have, want, func() bool {
+					return conditionsQuery.Visibility == tc.wantVisibility && conditionsQuery.Clouds == tc.wantClouds
+				})
+			}
+		})
+	}
+
 	var monthlyAvgTestCases = []struct {
 		label    string
 		resource string
 		want     float64
 	}{
-		{"expected averages", "/api/v1/location/weather/stats?temp=avgs", 294.92999267578125},
+		{"expected averages", "/api/v1/location/weather/stats?temp=avgs", 294.93},
 		// add edge cases here ..
 	}
 
 	for _, tc := range monthlyAvgTestCases {
 		t.Run(tc.label, func(t *testing.T) {
-			res, err := context.c.Get(context.mockServer.URL + tc.resource)
+			res, err := state.c.Get(state.mockServer.URL + tc.resource)
 			if err != nil {
 				t.Fatal(err)
 			}
 
 			statsQuery := map[string]interface{}{}
 
-			context.c.ReadFrom(res.Body)
+			state.c.ReadFrom(res.Body)
 			res.Body.Close()
-			json.Unmarshal(context.c.Bytes(), &statsQuery)
-			context.c.Buffer.Reset()
+			json.Unmarshal(state.c.Bytes(), &statsQuery)
+			state.c.Buffer.Reset()
 
 			avgs := statsQuery["temperatures"].(map[string]interface{})["avgs"]
 
@@ -318,5 +536,3317 @@ func TestHandlers(t *testing.T) {
 		})
 	}
 
-	// add more tests here ..
+	var registerAccountTestCases = []struct {
+		label    string
+		username string
+	}{
+		{"register same account twice", "twice"},
+		// add edge cases here ..
+	}
+
+	for _, tc := range registerAccountTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			account := struct {
+				Name string `json:"name,omitempty"`
+				ID   int64  `json:"id,omitempty"`
+			}{}
+
+			ids := []int64{}
+
+			for i := 0; i < 2; i++ {
+				body := strings.NewReader(`{"username": "` + tc.username + `"}`)
+
+				res, err := state.c.Post(state.mockServer.URL+"/api/v1/account/user/register", "application/json", body)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				state.c.ReadFrom(res.Body)
+				res.Body.Close()
+				json.Unmarshal(state.c.Bytes(), &account)
+				state.c.Buffer.Reset()
+
+				score(t, res.StatusCode, http.StatusOK, func() bool {
+					return res.StatusCode == http.StatusOK
+				})
+
+				ids = append(ids, account.ID)
+			}
+
+			score(t, ids[1], ids[0], func() bool {
+				return ids[0] != 0 && ids[0] == ids[1]
+			})
+		})
+	}
+
+	var renameAccountTestCases = []struct {
+		label    string
+		register []string
+		from     string
+		to       string
+		want     int
+	}{
+		{"rename account", []string{"before"}, "before", "after", http.StatusOK},
+		{"rename account to a taken name", []string{"first", "second"}, "first", "second", http.StatusConflict},
+		// add edge cases here ..
+	}
+
+	for _, tc := range renameAccountTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			for _, username := range tc.register {
+				body := strings.NewReader(`{"username": "` + username + `"}`)
+
+				res, err := state.c.Post(state.mockServer.URL+"/api/v1/account/user/register", "application/json", body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				res.Body.Close()
+			}
+
+			body := strings.NewReader(`{"username": "` + tc.from + `", "new_username": "` + tc.to + `"}`)
+
+			req, err := http.NewRequest(http.MethodPut, state.mockServer.URL+"/api/v1/account/user", body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req.Header.Set("Content-Type", "application/json")
+
+			res, err := state.c.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			score(t, res.StatusCode, tc.want, func() bool {
+				return res.StatusCode == tc.want
+			})
+		})
+	}
+
+	var temperatureDeltaTestCases = []struct {
+		label      string
+		resource   string
+		want       float64
+		wantStatus int
+	}{
+		{"no change in temperature", "/api/v1/location/weather/delta?city=Reno&from=" + url.QueryEscape(time.Now().Format(time.RFC3339)), 0.0, http.StatusOK},
+		{"no reading near requested time", "/api/v1/location/weather/delta?city=Reno&from=2000-01-01T00:00:00Z", 0.0, http.StatusNotFound},
+		{"no city", "/api/v1/location/weather/delta?from=2000-01-01T00:00:00Z", 0.0, http.StatusBadRequest},
+		// add edge cases here ..
+	}
+
+	for _, tc := range temperatureDeltaTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			res, err := state.c.Get(state.mockServer.URL + tc.resource)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			deltaQuery := struct {
+				Delta float64 `json:"delta"`
+				Error string  `json:"error,omitempty"`
+			}{}
+
+			state.c.ReadFrom(res.Body)
+			res.Body.Close()
+			json.Unmarshal(state.c.Bytes(), &deltaQuery)
+			state.c.Buffer.Reset()
+
+			score(t, deltaQuery, tc.want, func() bool {
+				return res.StatusCode == tc.wantStatus && deltaQuery.Delta == tc.want && (deltaQuery.Error != "") == (tc.wantStatus != http.StatusOK)
+			})
+		})
+	}
+
+	t.Run("only one instance refreshes a location", func(t *testing.T) {
+		const (
+			resource     = "/api/v1/location/weather?city=Bangkok"
+			numInstances = 2
+			numRequests  = 6
+		)
+
+		instances := []string{state.mockServer.URL}
+
+		for i := 1; i < numInstances; i++ {
+			instance := httptest.NewServer(state.mockServer.Config.Handler)
+			defer instance.Close()
+
+			instances = append(instances, instance.URL)
+		}
+
+		var wg sync.WaitGroup
+
+		for i := 0; i < numRequests; i++ {
+			wg.Add(1)
+
+			go func(instance string) {
+				defer wg.Done()
+
+				res, err := http.Get(instance + resource)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				res.Body.Close()
+			}(instances[i%numInstances])
+		}
+
+		wg.Wait()
+
+		hits := state.mockAPIServer.hitCount("bangkok.json")
+
+		score(t, hits, 1, func() bool {
+			return hits == 1
+		})
+	})
+
+	var batchTestCases = []struct {
+		label      string
+		cities     []string
+		wantStatus int
+		wantErrors int
+	}{
+		{"batch with mixed success and failure", []string{"London", "Atlantis"}, http.StatusOK, 1},
+		{"batch over the city limit", make([]string, maxBatchCities+1), http.StatusRequestEntityTooLarge, 0},
+		// add edge cases here ..
+	}
+
+	for _, tc := range batchTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			body, _ := json.Marshal(map[string]interface{}{"cities": tc.cities})
+
+			res, err := state.c.Post(state.mockServer.URL+"/api/v1/location/weather/batch", "application/json", bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			results := []struct {
+				City  string `json:"city"`
+				Error string `json:"error,omitempty"`
+			}{}
+
+			state.c.ReadFrom(res.Body)
+			res.Body.Close()
+			json.Unmarshal(state.c.Bytes(), &results)
+			state.c.Buffer.Reset()
+
+			failed := 0
+			for _, r := range results {
+				if r.Error != "" {
+					failed++
+				}
+			}
+
+			score(t, failed, tc.wantErrors, func() bool {
+				return res.StatusCode == tc.wantStatus && failed == tc.wantErrors
+			})
+		})
+	}
+
+	t.Run("batch weather by coordinates", func(t *testing.T) {
+		body, _ := json.Marshal(map[string]interface{}{
+			"coordinates": []map[string]float64{
+				{"lat": 47.5, "lon": 19.04},
+				{"lat": 0, "lon": 0},
+				{"lat": -23.55, "lon": -46.64},
+			},
+		})
+
+		res, err := state.c.Post(state.mockServer.URL+"/api/v1/location/weather/batch/coordinates", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		results := []struct {
+			City  string `json:"city"`
+			Error string `json:"error,omitempty"`
+		}{}
+
+		state.c.ReadFrom(res.Body)
+		res.Body.Close()
+		json.Unmarshal(state.c.Bytes(), &results)
+		state.c.Buffer.Reset()
+
+		have := []string{}
+		for _, r := range results {
+			have = append(have, r.City+"|"+r.Error)
+		}
+
+		want := []string{"Budapest|", "|city not found", "São Paulo|"}
+
+		score(t, have, want, func() bool {
+			return res.StatusCode == http.StatusOK && reflect.DeepEqual(have, want)
+		})
+
+		query, err := db.FetchLocationWeather(context.Background(), "São Paulo")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lr, wr := parseRows(query)
+
+		score(t, lr != nil && wr != nil, true, func() bool {
+			return lr != nil && wr != nil
+		})
+	})
+
+	t.Run("batch weather by coordinates stays within the daily api budget", func(t *testing.T) {
+		defer func(budget int) { dailyAPIBudget = budget }(dailyAPIBudget)
+
+		calls, err := db.APICallsToday(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dailyAPIBudget = calls + 1
+
+		body, _ := json.Marshal(map[string]interface{}{
+			"coordinates": []map[string]float64{
+				{"lat": 51.51, "lon": -0.13},
+				{"lat": 13.75, "lon": 100.49},
+			},
+		})
+
+		res, err := state.c.Post(state.mockServer.URL+"/api/v1/location/weather/batch/coordinates", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		results := []struct {
+			Error string `json:"error,omitempty"`
+		}{}
+
+		state.c.ReadFrom(res.Body)
+		res.Body.Close()
+		json.Unmarshal(state.c.Bytes(), &results)
+		state.c.Buffer.Reset()
+
+		spent := 0
+		for _, r := range results {
+			if r.Error == errAPIQuotaSpent.message {
+				spent++
+			}
+		}
+
+		after, err := db.APICallsToday(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		score(t, after, dailyAPIBudget, func() bool {
+			return res.StatusCode == http.StatusOK && len(results) == 2 && spent == 1 && after == dailyAPIBudget
+		})
+	})
+
+	t.Run("weather by coordinates is cached under the location's name", func(t *testing.T) {
+		reports := []struct {
+			CityName string `json:"city_name"`
+			AtTime   string `json:"at_time"`
+		}{{}, {}}
+
+		for i, query := range []string{"lat=39.53&lon=-119.81", "city=reno"} {
+			res, err := state.c.Get(state.mockServer.URL + "/api/v1/location/weather?" + query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			state.c.ReadFrom(res.Body)
+			res.Body.Close()
+			json.Unmarshal(state.c.Bytes(), &reports[i])
+			state.c.Buffer.Reset()
+		}
+
+		score(t, reports[1], reports[0], func() bool {
+			return reports[0].CityName == "Reno" && reports[0] == reports[1]
+		})
+
+		hits := state.mockAPIServer.hitCount("reno.json")
+
+		// a nearby coordinate is served from the cached location, HEAD requests included
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			req, err := http.NewRequest(method, state.mockServer.URL+"/api/v1/location/weather?lat=39.52&lon=-119.8", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			res, err := state.c.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			score(t, state.mockAPIServer.hitCount("reno.json"), hits, func() bool {
+				return res.StatusCode == http.StatusOK && state.mockAPIServer.hitCount("reno.json") == hits
+			})
+		}
+	})
+
+	var coordinateTestCases = []struct {
+		label      string
+		query      string
+		wantStatus int
+	}{
+		{"weather at an unknown coordinate", "lat=0&lon=0", http.StatusNotFound},
+		{"weather by coordinates and city", "lat=39.53&lon=-119.81&city=reno", http.StatusBadRequest},
+		{"weather at an invalid coordinate", "lat=91&lon=0", http.StatusBadRequest},
+	}
+
+	for _, tc := range coordinateTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			res, err := state.c.Get(state.mockServer.URL + "/api/v1/location/weather?" + tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			score(t, res.StatusCode, tc.wantStatus, func() bool {
+				return res.StatusCode == tc.wantStatus
+			})
+		})
+	}
+
+	t.Run("expected monthly summary", func(t *testing.T) {
+		if _, err := db.RefreshStatsSummary(); err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := state.c.Get(state.mockServer.URL + "/api/v1/location/weather/stats?summary=month")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		statsQuery := struct {
+			Summary struct {
+				Monthly map[string]interface{}
+			} `json:"summary"`
+		}{}
+
+		state.c.ReadFrom(res.Body)
+		res.Body.Close()
+		json.Unmarshal(state.c.Bytes(), &statsQuery)
+		state.c.Buffer.Reset()
+
+		_, found := statsQuery.Summary.Monthly["London"]
+
+		score(t, found, true, func() bool {
+			return found
+		})
+	})
+
+	var extremeWeatherTestCases = []struct {
+		label  string
+		params string
+		want   int
+	}{
+		{"no extreme weather by default", "", 0},
+		{"everywhere is hot", "&hot=0", 2},
+		{"everywhere is cold", "&cold=1000", 2},
+		{"extreme labels", "&labels=clouds,drizzle", 2},
+		{"one extreme label", "&labels=Clouds", 1},
+		// add edge cases here ..
+	}
+
+	t.Run("bookmark London and Reno", func(t *testing.T) {
+		for _, req := range []struct{ resource, body string }{
+			{"/api/v1/account/user/register", `{"username": "extreme"}`},
+			{"/api/v1/account/user/bookmark", `{"username": "extreme", "locations": ["London", "Reno"]}`},
+		} {
+			res, err := state.c.Post(state.mockServer.URL+req.resource, "application/json", strings.NewReader(req.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+		}
+	})
+
+	for _, tc := range extremeWeatherTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			res, err := state.c.Get(state.mockServer.URL + "/api/v1/account/user/bookmark/extreme?username=extreme" + tc.params)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			extremeQuery := struct {
+				Extreme []interface{} `json:"extreme"`
+			}{}
+
+			state.c.ReadFrom(res.Body)
+			res.Body.Close()
+			json.Unmarshal(state.c.Bytes(), &extremeQuery)
+			state.c.Buffer.Reset()
+
+			score(t, len(extremeQuery.Extreme), tc.want, func() bool {
+				return len(extremeQuery.Extreme) == tc.want
+			})
+		})
+	}
+
+	t.Run("extreme weather at the bookmarks of an unknown account is not found", func(t *testing.T) {
+		res, err := state.c.Get(state.mockServer.URL + "/api/v1/account/user/bookmark/extreme?username=nobody")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		score(t, res.StatusCode, http.StatusNotFound, func() bool {
+			return res.StatusCode == http.StatusNotFound
+		})
+	})
+
+	t.Run("slow upstream returns by the deadline", func(t *testing.T) {
+		defer func(d time.Duration) { requestTimeout = d }(requestTimeout)
+
+		requestTimeout = 500 * time.Millisecond
+
+		start := time.Now()
+
+		res, err := state.c.Get(state.mockServer.URL + "/api/v1/location/weather?city=" + slowLocation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		elapsed := time.Since(start)
+
+		score(t, res.StatusCode, http.StatusServiceUnavailable, func() bool {
+			return res.StatusCode == http.StatusServiceUnavailable && elapsed < slowResponseDelay
+		})
+	})
+
+	t.Run("replacing bookmarks removes those not in the new list", func(t *testing.T) {
+		const resource = "/api/v1/account/user/bookmark"
+
+		res, err := state.c.Post(state.mockServer.URL+"/api/v1/account/user/register", "application/json", strings.NewReader(`{"username": "replace"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		res, err = state.c.Post(state.mockServer.URL+resource, "application/json", strings.NewReader(`{"username": "replace", "locations": ["London", "Reno"]}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		req, err := http.NewRequest(http.MethodPut, state.mockServer.URL+resource, strings.NewReader(`{"username": "replace", "locations": ["Budapest"]}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+
+		res, err = state.c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bookmarksQuery := struct {
+			Bookmarks []string
+		}{}
+
+		state.c.ReadFrom(res.Body)
+		res.Body.Close()
+		json.Unmarshal(state.c.Bytes(), &bookmarksQuery)
+		state.c.Buffer.Reset()
+
+		score(t, bookmarksQuery.Bookmarks, []string{"Budapest"}, func() bool {
+			return len(bookmarksQuery.Bookmarks) == 1 && bookmarksQuery.Bookmarks[0] == "Budapest"
+		})
+	})
+
+	var bookmarkWeatherTestCases = []struct {
+		label    string
+		resource string
+		want     int
+	}{
+		{"weather at a bookmarked location", "/api/v1/account/user/bookmark/weather?username=replace&city=budapest", http.StatusOK},
+		{"weather at a location that isn't bookmarked", "/api/v1/account/user/bookmark/weather?username=replace&city=London", http.StatusNotFound},
+		{"weather at a bookmark of an unknown account", "/api/v1/account/user/bookmark/weather?username=nobody&city=Budapest", http.StatusNotFound},
+		{"weather at a bookmark without a city", "/api/v1/account/user/bookmark/weather?username=replace", http.StatusBadRequest},
+	}
+
+	for _, tc := range bookmarkWeatherTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			res, err := state.c.Get(state.mockServer.URL + tc.resource)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			locationQuery.CityName = ""
+
+			state.c.ReadFrom(res.Body)
+			res.Body.Close()
+			json.Unmarshal(state.c.Bytes(), &locationQuery)
+			state.c.Buffer.Reset()
+
+			score(t, res.StatusCode, tc.want, func() bool {
+				return res.StatusCode == tc.want && (tc.want != http.StatusOK || locationQuery.CityName == "Budapest")
+			})
+		})
+	}
+
+	t.Run("location weather requires a city", func(t *testing.T) {
+		res, err := state.c.Get(state.mockServer.URL + "/api/v1/location/weather")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		errorQuery := struct {
+			Error string `json:"error"`
+		}{}
+
+		state.c.ReadFrom(res.Body)
+		res.Body.Close()
+		json.Unmarshal(state.c.Bytes(), &errorQuery)
+		state.c.Buffer.Reset()
+
+		score(t, errorQuery.Error, errCityRequired.Error(), func() bool {
+			return res.StatusCode == http.StatusBadRequest && errorQuery.Error == errCityRequired.Error()
+		})
+	})
+
+	t.Run("location weather falls back to the default city", func(t *testing.T) {
+		defer func(c string) { defaultCity = c }(defaultCity)
+
+		defaultCity = "Reno"
+
+		res, err := state.c.Get(state.mockServer.URL + "/api/v1/location/weather")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		locationQuery.CityName = ""
+
+		state.c.ReadFrom(res.Body)
+		res.Body.Close()
+		json.Unmarshal(state.c.Bytes(), &locationQuery)
+		state.c.Buffer.Reset()
+
+		score(t, locationQuery.CityName, "Reno", func() bool {
+			return locationQuery.CityName == "Reno"
+		})
+	})
+
+	t.Run("nearby cached weather never calls the api", func(t *testing.T) {
+		if _, err := db.SeedLocation("Nearbyville", 64.15, -21.94); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := db.SeedWeather("Nearbyville", 270.15, 280.15, time.Now().Add(-time.Hour), "Clear"); err != nil {
+			t.Fatal(err)
+		}
+
+		hits := state.mockAPIServer.hitCount("nearbyville.json")
+
+		res, err := state.c.Get(state.mockServer.URL + "/api/v1/location/weather/nearby-cached?lat=64.1&lon=-21.9")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		nearbyQuery := struct {
+			CityName   string  `json:"city_name"`
+			DistanceKm float64 `json:"distance_km"`
+			AgeSeconds int64   `json:"age_seconds"`
+		}{}
+
+		state.c.ReadFrom(res.Body)
+		res.Body.Close()
+		json.Unmarshal(state.c.Bytes(), &nearbyQuery)
+		state.c.Buffer.Reset()
+
+		score(t, nearbyQuery.CityName, "Nearbyville", func() bool {
+			return nearbyQuery.CityName == "Nearbyville" &&
+				nearbyQuery.DistanceKm < 5 &&
+				nearbyQuery.AgeSeconds >= 3600 &&
+				state.mockAPIServer.hitCount("nearbyville.json") == hits
+		})
+
+		res, err = state.c.Get(state.mockServer.URL + "/api/v1/location/weather/nearby-cached?lat=-33.87&lon=151.21")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		score(t, res.StatusCode, http.StatusNotFound, func() bool {
+			return res.StatusCode == http.StatusNotFound
+		})
+	})
+
+	t.Run("weather near the client's ip", func(t *testing.T) {
+		defer func(l geoip.Locator) { geoLocator = l }(geoLocator)
+
+		var ipLocationTestCases = []struct {
+			label   string
+			locator geoip.Locator
+			want    int
+		}{
+			{"located", stubLocator{lat: 64.1, lon: -21.9}, http.StatusOK},
+			{"not located", stubLocator{err: geoip.ErrNotFound}, http.StatusBadRequest},
+			{"geolocation not configured", geoip.None{}, http.StatusBadRequest},
+		}
+
+		for _, tc := range ipLocationTestCases {
+			t.Run(tc.label, func(t *testing.T) {
+				geoLocator = tc.locator
+
+				res, err := state.c.Get(state.mockServer.URL + "/api/v1/location/weather/ip")
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				nearbyQuery := struct {
+					CityName string `json:"city_name"`
+				}{}
+
+				state.c.ReadFrom(res.Body)
+				res.Body.Close()
+				json.Unmarshal(state.c.Bytes(), &nearbyQuery)
+				state.c.Buffer.Reset()
+
+				score(t, res.StatusCode, tc.want, func() bool {
+					return res.StatusCode == tc.want && (tc.want != http.StatusOK || nearbyQuery.CityName == "Nearbyville")
+				})
+			})
+		}
+	})
+
+	t.Run("cached weather older than max_age isn't served", func(t *testing.T) {
+		defer func(f func() time.Time) { nowFunc = f }(nowFunc)
+
+		wr, err := db.WeatherAsOf(context.Background(), "Nearbyville", time.Now())
+		if err != nil || wr == nil {
+			t.Fatalf("have: %v, %v want: Nearbyville's reading", wr, err)
+		}
+
+		// as if Nearbyville's reading was taken exactly an hour ago
+		at := wr.AtTime.Add(time.Hour)
+		nowFunc = func() time.Time { return at }
+
+		var maxAgeTestCases = []struct {
+			maxAge string
+			want   int
+		}{
+			{"61m", http.StatusOK},
+			{"PT2H", http.StatusOK},
+			{"59m", http.StatusNotFound},
+			{"3000", http.StatusNotFound},
+			{"0s", http.StatusBadRequest},
+			{"soon", http.StatusBadRequest},
+		}
+
+		for _, tc := range maxAgeTestCases {
+			t.Run(tc.maxAge, func(t *testing.T) {
+				for _, path := range []string{
+					"/api/v1/location/weather/nearby-cached?lat=64.1&lon=-21.9",
+					"/api/v1/location/weather?city=Nearbyville&at=" + url.QueryEscape(at.Format(time.RFC3339)),
+				} {
+					res, err := state.c.Get(state.mockServer.URL + path + "&max_age=" + tc.maxAge)
+					if err != nil {
+						t.Fatal(err)
+					}
+					res.Body.Close()
+
+					score(t, res.StatusCode, tc.want, func() bool {
+						return res.StatusCode == tc.want
+					})
+				}
+			})
+		}
+
+		t.Run("all", func(t *testing.T) {
+			for _, tc := range maxAgeTestCases {
+				res, err := state.c.Get(state.mockServer.URL + "/api/v1/location/weather/all?limit=500&max_age=" + tc.maxAge)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				allQuery := struct {
+					Weather []struct {
+						CityName string `json:"city_name"`
+					} `json:"weather"`
+				}{}
+
+				state.c.ReadFrom(res.Body)
+				res.Body.Close()
+				json.Unmarshal(state.c.Bytes(), &allQuery)
+				state.c.Buffer.Reset()
+
+				listed := false
+				for _, report := range allQuery.Weather {
+					listed = listed || report.CityName == "Nearbyville"
+				}
+
+				// an old reading leaves the location out rather than failing the page
+				want, wantListed := tc.want, tc.want == http.StatusOK
+				if want == http.StatusNotFound {
+					want = http.StatusOK
+				}
+
+				score(t, listed, wantListed, func() bool {
+					return res.StatusCode == want && listed == wantListed
+				})
+			}
+		})
+
+		t.Run("extremes", func(t *testing.T) {
+			// long after every reading was taken
+			nowFunc = func() time.Time { return at.Add(24 * time.Hour * 365) }
+
+			for maxAge, want := range map[string]int{
+				"1h":   http.StatusNotFound,
+				"soon": http.StatusBadRequest,
+			} {
+				res, err := state.c.Get(state.mockServer.URL + "/api/v1/location/weather/extremes?max_age=" + maxAge)
+				if err != nil {
+					t.Fatal(err)
+				}
+				res.Body.Close()
+
+				score(t, res.StatusCode, want, func() bool {
+					return res.StatusCode == want
+				})
+			}
+		})
+	})
+
+	t.Run("stats refresh requires the admin token", func(t *testing.T) {
+		defer func(token string) { adminToken = token }(adminToken)
+
+		adminToken = "secret"
+
+		var refreshTestCases = []struct {
+			label string
+			token string
+			want  int
+		}{
+			{"no token", "", http.StatusUnauthorized},
+			{"wrong token", "guess", http.StatusUnauthorized},
+			{"admin token", "secret", http.StatusOK},
+		}
+
+		for _, tc := range refreshTestCases {
+			req, err := http.NewRequest(http.MethodPost, state.mockServer.URL+"/api/v1/admin/stats/refresh", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+
+			res, err := state.c.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			score(t, res.StatusCode, tc.want, func() bool {
+				return res.StatusCode == tc.want
+			})
+		}
+	})
+
+	t.Run("bulk registration reports conflicts", func(t *testing.T) {
+		defer func(token string) { adminToken = token }(adminToken)
+
+		adminToken = "secret"
+
+		res, err := state.c.Post(state.mockServer.URL+"/api/v1/account/user/register", "application/json", strings.NewReader(`{"username": "bulkexisting"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		body := strings.NewReader(`{"usernames": ["bulkone", "bulkexisting", "bulktwo", "bulkone", ""]}`)
+
+		req, err := http.NewRequest(http.MethodPost, state.mockServer.URL+"/api/v1/admin/accounts/bulk", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Header.Set("Content-Type", "application/json")
+
+		res, err = state.c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		results := []struct {
+			Username string `json:"username"`
+			Status   string `json:"status"`
+		}{}
+
+		state.c.ReadFrom(res.Body)
+		res.Body.Close()
+		json.Unmarshal(state.c.Bytes(), &results)
+		state.c.Buffer.Reset()
+
+		have := []string{}
+		for _, r := range results {
+			have = append(have, r.Status)
+		}
+
+		want := []string{"created", "conflict", "created", "conflict", "invalid"}
+
+		score(t, have, want, func() bool {
+			if res.StatusCode != http.StatusOK || len(have) != len(want) {
+				return false
+			}
+			for i := range want {
+				if have[i] != want[i] {
+					return false
+				}
+			}
+			return true
+		})
+
+		acc, err := db.ExistingAccount("bulktwo")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		score(t, acc, "an account for bulktwo", func() bool {
+			return acc != nil
+		})
+	})
+
+	t.Run("stats over the entry limit are rejected", func(t *testing.T) {
+		defer func(n int) { db.MaxStatsEntries = n }(db.MaxStatsEntries)
+
+		if _, err := db.RefreshStatsSummary(); err != nil {
+			t.Fatal(err)
+		}
+
+		db.MaxStatsEntries = 1 // the locations fetched above already have more readings than this
+
+		res, err := state.c.Get(state.mockServer.URL + "/api/v1/location/weather/stats?temp=lows")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		score(t, res.StatusCode, http.StatusUnprocessableEntity, func() bool {
+			return res.StatusCode == http.StatusUnprocessableEntity
+		})
+	})
+
+	var statsShapeTestCases = []struct {
+		query string
+		want  []string // the keys of the response
+	}{
+		{"count=query", []string{"count"}},
+		{"count=query&count=labels", []string{"count", "labels"}},
+		{"summary=month", []string{"summary"}},
+		{"temp=avgs&by=label", []string{"label_temperatures", "meta", "temperatures"}},
+		{"temp=extremes&by=label&granularity=month", []string{"label_counts", "temperature_extremes"}},
+		{"temp=avgs&metric=humidity", []string{"humidity", "meta"}},
+		{"by=dominant-label", []string{"dominant_labels"}},
+		{"by=label&by=dominant-label", []string{"dominant_labels", "label_temperatures"}},
+		{"temp=lows&temp=highs&metric=pressure", []string{"meta", "pressure"}},
+	}
+
+	for _, tc := range statsShapeTestCases {
+		t.Run("stats response shape for "+tc.query, func(t *testing.T) {
+			res, err := state.c.Get(state.mockServer.URL + "/api/v1/location/weather/stats?" + tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var (
+				raw   = map[string]json.RawMessage{}
+				typed = StatsResponse{}
+			)
+
+			state.c.ReadFrom(res.Body)
+			res.Body.Close()
+			json.Unmarshal(state.c.Bytes(), &raw)
+			typedErr := json.Unmarshal(state.c.Bytes(), &typed)
+			state.c.Buffer.Reset()
+
+			have := []string{}
+			for k := range raw {
+				have = append(have, k)
+			}
+			sort.Strings(have)
+
+			score(t, have, tc.want, func() bool {
+				return res.StatusCode == http.StatusOK && typedErr == nil && strings.Join(have, ",") == strings.Join(tc.want, ",")
+			})
+		})
+	}
+
+	t.Run("stats reject unsupported metrics", func(t *testing.T) {
+		for _, query := range []string{"temp=avgs&metric=wind", "temp=extremes&metric=humidity"} {
+			res, err := state.c.Get(state.mockServer.URL + "/api/v1/location/weather/stats?" + query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			score(t, res.StatusCode, http.StatusBadRequest, func() bool {
+				return res.StatusCode == http.StatusBadRequest
+			})
+		}
+	})
+
+	t.Run("bare stats report an overview when enabled", func(t *testing.T) {
+		defer func(enabled bool) { statsOverview = enabled }(statsOverview)
+
+		statsOverview = true
+
+		res, err := state.c.Get(state.mockServer.URL + "/api/v1/location/weather/stats")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		overviewQuery := map[string]interface{}{}
+
+		state.c.ReadFrom(res.Body)
+		res.Body.Close()
+		json.Unmarshal(state.c.Bytes(), &overviewQuery)
+		state.c.Buffer.Reset()
+
+		score(t, overviewQuery, "count, labels and summary", func() bool {
+			for _, field := range []string{"count", "labels", "summary"} {
+				if _, present := overviewQuery[field]; !present {
+					return false
+				}
+			}
+			return res.StatusCode == http.StatusOK
+		})
+	})
+
+	t.Run("debug view of a cached location is flat", func(t *testing.T) {
+		defer func(token string) { adminToken = token }(adminToken)
+
+		adminToken = "secret"
+
+		req, err := http.NewRequest(http.MethodGet, state.mockServer.URL+"/api/v1/location/weather/debug?city=London", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set("Authorization", "Bearer secret")
+
+		res, err := state.c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		debugQuery := map[string]interface{}{}
+
+		state.c.ReadFrom(res.Body)
+		res.Body.Close()
+		json.Unmarshal(state.c.Bytes(), &debugQuery)
+		state.c.Buffer.Reset()
+
+		score(t, debugQuery, "a flat London row", func() bool {
+			_, nested := debugQuery["temp_low"].(map[string]interface{})
+			return res.StatusCode == http.StatusOK && debugQuery["city_name"] == "London" && debugQuery["temp_low"] != nil && !nested
+		})
+
+		res, err = state.c.Get(state.mockServer.URL + "/api/v1/location/weather/debug?city=London")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		score(t, res.StatusCode, http.StatusUnauthorized, func() bool {
+			return res.StatusCode == http.StatusUnauthorized
+		})
+	})
+
+	t.Run("warmest and coldest cached locations", func(t *testing.T) {
+		res, err := state.c.Get(state.mockServer.URL + "/api/v1/location/weather/extremes")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		extremesQuery := struct {
+			Warmest struct {
+				CityName   string  `json:"city_name"`
+				MedianTemp float64 `json:"median_temp"`
+			} `json:"warmest"`
+			Coldest struct {
+				CityName   string  `json:"city_name"`
+				MedianTemp float64 `json:"median_temp"`
+			} `json:"coldest"`
+		}{}
+
+		state.c.ReadFrom(res.Body)
+		res.Body.Close()
+		json.Unmarshal(state.c.Bytes(), &extremesQuery)
+		state.c.Buffer.Reset()
+
+		score(t, extremesQuery, "a warmest and coldest location", func() bool {
+			return res.StatusCode == http.StatusOK &&
+				extremesQuery.Warmest.CityName != "" &&
+				extremesQuery.Coldest.CityName != "" &&
+				extremesQuery.Warmest.MedianTemp >= extremesQuery.Coldest.MedianTemp
+		})
+	})
+
+	t.Run("history export streams every reading", func(t *testing.T) {
+		const numReadings = 5000
+
+		query := `
+			insert into weather (location_id, labels, temp_high, temp_low, source, at_time)
+				select
+					(select id from locations where city_name = 'London'),
+					array['Clear'],
+					290,
+					280,
+					'seed',
+					now() - (i || ' minutes')::interval
+				from generate_series(1, $1) as i`
+
+		if _, err := db.GlobalConn.Exec(query, numReadings); err != nil {
+			t.Fatal(err)
+		}
+
+		type reading struct {
+			CityName string `json:"city_name"`
+			Error    string `json:"error"`
+		}
+
+		var (
+			historyQuery = []reading{}
+			statuses     = []int{}
+			parseErr     error
+		)
+
+		for offset := 0; ; offset += maxPageLimit {
+			res, err := state.c.Get(state.mockServer.URL + "/api/v1/location/weather/history?city=London&limit=" + strconv.Itoa(maxPageLimit+1) + "&offset=" + strconv.Itoa(offset))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			page := []reading{}
+
+			state.c.ReadFrom(res.Body)
+			res.Body.Close()
+			if err := json.Unmarshal(state.c.Bytes(), &page); err != nil {
+				parseErr = err
+			}
+			state.c.Buffer.Reset()
+
+			statuses = append(statuses, res.StatusCode)
+			historyQuery = append(historyQuery, page...)
+
+			if len(page) < maxPageLimit || parseErr != nil { // the limit is capped, so a full page is maxPageLimit
+				break
+			}
+		}
+
+		score(t, len(historyQuery), "more than the seeded readings, a capped page at a time", func() bool {
+			if parseErr != nil || len(historyQuery) < numReadings || len(statuses) <= numReadings/maxPageLimit {
+				return false
+			}
+			for _, status := range statuses {
+				if status != http.StatusOK {
+					return false
+				}
+			}
+			for _, h := range historyQuery {
+				if h.CityName != "London" || h.Error != "" {
+					return false
+				}
+			}
+			return true
+		})
+	})
+
+	t.Run("history export defaults to a page", func(t *testing.T) {
+		res, err := state.c.Get(state.mockServer.URL + "/api/v1/location/weather/history?city=London")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		historyQuery := []interface{}{}
+
+		state.c.ReadFrom(res.Body)
+		res.Body.Close()
+		json.Unmarshal(state.c.Bytes(), &historyQuery)
+		state.c.Buffer.Reset()
+
+		score(t, len(historyQuery), defaultPageLimit, func() bool {
+			return res.StatusCode == http.StatusOK && len(historyQuery) == defaultPageLimit
+		})
+	})
+
+	t.Run("stale locations are listed a page at a time", func(t *testing.T) {
+		defer func(token string) { adminToken = token }(adminToken)
+
+		adminToken = "secret"
+
+		for _, cityName := range []string{"Pageville", "Pagerville", "Pagestville"} {
+			if _, err := db.SeedWeather(cityName, 270, 280, time.Now().Add(-100*24*time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var (
+			have   = []string{}
+			offset = 0
+		)
+
+		for {
+			req, err := http.NewRequest(http.MethodGet, state.mockServer.URL+"/api/v1/admin/stale?older_than=2400h&limit=2&offset="+strconv.Itoa(offset), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req.Header.Set("Authorization", "Bearer secret")
+
+			res, err := state.c.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			staleQuery := struct {
+				Locations []struct {
+					City string `json:"city"`
+				} `json:"locations"`
+				Limit      int  `json:"limit"`
+				NextOffset *int `json:"next_offset"`
+			}{}
+
+			state.c.ReadFrom(res.Body)
+			res.Body.Close()
+			json.Unmarshal(state.c.Bytes(), &staleQuery)
+			state.c.Buffer.Reset()
+
+			if res.StatusCode != http.StatusOK || staleQuery.Limit != 2 || len(staleQuery.Locations) > 2 {
+				t.Fatalf("have: %d %+v want: a page of at most 2", res.StatusCode, staleQuery)
+			}
+
+			for _, l := range staleQuery.Locations {
+				if strings.HasPrefix(l.City, "Page") {
+					have = append(have, l.City)
+				}
+			}
+
+			if staleQuery.NextOffset == nil {
+				break
+			}
+
+			offset = *staleQuery.NextOffset
+		}
+
+		sort.Strings(have)
+
+		want := []string{"Pagerville", "Pagestville", "Pageville"}
+
+		score(t, have, want, func() bool {
+			return reflect.DeepEqual(have, want)
+		})
+	})
+
+	t.Run("activity counts readings per day", func(t *testing.T) {
+		for _, at := range []time.Time{
+			time.Date(2019, time.March, 4, 9, 0, 0, 0, time.UTC),
+			time.Date(2019, time.March, 4, 15, 0, 0, 0, time.UTC),
+			time.Date(2019, time.March, 6, 9, 0, 0, 0, time.UTC),
+		} {
+			if _, err := db.SeedWeather("Sparkville", 270, 280, at); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var activityTestCases = []struct {
+			query string
+			want  map[string]int
+		}{
+			{"city=sparkville", map[string]int{"2019-03-04": 2, "2019-03-06": 1}},
+			{"city=sparkville&fill=true", map[string]int{"2019-03-04": 2, "2019-03-05": 0, "2019-03-06": 1}},
+			{"city=sparkville&fill=true&from=2019-03-03&to=2019-03-04", map[string]int{"2019-03-03": 0, "2019-03-04": 2}},
+		}
+
+		for _, tc := range activityTestCases {
+			res, err := state.c.Get(state.mockServer.URL + "/api/v1/location/weather/activity?" + tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			have := map[string]int{}
+
+			state.c.ReadFrom(res.Body)
+			res.Body.Close()
+			json.Unmarshal(state.c.Bytes(), &have)
+			state.c.Buffer.Reset()
+
+			score(t, have, tc.want, func() bool {
+				return res.StatusCode == http.StatusOK && reflect.DeepEqual(have, tc.want)
+			})
+		}
+	})
+
+	t.Run("history downsampled into buckets", func(t *testing.T) {
+		for _, m := range []int{0, 20, 40, 120} {
+			at := time.Date(2019, time.March, 4, 10, m, 0, 0, time.UTC)
+			if _, err := db.SeedWeather("Chartville", 270+float64(m), 280+float64(m), at); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		res, err := state.c.Get(state.mockServer.URL + "/api/v1/location/weather/history?city=Chartville&bucket=1h&date=2019-03-04")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		seriesQuery := []struct {
+			Bucket     time.Time `json:"bucket"`
+			MedianTemp float64   `json:"median_temp"`
+		}{}
+
+		state.c.ReadFrom(res.Body)
+		res.Body.Close()
+		json.Unmarshal(state.c.Bytes(), &seriesQuery)
+		state.c.Buffer.Reset()
+
+		score(t, seriesQuery, "the 10:00 and 12:00 buckets", func() bool {
+			return res.StatusCode == http.StatusOK && len(seriesQuery) == 2 &&
+				seriesQuery[0].Bucket.Equal(time.Date(2019, time.March, 4, 10, 0, 0, 0, time.UTC)) && seriesQuery[0].MedianTemp == 295 &&
+				seriesQuery[1].Bucket.Equal(time.Date(2019, time.March, 4, 12, 0, 0, 0, time.UTC)) && seriesQuery[1].MedianTemp == 395
+		})
+
+		for _, resource := range []string{
+			"/api/v1/location/weather/history?city=Chartville&bucket=often",
+			"/api/v1/location/weather/history?bucket=1h",
+		} {
+			res, err := state.c.Get(state.mockServer.URL + resource)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			score(t, res.StatusCode, http.StatusBadRequest, func() bool {
+				return res.StatusCode == http.StatusBadRequest
+			})
+		}
+	})
+
+	var multiWordLocationTestCases = []struct {
+		label string
+		city  string
+		want  string
+		file  string
+	}{
+		{"location with a space", "san francisco", "San Francisco", "san+francisco.json"},
+		{"location with a space in capitals", "SAN  FRANCISCO", "San Francisco", "san+francisco.json"},
+		{"location with diacritics", "são paulo", "São Paulo", "são+paulo.json"},
+		{"location already title cased", "New York", "New York", "new+york.json"},
+	}
+
+	for _, tc := range multiWordLocationTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			res, err := state.c.Get(state.mockServer.URL + "/api/v1/location/weather?city=" + url.QueryEscape(tc.city))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			locationQuery.CityName = ""
+
+			state.c.ReadFrom(res.Body)
+			res.Body.Close()
+			json.Unmarshal(state.c.Bytes(), &locationQuery)
+			state.c.Buffer.Reset()
+
+			hits := state.mockAPIServer.hitCount(tc.file)
+
+			// each spelling is cached under the same name, so the api is only called once
+			score(t, locationQuery.CityName, tc.want, func() bool {
+				return res.StatusCode == http.StatusOK && locationQuery.CityName == tc.want && hits == 1
+			})
+		})
+	}
+
+	t.Run("provider and base round trip through the cache", func(t *testing.T) {
+		defer func(c cache.Cache) { weatherCache = c }(weatherCache)
+
+		weatherCache = cache.NewMemory()
+
+		// the first request is served from the database, the second from the memory cache
+		for _, from := range []string{"database", "memory"} {
+			res, err := state.c.Get(state.mockServer.URL + "/api/v1/location/weather?city=Reno")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			report := struct {
+				Provider string `json:"provider"`
+				Base     string `json:"base"`
+			}{}
+
+			state.c.ReadFrom(res.Body)
+			res.Body.Close()
+			json.Unmarshal(state.c.Bytes(), &report)
+			state.c.Buffer.Reset()
+
+			score(t, report, "provider: openweather base: stations from "+from, func() bool {
+				return res.StatusCode == http.StatusOK && report.Provider == api.ProviderOpenWeather && report.Base == "stations"
+			})
+		}
+	})
+
+	t.Run("read through only mode doesn't write fresh readings", func(t *testing.T) {
+		defer func(c cache.Cache) { weatherCache = c }(weatherCache)
+		defer func(f func() time.Time) { nowFunc = f }(nowFunc)
+		defer func() { readThroughOnly = false }()
+
+		weatherCache = cache.NewMemory()
+		readThroughOnly = true
+
+		// as if the cached reading has expired, so the location is fetched again
+		at := time.Now().Add(2 * cacheTTL)
+		nowFunc = func() time.Time { return at }
+
+		countRows := func() (n int) {
+			if err := db.GlobalConn.QueryRow(`select count(*) from weather`).Scan(&n); err != nil {
+				t.Fatal(err)
+			}
+			return n
+		}
+
+		before, hitsBefore := countRows(), state.mockAPIServer.hitCount("reno.json")
+
+		res, err := state.c.Get(state.mockServer.URL + "/api/v1/location/weather?city=Reno")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		locationQuery.CityName = ""
+
+		state.c.ReadFrom(res.Body)
+		res.Body.Close()
+		json.Unmarshal(state.c.Bytes(), &locationQuery)
+		state.c.Buffer.Reset()
+
+		after, hitsAfter := countRows(), state.mockAPIServer.hitCount("reno.json")
+
+		score(t, after, before, func() bool {
+			return res.StatusCode == http.StatusOK && locationQuery.CityName == "Reno" && hitsAfter == hitsBefore+1 && after == before
+		})
+	})
+
+	var asOfTestCases = []struct {
+		label string
+		at    string
+		want  int
+	}{
+		{"weather as of now", time.Now().Add(time.Hour).Format(time.RFC3339), http.StatusOK},
+		{"weather as of before any reading", "2000-01-01T12:00:00Z", http.StatusNotFound},
+		{"weather as of a malformed time", "yesterday", http.StatusBadRequest},
+	}
+
+	for _, tc := range asOfTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			hitsBefore := state.mockAPIServer.hitCount("reno.json")
+
+			res, err := state.c.Get(state.mockServer.URL + "/api/v1/location/weather?city=Reno&at=" + url.QueryEscape(tc.at))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			locationQuery.CityName = ""
+
+			state.c.ReadFrom(res.Body)
+			res.Body.Close()
+			json.Unmarshal(state.c.Bytes(), &locationQuery)
+			state.c.Buffer.Reset()
+
+			hits := state.mockAPIServer.hitCount("reno.json") - hitsBefore
+
+			// historical weather is only ever read from the database
+			score(t, res.StatusCode, tc.want, func() bool {
+				return res.StatusCode == tc.want && hits == 0 && (tc.want != http.StatusOK || locationQuery.CityName == "Reno")
+			})
+		})
+	}
+
+	t.Run("unknown location is not found", func(t *testing.T) {
+		res, err := state.c.Get(state.mockServer.URL + "/api/v1/location/weather?city=Atlantis")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		errorQuery := struct {
+			Error string `json:"error"`
+		}{}
+
+		state.c.ReadFrom(res.Body)
+		res.Body.Close()
+		json.Unmarshal(state.c.Bytes(), &errorQuery)
+		state.c.Buffer.Reset()
+
+		score(t, errorQuery.Error, "city not found", func() bool {
+			return res.StatusCode == http.StatusNotFound && errorQuery.Error == "city not found"
+		})
+	})
+
+	t.Run("spent api quota serves the latest reading or 503", func(t *testing.T) {
+		defer func(c cache.Cache) { weatherCache = c }(weatherCache)
+		defer func(f func() time.Time) { nowFunc = f }(nowFunc)
+		defer func(n int) { dailyAPIBudget = n }(dailyAPIBudget)
+
+		weatherCache = cache.NewMemory()
+
+		calls, err := db.IncrAPICalls(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dailyAPIBudget = calls // spent
+
+		// as if the cached reading has expired, so the location would be fetched again
+		at := time.Now().Add(2 * cacheTTL)
+		nowFunc = func() time.Time { return at }
+
+		hits := state.mockAPIServer.hitCount("reno.json")
+
+		res, err := state.c.Get(state.mockServer.URL + "/api/v1/location/weather?city=Reno")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		score(t, res.StatusCode, http.StatusOK, func() bool {
+			return res.StatusCode == http.StatusOK && state.mockAPIServer.hitCount("reno.json") == hits
+		})
+
+		res, err = state.c.Get(state.mockServer.URL + "/api/v1/location/weather?city=Quotaville")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		score(t, res.StatusCode, http.StatusServiceUnavailable, func() bool {
+			return res.StatusCode == http.StatusServiceUnavailable
+		})
+
+		res, err = state.c.Get(state.mockServer.URL + "/api/v1/location/forecast?city=Reno&cnt=7")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		after, err := db.APICallsToday(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the forecast isn't fetched, nor counted, once the budget is spent
+		score(t, res.StatusCode, http.StatusServiceUnavailable, func() bool {
+			return res.StatusCode == http.StatusServiceUnavailable && after == calls
+		})
+	})
+
+	t.Run("admin quota reports the calls made today", func(t *testing.T) {
+		defer func(token string) { adminToken = token }(adminToken)
+		defer func(n int) { dailyAPIBudget = n }(dailyAPIBudget)
+
+		adminToken = "secret"
+
+		calls, err := db.APICallsToday(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dailyAPIBudget = calls + 10
+
+		req, err := http.NewRequest(http.MethodGet, state.mockServer.URL+"/api/v1/admin/quota", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set("Authorization", "Bearer secret")
+
+		res, err := state.c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		quota := struct {
+			Calls     int  `json:"calls"`
+			Budget    *int `json:"budget"`
+			Remaining *int `json:"remaining"`
+		}{}
+
+		state.c.ReadFrom(res.Body)
+		res.Body.Close()
+		json.Unmarshal(state.c.Bytes(), &quota)
+		state.c.Buffer.Reset()
+
+		score(t, quota, "10 calls remaining", func() bool {
+			return res.StatusCode == http.StatusOK && quota.Calls == calls && quota.Remaining != nil && *quota.Remaining == 10
+		})
+	})
+
+	t.Run("weather by location id", func(t *testing.T) {
+		var id int64
+
+		if err := db.GlobalConn.QueryRow(`select id from locations where city_name = $1`, "Reno").Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+
+		var locationIDTestCases = []struct {
+			label string
+			query string
+			want  int
+		}{
+			{"known id", "location_id=" + strconv.FormatInt(id, 10), http.StatusOK},
+			{"unknown id", "location_id=" + strconv.FormatInt(id+1000, 10), http.StatusNotFound},
+			{"malformed id", "location_id=reno", http.StatusBadRequest},
+			{"id and city", "location_id=" + strconv.FormatInt(id, 10) + "&city=Reno", http.StatusBadRequest},
+		}
+
+		for _, tc := range locationIDTestCases {
+			t.Run(tc.label, func(t *testing.T) {
+				res, err := state.c.Get(state.mockServer.URL + "/api/v1/location/weather?" + tc.query)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				locationQuery.CityName = ""
+
+				state.c.ReadFrom(res.Body)
+				res.Body.Close()
+				json.Unmarshal(state.c.Bytes(), &locationQuery)
+				state.c.Buffer.Reset()
+
+				score(t, res.StatusCode, tc.want, func() bool {
+					return res.StatusCode == tc.want && (tc.want != http.StatusOK || locationQuery.CityName == "Reno")
+				})
+			})
+		}
+	})
+
+	t.Run("warm up caches every bookmarked location", func(t *testing.T) {
+		defer func(c cache.Cache) { weatherCache = c }(weatherCache)
+
+		weatherCache = cache.NewMemory()
+
+		acc, err := db.NewAccount("warmup")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := acc.NewBookmarkCollection(); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := db.EnsureLocation("Bangkok", 13.75, 100.52); err != nil {
+			t.Fatal(err)
+		}
+
+		ids, err := db.IDsFromNames("Bangkok")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := acc.UpdateBookmarkCollectionIDs(ids...); err != nil {
+			t.Fatal(err)
+		}
+
+		bookmarks, err := db.AllBookmarks()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		names, err := bookmarks.NamesFromIDs()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		queryCounts := func() map[string]int64 {
+			counts := map[string]int64{}
+
+			for _, cityName := range names {
+				query, err := db.FetchLocationWeather(context.Background(), cityName)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if lr, _ := parseRows(query); lr != nil {
+					counts[cityName] = lr.QueryCount.Int64
+				}
+			}
+
+			return counts
+		}
+
+		before := queryCounts()
+
+		warmed, err := warmCacheFromBookmarks(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		uncached := []string{}
+
+		for _, cityName := range names {
+			if _, cached := weatherCache.Get(weatherCacheKey{cityName, unitsStandard, langDefault}.String()); !cached {
+				uncached = append(uncached, cityName)
+			}
+		}
+
+		after := queryCounts()
+
+		score(t, uncached, "every bookmarked location cached", func() bool {
+			return warmed == len(names) && len(uncached) == 0 && hasParam(names, "bangkok")
+		})
+
+		score(t, after, before, func() bool {
+			return reflect.DeepEqual(after, before)
+		})
+	})
+
+	t.Run("export has the account and its bookmarks", func(t *testing.T) {
+		defer func(token string) { adminToken = token }(adminToken)
+
+		adminToken = "secret"
+
+		acc, err := db.NewAccount("exporter")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := acc.NewBookmarkCollection(); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := db.SeedWeather("Budapest", 280, 290, time.Now(), "Clear"); err != nil {
+			t.Fatal(err)
+		}
+
+		ids, err := db.IDsFromNames("Budapest")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := acc.UpdateBookmarkCollectionIDs(ids...); err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(http.MethodGet, state.mockServer.URL+"/api/v1/account/user/export?username=exporter&weather=true", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set("Authorization", "Bearer secret")
+
+		res, err := state.c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		export := struct {
+			Name      string `json:"name"`
+			ID        int64  `json:"id"`
+			Bookmarks []struct {
+				ID       int64  `json:"id"`
+				CityName string `json:"city_name"`
+				Weather  struct {
+					MedianTemp float64 `json:"median_temp"`
+				} `json:"weather"`
+			} `json:"bookmarks"`
+		}{}
+
+		state.c.ReadFrom(res.Body)
+		res.Body.Close()
+		json.Unmarshal(state.c.Bytes(), &export)
+		state.c.Buffer.Reset()
+
+		score(t, export, "the exporter account with budapest bookmarked at 285", func() bool {
+			return res.StatusCode == http.StatusOK &&
+				export.Name == "exporter" &&
+				export.ID == acc.ID.Int64 &&
+				len(export.Bookmarks) == 1 &&
+				export.Bookmarks[0].ID == int64(ids[0]) &&
+				export.Bookmarks[0].CityName == "Budapest" &&
+				export.Bookmarks[0].Weather.MedianTemp == 285
+		})
+
+		res, err = state.c.Get(state.mockServer.URL + "/api/v1/account/user/export?username=exporter")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		score(t, res.StatusCode, http.StatusUnauthorized, func() bool {
+			return res.StatusCode == http.StatusUnauthorized
+		})
+	})
+
+	t.Run("admin diff compares the cached and a fresh reading", func(t *testing.T) {
+		defer func(token string) { adminToken = token }(adminToken)
+
+		adminToken = "secret"
+
+		// the cached reading differs from the api's, which is clear, 285.37 to 292.59
+		if _, err := db.SeedWeather("New York", 280, 290, time.Now(), "Rain"); err != nil {
+			t.Fatal(err)
+		}
+
+		hits := state.mockAPIServer.hitCount("new+york.json")
+
+		req, err := http.NewRequest(http.MethodGet, state.mockServer.URL+"/api/v1/admin/weather/diff?city=new+york", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set("Authorization", "Bearer secret")
+
+		res, err := state.c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		diffQuery := struct {
+			Cached struct {
+				Conditions []string `json:"conditions"`
+			} `json:"cached"`
+			Fresh struct {
+				Conditions []string `json:"conditions"`
+			} `json:"fresh"`
+			Diff struct {
+				LowTemp           float64  `json:"low_temp"`
+				HighTemp          float64  `json:"high_temp"`
+				ConditionsAdded   []string `json:"conditions_added"`
+				ConditionsRemoved []string `json:"conditions_removed"`
+			} `json:"diff"`
+		}{}
+
+		state.c.ReadFrom(res.Body)
+		res.Body.Close()
+		json.Unmarshal(state.c.Bytes(), &diffQuery)
+		state.c.Buffer.Reset()
+
+		score(t, diffQuery, "temperatures up 5.37 and 2.59, rain cleared", func() bool {
+			d := diffQuery.Diff
+			return res.StatusCode == http.StatusOK &&
+				math.Abs(d.LowTemp-5.37) < 0.01 && math.Abs(d.HighTemp-2.59) < 0.01 &&
+				reflect.DeepEqual(d.ConditionsAdded, []string{"Clear"}) &&
+				reflect.DeepEqual(d.ConditionsRemoved, []string{"Rain"}) &&
+				state.mockAPIServer.hitCount("new+york.json") == hits+1
+		})
+
+		res, err = state.c.Get(state.mockServer.URL + "/api/v1/admin/weather/diff?city=new+york")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		score(t, res.StatusCode, http.StatusUnauthorized, func() bool {
+			return res.StatusCode == http.StatusUnauthorized
+		})
+	})
+
+	t.Run("missing fields of a cached reading are omitted", func(t *testing.T) {
+		wr, err := db.SeedWeather("Partialville", 270.15, 280.15, time.Now(), "Clear")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// as if the reading predates the low temperature being recorded, seeded readings
+		// already have no wind, visibility or clouds
+		if _, err := db.GlobalConn.Exec(`update weather set temp_low = null where location_id = $1`, wr.LocationRowID); err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := state.c.Get(state.mockServer.URL + "/api/v1/location/weather?city=Partialville")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		partialQuery := map[string]interface{}{}
+
+		state.c.ReadFrom(res.Body)
+		res.Body.Close()
+		json.Unmarshal(state.c.Bytes(), &partialQuery)
+		state.c.Buffer.Reset()
+
+		score(t, partialQuery, "only city_name, conditions, high_temp and at_time", func() bool {
+			for _, field := range []string{"low_temp", "median_temp", "wind", "visibility", "clouds"} {
+				if _, present := partialQuery[field]; present {
+					return false
+				}
+			}
+			return partialQuery["high_temp"] == 280.15
+		})
+	})
+
+	t.Run("cached weather is reported in the requested units", func(t *testing.T) {
+		defer func(c cache.Cache) { weatherCache = c }(weatherCache)
+
+		weatherCache = cache.NewMemory()
+
+		var unitsTestCases = []struct {
+			label    string
+			resource string
+			want     string // the JSON type of low_temp
+		}{
+			{"standard units", "/api/v1/location/weather?city=London&units=standard", "number"},
+			{"all units", "/api/v1/location/weather?city=London&units=all", "object"},
+			{"standard units again", "/api/v1/location/weather?city=London", "number"},
+		}
+
+		for _, tc := range unitsTestCases {
+			res, err := state.c.Get(state.mockServer.URL + tc.resource)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			unitsQuery := struct {
+				LowTemp json.RawMessage `json:"low_temp"`
+			}{}
+
+			state.c.ReadFrom(res.Body)
+			res.Body.Close()
+			json.Unmarshal(state.c.Bytes(), &unitsQuery)
+			state.c.Buffer.Reset()
+
+			have := "number"
+			if bytes.HasPrefix(unitsQuery.LowTemp, []byte("{")) {
+				have = "object"
+			}
+
+			score(t, have, tc.want, func() bool {
+				return have == tc.want
+			})
+		}
+	})
+
+	t.Run("HEAD reports freshness without a body", func(t *testing.T) {
+		res, err := state.c.Head(state.mockServer.URL + "/api/v1/location/weather?city=Reno")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		state.c.ReadFrom(res.Body)
+		res.Body.Close()
+		body := state.c.Len()
+		state.c.Buffer.Reset()
+
+		score(t, res.Header, "ETag, Last-Modified and Age headers", func() bool {
+			return res.StatusCode == http.StatusOK &&
+				body == 0 &&
+				res.Header.Get("ETag") != "" &&
+				res.Header.Get("Last-Modified") != "" &&
+				res.Header.Get("Age") != ""
+		})
+	})
+
+	t.Run("missing bookmark collection is not found", func(t *testing.T) {
+		const resource = "/api/v1/account/user/bookmark"
+
+		res, err := state.c.Post(state.mockServer.URL+"/api/v1/account/user/register", "application/json", strings.NewReader(`{"username": "nocollection"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if _, err := db.GlobalConn.Exec(`delete from bookmarks where id = (select id from accounts where user_name = 'nocollection')`); err != nil {
+			t.Fatal(err)
+		}
+
+		res, err = state.c.Get(state.mockServer.URL + resource + "?username=nocollection")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		score(t, res.StatusCode, http.StatusNotFound, func() bool {
+			return res.StatusCode == http.StatusNotFound
+		})
+
+		res, err = state.c.Post(state.mockServer.URL+resource, "application/json", strings.NewReader(`{"username": "nocollection", "locations": ["Reno"]}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		score(t, res.StatusCode, http.StatusNotFound, func() bool {
+			return res.StatusCode == http.StatusNotFound
+		})
+	})
+
+	var getForecastCountTestCases = []struct {
+		label    string
+		resource string
+		want     int
+	}{
+		{"forecast is limited to cnt", "/api/v1/location/forecast?city=Reno&cnt=3", 3},
+		{"forecast defaults to the full range", "/api/v1/location/forecast?city=London", api.MaxForecastCount},
+		// add edge cases here ..
+	}
+
+	for _, tc := range getForecastCountTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			res, err := state.c.Get(state.mockServer.URL + tc.resource)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			forecastQuery := struct {
+				Forecast []interface{} `json:"forecast"`
+			}{}
+
+			state.c.ReadFrom(res.Body)
+			res.Body.Close()
+			json.Unmarshal(state.c.Bytes(), &forecastQuery)
+			state.c.Buffer.Reset()
+
+			score(t, len(forecastQuery.Forecast), tc.want, func() bool {
+				return len(forecastQuery.Forecast) == tc.want
+			})
+		})
+	}
+
+	t.Run("excluded forecast sections aren't cached", func(t *testing.T) {
+		defer func(c cache.Cache) { weatherCache = c }(weatherCache)
+		defer func(exclude map[string]bool) { forecastExclude = exclude }(forecastExclude)
+
+		weatherCache = cache.NewMemory()
+		forecastExclude = map[string]bool{forecastSectionConditions: true}
+
+		res, err := state.c.Get(state.mockServer.URL + "/api/v1/location/forecast?city=Budapest&cnt=2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		data, cached := weatherCache.Get("forecast:Budapest:2")
+
+		stored := struct {
+			Forecast []map[string]interface{} `json:"forecast"`
+		}{}
+		json.Unmarshal(data, &stored)
+
+		score(t, string(data), "entries with temperatures but no conditions", func() bool {
+			if res.StatusCode != http.StatusOK || !cached || len(stored.Forecast) != 2 {
+				return false
+			}
+			for _, entry := range stored.Forecast {
+				_, conditions := entry["conditions"]
+				_, low := entry["low_temp"]
+				_, high := entry["high_temp"]
+				if conditions || !low || !high {
+					return false
+				}
+			}
+			return true
+		})
+	})
+
+	var getForecastInvalidCountTestCases = []struct {
+		label    string
+		resource string
+	}{
+		{"forecast cnt below range", "/api/v1/location/forecast?city=Reno&cnt=0"},
+		{"forecast cnt above range", "/api/v1/location/forecast?city=Reno&cnt=41"},
+		{"forecast cnt not a number", "/api/v1/location/forecast?city=Reno&cnt=few"},
+		{"forecast without a city", "/api/v1/location/forecast"},
+	}
+
+	for _, tc := range getForecastInvalidCountTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			res, err := state.c.Get(state.mockServer.URL + tc.resource)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			score(t, res.StatusCode, http.StatusBadRequest, func() bool {
+				return res.StatusCode == http.StatusBadRequest
+			})
+		})
+	}
+
+	t.Run("forecast for an unknown location is not found", func(t *testing.T) {
+		res, err := state.c.Get(state.mockServer.URL + "/api/v1/location/forecast?city=Atlantis")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body := struct {
+			Error string `json:"error"`
+		}{}
+
+		state.c.ReadFrom(res.Body)
+		res.Body.Close()
+		json.Unmarshal(state.c.Bytes(), &body)
+		state.c.Buffer.Reset()
+
+		score(t, res.StatusCode, http.StatusNotFound, func() bool {
+			return res.StatusCode == http.StatusNotFound && body.Error != ""
+		})
+	})
+
+	// add more tests here ..
+}
+
+func TestTemperatureConversions(t *testing.T) {
+	var conversionTestCases = []struct {
+		label  string
+		kelvin float64
+		want   temperature
+	}{
+		{"absolute zero", 0, temperature{0, -273.15, -459.67}},
+		{"freezing", 273.15, temperature{273.15, 0, 32}},
+		{"boiling", 373.15, temperature{373.15, 100, 212}},
+		{"celsius equals fahrenheit", 233.15, temperature{233.15, -40, -40}},
+	}
+
+	for _, tc := range conversionTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			have := newTemperature(tc.kelvin)
+
+			score(t, have, tc.want, func() bool {
+				return have == tc.want
+			})
+		})
+	}
+}
+
+func TestJSONTimeFormats(t *testing.T) {
+	defer func(f string) { timeFormat = f }(timeFormat)
+
+	at := jsonTime{time.Date(2019, time.March, 29, 21, 13, 52, 226000000, time.UTC)}
+
+	var timeFormatTestCases = []struct {
+		label  string
+		format string
+		want   string
+	}{
+		{"rfc3339", timeFormatRFC3339, `"2019-03-29T21:13:52.226Z"`},
+		{"unix seconds", timeFormatUnix, `1553894032`},
+		{"unix milliseconds", timeFormatUnixMillis, `1553894032226`},
+	}
+
+	for _, tc := range timeFormatTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			timeFormat = tc.format
+
+			have, err := json.Marshal(at)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			score(t, string(have), tc.want, func() bool {
+				return string(have) == tc.want
+			})
+
+			var back jsonTime
+
+			if err := json.Unmarshal(have, &back); err != nil {
+				t.Fatal(err)
+			}
+
+			want := at.Time
+			if tc.format == timeFormatUnix {
+				want = want.Truncate(time.Second)
+			}
+
+			score(t, back.Time, want, func() bool {
+				return back.Time.Equal(want)
+			})
+		})
+	}
+}
+
+func TestSupportedWeatherLabels(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/weather/labels", nil)
+	rec := httptest.NewRecorder()
+
+	ReportSupportedWeatherLabels(rec, req)
+
+	labelsQuery := struct {
+		Labels []string `json:"labels"`
+	}{}
+
+	json.Unmarshal(rec.Body.Bytes(), &labelsQuery)
+
+	score(t, labelsQuery.Labels, api.WeatherLabels, func() bool {
+		return rec.Code == http.StatusOK && len(labelsQuery.Labels) == len(api.WeatherLabels) && hasParam(labelsQuery.Labels, "thunderstorm")
+	})
+}
+
+func TestWorstHealth(t *testing.T) {
+	var healthTestCases = []struct {
+		label    string
+		statuses []string
+		want     string
+	}{
+		{"no subsystems", nil, healthOK},
+		{"all ok", []string{healthOK, healthOK, healthOK}, healthOK},
+		{"one degraded", []string{healthOK, healthDegraded, healthOK}, healthDegraded},
+		{"one down", []string{healthDegraded, healthOK, healthDown}, healthDown},
+	}
+
+	for _, tc := range healthTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			have := worstHealth(tc.statuses...)
+
+			score(t, have, tc.want, func() bool {
+				return have == tc.want
+			})
+		})
+	}
+}
+
+func TestDetailedHealthIsAlwaysReachable(t *testing.T) {
+	defer func(c cache.Cache) { weatherCache = c }(weatherCache)
+
+	weatherCache = cache.NewCounted(cache.NewMemory())
+	weatherCache.Get("missing")
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/health/detailed", nil)
+	rec := httptest.NewRecorder()
+
+	ReportDetailedHealth(rec, req)
+
+	healthQuery := struct {
+		Status string `json:"status"`
+		Cache  struct {
+			Backend string `json:"backend"`
+			Misses  int64  `json:"misses"`
+		} `json:"cache"`
+	}{}
+
+	json.Unmarshal(rec.Body.Bytes(), &healthQuery)
+
+	score(t, healthQuery, "a 200 with the status and cache stats", func() bool {
+		return rec.Code == http.StatusOK &&
+			healthQuery.Status != "" &&
+			healthQuery.Cache.Backend == cache.BackendMemory &&
+			healthQuery.Cache.Misses == 1
+	})
+}
+
+func TestStatsHelp(t *testing.T) {
+	var helpTestCases = []struct {
+		label    string
+		resource string
+		handler  http.HandlerFunc
+		want     int
+	}{
+		{"bare stats lists parameters", "/api/v1/location/weather/stats", ReportWeatherStatistics, http.StatusAccepted},
+		{"help lists parameters", "/api/v1/location/weather/stats/help", ReportWeatherStatisticsHelp, http.StatusOK},
+	}
+
+	for _, tc := range helpTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.resource, nil)
+			rec := httptest.NewRecorder()
+
+			tc.handler(rec, req)
+
+			helpQuery := struct {
+				ValidQueryParameters []string
+			}{}
+
+			json.Unmarshal(rec.Body.Bytes(), &helpQuery)
+
+			score(t, helpQuery.ValidQueryParameters, statsQueryParameters, func() bool {
+				return rec.Code == tc.want && len(helpQuery.ValidQueryParameters) == len(statsQueryParameters)
+			})
+		})
+	}
+}
+
+func TestStatsDateValidation(t *testing.T) {
+	var datesTestCases = []string{
+		"date=yesterday",
+		"date=2019-03-29&from=2019-03-01",
+		"from=2019-03-29&to=2019-03-01",
+		"from=2019-03-01&to=03/29/2019",
+	}
+
+	for _, tc := range datesTestCases {
+		t.Run(tc, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/location/weather/stats?summary=day&"+tc, nil)
+			rec := httptest.NewRecorder()
+
+			ReportWeatherStatistics(rec, req)
+
+			score(t, rec.Code, http.StatusBadRequest, func() bool {
+				return rec.Code == http.StatusBadRequest
+			})
+		})
+	}
+}
+
+func TestJSONDecodeErrors(t *testing.T) {
+	var decodeTestCases = []struct {
+		label string
+		body  string
+		want  string
+	}{
+		{"empty body", "", errBodyEmpty.Error()},
+		{"malformed JSON", `{"cities": [`, errBodyMalformed.Error()},
+		{"invalid syntax", `{"cities": ]}`, errBodyMalformed.Error()},
+		{"type mismatch", `{"cities": "London"}`, "invalid value for field cities: expected []string"},
+	}
+
+	for _, tc := range decodeTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/location/weather/batch", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+
+			ReportBatchLocationWeather(rec, req)
+
+			errorQuery := struct {
+				Error string `json:"error"`
+			}{}
+
+			json.Unmarshal(rec.Body.Bytes(), &errorQuery)
+
+			have := errorQuery.Error
+
+			score(t, have, tc.want, func() bool {
+				return rec.Code == http.StatusBadRequest && have == tc.want
+			})
+		})
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var requestIDTestCases = []struct {
+		label   string
+		inbound string
+		honored bool
+	}{
+		{"inbound id is honored", "gateway-1234.abc", true},
+		{"missing id is generated", "", false},
+		{"invalid id is replaced", "bad id\nforged log line", false},
+		{"overlong id is replaced", strings.Repeat("a", 129), false},
+	}
+
+	for _, tc := range requestIDTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			var seen string
+
+			h := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen = requestID(r.Context())
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/status", nil)
+			if tc.inbound != "" {
+				req.Header.Set(requestIDHeader, tc.inbound)
+			}
+
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			have := rec.Header().Get(requestIDHeader)
+
+			score(t, have, tc.inbound, func() bool {
+				if have == "" || have != seen {
+					return false
+				}
+				return (have == tc.inbound) == tc.honored
+			})
+		})
+	}
+}
+
+func TestInternalServerErrorLogsRequestID(t *testing.T) {
+	var logged bytes.Buffer
+
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	h := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		internalServerError(w, r, errors.New("db unreachable"))
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/location/weather", nil)
+	req.Header.Set(requestIDHeader, "gateway-1234")
+
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	have := logged.String()
+
+	score(t, have, "a log line with the request id and the error", func() bool {
+		return rec.Code == http.StatusInternalServerError &&
+			strings.Count(have, "\n") == 1 &&
+			strings.Contains(have, "gateway-1234") &&
+			strings.Contains(have, "db unreachable")
+	})
+}
+
+func TestWeatherCacheKey(t *testing.T) {
+	var keys = []weatherCacheKey{
+		{"London", unitsStandard, langDefault},
+		{"London", unitsAll, langDefault},
+		{"London", unitsStandard, "fr"},
+		{"London", unitsAll, "fr"},
+		{"London|all", unitsStandard, langDefault},
+		{"Paris", unitsStandard, langDefault},
+	}
+
+	seen := make(map[string]weatherCacheKey)
+
+	for _, k := range keys {
+		have := k.String()
+
+		if other, collides := seen[have]; collides {
+			t.Errorf("%+v and %+v have the same cache key: %s", k, other, have)
+		}
+
+		seen[have] = k
+	}
+}
+
+func TestNormalizeCityName(t *testing.T) {
+	var normalizeTestCases = []struct {
+		name string
+		want string
+	}{
+		{"london", "London"},
+		{"  san   francisco ", "San Francisco"},
+		{"SAN FRANCISCO", "San Francisco"},
+		{"são paulo", "São Paulo"},
+		{"SÃO PAULO", "São Paulo"},
+		{"New York", "New York"},
+		{"winston-salem", "Winston-Salem"},
+		{"new york", "New York"},
+		{"mckinney", "Mckinney"},
+		{"McKinney", "McKinney"},
+		{"  mcKinney ", "McKinney"},
+	}
+
+	for _, tc := range normalizeTestCases {
+		t.Run(tc.name, func(t *testing.T) {
+			have := normalizeCityName(tc.name)
+
+			score(t, have, tc.want, func() bool {
+				return have == tc.want
+			})
+		})
+	}
+}
+
+func TestCityNamesAreKeptWithoutNormalization(t *testing.T) {
+	defer func(enabled bool) { normalizeCityNames = enabled }(normalizeCityNames)
+
+	normalizeCityNames = false
+
+	var normalizeTestCases = []struct {
+		name string
+		want string
+	}{
+		{"McKinney", "McKinney"},
+		{"mckinney", "mckinney"},
+		{"  new   york ", "new york"},
+		{"   ", ""},
+	}
+
+	for _, tc := range normalizeTestCases {
+		t.Run(tc.name, func(t *testing.T) {
+			have := normalizeCityName(tc.name)
+
+			score(t, have, tc.want, func() bool {
+				return have == tc.want
+			})
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/admin/locations/merge", nil)
+
+	defer func(token string) { adminToken = token }(adminToken)
+
+	adminToken = "secret"
+	req.Header.Set("Authorization", "Bearer secret")
+
+	AdminMergeDuplicateLocations(rec, req)
+
+	score(t, rec.Code, http.StatusConflict, func() bool {
+		return rec.Code == http.StatusConflict
+	})
+}
+
+func TestParseDuration(t *testing.T) {
+	var durationTestCases = []struct {
+		label   string
+		value   string
+		unit    time.Duration
+		want    time.Duration
+		wantErr bool
+	}{
+		{"bare integer in the unit", "15", time.Minute, 15 * time.Minute, false},
+		{"go duration", "10m", time.Second, 10 * time.Minute, false},
+		{"go compound duration", "1h30m", time.Second, 90 * time.Minute, false},
+		{"iso 8601 days", "P1D", time.Second, 24 * time.Hour, false},
+		{"iso 8601 weeks", "P2W", time.Second, 14 * 24 * time.Hour, false},
+		{"iso 8601 time", "PT1H30M", time.Second, 90 * time.Minute, false},
+		{"iso 8601 fractional seconds", "PT1.5S", time.Second, 1500 * time.Millisecond, false},
+		{"iso 8601 days and time", "P1DT12H", time.Second, 36 * time.Hour, false},
+		{"iso 8601 months are ambiguous", "P1M", time.Second, 0, true},
+		{"iso 8601 without components", "P", time.Second, 0, true},
+		{"iso 8601 with an empty time", "P1DT", time.Second, 0, true},
+		{"unknown unit", "10 minutes", time.Second, 0, true},
+		{"empty", "", time.Second, 0, true},
+	}
+
+	for _, tc := range durationTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			have, err := parseDuration(tc.value, tc.unit)
+
+			score(t, have, tc.want, func() bool {
+				return (err != nil) == tc.wantErr && have == tc.want
+			})
+		})
+	}
+}
+
+func TestCacheTTLBoundary(t *testing.T) {
+	defer func(f func() time.Time) { nowFunc = f }(nowFunc)
+
+	at := time.Date(2019, time.March, 29, 21, 0, 0, 0, time.UTC)
+	ttl := cacheTTL
+
+	lr := &db.LocationRow{}
+	wr := &db.WeatherRow{AtTime: at}
+
+	var ttlTestCases = []struct {
+		label   string
+		elapsed time.Duration
+		want    bool
+	}{
+		{"just taken", 0, true},
+		{"just before the ttl", ttl - time.Nanosecond, true},
+		{"exactly the ttl", ttl, false},
+		{"after the ttl", ttl + time.Nanosecond, false},
+	}
+
+	for _, tc := range ttlTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			nowFunc = func() time.Time { return at.Add(tc.elapsed) }
+
+			have := isCached(lr, wr)
+
+			score(t, have, tc.want, func() bool {
+				return have == tc.want
+			})
+		})
+	}
+
+	t.Run("missing rows", func(t *testing.T) {
+		nowFunc = func() time.Time { return at }
+
+		if isCached(nil, wr) || isCached(lr, nil) {
+			t.Fail()
+		}
+	})
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(p []*net.IPNet) { trustedProxies = p }(trustedProxies)
+
+	trustedProxies = proxies
+
+	var clientIPTestCases = []struct {
+		label      string
+		remoteAddr string
+		forwarded  string
+		realIP     string
+		want       string
+	}{
+		{"direct", "203.0.113.7:4000", "", "", "203.0.113.7"},
+		{"single proxy", "10.0.0.2:4000", "203.0.113.7", "", "203.0.113.7"},
+		{"single proxy by address", "192.168.1.1:4000", "203.0.113.7", "", "203.0.113.7"},
+		{"chain of proxies", "10.0.0.2:4000", "203.0.113.7, 10.0.0.3", "", "203.0.113.7"},
+		{"real ip header", "10.0.0.2:4000", "", "203.0.113.7", "203.0.113.7"},
+		{"spoofed header from an untrusted peer", "203.0.113.7:4000", "198.51.100.1", "198.51.100.1", "203.0.113.7"},
+		{"spoofed header through a proxy", "10.0.0.2:4000", "198.51.100.1, 203.0.113.7", "", "203.0.113.7"},
+		{"garbled header through a proxy", "10.0.0.2:4000", "not-an-ip", "", "10.0.0.2"},
+		{"only proxies", "10.0.0.2:4000", "10.0.0.4, 10.0.0.3", "", "10.0.0.4"},
+	}
+
+	for _, tc := range clientIPTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/status", nil)
+			r.RemoteAddr = tc.remoteAddr
+
+			if tc.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tc.forwarded)
+			}
+			if tc.realIP != "" {
+				r.Header.Set("X-Real-IP", tc.realIP)
+			}
+
+			have := clientIP(r)
+
+			score(t, have, tc.want, func() bool {
+				return have == tc.want
+			})
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	for _, v := range []string{"10.0.0.0/33", "localhost", "10.0.0.1, ::1, fd00::/8"} {
+		_, err := parseTrustedProxies(v)
+
+		if wantErr := v != "10.0.0.1, ::1, fd00::/8"; (err != nil) != wantErr {
+			t.Errorf("have: %v for %q want error: %v", err, v, wantErr)
+		}
+	}
+}
+
+func TestUpstreamErrors(t *testing.T) {
+	var upstreamTestCases = []struct {
+		label      string
+		body       string
+		wantStatus int // 0 if the response has weather
+	}{
+		{"weather", `{"cod": 200, "main": {"temp_min": 270, "temp_max": 280}}`, 0},
+		{"weather without a cod", `{"main": {"temp_min": 270, "temp_max": 280}}`, 0},
+		{"error with a 200 cod", `{"cod": 200, "message": "internal error"}`, http.StatusBadGateway},
+		{"error without a cod", `{"message": "internal error"}`, http.StatusBadGateway},
+		{"empty body", `{}`, http.StatusBadGateway},
+		{"unknown location", `{"cod": "404", "message": "city not found"}`, http.StatusNotFound},
+		{"invalid api key", `{"cod": 401, "message": "Invalid API key."}`, http.StatusBadGateway},
+	}
+
+	for _, tc := range upstreamTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			location := &api.Location{}
+			if err := json.Unmarshal([]byte(tc.body), location); err != nil {
+				t.Fatal(err)
+			}
+
+			err := newUpstreamError(location)
+
+			if tc.wantStatus == 0 {
+				score(t, err, nil, func() bool { return err == nil })
+				return
+			}
+
+			score(t, err, tc.wantStatus, func() bool {
+				return err != nil && err.status == tc.wantStatus && err.message != ""
+			})
+		})
+	}
+}
+
+func TestForecastUpstreamErrors(t *testing.T) {
+	var upstreamTestCases = []struct {
+		label      string
+		body       string
+		wantStatus int // 0 if the response has a forecast
+	}{
+		{"forecast", `{"cod": "200", "message": 0, "cnt": 1, "list": [{"dt": 1553878800}]}`, 0},
+		{"unknown location", `{"cod": "404", "message": "city not found"}`, http.StatusNotFound},
+		{"invalid api key", `{"cod": 401, "message": "Invalid API key."}`, http.StatusBadGateway},
+		{"numeric message", `{"cod": 500, "message": 0}`, http.StatusBadGateway},
+		{"empty body", `{}`, http.StatusBadGateway},
+	}
+
+	for _, tc := range upstreamTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			f := &api.Forecast{}
+			if err := json.Unmarshal([]byte(tc.body), f); err != nil {
+				t.Fatal(err)
+			}
+
+			err := newForecastUpstreamError(f)
+
+			if tc.wantStatus == 0 {
+				score(t, err, nil, func() bool { return err == nil })
+				return
+			}
+
+			score(t, err, tc.wantStatus, func() bool {
+				return err != nil && err.status == tc.wantStatus && err.message != ""
+			})
+		})
+	}
+}
+
+func TestCacheControlMaxAge(t *testing.T) {
+	defer func(f func() time.Time) { nowFunc = f }(nowFunc)
+	defer func(d time.Duration) { cacheTTL = d }(cacheTTL)
+
+	cacheTTL = time.Minute
+
+	at := time.Date(2019, time.March, 29, 21, 0, 0, 0, time.UTC)
+	report := &weatherReport{CityName: "Reno", AtTime: jsonTime{at}}
+
+	var cacheControlTestCases = []struct {
+		label   string
+		elapsed time.Duration
+		want    string
+	}{
+		{"just taken", 0, "max-age=60"},
+		{"half way through the ttl", 30 * time.Second, "max-age=30"},
+		{"just before the ttl", cacheTTL - time.Second, "max-age=1"},
+		{"less than a second left", cacheTTL - time.Millisecond, "no-cache"},
+		{"stale", cacheTTL + time.Hour, "no-cache"},
+	}
+
+	for _, tc := range cacheControlTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			nowFunc = func() time.Time { return at.Add(tc.elapsed) }
+
+			w := httptest.NewRecorder()
+			setFreshnessHeaders(w, report, "")
+
+			have := w.Header().Get("Cache-Control")
+
+			score(t, have, tc.want, func() bool {
+				return have == tc.want
+			})
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		defer func() { cacheControl = true }()
+
+		cacheControl = false
+
+		w := httptest.NewRecorder()
+		setFreshnessHeaders(w, report, "")
+
+		if have := w.Header().Get("Cache-Control"); have != "" {
+			t.Errorf("have: %q want: no header", have)
+		}
+	})
+}
+
+func TestStaleWarning(t *testing.T) {
+	defer func(f func() time.Time) { nowFunc = f }(nowFunc)
+	defer func(d time.Duration) { cacheTTL = d }(cacheTTL)
+
+	cacheTTL = time.Minute
+
+	at := time.Date(2019, time.March, 29, 21, 0, 0, 0, time.UTC)
+	report := &weatherReport{CityName: "Reno", AtTime: jsonTime{at}}
+
+	var staleWarningTestCases = []struct {
+		label   string
+		elapsed time.Duration
+		want    string
+	}{
+		{"fresh", 30 * time.Second, ""},
+		{"stale", cacheTTL + time.Hour, staleWarning},
+	}
+
+	for _, tc := range staleWarningTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			nowFunc = func() time.Time { return at.Add(tc.elapsed) }
+
+			w := httptest.NewRecorder()
+			setFreshnessHeaders(w, report, "")
+
+			have := w.Header().Get("Warning")
+
+			score(t, have, tc.want, func() bool {
+				return have == tc.want
+			})
+		})
+	}
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	const limit = 2
+
+	var (
+		started = make(chan struct{})
+		release = make(chan struct{})
+	)
+
+	// requests for weather are held until released, others are answered straight away
+	h := withConcurrencyLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/location/weather" {
+			started <- struct{}{}
+			<-release
+		}
+		sendMessage(w, "ok")
+	}), limit)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < limit; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/location/weather?city=Reno", nil))
+		}()
+		<-started
+	}
+
+	t.Run("excess requests are turned away", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/location/weather?city=Reno", nil))
+
+		score(t, w.Code, http.StatusServiceUnavailable, func() bool {
+			return w.Code == http.StatusServiceUnavailable && w.Header().Get("Retry-After") != ""
+		})
+	})
+
+	t.Run("health checks are exempt", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/health/detailed", nil))
+
+		score(t, w.Code, http.StatusOK, func() bool {
+			return w.Code == http.StatusOK
+		})
+	})
+
+	close(release)
+	wg.Wait()
+
+	t.Run("requests are accepted once others finish", func(t *testing.T) {
+		go func() { <-started }()
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/location/weather?city=Reno", nil))
+
+		score(t, w.Code, http.StatusOK, func() bool {
+			return w.Code == http.StatusOK
+		})
+	})
+}
+
+func TestRoundToInt(t *testing.T) {
+	var roundTestCases = []struct {
+		label string
+		temp  float64
+		want  float64
+	}{
+		{"below a half", 37.49, 37},
+		{"a half", 37.5, 38},
+		{"above a half", 37.51, 38},
+		{"negative half", -0.5, -1},
+	}
+
+	for _, tc := range roundTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			// the same temperature in the selected unit, whichever unit that is
+			all := (&multiUnitWeatherReport{LowTemp: &temperature{tc.temp, tc.temp, tc.temp}}).roundedToInt()
+			standard := (&weatherReport{LowTemp: &tc.temp}).roundedToInt()
+
+			score(t, *standard.LowTemp, tc.want, func() bool {
+				return *standard.LowTemp == tc.want && *all.LowTemp == temperature{tc.want, tc.want, tc.want} && all.HighTemp == nil
+			})
+		})
+	}
+
+	t.Run("rounded after conversion", func(t *testing.T) {
+		// 310.64K is 37.49C and 99.48F, rounding to 311K first would report 38C instead
+		report := (&weatherReport{LowTemp: floatPtr(310.64)}).inAllUnits().roundedToInt()
+
+		score(t, *report.LowTemp, temperature{311, 37, 99}, func() bool {
+			return *report.LowTemp == temperature{311, 37, 99}
+		})
+	})
+}
+
+func floatPtr(f float64) *float64 {
+	return &f
+}
+
+func TestShutdownDrain(t *testing.T) {
+	// startServer serves a handler that signals when a request has started, then holds it until
+	// released, and returns the server's url and a channel with serve's result
+	startServer := func(t *testing.T, started, release chan struct{}, stop chan os.Signal, drain time.Duration) (string, *inFlightCounter, chan error) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		requests := &inFlightCounter{}
+
+		server := &http.Server{
+			Handler: requests.track(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				started <- struct{}{}
+				<-release
+				sendMessage(w, "ok")
+			})),
+		}
+
+		served := make(chan error, 1)
+
+		go func() { served <- serve(server, l, stop, drain, requests) }()
+
+		return "http://" + l.Addr().String(), requests, served
+	}
+
+	// get requests 'url', sending the response status, or 0 if the request failed
+	get := func(url string, status chan int) {
+		res, err := http.Get(url)
+		if err != nil {
+			status <- 0
+			return
+		}
+
+		res.Body.Close()
+		status <- res.StatusCode
+	}
+
+	t.Run("requests in flight finish before shutdown", func(t *testing.T) {
+		var (
+			started = make(chan struct{})
+			release = make(chan struct{})
+			stop    = make(chan os.Signal, 1)
+			status  = make(chan int, 1)
+		)
+
+		url, requests, served := startServer(t, started, release, stop, 5*time.Second)
+
+		go get(url, status)
+		<-started
+
+		stop <- os.Interrupt
+
+		go func() {
+			time.Sleep(100 * time.Millisecond) // the server must still be waiting on the request
+			close(release)
+		}()
+
+		have := <-status
+
+		score(t, have, http.StatusOK, func() bool {
+			return have == http.StatusOK
+		})
+
+		if err := <-served; err != nil {
+			t.Errorf("have: %v want: %v", err, nil)
+		}
+
+		if n := requests.count(); n != 0 {
+			t.Errorf("have: %v want: %v requests in flight", n, 0)
+		}
+	})
+
+	t.Run("requests in flight are closed after the drain period", func(t *testing.T) {
+		var (
+			started = make(chan struct{})
+			release = make(chan struct{})
+			stop    = make(chan os.Signal, 1)
+			status  = make(chan int, 1)
+		)
+
+		defer close(release)
+
+		url, _, served := startServer(t, started, release, stop, 50*time.Millisecond)
+
+		go get(url, status)
+		<-started
+
+		stop <- os.Interrupt
+
+		<-served
+
+		have := <-status
+
+		score(t, have, 0, func() bool {
+			return have == 0
+		})
+	})
+}
+
+func TestCompactWeather(t *testing.T) {
+	at := time.Date(2019, time.March, 29, 17, 4, 5, 0, time.UTC)
+
+	var compactWeatherTestCases = []struct {
+		label  string
+		report *weatherReport
+		want   string
+	}{
+		{
+			"every field",
+			&weatherReport{
+				CityName:   "Reno",
+				Conditions: []string{"Clear"},
+				LowTemp:    floatPtr(270.1),
+				HighTemp:   floatPtr(282.3),
+				MedianTemp: floatPtr(276.2),
+				AtTime:     jsonTime{at},
+			},
+			`["Reno",270.1,282.3,276.2,["Clear"],"2019-03-29T17:04:05Z"]`,
+		},
+		{
+			"missing temperatures and conditions",
+			&weatherReport{
+				CityName: "Reno",
+				AtTime:   jsonTime{at},
+			},
+			`["Reno",null,null,null,[],"2019-03-29T17:04:05Z"]`,
+		},
+	}
+
+	for _, tc := range compactWeatherTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			b, err := json.Marshal(compactWeather{tc.report})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			have := string(b)
+
+			score(t, have, tc.want, func() bool {
+				return have == tc.want
+			})
+		})
+	}
+
+	t.Run("unsupported shapes are rejected", func(t *testing.T) {
+		_, err := parseWeatherShape(url.Values{"shape": []string{"tiny"}})
+
+		score(t, err, "an unsupported shape error", func() bool {
+			return err != nil
+		})
+	})
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	var methodNotAllowedTestCases = []struct {
+		path    string
+		handler http.HandlerFunc
+		allow   string
+	}{
+		{"/api/v1/account/user", AccountUserAction, "GET, PUT"},
+		{"/api/v1/account/user/register", CreateNewAccount, "POST"},
+		{"/api/v1/account/user/bookmark", AccountBookmarksCollectionAction, "GET, POST, PUT"},
+		{"/api/v1/account/user/bookmark/extreme", ReportExtremeBookmarkWeather, "GET"},
+		{"/api/v1/account/user/bookmark/weather", ReportBookmarkWeather, "GET"},
+		{"/api/v1/account/user/export", ExportAccount, "GET"},
+		{"/api/v1/location/weather", ReportLocationWeather, "GET, HEAD"},
+		{"/api/v1/location/weather/batch", ReportBatchLocationWeather, "POST"},
+		{"/api/v1/location/weather/batch/coordinates", ReportBatchCoordinateWeather, "POST"},
+		{"/api/v1/location/weather/stats", ReportWeatherStatistics, "GET"},
+		{"/api/v1/location/weather/stats/help", ReportWeatherStatisticsHelp, "GET"},
+		{"/api/v1/location/weather/delta", ReportTemperatureDelta, "GET"},
+		{"/api/v1/location/weather/nearby-cached", ReportNearbyCachedWeather, "GET"},
+		{"/api/v1/location/weather/ip", ReportIPLocationWeather, "GET"},
+		{"/api/v1/location/weather/all", ReportAllLocationWeather, "GET"},
+		{"/api/v1/location/weather/extremes", ReportExtremeCachedWeather, "GET"},
+		{"/api/v1/location/weather/history", ReportWeatherHistory, "GET"},
+		{"/api/v1/location/weather/activity", ReportWeatherActivity, "GET"},
+		{"/api/v1/location/weather/debug", AdminDebugLocationWeather, "GET"},
+		{"/api/v1/location/forecast", ReportLocationForecast, "GET"},
+		{"/api/v1/weather/labels", ReportSupportedWeatherLabels, "GET"},
+		{"/api/v1/admin/stats/refresh", AdminRefreshStatsSummary, "POST"},
+		{"/api/v1/admin/accounts/bulk", AdminBulkCreateAccounts, "POST"},
+		{"/api/v1/admin/weather/purge", AdminPurgeWeather, "POST"},
+		{"/api/v1/admin/locations/merge", AdminMergeDuplicateLocations, "POST"},
+		{"/api/v1/admin/stale", AdminReportStaleLocations, "GET"},
+		{"/api/v1/admin/quota", AdminReportAPIQuota, "GET"},
+		{"/api/v1/admin/weather/diff", AdminDiffLocationWeather, "GET"},
+		{"/api/v1/admin/endpoints", AdminEndpointSwitches, "GET, PUT"},
+		{"/api/v1/health/detailed", ReportDetailedHealth, "GET"},
+	}
+
+	for _, tc := range methodNotAllowedTestCases {
+		t.Run(tc.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tc.handler(w, httptest.NewRequest(http.MethodPatch, tc.path, nil))
+
+			body := struct {
+				Error   string   `json:"error"`
+				Allowed []string `json:"allowed"`
+			}{}
+
+			json.Unmarshal(w.Body.Bytes(), &body)
+
+			have := w.Header().Get("Allow")
+
+			score(t, have, tc.allow, func() bool {
+				return w.Code == http.StatusMethodNotAllowed && have == tc.allow && strings.Join(body.Allowed, ", ") == tc.allow && body.Error != ""
+			})
+		})
+	}
+}
+
+func TestStatsResponseOmitsUnrequestedStats(t *testing.T) {
+	var statsResponseTestCases = []struct {
+		label    string
+		response StatsResponse
+		want     string
+	}{
+		{"nothing requested", StatsResponse{}, `{}`},
+		{"requested but empty", StatsResponse{Labels: &[]string{}, LabelTemperatures: &map[string]float64{}}, `{"labels":[],"label_temperatures":{}}`},
+		{"counts", StatsResponse{Count: &statsCount{7}}, `{"count":{"location_queries":7}}`},
+		{"one temperature filter", StatsResponse{Temperatures: &statsTemperatures{Lows: &statsTemperatureReport{Nested: db.LocationTemperatureQueryResult{}}}}, `{"temperatures":{"lows":{}}}`},
+		{"one temperature series", StatsResponse{Temperatures: &statsTemperatures{Avgs: &statsTemperatureReport{Series: map[string][]db.TemperaturePoint{}}}}, `{"temperatures":{"avgs":{}}}`},
+	}
+
+	for _, tc := range statsResponseTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			b, err := json.Marshal(tc.response)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			have := string(b)
+
+			score(t, have, tc.want, func() bool {
+				return have == tc.want
+			})
+		})
+	}
+}
+
+func TestJSONContentType(t *testing.T) {
+	var contentTypeTestCases = []struct {
+		label       string
+		contentType string
+		require     bool
+		want        int
+	}{
+		{"json", "application/json", true, http.StatusBadRequest}, // past the check, the empty body is rejected
+		{"json with a charset", "application/json; charset=utf-8", true, http.StatusBadRequest},
+		{"missing", "", true, http.StatusUnsupportedMediaType},
+		{"form", "application/x-www-form-urlencoded", true, http.StatusUnsupportedMediaType},
+		{"text", "text/plain", true, http.StatusUnsupportedMediaType},
+		{"text when not required", "text/plain", false, http.StatusBadRequest},
+	}
+
+	defer func(require bool) { requireJSONContentType = require }(requireJSONContentType)
+
+	for _, tc := range contentTypeTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			requireJSONContentType = tc.require
+
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/location/weather/batch", strings.NewReader(""))
+			if tc.contentType != "" {
+				req.Header.Set("Content-Type", tc.contentType)
+			}
+
+			rec := httptest.NewRecorder()
+
+			ReportBatchLocationWeather(rec, req)
+
+			score(t, rec.Code, tc.want, func() bool {
+				return rec.Code == tc.want
+			})
+		})
+	}
+}
+
+func TestEndpointSwitches(t *testing.T) {
+	defer func(token string) { adminToken = token }(adminToken)
+	defer func(s *endpointSwitches) { endpoints = s }(endpoints)
+
+	adminToken = "secret"
+	endpoints = &endpointSwitches{disabled: map[string]bool{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/status", func(w http.ResponseWriter, r *http.Request) { sendMessage(w, "ok") })
+	mux.HandleFunc(endpointSwitchesPath, AdminEndpointSwitches)
+
+	handler := withEndpointSwitches(mux)
+
+	switchEndpoint := func(path string, enabled bool) int {
+		body := fmt.Sprintf(`{"path": %q, "enabled": %t}`, path, enabled)
+
+		req := httptest.NewRequest(http.MethodPut, endpointSwitchesPath, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Header.Set("Content-Type", "application/json")
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		return rec.Code
+	}
+
+	status := func() (int, string) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/status", nil))
+
+		body := struct {
+			Error string `json:"error"`
+		}{}
+		json.Unmarshal(rec.Body.Bytes(), &body)
+
+		return rec.Code, body.Error
+	}
+
+	var endpointSwitchTestCases = []struct {
+		label   string
+		enabled bool
+		want    int
+	}{
+		{"switched off", false, http.StatusServiceUnavailable},
+		{"switched back on", true, http.StatusOK},
+	}
+
+	for _, tc := range endpointSwitchTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			if code := switchEndpoint("/api/v1/status", tc.enabled); code != http.StatusOK {
+				t.Fatalf("failed to switch the endpoint: %d", code)
+			}
+
+			have, message := status()
+
+			score(t, have, tc.want, func() bool {
+				return have == tc.want && (tc.enabled || message == errEndpointDisabled.Error())
+			})
+		})
+	}
+
+	t.Run("the switches can't be switched off", func(t *testing.T) {
+		have := switchEndpoint(endpointSwitchesPath, false)
+
+		score(t, have, http.StatusBadRequest, func() bool {
+			return have == http.StatusBadRequest && endpoints.enabled(endpointSwitchesPath)
+		})
+	})
+}
+
+func TestStoreError(t *testing.T) {
+	var storeErrorTestCases = []struct {
+		label string
+		err   error
+		want  int
+	}{
+		{"unique violation", fmt.Errorf("%w: Key (user_name)=(taken) already exists.", db.ErrConflict), http.StatusConflict},
+		{"foreign key violation", fmt.Errorf("%w: Key (id)=(-1) is not present.", db.ErrInvalidReference), http.StatusUnprocessableEntity},
+		{"other", errors.New("connection refused"), http.StatusInternalServerError},
+	}
+
+	for _, tc := range storeErrorTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+
+			storeError(rec, httptest.NewRequest(http.MethodPost, "/api/v1/account/user/register", nil), tc.err)
+
+			score(t, rec.Code, tc.want, func() bool {
+				return rec.Code == tc.want
+			})
+		})
+	}
+}
+
+func TestParsePagination(t *testing.T) {
+	defer func(limit, max int) { defaultPageLimit, maxPageLimit = limit, max }(defaultPageLimit, maxPageLimit)
+
+	defaultPageLimit, maxPageLimit = 50, 500
+
+	var paginationTestCases = []struct {
+		label      string
+		query      string
+		wantLimit  int
+		wantOffset int
+		wantErr    bool
+	}{
+		{"defaults", "", 50, 0, false},
+		{"requested", "limit=20&offset=40", 20, 40, false},
+		{"capped", "limit=5000", 500, 0, false},
+		{"zero limit", "limit=0", 0, 0, true},
+		{"negative limit", "limit=-1", 0, 0, true},
+		{"limit not a number", "limit=many", 0, 0, true},
+		{"negative offset", "offset=-10", 0, 0, true},
+		{"offset not a number", "offset=next", 0, 0, true},
+	}
+
+	for _, tc := range paginationTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			limit, offset, err := parsePagination(httptest.NewRequest(http.MethodGet, "/api/v1/location/weather/all?"+tc.query, nil))
+
+			score(t, []int{limit, offset}, []int{tc.wantLimit, tc.wantOffset}, func() bool {
+				if tc.wantErr {
+					return err != nil
+				}
+				return err == nil && limit == tc.wantLimit && offset == tc.wantOffset
+			})
+		})
+	}
+}
+
+func TestListEndpointsRejectInvalidPagination(t *testing.T) {
+	defer func(token string) { adminToken = token }(adminToken)
+
+	adminToken = "secret"
+
+	var listTestCases = []struct {
+		label   string
+		target  string
+		handler http.HandlerFunc
+	}{
+		{"all", "/api/v1/location/weather/all", ReportAllLocationWeather},
+		{"history", "/api/v1/location/weather/history", ReportWeatherHistory},
+		{"stale", "/api/v1/admin/stale", AdminReportStaleLocations},
+	}
+
+	for _, tc := range listTestCases {
+		for _, query := range []string{"limit=0", "limit=-1", "limit=many", "offset=-10"} {
+			t.Run(tc.label+" "+query, func(t *testing.T) {
+				req := httptest.NewRequest(http.MethodGet, tc.target+"?"+query, nil)
+				req.Header.Set("Authorization", "Bearer secret")
+
+				rec := httptest.NewRecorder()
+
+				tc.handler(rec, req)
+
+				score(t, rec.Code, http.StatusBadRequest, func() bool {
+					return rec.Code == http.StatusBadRequest
+				})
+			})
+		}
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	defer func(origins []string, maxAge time.Duration) {
+		corsAllowedOrigins, corsMaxAge = origins, maxAge
+	}(corsAllowedOrigins, corsMaxAge)
+
+	corsAllowedOrigins = []string{"https://weather.example.com"}
+
+	handler := withCORS(http.HandlerFunc(ReportWeatherStatisticsHelp))
+
+	var corsTestCases = []struct {
+		label         string
+		method        string
+		origin        string
+		requestMethod string
+		maxAge        time.Duration
+		wantStatus    int
+		wantMaxAge    string
+		wantOrigin    string
+	}{
+		{"preflight", http.MethodOptions, "https://weather.example.com", http.MethodGet, 10 * time.Minute, http.StatusNoContent, "600", "https://weather.example.com"},
+		{"preflight with a configured max age", http.MethodOptions, "https://weather.example.com", http.MethodGet, time.Hour, http.StatusNoContent, "3600", "https://weather.example.com"},
+		{"preflight from another origin", http.MethodOptions, "https://elsewhere.example.com", http.MethodGet, 10 * time.Minute, http.StatusNoContent, "", ""},
+		{"not a preflight", http.MethodGet, "https://weather.example.com", "", 10 * time.Minute, http.StatusOK, "", "https://weather.example.com"},
+	}
+
+	for _, tc := range corsTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			corsMaxAge = tc.maxAge
+
+			req := httptest.NewRequest(tc.method, "/api/v1/location/weather/stats/help", nil)
+			req.Header.Set("Origin", tc.origin)
+			if tc.requestMethod != "" {
+				req.Header.Set("Access-Control-Request-Method", tc.requestMethod)
+			}
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			have := rec.Header().Get("Access-Control-Max-Age")
+
+			score(t, have, tc.wantMaxAge, func() bool {
+				return rec.Code == tc.wantStatus && have == tc.wantMaxAge &&
+					rec.Header().Get("Access-Control-Allow-Origin") == tc.wantOrigin
+			})
+		})
+	}
 }
@@ -0,0 +1,76 @@
+// Package units defines conversions between the units of measurement used by the
+// openweather api and the units clients display. The openweather api reports temperatures
+// in kelvin and wind speeds in meters per second by default.
+package units
+
+import "math"
+
+const (
+	absoluteZeroCelsius = -273.15
+	metersPerMile       = 1609.344
+	secondsPerHour      = 3600
+)
+
+// KelvinToCelsius converts a temperature in kelvin to celsius.
+func KelvinToCelsius(k float64) float64 {
+	return k + absoluteZeroCelsius
+}
+
+// KelvinToFahrenheit converts a temperature in kelvin to fahrenheit.
+func KelvinToFahrenheit(k float64) float64 {
+	return CelsiusToFahrenheit(KelvinToCelsius(k))
+}
+
+// CelsiusToKelvin converts a temperature in celsius to kelvin.
+func CelsiusToKelvin(c float64) float64 {
+	return c - absoluteZeroCelsius
+}
+
+// CelsiusToFahrenheit converts a temperature in celsius to fahrenheit.
+func CelsiusToFahrenheit(c float64) float64 {
+	return c*9/5 + 32
+}
+
+// FahrenheitToCelsius converts a temperature in fahrenheit to celsius.
+func FahrenheitToCelsius(f float64) float64 {
+	return (f - 32) * 5 / 9
+}
+
+// FahrenheitToKelvin converts a temperature in fahrenheit to kelvin.
+func FahrenheitToKelvin(f float64) float64 {
+	return CelsiusToKelvin(FahrenheitToCelsius(f))
+}
+
+// MetersPerSecondToMilesPerHour converts a speed in meters per second to miles per hour.
+func MetersPerSecondToMilesPerHour(mps float64) float64 {
+	return mps * secondsPerHour / metersPerMile
+}
+
+// MilesPerHourToMetersPerSecond converts a speed in miles per hour to meters per second.
+func MilesPerHourToMetersPerSecond(mph float64) float64 {
+	return mph * metersPerMile / secondsPerHour
+}
+
+var compassPoints = [...]string{
+	"N", "NNE", "NE", "ENE",
+	"E", "ESE", "SE", "SSE",
+	"S", "SSW", "SW", "WSW",
+	"W", "WNW", "NW", "NNW",
+}
+
+// DegreesToCompass converts a wind direction in meteorological degrees to a 16-point compass
+// label, for example 0 is "N" and 90 is "E". Each label covers 22.5 degrees centred on its
+// direction, and a direction on the boundary between two labels takes the clockwise one.
+// Directions outside [0, 360) wrap around.
+func DegreesToCompass(deg float64) string {
+	const sector = 360.0 / float64(len(compassPoints))
+
+	deg = math.Mod(deg, 360)
+	if deg < 0 {
+		deg += 360
+	}
+
+	i := int(math.Floor(deg/sector+0.5)) % len(compassPoints)
+
+	return compassPoints[i]
+}
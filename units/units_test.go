@@ -0,0 +1,120 @@
+package units
+
+import (
+	"math"
+	"testing"
+)
+
+const tolerance = 1e-9
+
+func approxEqual(a, b float64) bool {
+	return math.Abs(a-b) < tolerance
+}
+
+func TestConversions(t *testing.T) {
+	var conversionTestCases = []struct {
+		label   string
+		convert func(float64) float64
+		in      float64
+		want    float64
+	}{
+		{"kelvin to celsius at absolute zero", KelvinToCelsius, 0, -273.15},
+		{"kelvin to celsius at freezing", KelvinToCelsius, 273.15, 0},
+		{"kelvin to celsius at boiling", KelvinToCelsius, 373.15, 100},
+		{"kelvin to fahrenheit at absolute zero", KelvinToFahrenheit, 0, -459.67},
+		{"kelvin to fahrenheit at freezing", KelvinToFahrenheit, 273.15, 32},
+		{"kelvin to fahrenheit at boiling", KelvinToFahrenheit, 373.15, 212},
+		{"celsius to kelvin at absolute zero", CelsiusToKelvin, -273.15, 0},
+		{"celsius to kelvin at freezing", CelsiusToKelvin, 0, 273.15},
+		{"celsius to kelvin at boiling", CelsiusToKelvin, 100, 373.15},
+		{"celsius to fahrenheit at freezing", CelsiusToFahrenheit, 0, 32},
+		{"celsius to fahrenheit at boiling", CelsiusToFahrenheit, 100, 212},
+		{"celsius to fahrenheit where they meet", CelsiusToFahrenheit, -40, -40},
+		{"fahrenheit to celsius at freezing", FahrenheitToCelsius, 32, 0},
+		{"fahrenheit to celsius at boiling", FahrenheitToCelsius, 212, 100},
+		{"fahrenheit to celsius where they meet", FahrenheitToCelsius, -40, -40},
+		{"fahrenheit to kelvin at absolute zero", FahrenheitToKelvin, -459.67, 0},
+		{"fahrenheit to kelvin at freezing", FahrenheitToKelvin, 32, 273.15},
+		{"fahrenheit to kelvin at boiling", FahrenheitToKelvin, 212, 373.15},
+		{"meters per second to miles per hour at rest", MetersPerSecondToMilesPerHour, 0, 0},
+		{"meters per second to miles per hour", MetersPerSecondToMilesPerHour, 1609.344, 3600},
+		{"meters per second to miles per hour at 10", MetersPerSecondToMilesPerHour, 10, 22.369362920544},
+		{"miles per hour to meters per second at rest", MilesPerHourToMetersPerSecond, 0, 0},
+		{"miles per hour to meters per second", MilesPerHourToMetersPerSecond, 3600, 1609.344},
+		{"miles per hour to meters per second at 60", MilesPerHourToMetersPerSecond, 60, 26.8224},
+	}
+
+	for _, tc := range conversionTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			if have := tc.convert(tc.in); !approxEqual(have, tc.want) {
+				t.Errorf("have: %v want: %v", have, tc.want)
+			}
+		})
+	}
+}
+
+func TestRoundTrips(t *testing.T) {
+	var roundTripTestCases = []struct {
+		label string
+		there func(float64) float64
+		back  func(float64) float64
+	}{
+		{"kelvin and celsius", KelvinToCelsius, CelsiusToKelvin},
+		{"kelvin and fahrenheit", KelvinToFahrenheit, FahrenheitToKelvin},
+		{"celsius and fahrenheit", CelsiusToFahrenheit, FahrenheitToCelsius},
+		{"meters per second and miles per hour", MetersPerSecondToMilesPerHour, MilesPerHourToMetersPerSecond},
+	}
+
+	for _, tc := range roundTripTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			for _, v := range []float64{-100, -40, 0, 0.5, 32, 100, 273.15, 1000} {
+				if have := tc.back(tc.there(v)); !approxEqual(have, v) {
+					t.Errorf("have: %v want: %v", have, v)
+				}
+			}
+		})
+	}
+}
+
+func TestDegreesToCompass(t *testing.T) {
+	var compassTestCases = []struct {
+		label string
+		deg   float64
+		want  string
+	}{
+		{"north", 0, "N"},
+		{"just before the N/NNE boundary", 11.24, "N"},
+		{"N/NNE boundary", 11.25, "NNE"},
+		{"NNE/NE boundary", 33.75, "NE"},
+		{"NE/ENE boundary", 56.25, "ENE"},
+		{"ENE/E boundary", 78.75, "E"},
+		{"east", 90, "E"},
+		{"E/ESE boundary", 101.25, "ESE"},
+		{"ESE/SE boundary", 123.75, "SE"},
+		{"SE/SSE boundary", 146.25, "SSE"},
+		{"SSE/S boundary", 168.75, "S"},
+		{"south", 180, "S"},
+		{"S/SSW boundary", 191.25, "SSW"},
+		{"SSW/SW boundary", 213.75, "SW"},
+		{"SW/WSW boundary", 236.25, "WSW"},
+		{"WSW/W boundary", 258.75, "W"},
+		{"west", 270, "W"},
+		{"W/WNW boundary", 281.25, "WNW"},
+		{"WNW/NW boundary", 303.75, "NW"},
+		{"NW/NNW boundary", 326.25, "NNW"},
+		{"NNW/N boundary", 348.75, "N"},
+		{"just before full circle", 359.99, "N"},
+		{"full circle", 360, "N"},
+		{"more than a full circle", 450, "E"},
+		{"negative", -90, "W"},
+		{"small negative", -5, "N"},
+	}
+
+	for _, tc := range compassTestCases {
+		t.Run(tc.label, func(t *testing.T) {
+			if have := DegreesToCompass(tc.deg); have != tc.want {
+				t.Errorf("have: %v want: %v", have, tc.want)
+			}
+		})
+	}
+}